@@ -0,0 +1,160 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// activationConfig controls when newly downloaded bundle revisions start
+// being enforced. Revisions that arrive outside of an activation window are
+// held back, and the previously active revision remains in force.
+type activationConfig struct {
+	Windows   []activationWindow `json:"windows,omitempty"`
+	Revisions []revisionSchedule `json:"revisions,omitempty"`
+}
+
+// activationWindow is a recurring UTC time window, e.g. 02:00-04:00 on
+// Saturdays. A window whose end is before its start wraps past midnight.
+type activationWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+
+	days       map[time.Weekday]bool
+	start, end time.Duration
+}
+
+// revisionSchedule pins the activation of a specific bundle revision to a
+// point in time, and optionally reverts to the previous revision later.
+type revisionSchedule struct {
+	Bundle     string     `json:"bundle,omitempty"`
+	Revision   string     `json:"revision"`
+	ActivateAt *time.Time `json:"activate_at,omitempty"`
+	RevertAt   *time.Time `json:"revert_at,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (c *activationConfig) validate() error {
+
+	for i := range c.Windows {
+		w := &c.Windows[i]
+
+		var err error
+		if w.start, err = parseClock(w.Start); err != nil {
+			return fmt.Errorf("activation window %d: %w", i, err)
+		}
+		if w.end, err = parseClock(w.End); err != nil {
+			return fmt.Errorf("activation window %d: %w", i, err)
+		}
+
+		w.days = map[time.Weekday]bool{}
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("activation window %d: unknown day %q", i, d)
+			}
+			w.days[wd] = true
+		}
+	}
+
+	for i, r := range c.Revisions {
+		if r.Revision == "" {
+			return fmt.Errorf("activation revision %d: revision is required", i)
+		}
+		if r.ActivateAt != nil && r.RevertAt != nil && !r.RevertAt.After(*r.ActivateAt) {
+			return fmt.Errorf("activation revision %d: revert_at must be after activate_at", i)
+		}
+	}
+
+	return nil
+}
+
+// parseClock parses an HH:MM time of day into the offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w activationWindow) contains(now time.Time) bool {
+
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	offset := now.Sub(midnight)
+	day := now.Weekday()
+
+	if w.start <= w.end {
+		return (len(w.days) == 0 || w.days[day]) && offset >= w.start && offset < w.end
+	}
+
+	// The window wraps past midnight; the part after midnight belongs to the
+	// window that opened on the previous day.
+	if offset >= w.start {
+		return len(w.days) == 0 || w.days[day]
+	}
+	if offset < w.end {
+		return len(w.days) == 0 || w.days[(day+6)%7]
+	}
+
+	return false
+}
+
+// schedule returns the explicit schedule of the given revision, if any.
+func (c *activationConfig) schedule(revisions map[string]string) *revisionSchedule {
+
+	for i, r := range c.Revisions {
+		for bundle, rev := range revisions {
+			if rev == r.Revision && (r.Bundle == "" || r.Bundle == bundle) {
+				return &c.Revisions[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// canActivate reports whether a revision may become active at now.
+func (c *activationConfig) canActivate(revisions map[string]string, now time.Time) bool {
+
+	if s := c.schedule(revisions); s != nil && s.ActivateAt != nil {
+		return !now.Before(*s.ActivateAt)
+	}
+
+	if len(c.Windows) == 0 {
+		return true
+	}
+
+	for _, w := range c.Windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shouldRevert reports whether an active revision has reached the end of its
+// scheduled activation.
+func (c *activationConfig) shouldRevert(revisions map[string]string, now time.Time) bool {
+
+	s := c.schedule(revisions)
+	return s != nil && s.RevertAt != nil && !now.Before(*s.RevertAt)
+}
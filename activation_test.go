@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestActivationWindowContains(t *testing.T) {
+	cfg := activationConfig{Windows: []activationWindow{
+		{Days: []string{"Saturday"}, Start: "02:00", End: "04:00"},
+		{Days: []string{"sunday"}, Start: "23:00", End: "01:00"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		time     string
+		expected bool
+	}{
+		{"2026-10-24T02:00:00Z", true},  // Saturday, window opens
+		{"2026-10-24T03:59:00Z", true},  // Saturday, inside
+		{"2026-10-24T04:00:00Z", false}, // Saturday, window closed
+		{"2026-10-23T02:30:00Z", false}, // Friday
+		{"2026-10-25T23:30:00Z", true},  // Sunday, before midnight
+		{"2026-10-26T00:30:00Z", true},  // Monday, wrapped from Sunday
+		{"2026-10-27T00:30:00Z", false}, // Tuesday, wrapped from Monday
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.time, func(t *testing.T) {
+			now, _ := time.Parse(time.RFC3339, tc.time)
+			if result := cfg.canActivate(nil, now); result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestActivationConfigValidate(t *testing.T) {
+	tests := []activationConfig{
+		{Windows: []activationWindow{{Start: "2am", End: "04:00"}}},
+		{Windows: []activationWindow{{Days: []string{"someday"}, Start: "02:00", End: "04:00"}}},
+		{Revisions: []revisionSchedule{{}}},
+	}
+
+	for _, tc := range tests {
+		if err := tc.validate(); err == nil {
+			t.Errorf("Expected validation error for %+v", tc)
+		}
+	}
+}
+
+func TestRevisionTrackerSchedule(t *testing.T) {
+	activateAt, _ := time.Parse(time.RFC3339, "2026-10-24T02:00:00Z")
+	revertAt := activateAt.Add(2 * time.Hour)
+
+	tracker := &revisionTracker{config: authzPluginConfig{Activation: activationConfig{
+		Revisions: []revisionSchedule{{Revision: "v2", ActivateAt: &activateAt, RevertAt: &revertAt}},
+	}}}
+
+	v1 := &revision{bundles: map[string]string{"authz": "v1"}, landed: activateAt.Add(-48 * time.Hour)}
+	v1.activated = v1.landed
+	v2 := &revision{bundles: map[string]string{"authz": "v2"}, landed: activateAt.Add(-24 * time.Hour)}
+	tracker.active, tracker.latest = v1, v2
+
+	if rev := tracker.route(activateAt.Add(-time.Minute), authorization.Request{}).enforce; rev != v1 {
+		t.Fatalf("Expected v1 to be enforced before activation, got %v", rev)
+	}
+
+	if rev := tracker.route(activateAt, authorization.Request{}).enforce; rev != nil {
+		t.Fatalf("Expected latest revision to be enforced once activated, got %v", rev)
+	}
+
+	if rev := tracker.route(revertAt, authorization.Request{}).enforce; rev != v1 {
+		t.Fatalf("Expected v1 to be enforced after revert, got %v", rev)
+	}
+
+	if rev := tracker.route(revertAt.Add(time.Hour), authorization.Request{}).enforce; rev != v1 {
+		t.Fatalf("Expected reverted revision to stay inactive, got %v", rev)
+	}
+}
+
+func TestRevisionTrackerCanary(t *testing.T) {
+	now := time.Now()
+
+	tracker := &revisionTracker{config: authzPluginConfig{Canary: &canaryConfig{
+		Percent:  50,
+		HashBy:   canaryHashByUser,
+		Step:     50,
+		Interval: duration(time.Minute),
+	}, Divergence: divergenceConfig{SampleRate: 1, MaxSamples: 10}}}
+
+	v1 := &revision{bundles: map[string]string{"authz": "v1"}, landed: now.Add(-time.Hour), activated: now.Add(-time.Hour)}
+	v2 := &revision{bundles: map[string]string{"authz": "v2"}, landed: now}
+	tracker.active, tracker.latest = v1, v2
+
+	users := map[bool]string{}
+	for i := 0; len(users) < 2; i++ {
+		user := string(rune('a' + i))
+		users[canaryBucket(user) < 50] = user
+	}
+
+	route := tracker.route(now, authorization.Request{User: users[true]})
+	if route.enforce != nil || route.compare != v1 {
+		t.Fatalf("Expected canary user to be enforced by the candidate, got %+v", route)
+	}
+
+	route = tracker.route(now, authorization.Request{User: users[false]})
+	if route.enforce != v1 || route.compare != v2 {
+		t.Fatalf("Expected stable user to be enforced by the active revision, got %+v", route)
+	}
+
+	tracker.recordComparison(route, false, true, nil)
+	if samples := tracker.divergences.list(); len(samples) != 1 || samples[0].EnforcedRevision != "authz@v1" || samples[0].ComparedRevision != "authz@v2" {
+		t.Fatalf("Expected one divergence sample, got %+v", samples)
+	}
+	tracker.route(now.Add(2*time.Minute), authorization.Request{})
+	if !route.canary.frozen {
+		t.Fatal("Expected canary to freeze after divergence")
+	}
+
+	tracker.canary = &canary{candidate: v2, percent: 50, stepped: now}
+	tracker.recordComparison(revisionRoute{compare: v1, mode: compareModeCanary, canary: tracker.canary}, true, true, nil)
+	if route := tracker.route(now.Add(2*time.Minute), authorization.Request{User: users[false]}); route.enforce != nil || route.compare != nil {
+		t.Fatalf("Expected candidate to be promoted after a clean step, got %+v", route)
+	}
+}
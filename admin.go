@@ -0,0 +1,471 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	version_pkg "github.com/open-policy-agent/opa-docker-authz/version"
+)
+
+// maxAdminBodySize bounds the size of policies and documents accepted by the
+// admin API.
+const maxAdminBodySize = 8 << 20
+
+// adminRole is the level of access granted to an admin API client. Each role
+// includes the permissions of the roles below it.
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleRead
+	roleWrite
+)
+
+func (r adminRole) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleWrite:
+		return "write"
+	default:
+		return "none"
+	}
+}
+
+type adminRoleKey struct{}
+
+// adminConfig holds the settings of the admin listener.
+type adminConfig struct {
+	addr          string
+	tokenFile     string
+	readTokenFile string
+	readSubjects  []string
+	writeSubjects []string
+	tlsCertFile   string
+	tlsKeyFile    string
+	clientCAFile  string
+	tlsReload     time.Duration
+
+	// svid, when set, is served instead of the TLS certificate and key.
+	svid *workloadSVID
+}
+
+// tls returns true when the admin API is served over TLS.
+func (cfg adminConfig) tls() bool {
+	return cfg.svid != nil || (cfg.tlsCertFile != "" && cfg.tlsKeyFile != "")
+}
+
+// adminServer exposes the runtime management endpoints of the plugin. Every
+// request must present a configured bearer token or a client certificate
+// signed by the configured CA, which determines the role of the client.
+type adminServer struct {
+	plugin        *DockerAuthZPlugin
+	tokens        map[adminRole][]byte
+	mtls          bool
+	readSubjects  map[string]bool
+	writeSubjects map[string]bool
+}
+
+func newAdminServer(p *DockerAuthZPlugin, cfg adminConfig) (*adminServer, error) {
+
+	s := &adminServer{
+		plugin:        p,
+		tokens:        map[adminRole][]byte{},
+		mtls:          cfg.clientCAFile != "",
+		readSubjects:  map[string]bool{},
+		writeSubjects: map[string]bool{},
+	}
+
+	for role, file := range map[adminRole]string{roleWrite: cfg.tokenFile, roleRead: cfg.readTokenFile} {
+		if file == "" {
+			continue
+		}
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		token := []byte(strings.TrimSpace(string(bs)))
+		if len(token) == 0 {
+			return nil, fmt.Errorf("admin token file %s is empty", file)
+		}
+		s.tokens[role] = token
+	}
+
+	if len(s.tokens) == 2 && subtle.ConstantTimeCompare(s.tokens[roleRead], s.tokens[roleWrite]) == 1 {
+		return nil, fmt.Errorf("admin read and write tokens must differ")
+	}
+
+	for _, subject := range cfg.readSubjects {
+		s.readSubjects[subject] = true
+	}
+	for _, subject := range cfg.writeSubjects {
+		s.writeSubjects[subject] = true
+	}
+
+	// Policies and data are published as bundles in -config-file mode, so
+	// the write role, which uploads them, is refused up front rather than
+	// failing every upload.
+	if p.configFile != "" && (len(s.tokens[roleWrite]) > 0 || len(cfg.writeSubjects) > 0) {
+		return nil, fmt.Errorf("admin API write role is not available with -config-file, publish a bundle instead")
+	}
+
+	if len(s.tokens) == 0 && !s.mtls {
+		return nil, fmt.Errorf("admin API requires a token file or a client CA file")
+	}
+
+	if s.mtls && !cfg.tls() {
+		return nil, fmt.Errorf("admin API client certificate authentication requires a TLS certificate and key")
+	}
+
+	// Tokens sent in cleartext could be captured on the network, so they are
+	// only accepted over TLS, or on a unix socket only local clients reach.
+	if len(s.tokens) > 0 && !cfg.tls() && !strings.HasPrefix(cfg.addr, "unix://") {
+		return nil, fmt.Errorf("admin API bearer tokens require a TLS certificate and key, or a unix:// address")
+	}
+
+	return s, nil
+}
+
+func (s *adminServer) handler() http.Handler {
+
+	r := mux.NewRouter()
+	r.Handle("/admin/status", s.require(roleRead, s.getStatus)).Methods(http.MethodGet)
+	r.Handle("/admin/decisions", s.require(roleRead, s.getDecisions)).Methods(http.MethodGet)
+	r.Handle("/admin/decisions/{id}/explain", s.require(roleWrite, s.getExplanation)).Methods(http.MethodGet)
+	r.Handle("/admin/divergences", s.require(roleRead, s.getDivergences)).Methods(http.MethodGet)
+	r.Handle("/metrics", s.require(roleRead, metricsHandler().ServeHTTP)).Methods(http.MethodGet)
+	r.Handle("/admin/loglevel", s.require(roleRead, s.getLogLevel)).Methods(http.MethodGet)
+	r.Handle("/admin/loglevel", s.require(roleWrite, s.putLogLevel)).Methods(http.MethodPut)
+	r.Handle("/admin/policies/{name}", s.require(roleWrite, s.putPolicy)).Methods(http.MethodPut)
+	r.Handle("/admin/data", s.require(roleWrite, s.putData)).Methods(http.MethodPut)
+	r.Handle("/admin/data/{path:.*}", s.require(roleWrite, s.putData)).Methods(http.MethodPut)
+	r.Use(s.authenticate)
+
+	return r
+}
+
+// certificateRole maps a verified client certificate to a role. Without any
+// configured subjects, every certificate issued by the client CA is granted
+// the write role, or the read role in -config-file mode.
+func (s *adminServer) certificateRole(r *http.Request) adminRole {
+
+	if !s.mtls || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return roleNone
+	}
+
+	if len(s.readSubjects) == 0 && len(s.writeSubjects) == 0 {
+		if s.plugin.configFile != "" {
+			return roleRead
+		}
+		return roleWrite
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	switch {
+	case s.writeSubjects[subject]:
+		return roleWrite
+	case s.readSubjects[subject]:
+		return roleRead
+	default:
+		return roleNone
+	}
+}
+
+func (s *adminServer) tokenRole(r *http.Request) adminRole {
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return roleNone
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	for _, role := range []adminRole{roleWrite, roleRead} {
+		if expected, ok := s.tokens[role]; ok && subtle.ConstantTimeCompare(token, expected) == 1 {
+			return role
+		}
+	}
+
+	return roleNone
+}
+
+func (s *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		role := s.certificateRole(r)
+		if tr := s.tokenRole(r); tr > role {
+			role = tr
+		}
+
+		if role == roleNone {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminRoleKey{}, role)))
+	})
+}
+
+// require wraps h so that it is only invoked for clients holding at least
+// the given role.
+func (s *adminServer) require(role adminRole, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		granted, _ := r.Context().Value(adminRoleKey{}).(adminRole)
+		if granted < role {
+			writeAdminError(w, http.StatusForbidden, fmt.Sprintf("%s role required", role))
+			return
+		}
+
+		h(w, r)
+	})
+}
+
+func (s *adminServer) getStatus(w http.ResponseWriter, _ *http.Request) {
+
+	mode := "policy-file"
+	if s.plugin.configFile != "" {
+		mode = "config-file"
+	}
+
+	status := map[string]interface{}{
+		"id":             s.plugin.instanceID,
+		"mode":           mode,
+		"allow_path":     s.plugin.allowPath,
+		"plugin_version": version_pkg.Version,
+		"opa_version":    version_pkg.OPAVersion,
+		"overlay":        s.plugin.overlay.status(),
+	}
+
+	if s.plugin.tracker() != nil {
+		status["revisions"] = s.plugin.tracker().status()
+	}
+
+	if s.plugin.refresher != nil {
+		if snap, err := s.plugin.refresher.snapshot(); err == nil {
+			status["data_loaded"] = snap.loaded.Format(time.RFC3339Nano)
+		}
+	}
+
+	writeAdminJSON(w, status)
+}
+
+func (s *adminServer) getDecisions(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, map[string]interface{}{
+		"decisions": s.plugin.history.list(),
+	})
+}
+
+// getExplanation returns the trace of a sampled decision. As traces hold the
+// values of the input, which are not scrubbed, the write role is required.
+func (s *adminServer) getExplanation(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+
+	e := s.plugin.explanations.get(id)
+	if e == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("no explanation of decision %s", id))
+		return
+	}
+
+	writeAdminJSON(w, e)
+}
+
+func (s *adminServer) getDivergences(w http.ResponseWriter, _ *http.Request) {
+
+	samples := []divergenceSample{}
+	if s.plugin.tracker() != nil {
+		samples = s.plugin.tracker().divergences.list()
+	}
+
+	writeAdminJSON(w, map[string]interface{}{
+		"divergences": samples,
+	})
+}
+
+func (s *adminServer) getLogLevel(w http.ResponseWriter, _ *http.Request) {
+
+	level, expires := logs.level()
+	result := map[string]interface{}{"level": level.String()}
+	if !expires.IsZero() {
+		result["expires"] = expires.Format(time.RFC3339)
+	}
+
+	writeAdminJSON(w, result)
+}
+
+// putLogLevel changes the log level, for the given duration when one is
+// given, after which the level given on the command line is restored.
+func (s *adminServer) putLogLevel(w http.ResponseWriter, r *http.Request) {
+
+	var req struct {
+		Level    string `json:"level"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBodySize)).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var d time.Duration
+	if req.Duration != "" {
+		if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid duration %q", req.Duration))
+			return
+		}
+	}
+
+	logs.set(level, d)
+
+	log.Printf("Admin API: log level set to %v by %s", level, r.RemoteAddr)
+	s.getLogLevel(w, r)
+}
+
+func (s *adminServer) putPolicy(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["name"]
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBodySize))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	base := map[string]string{}
+	if src, err := os.ReadFile(s.plugin.policyFile); err == nil {
+		base[s.plugin.policyFile] = string(src)
+	}
+
+	if err := s.plugin.overlay.putModule(name, string(bs), base); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("Admin API: policy %s uploaded by %s", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) putData(w http.ResponseWriter, r *http.Request) {
+
+	path := mux.Vars(r)["path"]
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBodySize))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.plugin.overlay.putData(path, bs); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("Admin API: data document /%s uploaded by %s", path, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// serveAdmin starts the admin listener in the background, on a TCP address or
+// a unix:// socket. TLS is enabled when a certificate, or the SVID of the
+// plugin, is configured; client certificates are verified against the client
+// CA when one is given.
+func serveAdmin(p *DockerAuthZPlugin, cfg adminConfig) error {
+
+	s, err := newAdminServer(p, cfg)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler: s.handler(),
+	}
+
+	var files *tlsFiles
+	if cfg.svid != nil {
+		files, err = newSVIDTLSFiles(cfg.svid, cfg.clientCAFile)
+	} else if cfg.tls() {
+		files, err = newTLSFiles(cfg.tlsCertFile, cfg.tlsKeyFile, cfg.clientCAFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	l, err := listenAdmin(cfg.addr)
+	if err != nil {
+		return err
+	}
+
+	if files == nil {
+		go func() {
+			log.Printf("Starting admin API on %s.", cfg.addr)
+			if err := srv.Serve(l); err != nil {
+				log.Printf("Failed serving admin API: %v", err)
+			}
+		}()
+		return nil
+	}
+
+	files.watch(cfg.tlsReload)
+	srv.TLSConfig = files.config()
+
+	go func() {
+		log.Printf("Starting admin API on %s (TLS).", cfg.addr)
+		if err := srv.ServeTLS(l, "", ""); err != nil {
+			log.Printf("Failed serving admin API: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// listenAdmin listens on addr, a TCP address or unix:///path/to/socket. Unix
+// sockets are only accessible to the owner of the plugin process.
+func listenAdmin(addr string) (net.Listener, error) {
+
+	socket := strings.TrimPrefix(addr, "unix://")
+	if socket == addr {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func newTestAdminServer(t *testing.T, policy string) (*DockerAuthZPlugin, *httptest.Server) {
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.rego")
+	if err := os.WriteFile(policyFile, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	readTokenFile := filepath.Join(dir, "read-token")
+	if err := os.WriteFile(readTokenFile, []byte("viewer\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		overlay:    newRuntimeOverlay(),
+		history:    newDecisionHistory(decisionHistorySize),
+	}
+	s, err := newAdminServer(p, adminConfig{addr: "unix://" + filepath.Join(dir, "admin.sock"), tokenFile: tokenFile, readTokenFile: readTokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+func adminRequest(t *testing.T, method, url, token, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminUpload(t *testing.T) {
+	p, srv := newTestAdminServer(t, `package docker.authz
+allow { data.users[input.User].admin }`)
+
+	r := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.40/info", User: "alice"}
+
+	if d, _ := p.evaluate(context.Background(), r); d.Allowed {
+		t.Fatal("Expected request to be denied before upload")
+	}
+
+	if code := adminRequest(t, http.MethodPut, srv.URL+"/admin/data/users", "wrong", `{}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for bad token, got %d", code)
+	}
+
+	if code := adminRequest(t, http.MethodPut, srv.URL+"/admin/data/users/alice", "secret", `{"admin": true}`); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for data upload, got %d", code)
+	}
+
+	if d, err := p.evaluate(context.Background(), r); !d.Allowed || err != nil {
+		t.Fatalf("Expected request to be allowed after data upload, got %v (%v)", d.Allowed, err)
+	}
+
+	if code := adminRequest(t, http.MethodPut, srv.URL+"/admin/policies/broken", "secret", `package docker.authz
+allow { undefined_ref }`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid policy, got %d", code)
+	}
+
+	if code := adminRequest(t, http.MethodPut, srv.URL+"/admin/policies/emergency", "secret", `package docker.authz
+deny_all { true }`); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for policy upload, got %d", code)
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	_, srv := newTestAdminServer(t, `package docker.authz
+allow { true }`)
+
+	tests := []struct {
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{http.MethodGet, "/admin/status", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/status", "viewer", http.StatusOK},
+		{http.MethodGet, "/admin/decisions", "viewer", http.StatusOK},
+		{http.MethodGet, "/admin/divergences", "viewer", http.StatusOK},
+		{http.MethodGet, "/metrics", "viewer", http.StatusOK},
+		{http.MethodGet, "/admin/loglevel", "viewer", http.StatusOK},
+		{http.MethodPut, "/admin/loglevel", "viewer", http.StatusForbidden},
+		{http.MethodPut, "/admin/loglevel", "secret", http.StatusBadRequest},
+		{http.MethodPut, "/admin/data/users", "viewer", http.StatusForbidden},
+		{http.MethodPut, "/admin/policies/p", "viewer", http.StatusForbidden},
+		{http.MethodGet, "/admin/status", "secret", http.StatusOK},
+		{http.MethodPut, "/admin/data/users", "secret", http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path+" as "+tc.token, func(t *testing.T) {
+			if code := adminRequest(t, tc.method, srv.URL+tc.path, tc.token, `{}`); code != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestAdminTokensRequireTLS(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newAdminServer(&DockerAuthZPlugin{}, adminConfig{addr: ":8182", tokenFile: tokenFile}); err == nil {
+		t.Fatal("Expected error for bearer tokens without TLS on a TCP address")
+	}
+
+	socket := filepath.Join(dir, "admin.sock")
+	if err := serveAdmin(&DockerAuthZPlugin{}, adminConfig{addr: "unix://" + socket, tokenFile: tokenFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://admin/admin/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected %d without a token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestAdminConfigFileWriteRole(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &DockerAuthZPlugin{configFile: filepath.Join(dir, "config.yaml")}
+	addr := "unix://" + filepath.Join(dir, "admin.sock")
+
+	if _, err := newAdminServer(p, adminConfig{addr: addr, tokenFile: tokenFile}); err == nil {
+		t.Fatal("Expected error for a write token in -config-file mode")
+	}
+	if _, err := newAdminServer(p, adminConfig{addr: addr, readTokenFile: tokenFile, writeSubjects: []string{"ops"}}); err == nil {
+		t.Fatal("Expected error for write subjects in -config-file mode")
+	}
+	if _, err := newAdminServer(p, adminConfig{addr: addr, readTokenFile: tokenFile}); err != nil {
+		t.Fatalf("Expected read token to be accepted in -config-file mode, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apparmorDefaultProfile    = "docker-default"
+	apparmorUnconfinedProfile = "unconfined"
+)
+
+// AppArmorProfile describes the AppArmor profile a container is created with.
+type AppArmorProfile struct {
+	Profile string
+
+	// Default is true when the request does not select a profile, and the
+	// daemon applies its default profile.
+	Default bool
+
+	// Loaded and Mode report whether the profile is loaded on the host, and
+	// in which mode, when the list of loaded profiles is available.
+	Loaded *bool  `json:",omitempty"`
+	Mode   string `json:",omitempty"`
+}
+
+// apparmorProfile returns the AppArmor profile of a container create
+// request, or nil for any other request.
+func apparmorProfile(body map[string]interface{}) *AppArmorProfile {
+
+	hostConfig, ok := body["HostConfig"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	// Docker does not confine privileged containers unless a profile is
+	// given explicitly.
+	privileged, _ := hostConfig["Privileged"].(bool)
+
+	for _, opt := range stringList(hostConfig["SecurityOpt"]) {
+		if strings.HasPrefix(opt, "apparmor=") || strings.HasPrefix(opt, "apparmor:") {
+			return &AppArmorProfile{Profile: opt[len("apparmor="):]}
+		}
+	}
+
+	if privileged {
+		return &AppArmorProfile{Profile: apparmorUnconfinedProfile, Default: true}
+	}
+
+	return &AppArmorProfile{Profile: apparmorDefaultProfile, Default: true}
+}
+
+// apparmorProfiles is the list of AppArmor profiles loaded on the host, read
+// from securityfs.
+type apparmorProfiles struct {
+	path string
+
+	mu       sync.RWMutex
+	profiles map[string]string
+}
+
+func newAppArmorProfiles(path string) *apparmorProfiles {
+	return &apparmorProfiles{path: path}
+}
+
+// start loads the profile list, and reloads it on interval when positive.
+// Failures are logged, leaving the previous list in place.
+func (a *apparmorProfiles) start(interval time.Duration) {
+
+	if err := a.load(); err != nil {
+		log.Printf("Failed to load AppArmor profiles: %v", err)
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.load(); err != nil {
+				log.Printf("Failed to reload AppArmor profiles: %v", err)
+			}
+		}
+	}()
+}
+
+// load reads the profile list, in which each line has the form
+// "name (mode)".
+func (a *apparmorProfiles) load() error {
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	profiles := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		name, mode := line, ""
+		if i := strings.LastIndex(line, " ("); i >= 0 && strings.HasSuffix(line, ")") {
+			name, mode = line[:i], line[i+2:len(line)-1]
+		}
+		profiles[name] = mode
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.profiles = profiles
+	a.mu.Unlock()
+
+	return nil
+}
+
+// resolve reports whether the profile is loaded. The unconfined profile is
+// never listed, and is not reported either way.
+func (a *apparmorProfiles) resolve(profile *AppArmorProfile) {
+
+	if a == nil || profile == nil || profile.Profile == apparmorUnconfinedProfile {
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.profiles == nil {
+		return
+	}
+
+	mode, ok := a.profiles[profile.Profile]
+	profile.Loaded = &ok
+	profile.Mode = mode
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAppArmorProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profiles")
+	content := "docker-default (enforce)\napproved-web (complain)\n/usr/bin/man (enforce)\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles := newAppArmorProfiles(path)
+	if err := profiles.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, missing := true, false
+
+	tests := []struct {
+		name     string
+		hostCfg  map[string]interface{}
+		expected *AppArmorProfile
+	}{
+		{
+			name:     "default",
+			hostCfg:  map[string]interface{}{},
+			expected: &AppArmorProfile{Profile: "docker-default", Default: true, Loaded: &loaded, Mode: "enforce"},
+		},
+		{
+			name:     "privileged",
+			hostCfg:  map[string]interface{}{"Privileged": true},
+			expected: &AppArmorProfile{Profile: "unconfined", Default: true},
+		},
+		{
+			name:     "unconfined",
+			hostCfg:  map[string]interface{}{"SecurityOpt": []interface{}{"apparmor=unconfined"}},
+			expected: &AppArmorProfile{Profile: "unconfined"},
+		},
+		{
+			name:     "loaded",
+			hostCfg:  map[string]interface{}{"SecurityOpt": []interface{}{"apparmor:approved-web"}},
+			expected: &AppArmorProfile{Profile: "approved-web", Loaded: &loaded, Mode: "complain"},
+		},
+		{
+			name:     "missing",
+			hostCfg:  map[string]interface{}{"Privileged": true, "SecurityOpt": []interface{}{"apparmor=other"}},
+			expected: &AppArmorProfile{Profile: "other", Loaded: &missing},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := apparmorProfile(map[string]interface{}{"HostConfig": tc.hostCfg})
+			profiles.resolve(result)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditTypeDecision   = "decision"
+	auditTypeCheckpoint = "checkpoint"
+)
+
+// auditLine is a single line of the audit log. Each line carries the hash of
+// the line before it, so removing or editing a line breaks the chain.
+// Checkpoint lines are additionally signed, so that the chain cannot simply
+// be recomputed after editing.
+type auditLine struct {
+	Seq       uint64          `json:"seq"`
+	PrevHash  string          `json:"prev_hash"`
+	Type      string          `json:"type"`
+	Entry     json.RawMessage `json:"entry"`
+	Signature string          `json:"signature,omitempty"`
+	Hash      string          `json:"hash"`
+}
+
+func (l *auditLine) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatUint(l.Seq, 10) + "|" + l.PrevHash + "|" + l.Type + "|"))
+	h.Write(l.Entry)
+	return h.Sum(nil)
+}
+
+// auditCheckpoint is the entry of a checkpoint line.
+type auditCheckpoint struct {
+	Timestamp string `json:"timestamp"`
+	Head      string `json:"head"`
+}
+
+// auditLog appends hash-chained decision records to a file.
+type auditLog struct {
+	mu              sync.Mutex
+	w               io.Writer
+	seq             uint64
+	prevHash        string
+	signer          crypto.Signer
+	checkpointEvery uint64
+	sinceCheckpoint uint64
+}
+
+// openAuditLog opens the audit log at path for appending, resuming the hash
+// chain from its last line.
+func openAuditLog(path string, signer crypto.Signer, checkpointEvery uint64) (*auditLog, error) {
+
+	l := &auditLog{signer: signer, checkpointEvery: checkpointEvery}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	last, since, valid, err := scanAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+
+	// A crash may have left a partially written line at the end of the log,
+	// which is discarded.
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if last != nil {
+		l.seq, l.prevHash = last.Seq, last.Hash
+	}
+	l.sinceCheckpoint = since
+	l.w = f
+
+	return l, nil
+}
+
+// scanAuditLog returns the last complete line of an audit log, the number of
+// decisions after its last checkpoint, and the offset of the end of the last
+// complete line.
+func scanAuditLog(r io.Reader) (*auditLine, uint64, int64, error) {
+
+	var last *auditLine
+	var since uint64
+	var offset int64
+
+	br := bufio.NewReader(r)
+	for {
+		bs, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return last, since, offset, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		var line auditLine
+		if err := json.Unmarshal(bs, &line); err != nil {
+			// Only the last line may be incomplete.
+			if _, err := br.Peek(1); err == io.EOF {
+				return last, since, offset, nil
+			}
+			return nil, 0, 0, fmt.Errorf("offset %d: %w", offset, err)
+		}
+
+		if line.Type == auditTypeCheckpoint {
+			since = 0
+		} else {
+			since++
+		}
+		last = &line
+		offset += int64(len(bs))
+	}
+}
+
+// record appends the decision to the log, followed by a signed checkpoint
+// when one is due.
+func (l *auditLog) record(entry interface{}) error {
+
+	if l == nil {
+		return nil
+	}
+
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.append(auditTypeDecision, bs, false); err != nil {
+		return err
+	}
+
+	l.sinceCheckpoint++
+	if l.signer != nil && l.checkpointEvery > 0 && l.sinceCheckpoint >= l.checkpointEvery {
+		return l.checkpoint()
+	}
+
+	return nil
+}
+
+// checkpoint appends a signed checkpoint line. Callers must hold l.mu.
+func (l *auditLog) checkpoint() error {
+
+	bs, err := json.Marshal(auditCheckpoint{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Head:      l.prevHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	l.sinceCheckpoint = 0
+	if err := l.append(auditTypeCheckpoint, bs, true); err != nil {
+		return err
+	}
+
+	// Signed checkpoints are synced, so that they survive a crash.
+	if f, ok := l.w.(*os.File); ok {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+// close appends a final checkpoint covering the decisions recorded since the
+// last one, so that the whole log is signed, and closes the log.
+func (l *auditLog) close() error {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	if l.signer != nil && l.sinceCheckpoint > 0 {
+		err = l.checkpoint()
+	}
+
+	if f, ok := l.w.(*os.File); ok {
+		if serr := f.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if c, ok := l.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (l *auditLog) append(typ string, entry []byte, sign bool) error {
+
+	line := auditLine{
+		Seq:      l.seq + 1,
+		PrevHash: l.prevHash,
+		Type:     typ,
+		Entry:    entry,
+	}
+
+	digest := line.digest()
+	line.Hash = hex.EncodeToString(digest)
+
+	if sign {
+		sig, err := signDigest(l.signer, digest)
+		if err != nil {
+			return err
+		}
+		line.Signature = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	bs, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.w.Write(append(bs, '\n')); err != nil {
+		return err
+	}
+
+	l.seq, l.prevHash = line.Seq, line.Hash
+	return nil
+}
+
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+func verifyDigest(pub crypto.PublicKey, digest, sig []byte) bool {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, digest, sig)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	default:
+		return false
+	}
+}
+
+// loadSigner reads a PEM encoded PKCS #8 private key.
+func loadSigner(path string) (crypto.Signer, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+// loadPublicKey reads a PEM encoded PKIX public key.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// verifyAuditLog checks the hash chain of an audit log from its first line
+// and, when a public key is given, the signatures of its checkpoints, which
+// must follow at most every decisions apart and cover the last decision. It
+// returns the number of decision and checkpoint lines verified.
+func verifyAuditLog(r io.Reader, pub crypto.PublicKey, every uint64) (int, int, error) {
+
+	var decisions, checkpoints int
+	var since uint64
+	var prev *auditLine
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var line auditLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return decisions, checkpoints, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		if prev == nil && (line.Seq != 1 || line.PrevHash != "") {
+			return decisions, checkpoints, fmt.Errorf("line %d: log starts at sequence %d instead of 1", n, line.Seq)
+		}
+		if prev != nil && (line.Seq != prev.Seq+1 || line.PrevHash != prev.Hash) {
+			return decisions, checkpoints, fmt.Errorf("line %d: chain broken after sequence %d", n, prev.Seq)
+		}
+
+		digest := line.digest()
+		if hex.EncodeToString(digest) != line.Hash {
+			return decisions, checkpoints, fmt.Errorf("line %d: hash mismatch for sequence %d", n, line.Seq)
+		}
+
+		if line.Type == auditTypeCheckpoint {
+			checkpoints++
+			since = 0
+			if pub != nil {
+				sig, err := base64.StdEncoding.DecodeString(line.Signature)
+				if err != nil || !verifyDigest(pub, digest, sig) {
+					return decisions, checkpoints, fmt.Errorf("line %d: invalid checkpoint signature for sequence %d", n, line.Seq)
+				}
+			}
+		} else {
+			decisions++
+			since++
+			if pub != nil && every > 0 && since > every {
+				return decisions, checkpoints, fmt.Errorf("line %d: no signed checkpoint in the %d decisions before sequence %d", n, every, line.Seq)
+			}
+		}
+
+		prev = &line
+	}
+
+	if err := scanner.Err(); err != nil {
+		return decisions, checkpoints, err
+	}
+
+	if pub != nil && since > 0 {
+		return decisions, checkpoints, fmt.Errorf("the last %d decisions are not covered by a signed checkpoint", since)
+	}
+
+	return decisions, checkpoints, nil
+}
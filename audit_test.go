@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	l := &auditLog{w: &buf, signer: priv, checkpointEvery: 2}
+	for i := 0; i < 5; i++ {
+		if err := l.record(map[string]interface{}{"result": i%2 == 0, "user": "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), pub, 2); err == nil {
+		t.Error("Expected decision not covered by a checkpoint to be detected")
+	}
+
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decisions, checkpoints, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), pub, 2)
+	if err != nil || decisions != 5 || checkpoints != 3 {
+		t.Fatalf("Expected intact log with 5 decisions and 3 checkpoints, got %d, %d (%v)", decisions, checkpoints, err)
+	}
+
+	if _, _, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), pub, 1); err == nil {
+		t.Error("Expected checkpoints further apart than required to be detected")
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	tampered := strings.Join(append(append([]string{}, lines[:1]...), lines[2:]...), "")
+	if _, _, err := verifyAuditLog(strings.NewReader(tampered), pub, 2); err == nil {
+		t.Error("Expected removed line to be detected")
+	}
+
+	tampered = strings.Join(lines[3:], "")
+	if _, _, err := verifyAuditLog(strings.NewReader(tampered), pub, 2); err == nil {
+		t.Error("Expected removed head to be detected")
+	}
+
+	tampered = strings.Replace(buf.String(), `"alice"`, `"mallory"`, 1)
+	if _, _, err := verifyAuditLog(strings.NewReader(tampered), pub, 2); err == nil {
+		t.Error("Expected edited line to be detected")
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, _, err := verifyAuditLog(bytes.NewReader(buf.Bytes()), otherPub, 2); err == nil {
+		t.Error("Expected checkpoint signed by another key to be rejected")
+	}
+
+	var rewritten bytes.Buffer
+	unsigned := &auditLog{w: &rewritten}
+	for i := 0; i < 5; i++ {
+		if err := unsigned.record(map[string]interface{}{"result": true, "user": "mallory"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := verifyAuditLog(bytes.NewReader(rewritten.Bytes()), pub, 2); err == nil {
+		t.Error("Expected rewritten log without checkpoints to be rejected")
+	}
+	if _, _, err := verifyAuditLog(bytes.NewReader(rewritten.Bytes()), nil, 2); err != nil {
+		t.Errorf("Expected unsigned chain to verify without a public key, got %v", err)
+	}
+
+	last, since, _, err := scanAuditLog(bytes.NewReader(buf.Bytes()))
+	if err != nil || last.Seq != 8 || last.Hash != l.prevHash || since != 0 {
+		t.Errorf("Expected chain to resume from sequence 8, got %+v, %d (%v)", last, since, err)
+	}
+}
+
+func TestAuditLogTornTail(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := openAuditLog(path, priv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.record(map[string]interface{}{"result": true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.w.(*os.File).Close()
+
+	// A crash in the middle of writing a line.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"seq":5,"prev_hash":"`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = openAuditLog(path, priv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.seq != 4 || l.sinceCheckpoint != 1 {
+		t.Fatalf("Expected chain to resume from sequence 4 with 1 decision since the last checkpoint, got %d, %d", l.seq, l.sinceCheckpoint)
+	}
+	if err := l.record(map[string]interface{}{"result": false}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	decisions, checkpoints, err := verifyAuditLog(f, pub, 2)
+	if err != nil || decisions != 4 || checkpoints != 2 {
+		t.Fatalf("Expected intact log with 4 decisions and 2 checkpoints, got %d, %d (%v)", decisions, checkpoints, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// auditdOp is the op field of the records of the plugin, which tells them
+// apart from those of other programs, e.g. with ausearch -m USER_AVC.
+const auditdOp = "docker-authz"
+
+// auditdWriter sends user messages to the kernel audit subsystem.
+type auditdWriter interface {
+	send(text string) error
+	close() error
+}
+
+// auditdSink sends decisions to the kernel audit subsystem as USER_AVC
+// records, the type of the access decisions of user space object managers,
+// so that they are logged by auditd along with the records of the kernel.
+type auditdSink struct {
+	w auditdWriter
+
+	// allowed is set when allowed decisions are sent too. Only denied
+	// decisions are sent otherwise.
+	allowed bool
+}
+
+func (s *auditdSink) Start(context.Context) error {
+	return nil
+}
+
+func (s *auditdSink) Record(event map[string]interface{}) error {
+
+	if allowed, _ := event["result"].(bool); allowed && !s.allowed {
+		return nil
+	}
+
+	return s.w.send(auditdRecord(event))
+}
+
+func (s *auditdSink) Flush(context.Context) error {
+	return nil
+}
+
+func (s *auditdSink) Stop(context.Context) error {
+	return s.w.close()
+}
+
+// auditdRecord returns the text of the audit record of a decision event. The
+// fields, always present and in this order, are:
+//
+//	op=docker-authz decision=denied acct="alice" method="POST" path="/v1.43/containers/create" code="privileged" decision_id="..." error=? res=failed
+//
+// Values received from clients are encoded as auditd does: quoted, or
+// hex encoded when they hold spaces, quotes or control characters. Missing
+// values are ?.
+func auditdRecord(event map[string]interface{}) string {
+
+	input, _ := event["input"].(map[string]interface{})
+	allowed, _ := event["result"].(bool)
+
+	decision, res := "denied", "failed"
+	if allowed {
+		decision, res = "allowed", "success"
+	}
+
+	field := func(m map[string]interface{}, key string) string {
+		s, _ := m[key].(string)
+		return auditdValue(s)
+	}
+
+	return strings.Join([]string{
+		"op=" + auditdOp,
+		"decision=" + decision,
+		"acct=" + field(input, "User"),
+		"method=" + field(input, "Method"),
+		"path=" + field(input, "Path"),
+		"code=" + field(event, "code"),
+		"decision_id=" + field(event, "decision_id"),
+		"error=" + field(event, "error"),
+		"res=" + res,
+	}, " ")
+}
+
+// auditdValue encodes an untrusted value of an audit record.
+func auditdValue(s string) string {
+
+	if s == "" {
+		return "?"
+	}
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '"' || c > '~' {
+			return strings.ToUpper(hex.EncodeToString([]byte(s)))
+		}
+	}
+
+	return `"` + s + `"`
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// auditdAckTimeout bounds the wait for the kernel to acknowledge a record.
+const auditdAckTimeout = time.Second
+
+// netlinkAudit sends user messages over a NETLINK_AUDIT socket, which
+// requires the CAP_AUDIT_WRITE capability.
+type netlinkAudit struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+}
+
+// dialAuditd opens a netlink socket to the kernel audit subsystem.
+func dialAuditd() (auditdWriter, error) {
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_AUDIT)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	tv := unix.NsecToTimeval(auditdAckTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	return &netlinkAudit{fd: fd}, nil
+}
+
+// send sends text as a USER_AVC record, and waits for the kernel to
+// acknowledge it, so that missing privileges are reported.
+func (a *netlinkAudit) send(text string) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+
+	payload := append([]byte(text), 0)
+	msg := make([]byte, unix.NLMSG_HDRLEN+len(payload))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&msg[0])) = unix.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  unix.AUDIT_USER_AVC,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		Seq:   a.seq,
+	}
+	copy(msg[unix.NLMSG_HDRLEN:], payload)
+
+	if err := unix.Sendto(a.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(a.fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		if n < unix.NLMSG_HDRLEN {
+			return fmt.Errorf("short netlink audit reply")
+		}
+		hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&buf[0]))
+		if hdr.Seq != a.seq || hdr.Type != unix.NLMSG_ERROR {
+			continue
+		}
+		if n < unix.NLMSG_HDRLEN+4 {
+			return fmt.Errorf("short netlink audit reply")
+		}
+		if errno := *(*int32)(unsafe.Pointer(&buf[unix.NLMSG_HDRLEN])); errno != 0 {
+			return fmt.Errorf("audit: %w", unix.Errno(-errno))
+		}
+		return nil
+	}
+}
+
+func (a *netlinkAudit) close() error {
+	return unix.Close(a.fd)
+}
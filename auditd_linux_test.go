@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkAudit(t *testing.T) {
+
+	w, err := dialAuditd()
+	if err != nil {
+		t.Skipf("audit netlink unavailable: %v", err)
+	}
+	defer w.close()
+
+	err = w.send(auditdRecord(map[string]interface{}{"result": false, "decision_id": "test"}))
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, unix.EAGAIN) {
+		t.Skipf("audit records cannot be written: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
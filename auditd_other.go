@@ -0,0 +1,16 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// dialAuditd is only supported on Linux.
+func dialAuditd() (auditdWriter, error) {
+	return nil, fmt.Errorf("the kernel audit subsystem is not supported on this platform")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeAuditdWriter struct {
+	records []string
+	closed  bool
+}
+
+func (w *fakeAuditdWriter) send(text string) error {
+	w.records = append(w.records, text)
+	return nil
+}
+
+func (w *fakeAuditdWriter) close() error {
+	w.closed = true
+	return nil
+}
+
+func TestAuditdRecord(t *testing.T) {
+
+	tests := []struct {
+		note     string
+		event    map[string]interface{}
+		expected string
+	}{
+		{
+			note: "denied",
+			event: map[string]interface{}{
+				"decision_id": "4a1b",
+				"result":      false,
+				"code":        "privileged",
+				"input":       map[string]interface{}{"User": "alice", "Method": "POST", "Path": "/v1.43/containers/create"},
+			},
+			expected: `op=docker-authz decision=denied acct="alice" method="POST" path="/v1.43/containers/create" code="privileged" decision_id="4a1b" error=? res=failed`,
+		},
+		{
+			note: "allowed without user",
+			event: map[string]interface{}{
+				"decision_id": "4a1c",
+				"result":      true,
+				"input":       map[string]interface{}{"Method": "GET", "Path": "/_ping"},
+			},
+			expected: `op=docker-authz decision=allowed acct=? method="GET" path="/_ping" code=? decision_id="4a1c" error=? res=success`,
+		},
+		{
+			note: "encoded values",
+			event: map[string]interface{}{
+				"result": false,
+				"error":  "eval error",
+				"input":  map[string]interface{}{"User": `a"b`, "Method": "GET", "Path": "/x y"},
+			},
+			expected: `op=docker-authz decision=denied acct=612262 method="GET" path=2F782079 code=? decision_id=? error=6576616C206572726F72 res=failed`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			if actual := auditdRecord(tc.event); actual != tc.expected {
+				t.Fatalf("Expected %s, got %s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAuditdSink(t *testing.T) {
+
+	denied := map[string]interface{}{"result": false, "input": map[string]interface{}{"User": "alice"}}
+	allowed := map[string]interface{}{"result": true, "input": map[string]interface{}{"User": "bob"}}
+
+	w := &fakeAuditdWriter{}
+	s := &auditdSink{w: w}
+	for _, event := range []map[string]interface{}{denied, allowed} {
+		if err := s.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.records) != 1 || w.records[0] != auditdRecord(denied) {
+		t.Fatalf("Expected only the denied decision, got %v", w.records)
+	}
+
+	w = &fakeAuditdWriter{}
+	s = &auditdSink{w: w, allowed: true}
+	for _, event := range []map[string]interface{}{denied, allowed} {
+		if err := s.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.records) != 2 {
+		t.Fatalf("Expected both decisions, got %v", w.records)
+	}
+
+	if err := s.Stop(context.Background()); err != nil || !w.closed {
+		t.Fatalf("Expected the writer to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPendingDecisions bounds the number of encoded decisions a sink keeps
+// while its destination is unavailable.
+const maxPendingDecisions = 100000
+
+// decisionBatch holds the encoded decisions waiting to be sent by a sink.
+// When the destination stays unavailable, the oldest decisions are dropped.
+// With a spool, the decisions are kept on disk instead of in memory from the
+// first failure until the spool has been drained.
+type decisionBatch struct {
+	name string
+
+	mu      sync.Mutex
+	items   [][]byte
+	dropped int
+	spool   *decisionSpool
+}
+
+// spoolTo keeps the decisions that could not be sent in the spool in dir.
+func (b *decisionBatch) spoolTo(dir string, maxBytes int64) error {
+
+	spool, err := openDecisionSpool(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.spool = spool
+
+	return nil
+}
+
+func (b *decisionBatch) add(item []byte) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.spool != nil && !b.spool.empty() {
+		b.spoolItems([][]byte{item})
+		return
+	}
+
+	if len(b.items) >= maxPendingDecisions {
+		b.items = b.items[1:]
+		b.dropped++
+	}
+	b.items = append(b.items, item)
+}
+
+// take removes and returns the pending decisions. Spooled decisions are
+// returned first, and removed from the spool by the next take unless they
+// are requeued.
+func (b *decisionBatch) take() [][]byte {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.dropped > 0 {
+		log.Printf("Dropped %d decisions that could not be sent to %s", b.dropped, b.name)
+		b.dropped = 0
+	}
+
+	if b.spool != nil {
+		if err := b.spool.release(); err != nil {
+			log.Printf("Failed to remove decisions sent to %s from spool: %v", b.name, err)
+		}
+		if !b.spool.empty() {
+			items, err := b.spool.take()
+			if err != nil {
+				log.Printf("Failed to read decisions for %s from spool: %v", b.name, err)
+			}
+			return items
+		}
+	}
+
+	items := b.items
+	b.items = nil
+
+	return items
+}
+
+// requeue puts back decisions that could not be sent, ahead of the ones
+// added since they were taken.
+func (b *decisionBatch) requeue(items [][]byte) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.spool != nil {
+		if !b.spool.empty() {
+			b.spool.retain()
+			return
+		}
+		b.spoolItems(append(items, b.items...))
+		b.items = nil
+		return
+	}
+
+	b.items = append(items, b.items...)
+	if n := len(b.items) - maxPendingDecisions; n > 0 {
+		b.items = b.items[n:]
+		b.dropped += n
+	}
+}
+
+// spoolItems writes items to the spool. b.mu must be held.
+func (b *decisionBatch) spoolItems(items [][]byte) {
+
+	dropped, err := b.spool.write(items)
+	if err != nil {
+		log.Printf("Failed to spool decisions for %s: %v", b.name, err)
+	}
+	b.dropped += dropped
+}
+
+// flushEvery calls flush on every interval until ctx is done.
+func flushEvery(ctx context.Context, name string, interval time.Duration, flush func(context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := flush(ctx); err != nil {
+					log.Printf("Failed to send decisions to %s: %v", name, err)
+				}
+			}
+		}
+	}()
+}
+
+// expandTimeLayout replaces the {year}, {month}, {day}, {hour} and {host}
+// placeholders of layout.
+func expandTimeLayout(layout string, t time.Time, host string) string {
+	return strings.NewReplacer(
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+		"{host}", host,
+	).Replace(layout)
+}
+
+// clientTransport returns the transport of HTTP clients connecting to other
+// services, e.g. decision sinks, registries or data URLs. Like the default
+// transport, it connects through the proxy given by HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY, and its TLS configuration is given by clientTLSConfig.
+func clientTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile == "" && certFile == "" && keyFile == "" && pluginSVID == nil {
+		return transport, nil
+	}
+
+	tlsConfig, err := clientTLSConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+// clientTLSConfig returns the TLS configuration of clients connecting to other
+// services. caFile, when set, replaces the system roots used to verify the
+// server's certificate, and certFile and keyFile, when set, are presented as
+// the client certificate. Otherwise, the SVID of the plugin is presented when
+// -spiffe-svid is set.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		bs, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if svid := pluginSVID; svid != nil {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := svid.certificate(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
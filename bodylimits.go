@@ -0,0 +1,121 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// defaultBodyFamily names the limit applying to the endpoint families not
+// given a limit of their own.
+const defaultBodyFamily = "default"
+
+// bodyLimits bounds the size of the request bodies decoded into the input,
+// by endpoint family, e.g. exec or build. Larger bodies are left out of the
+// input, which is marked with BodyTruncated, and the request is denied
+// unless policy is set, in which case the policy decides.
+type bodyLimits struct {
+	families map[string]int64
+	policy   bool
+}
+
+// truncatedBodyDecision is the decision on requests whose body was left out
+// of the input, unless the policy decides.
+var truncatedBodyDecision = decision{
+	Code:    "body_truncated",
+	Message: "request body exceeds its limit and can not be inspected",
+}
+
+// parseBodyLimits parses comma separated family=bytes pairs, where the
+// default family applies to endpoints without a limit of their own.
+func parseBodyLimits(s string) (*bodyLimits, error) {
+
+	pairs := splitList(s)
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	l := &bodyLimits{families: map[string]int64{}}
+	for _, pair := range pairs {
+		family, size, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid body limit %q, expected family=bytes", pair)
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid body limit %q, expected family=bytes", pair)
+		}
+		l.families[family] = n
+	}
+
+	return l, nil
+}
+
+// limit returns the body size limit of the endpoint family, and false when
+// bodies of the family are not limited.
+func (l *bodyLimits) limit(family string) (int64, bool) {
+
+	if l == nil {
+		return 0, false
+	}
+
+	if n, ok := l.families[family]; ok {
+		return n, true
+	}
+
+	n, ok := l.families[defaultBodyFamily]
+	return n, ok
+}
+
+// apply drops the body of r when it exceeds the limit of its endpoint family,
+// reporting whether it did.
+func (l *bodyLimits) apply(r *authorization.Request) bool {
+
+	if l == nil || len(r.RequestBody) == 0 {
+		return false
+	}
+
+	family := endpointFamily(r.RequestURI)
+	n, ok := l.limit(family)
+	if !ok || int64(len(r.RequestBody)) <= n {
+		return false
+	}
+
+	bodyTruncations.WithLabelValues(family).Inc()
+	r.RequestBody = nil
+
+	return true
+}
+
+// deny reports whether the request of input, whose body was left out, is
+// denied without evaluating the policy.
+func (l *bodyLimits) deny(input interface{}) bool {
+
+	if l == nil || l.policy {
+		return false
+	}
+
+	doc, _ := input.(map[string]interface{})
+	return doc["BodyTruncated"] == true
+}
+
+// endpointFamily returns the family of the endpoint of a request URI, which
+// is the first segment of its path, e.g. containers, images or build. Exec
+// endpoints, which are partly below /containers, form a family of their own.
+func endpointFamily(uri string) string {
+
+	path, _, _ := strings.Cut(uri, "?")
+	parts := strings.Split(strings.Trim(trimAPIVersion(path), "/"), "/")
+
+	if len(parts) >= 3 && parts[0] == "containers" && parts[2] == "exec" {
+		return "exec"
+	}
+
+	return parts[0]
+}
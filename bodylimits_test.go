@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestEndpointFamily(t *testing.T) {
+
+	tests := map[string]string{
+		"/v1.41/containers/create":          "containers",
+		"/v1.41/containers/abc/exec":        "exec",
+		"/v1.41/exec/123/start":             "exec",
+		"/v1.41/build?t=app":                "build",
+		"/images/create?fromImage=alpine":   "images",
+		"/v1.41/services/create":            "services",
+		"/v1.41/containers/abc/exec/../foo": "exec",
+		"/_ping":                            "_ping",
+	}
+
+	for uri, expected := range tests {
+		if family := endpointFamily(uri); family != expected {
+			t.Errorf("Expected %v for %v, got %v", expected, uri, family)
+		}
+	}
+}
+
+func TestParseBodyLimits(t *testing.T) {
+
+	l, err := parseBodyLimits("exec=16, default=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, ok := l.limit("exec"); !ok || n != 16 {
+		t.Errorf("Expected 16 for exec, got %v", n)
+	}
+	if n, ok := l.limit("containers"); !ok || n != 1024 {
+		t.Errorf("Expected default of 1024 for containers, got %v", n)
+	}
+
+	if l, err := parseBodyLimits(""); err != nil || l != nil {
+		t.Errorf("Expected no limits, got %v (error: %v)", l, err)
+	}
+
+	for _, s := range []string{"exec", "exec=-1", "exec=4KB"} {
+		if _, err := parseBodyLimits(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestBodyLimitsInput(t *testing.T) {
+
+	l, err := parseBodyLimits("exec=16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &DockerAuthZPlugin{bodyLimits: l}
+
+	before := counterValue(t, bodyTruncations.WithLabelValues("exec"))
+
+	r := authorization.Request{
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.41/containers/abc/exec",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(`{"Cmd": ["sh"], "Privileged": true}`),
+	}
+
+	input, err := p.buildInput(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := input.(map[string]interface{})
+	if body, _ := doc["Body"].(map[string]interface{}); doc["BodyTruncated"] != true || body != nil {
+		t.Fatalf("Expected body to be left out, got %v and %v", doc["BodyTruncated"], doc["Body"])
+	}
+	if delta := counterValue(t, bodyTruncations.WithLabelValues("exec")) - before; delta != 1 {
+		t.Errorf("Expected 1 truncation, got %v", delta)
+	}
+
+	r.RequestURI = "/v1.41/containers/create"
+	if input, err = p.buildInput(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	doc = input.(map[string]interface{})
+	if body, _ := doc["Body"].(map[string]interface{}); doc["BodyTruncated"] != nil || body["Privileged"] != true {
+		t.Fatalf("Expected body of unlimited family in input, got %v", doc)
+	}
+}
+
+func TestBodyLimitsDeny(t *testing.T) {
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(policyFile, []byte("package docker.authz\n\nallow = true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := parseBodyLimits("exec=16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		overlay:    newRuntimeOverlay(),
+		history:    newDecisionHistory(decisionHistorySize),
+		bodyLimits: l,
+	}
+
+	r := authorization.Request{
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.41/containers/abc/exec",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(`{"Cmd": ["sh"], "Privileged": true}`),
+	}
+
+	// A truncated body is denied even though the policy allows everything.
+	resp := p.AuthZReq(r)
+	if resp.Allow || !strings.Contains(resp.Msg, "body_truncated") {
+		t.Fatalf("Expected truncated body to be denied, got %+v", resp)
+	}
+
+	// Bodies within their limit are evaluated.
+	if resp := p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"}); !resp.Allow {
+		t.Fatalf("Expected request to be allowed, got %+v", resp)
+	}
+
+	// With -body-truncation policy, the policy decides.
+	l.policy = true
+	if resp := p.AuthZReq(r); !resp.Allow {
+		t.Fatalf("Expected the policy to decide, got %+v", resp)
+	}
+}
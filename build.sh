@@ -5,11 +5,16 @@ set -e
 
 OPA_VERSION=$(go list -m -f '{{.Version}}' github.com/open-policy-agent/opa)
 
+# CONFIG_PUBLIC_KEY names a PEM encoded public key the config file must then be
+# signed with.
+LDFLAGS="-X github.com/open-policy-agent/opa-docker-authz/version.Version=$VERSION -X github.com/open-policy-agent/opa-docker-authz/version.OPAVersion=$OPA_VERSION"
+if [ -n "$CONFIG_PUBLIC_KEY" ]; then
+    LDFLAGS="$LDFLAGS -X main.configPublicKey=$(grep -v -- '-----' "$CONFIG_PUBLIC_KEY" | tr -d '\n')"
+fi
+
 echo "Building opa-docker-authz version: $VERSION (OPA version: $OPA_VERSION)"
 
 echo -e "\nBuilding opa-docker-authz ..."
-CGO_ENABLED=0 go build -ldflags \
-    "-X github.com/open-policy-agent/opa-docker-authz/version.Version=$VERSION -X github.com/open-policy-agent/opa-docker-authz/version.OPAVersion=$OPA_VERSION" \
-    -o opa-docker-authz
+CGO_ENABLED=0 go build -ldflags "$LDFLAGS" -o opa-docker-authz
 
 echo -e "\n... done!"
@@ -0,0 +1,235 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	buildContextSourceBody   = "body"
+	buildContextSourceRemote = "remote"
+
+	defaultDockerfileName = "Dockerfile"
+
+	// maxDockerfileSize bounds the size of Dockerfiles and .dockerignore
+	// files read from build contexts.
+	maxDockerfileSize = 1 << 20
+)
+
+var errBuildContextUnavailable = errors.New("build context is not available to authorization plugins")
+
+// BuildContext holds the Dockerfile and .dockerignore of a build request.
+type BuildContext struct {
+	Source         string `json:",omitempty"`
+	DockerfilePath string
+	Dockerfile     string `json:",omitempty"`
+	Dockerignore   string `json:",omitempty"`
+
+	// Error is set when the build context could not be inspected.
+	Error string `json:",omitempty"`
+}
+
+// buildContextInspector extracts the Dockerfile of build requests, reading
+// at most limit bytes of the build context.
+type buildContextInspector struct {
+	client *http.Client
+	limit  int64
+
+	// hosts are the hosts remote build contexts may be fetched from, as
+	// host or host:port. Remote build contexts are not fetched without
+	// any, so that clients can not make the plugin send requests from its
+	// network position.
+	hosts map[string]bool
+}
+
+func newBuildContextInspector(limit int64, hosts []string) *buildContextInspector {
+
+	b := &buildContextInspector{
+		limit: limit,
+		hosts: map[string]bool{},
+	}
+	for _, host := range hosts {
+		b.hosts[strings.ToLower(host)] = true
+	}
+
+	b.client = &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return b.checkHost(req.URL)
+		},
+	}
+
+	return b
+}
+
+// checkHost returns an error unless remote build contexts may be fetched
+// from the host of u.
+func (b *buildContextInspector) checkHost(u *url.URL) error {
+
+	if b.hosts[strings.ToLower(u.Host)] || b.hosts[strings.ToLower(u.Hostname())] {
+		return nil
+	}
+
+	return fmt.Errorf("remote build context host %q is not allowed", u.Host)
+}
+
+// isBuildRequest reports whether the request builds an image.
+func isBuildRequest(method, path string) bool {
+	return method == "POST" && trimAPIVersion(path) == "/build"
+}
+
+// inspect extracts the Dockerfile of a build request. The daemon only passes
+// JSON bodies to authorization plugins, so the context is inspected when it
+// is passed regardless, or when it is given as a remote URL.
+func (b *buildContextInspector) inspect(ctx context.Context, query url.Values, body []byte) *BuildContext {
+
+	bc := &BuildContext{DockerfilePath: query.Get("dockerfile")}
+	if bc.DockerfilePath == "" {
+		bc.DockerfilePath = defaultDockerfileName
+	}
+
+	var err error
+	switch remote := query.Get("remote"); {
+	case len(body) > 0:
+		bc.Source = buildContextSourceBody
+		err = extractBuildContext(bytes.NewReader(body), bc)
+	case remote != "":
+		bc.Source = buildContextSourceRemote
+		err = b.fetch(ctx, remote, bc)
+	default:
+		err = errBuildContextUnavailable
+	}
+
+	if err != nil {
+		bc.Error = err.Error()
+	}
+
+	return bc
+}
+
+// fetch reads a remote build context, which is either a tarball or a plain
+// text Dockerfile. Git repositories are not supported.
+func (b *buildContextInspector) fetch(ctx context.Context, remote string, bc *BuildContext) error {
+
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Fragment != "" || strings.HasSuffix(u.Path, ".git") {
+		return fmt.Errorf("remote build context %q is not supported", remote)
+	}
+	if err := b.checkHost(u); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", remote, resp.Status)
+	}
+
+	r := bufio.NewReader(io.LimitReader(resp.Body, b.limit))
+	if isTextDockerfile(r) {
+		bs, err := io.ReadAll(io.LimitReader(r, maxDockerfileSize))
+		if err != nil {
+			return err
+		}
+		bc.Dockerfile = string(bs)
+		return nil
+	}
+
+	return extractBuildContext(r, bc)
+}
+
+// isTextDockerfile reports whether r holds a plain text Dockerfile rather
+// than an archive, as decided by the daemon for remote contexts.
+func isTextDockerfile(r *bufio.Reader) bool {
+
+	head, _ := r.Peek(512)
+	if len(head) == 0 {
+		return false
+	}
+
+	if head[0] == 0x1f || len(head) > 262 && string(head[257:262]) == "ustar" {
+		return false
+	}
+
+	return !bytes.ContainsRune(head, 0)
+}
+
+// extractBuildContext reads a possibly compressed tar archive until it has
+// found the Dockerfile and .dockerignore, or reached its end.
+func extractBuildContext(r io.Reader, bc *BuildContext) error {
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	dockerfile := path.Clean(bc.DockerfilePath)
+	foundDockerfile, foundIgnore := false, false
+
+	tr := tar.NewReader(r)
+	for !foundDockerfile || !foundIgnore {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var target *string
+		switch path.Clean(hdr.Name) {
+		case dockerfile:
+			target, foundDockerfile = &bc.Dockerfile, true
+		case ".dockerignore":
+			target, foundIgnore = &bc.Dockerignore, true
+		default:
+			continue
+		}
+
+		bs, err := io.ReadAll(io.LimitReader(tr, maxDockerfileSize))
+		if err != nil {
+			return err
+		}
+		*target = string(bs)
+	}
+
+	if !foundDockerfile {
+		return fmt.Errorf("%s not found in build context", bc.DockerfilePath)
+	}
+
+	return nil
+}
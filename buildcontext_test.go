@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func buildContextTar(t *testing.T, files map[string]string, compress bool) []byte {
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	var tw *tar.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestBuildContextInspection(t *testing.T) {
+	files := map[string]string{
+		"app/main.go":       "package main",
+		"./Dockerfile":      "FROM alpine\n",
+		"build/Dockerfile":  "FROM scratch\n",
+		".dockerignore":     "*.log\n",
+		"build/placeholder": "",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/context.tar.gz":
+			_, _ = w.Write(buildContextTar(t, files, true))
+		case "/Dockerfile":
+			_, _ = w.Write([]byte("FROM busybox\nADD https://example.com/x /x\n"))
+		case "/redirect":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBuildContextInspector(1<<20, []string{u.Host})
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		body     []byte
+		expected BuildContext
+	}{
+		{
+			name:     "body",
+			query:    url.Values{},
+			body:     buildContextTar(t, files, false),
+			expected: BuildContext{Source: "body", DockerfilePath: "Dockerfile", Dockerfile: "FROM alpine\n", Dockerignore: "*.log\n"},
+		},
+		{
+			name:     "remote tarball",
+			query:    url.Values{"remote": {server.URL + "/context.tar.gz"}, "dockerfile": {"build/Dockerfile"}},
+			expected: BuildContext{Source: "remote", DockerfilePath: "build/Dockerfile", Dockerfile: "FROM scratch\n", Dockerignore: "*.log\n"},
+		},
+		{
+			name:     "remote dockerfile",
+			query:    url.Values{"remote": {server.URL + "/Dockerfile"}},
+			expected: BuildContext{Source: "remote", DockerfilePath: "Dockerfile", Dockerfile: "FROM busybox\nADD https://example.com/x /x\n"},
+		},
+		{
+			name:     "git",
+			query:    url.Values{"remote": {"https://github.com/example/repo.git"}},
+			expected: BuildContext{Source: "remote", DockerfilePath: "Dockerfile", Error: `remote build context "https://github.com/example/repo.git" is not supported`},
+		},
+		{
+			name:     "host not allowed",
+			query:    url.Values{"remote": {"http://169.254.169.254/latest/meta-data/"}},
+			expected: BuildContext{Source: "remote", DockerfilePath: "Dockerfile", Error: `remote build context host "169.254.169.254" is not allowed`},
+		},
+		{
+			name:     "redirect to host not allowed",
+			query:    url.Values{"remote": {server.URL + "/redirect"}},
+			expected: BuildContext{Source: "remote", DockerfilePath: "Dockerfile", Error: `Get "http://169.254.169.254/latest/meta-data/": remote build context host "169.254.169.254" is not allowed`},
+		},
+		{
+			name:     "unavailable",
+			query:    url.Values{},
+			expected: BuildContext{DockerfilePath: "Dockerfile", Error: errBuildContextUnavailable.Error()},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := b.inspect(context.Background(), tc.query, tc.body)
+			if *result != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, *result)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Decisions of the requests opening BuildKit sessions, set with
+// -buildkit-sessions.
+const (
+	sessionDecisionPolicy = "policy"
+	sessionDecisionAllow  = "allow"
+	sessionDecisionDeny   = "deny"
+)
+
+const (
+	// buildKitFrontend is the frontend the daemon builds with, unless the
+	// BUILDKIT_SYNTAX build argument names the image of another.
+	buildKitFrontend = "dockerfile.v0"
+
+	// buildKitClientSession is the remote of builds whose context is sent
+	// over the session of the client.
+	buildKitClientSession = "client-session"
+
+	sessionIDHeader     = "X-Docker-Expose-Session-Uuid"
+	sessionNameHeader   = "X-Docker-Expose-Session-Name"
+	sessionMethodHeader = "X-Docker-Expose-Session-Grpc-Method"
+)
+
+// BuildKitSession is the input.session document: a request upgrading to the
+// gRPC stream of a BuildKit session, through which the daemon reads the build
+// context, secrets and SSH agents of the client. The stream itself is not
+// passed to authorization plugins.
+type BuildKitSession struct {
+	// Endpoint is session for POST /session, or grpc for POST /grpc, which
+	// exposes the BuildKit API of the daemon to clients such as buildx.
+	Endpoint string `json:"endpoint"`
+
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Methods are the gRPC methods the client exposes to the daemon, e.g.
+	// /moby.filesync.v1.FileSync/DiffCopy, and Services their services.
+	Methods  []string `json:"methods"`
+	Services []string `json:"services"`
+}
+
+// BuildKitBuild is the input.buildkit document: the parts of a BuildKit build
+// request, /build?version=2, known when it is authorized.
+type BuildKitBuild struct {
+	// Frontend is dockerfile.v0, or the image of the BUILDKIT_SYNTAX build
+	// argument. The syntax directive of the Dockerfile is not known, as the
+	// Dockerfile is sent over the session.
+	Frontend string `json:"frontend"`
+
+	// Attrs are the attributes the daemon passes to the frontend, e.g.
+	// target, platform or build-arg:VERSION.
+	Attrs map[string]string `json:"attrs"`
+
+	// Contexts maps the names of the contexts of the build to their source:
+	// a URL, or client-session when the client sends them.
+	Contexts map[string]string `json:"contexts"`
+
+	// Session is the ID of the session the client opens with POST /session.
+	Session string `json:"session"`
+}
+
+// isSessionRequest reports whether the request opens a BuildKit session.
+func isSessionRequest(method, path string) bool {
+
+	path = trimAPIVersion(path)
+	return method == "POST" && (path == "/session" || path == "/grpc")
+}
+
+// buildKitSession returns the session opened by /session and /grpc requests,
+// or nil for any other request.
+func buildKitSession(method, path string, headers map[string]string) *BuildKitSession {
+
+	if !isSessionRequest(method, path) {
+		return nil
+	}
+
+	session := &BuildKitSession{Endpoint: strings.TrimPrefix(trimAPIVersion(path), "/")}
+	session.ID, _ = headerValue(headers, sessionIDHeader)
+	session.Name, _ = headerValue(headers, sessionNameHeader)
+
+	// Clients send a header per method, of which the daemon passes the last
+	// one; intermediaries may join them.
+	methods, _ := headerValue(headers, sessionMethodHeader)
+	services := map[string]bool{}
+	session.Methods = []string{}
+	for _, method := range strings.Split(methods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			session.Methods = append(session.Methods, method)
+			service, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+			services[service] = true
+		}
+	}
+	sort.Strings(session.Methods)
+	session.Services = sortedSet(services)
+
+	return session
+}
+
+// buildKitBuild returns the BuildKit build of /build?version=2 requests, or nil
+// for any other request. The attributes are derived from the query as by the
+// daemon.
+func buildKitBuild(method, path string, query url.Values) *BuildKitBuild {
+
+	if !isBuildRequest(method, path) || query.Get("version") != "2" {
+		return nil
+	}
+
+	build := &BuildKitBuild{
+		Frontend: buildKitFrontend,
+		Attrs:    map[string]string{},
+		Contexts: map[string]string{},
+		Session:  query.Get("session"),
+	}
+
+	for param, attr := range map[string]string{"target": "target", "platform": "platform", "dockerfile": "filename", "shmsize": "shm-size"} {
+		if v := query.Get(param); v != "" {
+			build.Attrs[attr] = v
+		}
+	}
+	if queryFlag(query, "nocache") {
+		build.Attrs["no-cache"] = ""
+	}
+	if queryFlag(query, "pull") {
+		build.Attrs["image-resolve-mode"] = "pull"
+	}
+	if mode := query.Get("networkmode"); mode == "host" || mode == "none" {
+		build.Attrs["force-network-mode"] = mode
+	}
+	if hosts := query["extrahosts"]; len(hosts) > 0 {
+		build.Attrs["add-hosts"] = strings.Join(hosts, ",")
+	}
+
+	var cacheFrom []string
+	if json.Unmarshal([]byte(query.Get("cachefrom")), &cacheFrom) == nil && len(cacheFrom) > 0 {
+		build.Attrs["cache-from"] = strings.Join(cacheFrom, ",")
+	}
+
+	var buildArgs map[string]*string
+	if json.Unmarshal([]byte(query.Get("buildargs")), &buildArgs) == nil {
+		for k, v := range buildArgs {
+			if v != nil {
+				build.Attrs["build-arg:"+k] = *v
+			}
+		}
+		if syntax := buildArgs["BUILDKIT_SYNTAX"]; syntax != nil && *syntax != "" {
+			build.Frontend = *syntax
+		}
+	}
+
+	var labels map[string]string
+	if json.Unmarshal([]byte(query.Get("labels")), &labels) == nil {
+		for k, v := range labels {
+			build.Attrs["label:"+k] = v
+		}
+	}
+
+	// The Dockerfile is read from the context when it is remote.
+	remote := query.Get("remote")
+	if remote == "" {
+		remote = buildKitClientSession
+	}
+	build.Contexts["context"] = remote
+	if remote == buildKitClientSession {
+		build.Contexts["dockerfile"] = remote
+	} else {
+		build.Attrs["context"] = remote
+	}
+
+	return build
+}
+
+// sessionDecision returns the decision of requests opening BuildKit sessions
+// under mode, and false when they are left to the policy.
+func sessionDecision(mode string) (decision, bool) {
+
+	switch mode {
+	case sessionDecisionAllow:
+		return decision{Allowed: true}, true
+	case sessionDecisionDeny:
+		return decision{Message: "BuildKit sessions are not allowed"}, true
+	}
+
+	return decision{}, false
+}
+
+// validSessionDecision returns an error unless mode is a decision of
+// -buildkit-sessions.
+func validSessionDecision(mode string) error {
+
+	switch mode {
+	case sessionDecisionPolicy, sessionDecisionAllow, sessionDecisionDeny:
+		return nil
+	}
+
+	return fmt.Errorf("invalid BuildKit session decision %q, expected policy, allow or deny", mode)
+}
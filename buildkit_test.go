@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestBuildKitSession(t *testing.T) {
+
+	headers := map[string]string{
+		"X-Docker-Expose-Session-Uuid":        "wq4zxfpxa2y5sq0kq0dnr3hhw",
+		"X-Docker-Expose-Session-Name":        "app",
+		"X-Docker-Expose-Session-Grpc-Method": "/moby.filesync.v1.FileSync/DiffCopy, /moby.secrets.v1.Secrets/GetSecret,/moby.filesync.v1.FileSync/TarStream",
+	}
+
+	expected := &BuildKitSession{
+		Endpoint: "session",
+		ID:       "wq4zxfpxa2y5sq0kq0dnr3hhw",
+		Name:     "app",
+		Methods:  []string{"/moby.filesync.v1.FileSync/DiffCopy", "/moby.filesync.v1.FileSync/TarStream", "/moby.secrets.v1.Secrets/GetSecret"},
+		Services: []string{"moby.filesync.v1.FileSync", "moby.secrets.v1.Secrets"},
+	}
+	if result := buildKitSession("POST", "/v1.41/session", headers); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	expected = &BuildKitSession{Endpoint: "grpc", Methods: []string{}, Services: []string{}}
+	if result := buildKitSession("POST", "/grpc", nil); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	if result := buildKitSession("POST", "/v1.41/build", headers); result != nil {
+		t.Errorf("Expected no session, got %+v", result)
+	}
+}
+
+func TestBuildKitBuild(t *testing.T) {
+
+	query := url.Values{
+		"version":     {"2"},
+		"session":     {"wq4zxfpxa2y5sq0kq0dnr3hhw"},
+		"remote":      {"client-session"},
+		"dockerfile":  {"build/Dockerfile"},
+		"target":      {"release"},
+		"nocache":     {"1"},
+		"networkmode": {"host"},
+		"buildargs":   {`{"VERSION": "1.2", "BUILDKIT_SYNTAX": "docker/dockerfile:1.5", "UNSET": null}`},
+		"labels":      {`{"team": "shop"}`},
+		"cachefrom":   {`["registry.example.com/app:cache"]`},
+	}
+
+	expected := &BuildKitBuild{
+		Frontend: "docker/dockerfile:1.5",
+		Attrs: map[string]string{
+			"filename":                  "build/Dockerfile",
+			"target":                    "release",
+			"no-cache":                  "",
+			"force-network-mode":        "host",
+			"build-arg:VERSION":         "1.2",
+			"build-arg:BUILDKIT_SYNTAX": "docker/dockerfile:1.5",
+			"label:team":                "shop",
+			"cache-from":                "registry.example.com/app:cache",
+		},
+		Contexts: map[string]string{"context": "client-session", "dockerfile": "client-session"},
+		Session:  "wq4zxfpxa2y5sq0kq0dnr3hhw",
+	}
+	if result := buildKitBuild("POST", "/v1.41/build", query); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	remote := url.Values{"version": {"2"}, "remote": {"https://github.com/example/app.git"}}
+	expected = &BuildKitBuild{
+		Frontend: buildKitFrontend,
+		Attrs:    map[string]string{"context": "https://github.com/example/app.git"},
+		Contexts: map[string]string{"context": "https://github.com/example/app.git"},
+	}
+	if result := buildKitBuild("POST", "/v1.41/build", remote); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	if result := buildKitBuild("POST", "/v1.41/build", url.Values{"t": {"app"}}); result != nil {
+		t.Errorf("Expected classic builds to have no BuildKit build, got %+v", result)
+	}
+}
+
+func TestSessionDecision(t *testing.T) {
+
+	r := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.41/session"}
+
+	for mode, allowed := range map[string]bool{sessionDecisionAllow: true, sessionDecisionDeny: false} {
+		d, err := (&DockerAuthZPlugin{sessions: mode}).evaluate(context.Background(), r)
+		if err != nil || d.Allowed != allowed {
+			t.Errorf("Expected allowed %v under %v, got %+v (error: %v)", allowed, mode, d, err)
+		}
+	}
+
+	if err := validSessionDecision("ignore"); err == nil {
+		t.Error("Expected an invalid decision to be rejected")
+	}
+}
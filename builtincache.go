@@ -0,0 +1,142 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultBuiltinCacheSize is the number of results kept by the builtin cache
+// unless -builtin-cache-size is given.
+const defaultBuiltinCacheSize = 10000
+
+// builtinCache caches the results of the builtins calling external services,
+// e.g. registry.manifest or ldap.query. The cache is shared by every builtin
+// and bounded to a number of entries, evicting the least recently used ones,
+// while each builtin caches its results for its own TTL.
+type builtinCache struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[builtinCacheKey]*list.Element
+	lru     *list.List
+}
+
+type builtinCacheKey struct {
+	view *builtinCacheView
+	key  string
+}
+
+type builtinCacheEntry struct {
+	key     builtinCacheKey
+	value   interface{}
+	expires time.Time
+}
+
+func newBuiltinCache(limit int) *builtinCache {
+	return &builtinCache{limit: limit, entries: map[builtinCacheKey]*list.Element{}, lru: list.New()}
+}
+
+// builtinResults is the cache of the results of builtins.
+var builtinResults = newBuiltinCache(defaultBuiltinCacheSize)
+
+// setLimit sets the number of entries kept by the cache, evicting entries
+// beyond it.
+func (c *builtinCache) setLimit(limit int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	c.evict(time.Now())
+}
+
+// view returns the part of the cache holding the results of a builtin, kept
+// for ttl. Views do not share entries, even when created for the same builtin.
+func (c *builtinCache) view(builtin string, ttl time.Duration) *builtinCacheView {
+	return &builtinCacheView{cache: c, builtin: builtin, ttl: ttl}
+}
+
+// evict removes expired entries from the back of the cache, and the least
+// recently used entries beyond the limit. c.mu must be held.
+func (c *builtinCache) evict(now time.Time) {
+
+	for back := c.lru.Back(); back != nil; back = c.lru.Back() {
+		entry := back.Value.(*builtinCacheEntry)
+		switch {
+		case now.After(entry.expires):
+			c.remove(back, "expired")
+		case c.lru.Len() > c.limit:
+			c.remove(back, "size")
+		default:
+			return
+		}
+	}
+}
+
+func (c *builtinCache) remove(e *list.Element, reason string) {
+
+	entry := e.Value.(*builtinCacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.key)
+
+	builtinCacheEvictions.WithLabelValues(entry.key.view.builtin, reason).Inc()
+	builtinCacheEntries.WithLabelValues(entry.key.view.builtin).Dec()
+}
+
+// builtinCacheView caches the results of a builtin in a builtinCache.
+type builtinCacheView struct {
+	cache   *builtinCache
+	builtin string
+	ttl     time.Duration
+	group   singleflight.Group
+}
+
+// get returns the cached value of key, calling fetch when there is none or
+// it has expired. Concurrent lookups of the same key share a single call of
+// fetch. Errors are not cached.
+func (v *builtinCacheView) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+
+	c := v.cache
+	k := builtinCacheKey{view: v, key: key}
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[k]; ok {
+		entry := e.Value.(*builtinCacheEntry)
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.mu.Unlock()
+			builtinCacheRequests.WithLabelValues(v.builtin, "hit").Inc()
+			return entry.value, nil
+		}
+		c.remove(e, "expired")
+	}
+	c.mu.Unlock()
+
+	builtinCacheRequests.WithLabelValues(v.builtin, "miss").Inc()
+
+	value, err, _ := v.group.Do(key, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[k]; ok {
+		e.Value = &builtinCacheEntry{key: k, value: value, expires: now.Add(v.ttl)}
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[k] = c.lru.PushFront(&builtinCacheEntry{key: k, value: value, expires: now.Add(v.ttl)})
+		builtinCacheEntries.WithLabelValues(v.builtin).Inc()
+	}
+	c.evict(now)
+
+	return value, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBuiltinCache(t *testing.T) {
+
+	cache := newBuiltinCache(2)
+	manifests := cache.view("test.manifest", time.Minute)
+	queries := newBuiltinCache(2).view("test.query", 0)
+
+	// Metrics are global, so only their changes are checked.
+	hits := counterValue(t, builtinCacheRequests.WithLabelValues("test.manifest", "hit"))
+	evictions := counterValue(t, builtinCacheEvictions.WithLabelValues("test.manifest", "size"))
+
+	calls := 0
+	fetch := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			calls++
+			return v, nil
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		v, err := manifests.get("a", fetch("a"))
+		if err != nil || v != "a" {
+			t.Fatalf("Expected a, got %v (err: %v)", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected 1 call, got %d", calls)
+	}
+	if n := counterValue(t, builtinCacheRequests.WithLabelValues("test.manifest", "hit")) - hits; n != 1 {
+		t.Fatalf("Expected 1 hit, got %v", n)
+	}
+
+	// Results of views without TTL expire immediately.
+	_, _ = queries.get("a", fetch("a"))
+	_, _ = queries.get("a", fetch("a"))
+	if calls != 3 {
+		t.Fatalf("Expected 3 calls, got %d", calls)
+	}
+
+	// The least recently used entry is evicted beyond the limit.
+	_, _ = manifests.get("b", fetch("b"))
+	_, _ = manifests.get("a", fetch("a"))
+	_, _ = manifests.get("c", fetch("c"))
+	if calls != 5 {
+		t.Fatalf("Expected 5 calls, got %d", calls)
+	}
+	_, _ = manifests.get("a", fetch("a"))
+	if calls != 5 {
+		t.Fatalf("Expected a to be cached, got %d calls", calls)
+	}
+	_, _ = manifests.get("b", fetch("b"))
+	if calls != 6 {
+		t.Fatalf("Expected b to be evicted, got %d calls", calls)
+	}
+
+	if n := cache.lru.Len(); n != 2 {
+		t.Fatalf("Expected 2 entries, got %d", n)
+	}
+	if n := counterValue(t, builtinCacheEvictions.WithLabelValues("test.manifest", "size")) - evictions; n != 2 {
+		t.Fatalf("Expected 2 evictions, got %v", n)
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetCounter().GetValue()
+}
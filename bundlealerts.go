@@ -0,0 +1,176 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+const defaultBundleAlertFailures = 3
+
+// Bundle alert states.
+const (
+	bundleAlertFailing   = "failing"
+	bundleAlertRecovered = "recovered"
+)
+
+// bundleAlertConfig sets the webhook alerted after AfterFailures consecutive
+// failures to download or activate a bundle.
+type bundleAlertConfig struct {
+	AfterFailures int    `json:"after_failures,omitempty"`
+	Webhook       string `json:"webhook,omitempty"`
+}
+
+func (c *bundleAlertConfig) validate() error {
+
+	if c.AfterFailures < 0 {
+		return fmt.Errorf("bundle_alerts after_failures must not be negative")
+	}
+
+	if c.AfterFailures == 0 {
+		c.AfterFailures = defaultBundleAlertFailures
+	}
+
+	if c.Webhook != "" {
+		u, err := url.Parse(c.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bundle_alerts webhook must be an http or https URL, got %q", c.Webhook)
+		}
+	}
+
+	return nil
+}
+
+// BundleAlert is posted to the webhook when a bundle has failed to download
+// or activate AfterFailures times in a row, and once it succeeds again.
+type BundleAlert struct {
+	Bundle    string    `json:"bundle"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Revision  string    `json:"active_revision,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Errors    []string  `json:"errors,omitempty"`
+	HTTPCode  string    `json:"http_code,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// bundleAlerter counts the consecutive failures of each bundle from the
+// statuses of the bundle plugin.
+type bundleAlerter struct {
+	client *http.Client
+
+	failures map[string]int
+	requests map[string]time.Time
+	alerted  map[string]bool
+}
+
+func newBundleAlerter() *bundleAlerter {
+	return &bundleAlerter{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		failures: map[string]int{},
+		requests: map[string]time.Time{},
+		alerted:  map[string]bool{},
+	}
+}
+
+// observe counts the download attempts reported by statuses, and returns the
+// alerts to send. Statuses not reporting a new attempt are ignored, as the
+// bundle plugin reports every bundle whenever one of them changes.
+func (a *bundleAlerter) observe(cfg bundleAlertConfig, statuses map[string]*bundlePlugin.Status) []BundleAlert {
+
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var alerts []BundleAlert
+	for _, name := range names {
+		status := statuses[name]
+		if status.LastRequest.IsZero() || status.LastRequest.Equal(a.requests[name]) {
+			continue
+		}
+		a.requests[name] = status.LastRequest
+
+		alert := BundleAlert{
+			Bundle:    name,
+			Revision:  status.ActiveRevision,
+			Code:      status.Code,
+			Message:   status.Message,
+			HTTPCode:  status.HTTPCode.String(),
+			Timestamp: status.LastRequest.UTC(),
+		}
+		for _, err := range status.Errors {
+			alert.Errors = append(alert.Errors, err.Error())
+		}
+
+		if status.Code == "" {
+			if a.alerted[name] {
+				alert.State, alert.Failures = bundleAlertRecovered, a.failures[name]
+				alerts = append(alerts, alert)
+			}
+			delete(a.failures, name)
+			delete(a.alerted, name)
+			continue
+		}
+
+		a.failures[name]++
+		if a.failures[name] >= cfg.AfterFailures && !a.alerted[name] {
+			a.alerted[name] = true
+			alert.State, alert.Failures = bundleAlertFailing, a.failures[name]
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts
+}
+
+// send logs alert and posts it to the webhook, if configured.
+func (a *bundleAlerter) send(ctx context.Context, webhook string, alert BundleAlert) error {
+
+	if alert.State == bundleAlertFailing {
+		log.Printf("Bundle %s failed %d times in a row: %s", alert.Bundle, alert.Failures, alert.Message)
+	} else {
+		log.Printf("Bundle %s recovered after %d failures", alert.Bundle, alert.Failures)
+	}
+
+	if webhook == "" {
+		return nil
+	}
+
+	bs, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bundle alert webhook: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+func TestBundleAlerterObserve(t *testing.T) {
+
+	cfg := bundleAlertConfig{AfterFailures: 2}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newBundleAlerter()
+	start := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	failed := func(i int) *bundlePlugin.Status {
+		return &bundlePlugin.Status{
+			ActiveRevision: "v1",
+			LastRequest:    start.Add(time.Duration(i) * time.Minute),
+			Code:           "bundle_error",
+			Message:        "server replied with Internal Server Error",
+			HTTPCode:       "500",
+			Errors:         []error{errors.New("download failed")},
+		}
+	}
+	ok := &bundlePlugin.Status{ActiveRevision: "v2", LastRequest: start.Add(10 * time.Minute)}
+
+	if alerts := a.observe(cfg, map[string]*bundlePlugin.Status{"authz": failed(1)}); len(alerts) != 0 {
+		t.Fatalf("Expected no alert after one failure, got %+v", alerts)
+	}
+
+	// The same attempt reported again is not counted twice.
+	if alerts := a.observe(cfg, map[string]*bundlePlugin.Status{"authz": failed(1)}); len(alerts) != 0 {
+		t.Fatalf("Expected no alert for a repeated status, got %+v", alerts)
+	}
+
+	alerts := a.observe(cfg, map[string]*bundlePlugin.Status{"authz": failed(2)})
+	if len(alerts) != 1 {
+		t.Fatalf("Expected an alert after two failures, got %+v", alerts)
+	}
+	alert := alerts[0]
+	if alert.State != bundleAlertFailing || alert.Failures != 2 || alert.Code != "bundle_error" || alert.HTTPCode != "500" || len(alert.Errors) != 1 || alert.Revision != "v1" {
+		t.Fatalf("Expected a failing alert with the error detail, got %+v", alert)
+	}
+
+	// Further failures do not alert again until the bundle recovers.
+	if alerts := a.observe(cfg, map[string]*bundlePlugin.Status{"authz": failed(3)}); len(alerts) != 0 {
+		t.Fatalf("Expected a single alert per streak, got %+v", alerts)
+	}
+
+	alerts = a.observe(cfg, map[string]*bundlePlugin.Status{"authz": ok})
+	if len(alerts) != 1 || alerts[0].State != bundleAlertRecovered || alerts[0].Failures != 3 {
+		t.Fatalf("Expected a recovered alert after 3 failures, got %+v", alerts)
+	}
+
+	if alerts := a.observe(cfg, map[string]*bundlePlugin.Status{"authz": failed(11)}); len(alerts) != 0 {
+		t.Fatalf("Expected the count to restart after recovering, got %+v", alerts)
+	}
+}
+
+func TestBundleAlerterSend(t *testing.T) {
+
+	var received BundleAlert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	a := newBundleAlerter()
+	alert := BundleAlert{Bundle: "authz", State: bundleAlertFailing, Failures: 3, Message: "unreachable"}
+	if err := a.send(context.Background(), server.URL, alert); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Bundle != "authz" || received.State != bundleAlertFailing || received.Failures != 3 || received.Message != "unreachable" {
+		t.Fatalf("Expected the alert to be posted, got %+v", received)
+	}
+
+	cfg := bundleAlertConfig{Webhook: "hooks.example.com/alerts"}
+	if err := cfg.validate(); err == nil {
+		t.Fatal("Expected a webhook without a scheme to be rejected")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+)
+
+// persistBundles returns the OPA configuration bs, given as YAML or JSON, with
+// every bundle persisted to dir. OPA then keeps the last activated revision
+// of each bundle on disk, and activates it at startup instead of waiting for
+// the bundle servers, which the Docker daemon would otherwise wait on. Newer
+// revisions are downloaded in the background. Bundles explicitly configured
+// with persist: false are left alone.
+func persistBundles(bs []byte, dir string) ([]byte, error) {
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	if doc["bundle"] != nil {
+		return nil, fmt.Errorf("bundles configured with the deprecated bundle key cannot be cached, use the bundles key instead")
+	}
+
+	doc["persistence_directory"] = dir
+
+	bundles, _ := doc["bundles"].(map[string]interface{})
+	for name, b := range bundles {
+		source, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("bundles.%s: expected an object", name)
+		}
+		if _, ok := source["persist"]; !ok {
+			source["persist"] = true
+		}
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/sdk"
+)
+
+func TestPersistBundles(t *testing.T) {
+
+	bs, err := persistBundles([]byte(`
+services:
+  acme:
+    url: https://bundles.example.com
+bundles:
+  authz:
+    service: acme
+  audit:
+    service: acme
+    persist: false
+`), "/var/lib/opa-docker-authz/bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		PersistenceDirectory string `json:"persistence_directory"`
+		Bundles              map[string]struct {
+			Persist bool `json:"persist"`
+		} `json:"bundles"`
+	}
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.PersistenceDirectory != "/var/lib/opa-docker-authz/bundles" {
+		t.Errorf("Expected persistence directory, got %q", doc.PersistenceDirectory)
+	}
+	if !doc.Bundles["authz"].Persist || doc.Bundles["audit"].Persist {
+		t.Errorf("Expected authz persisted and audit not, got %+v", doc.Bundles)
+	}
+
+	if _, err := persistBundles([]byte(`bundle: {name: authz, service: acme}`), "/tmp"); err == nil {
+		t.Error("Expected error for legacy bundle configuration")
+	}
+}
+
+func TestBundleCacheColdStart(t *testing.T) {
+
+	var buf bytes.Buffer
+	err := bundle.Write(&buf, bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "1"},
+		Data:     map[string]interface{}{},
+		Modules: []bundle.ModuleFile{{
+			URL:  "/authz.rego",
+			Path: "/authz.rego",
+			Raw:  []byte("package docker.authz\n\nallow = true\n"),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := buf.Bytes()
+
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+services:
+  acme:
+    url: `+srv.URL+`
+bundles:
+  authz:
+    service: acme
+    resource: bundle.tar.gz
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+
+	start := func() *sdk.OPA {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		opa, err := initOPA(ctx, configFile, "", cacheDir, serviceTLS{}, defaultInputVersion, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := opa.Decision(ctx, sdk.DecisionOptions{Path: "/docker/authz/allow"})
+		if err != nil || result.Result != true {
+			t.Fatalf("Expected allow, got %v (error: %v)", result, err)
+		}
+		return opa
+	}
+
+	start().Stop(context.Background())
+
+	// The bundle server is down, but the cached bundle is activated.
+	down.Store(true)
+	start().Stop(context.Background())
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// canaryConfig enables gradual rollout of new bundle revisions. Once a
+// revision may be activated, it is first enforced for a share of requests
+// only, and ramped up while its decisions agree with the previous revision.
+type canaryConfig struct {
+	Percent       float64  `json:"percent"`
+	HashBy        string   `json:"hash_by,omitempty"`
+	Step          float64  `json:"step,omitempty"`
+	Interval      duration `json:"interval,omitempty"`
+	MaxDivergence float64  `json:"max_divergence,omitempty"`
+	MinRequests   uint64   `json:"min_requests,omitempty"`
+}
+
+const (
+	canaryHashByUser    = "user"
+	canaryHashByRequest = "request"
+)
+
+func (c *canaryConfig) enabled() bool {
+	return c != nil && c.Percent > 0 && c.Percent < 100
+}
+
+func (c *canaryConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100")
+	}
+
+	switch c.HashBy {
+	case "":
+		c.HashBy = canaryHashByUser
+	case canaryHashByUser, canaryHashByRequest:
+	default:
+		return fmt.Errorf("canary hash_by must be %q or %q", canaryHashByUser, canaryHashByRequest)
+	}
+
+	if c.Step < 0 || c.MaxDivergence < 0 || c.MaxDivergence > 1 {
+		return fmt.Errorf("canary step must be positive and max_divergence between 0 and 1")
+	}
+
+	if c.Step > 0 && c.Interval <= 0 {
+		return fmt.Errorf("canary interval is required when step is set")
+	}
+
+	return nil
+}
+
+// canaryBucket maps a key onto [0, 100).
+func canaryBucket(key string) float64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// canary is the rollout state of a candidate revision.
+type canary struct {
+	candidate *revision
+	percent   float64
+	stepped   time.Time
+	compared  uint64
+	diverged  uint64
+	frozen    bool
+}
+
+// ramp raises the share of the candidate once per interval, provided enough
+// requests were compared and the divergence stayed below the threshold. It
+// returns true once the candidate should be fully promoted.
+func (c *canary) ramp(cfg *canaryConfig, now time.Time) bool {
+
+	if cfg.Step <= 0 || c.frozen || now.Sub(c.stepped) < time.Duration(cfg.Interval) {
+		return false
+	}
+
+	if c.compared < cfg.MinRequests {
+		return false
+	}
+
+	if c.compared > 0 && float64(c.diverged)/float64(c.compared) > cfg.MaxDivergence {
+		log.Printf("Canary of bundle revision %v frozen at %v%%: %d of %d decisions diverged", c.candidate, c.percent, c.diverged, c.compared)
+		c.frozen = true
+		return false
+	}
+
+	c.percent += cfg.Step
+	c.stepped = now
+	c.compared, c.diverged = 0, 0
+
+	if c.percent >= 100 {
+		return true
+	}
+
+	log.Printf("Canary of bundle revision %v ramped to %v%%", c.candidate, c.percent)
+	return false
+}
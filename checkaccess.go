@@ -0,0 +1,930 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// runCheckAccess implements the check-access subcommand, which evaluates the
+// policy against the API request a docker CLI invocation would send, e.g.
+//
+//	opa-docker-authz check-access -policy-file authz.rego --user alice -- docker run --privileged nginx
+//
+// The exit code is 0 when the request is allowed, 1 when it is denied and 2
+// on errors.
+func runCheckAccess(args []string) int {
+
+	fs := flag.NewFlagSet("check-access", flag.ContinueOnError)
+	policyFile := fs.String("policy-file", "", "sets the path of the policy file to evaluate")
+	dataDir := fs.String("data-dir", "", "sets the path of data files to load")
+	allowPath := fs.String("allowPath", "data.docker.authz.allow", "sets the path of the allow decision in OPA")
+	user := fs.String("user", "", "sets the user the request is authenticated as")
+	apiVersion := fs.String("api-version", "1.41", "sets the Docker API version of the request")
+	printInput := fs.Bool("print-input", false, "print the input document the policy is evaluated with")
+	inputVersion := fs.Int("input-schema-version", defaultInputVersion, "sets the version of the shape of the input document given to the policy")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *policyFile == "" || fs.NArg() == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: opa-docker-authz check-access -policy-file <file> [-user <name>] -- docker <command> [args...]")
+		return 2
+	}
+
+	r, err := dockerCommandRequest(fs.Args(), *apiVersion)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *user != "" {
+		r.User = *user
+		r.UserAuthNMethod = "TLS"
+	}
+
+	if err := validInputVersion(*inputVersion); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	input, err := makeInput(r)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	versionInput(input.(map[string]interface{}), *inputVersion)
+
+	ctx := context.Background()
+	query, err := prepareOfflinePolicy(ctx, *policyFile, *dataDir, *allowPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	buf := topdown.NewBufferTracer()
+	rs, err := query.Eval(ctx, rego.EvalInput(input), rego.EvalQueryTracer(buf))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var d decision
+	if len(rs) > 0 {
+		if d, err = parseDecision(rs[0].Expressions[0].Value); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	fmt.Printf("Request: %s %s\n", r.RequestMethod, r.RequestURI)
+	if *printInput {
+		bs, _ := json.MarshalIndent(input, "", "  ")
+		fmt.Printf("Input: %s\n", bs)
+	}
+
+	if d.Allowed {
+		fmt.Println("Decision: allowed")
+		return 0
+	}
+
+	fmt.Println("Decision: denied")
+
+	// A code or message explains the denial already.
+	if d.Code != "" || d.Message != "" {
+		if d.Code != "" {
+			fmt.Println("Code:", d.Code)
+		}
+		if d.Message != "" {
+			fmt.Println("Message:", d.Message)
+		}
+		return 1
+	}
+
+	ref, err := ast.ParseRef(normalizeAllowPath(*allowPath, false))
+	if err == nil {
+		printFailures(os.Stdout, ref, *buf)
+	}
+
+	return 1
+}
+
+// prepareOfflinePolicy prepares the evaluation of the allow decision of a
+// policy file and data directory outside of the plugin.
+func prepareOfflinePolicy(ctx context.Context, policyFile, dataDir, allowPath string) (rego.PreparedEvalQuery, error) {
+
+	bs, err := os.ReadFile(policyFile)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, err
+	}
+
+	dataDirs := []string{}
+	if dataDir != "" {
+		dataDirs = []string{dataDir}
+	}
+
+	return rego.New(
+		rego.Query(normalizeAllowPath(allowPath, false)),
+		rego.Module(policyFile, string(bs)),
+		rego.Load(dataDirs, nil),
+	).PrepareForEval(ctx)
+}
+
+// printFailures reports the expressions that failed in the definitions of
+// the rule at path, along with the rules that were satisfied where a negated
+// expression failed, e.g. the deny rules behind a failed "not deny".
+func printFailures(w io.Writer, path ast.Ref, trace []*topdown.Event) {
+
+	rules := map[uint64]*ast.Rule{}
+	satisfied := map[string][]*ast.Rule{}
+	for _, event := range trace {
+		rule, ok := event.Node.(*ast.Rule)
+		if !ok {
+			continue
+		}
+		switch event.Op {
+		case topdown.EnterOp:
+			rules[event.QueryID] = rule
+		case topdown.ExitOp:
+			key := rule.Path().String()
+			if !containsRule(satisfied[key], rule) {
+				satisfied[key] = append(satisfied[key], rule)
+			}
+		}
+	}
+
+	reported := map[*ast.Rule]bool{}
+	seen := map[*ast.Expr]bool{}
+	for _, event := range trace {
+		expr, ok := event.Node.(*ast.Expr)
+		if !ok || event.Op != topdown.FailOp || seen[expr] {
+			continue
+		}
+		rule, ok := rules[event.QueryID]
+		if !ok || rule.Default || !rule.Path().Equal(path) {
+			continue
+		}
+		seen[expr] = true
+
+		if !reported[rule] {
+			reported[rule] = true
+			fmt.Fprintf(w, "Failed: %s (%s)\n", path, locationString(rule.Location))
+		}
+		fmt.Fprintf(w, "  %s (%s)\n", sourceText(expr.Location, expr), locationString(expr.Location))
+
+		if term, ok := expr.Terms.(*ast.Term); ok && expr.Negated {
+			if ref, ok := term.Value.(ast.Ref); ok {
+				for _, r := range satisfied[ref.String()] {
+					fmt.Fprintf(w, "    satisfied: %s (%s)\n", ref, locationString(r.Location))
+				}
+			}
+		}
+	}
+
+	if len(reported) == 0 {
+		fmt.Fprintf(w, "Undefined: %s has no definition that applies\n", path)
+	}
+}
+
+func containsRule(rules []*ast.Rule, rule *ast.Rule) bool {
+
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+
+	return false
+}
+
+func locationString(loc *ast.Location) string {
+
+	if loc == nil {
+		return "unknown location"
+	}
+
+	return fmt.Sprintf("%s:%d", loc.File, loc.Row)
+}
+
+// sourceText returns the policy source of node, rather than its compiled
+// form, which refers to generated variables.
+func sourceText(loc *ast.Location, node fmt.Stringer) string {
+
+	if loc != nil && len(loc.Text) > 0 {
+		return string(loc.Text)
+	}
+
+	return node.String()
+}
+
+// dockerCommandRequest translates a docker CLI invocation into the API
+// request it sends to the daemon. When a command sends several requests, the
+// one creating or changing an object is returned.
+func dockerCommandRequest(args []string, apiVersion string) (authorization.Request, error) {
+
+	if len(args) > 0 && args[0] == "docker" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return authorization.Request{}, fmt.Errorf("missing docker command")
+	}
+
+	command, args := args[0], args[1:]
+
+	// Management commands, e.g. docker container run, are equivalent to
+	// their short forms.
+	if group := command; (group == "container" || group == "image") && len(args) > 0 {
+		command, args = args[0], args[1:]
+		switch {
+		case command == "ls" && group == "container":
+			command = "ps"
+		case command == "ls" && group == "image":
+			command = "images"
+		case command == "rm" && group == "image":
+			command = "rmi"
+		}
+	}
+
+	base := "/v" + strings.TrimPrefix(apiVersion, "v")
+
+	request := func(method, path string, query url.Values, body interface{}) (authorization.Request, error) {
+
+		r := authorization.Request{
+			RequestMethod:  method,
+			RequestURI:     base + path,
+			RequestHeaders: map[string]string{},
+		}
+		if len(query) > 0 {
+			r.RequestURI += "?" + query.Encode()
+		}
+		if body != nil {
+			bs, err := json.Marshal(body)
+			if err != nil {
+				return r, err
+			}
+			r.RequestBody = bs
+			r.RequestHeaders["Content-Type"] = "application/json"
+		}
+		return r, nil
+	}
+
+	switch command {
+	case "run", "create":
+		name, platform, body, err := containerCreateBody(args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		query := url.Values{}
+		if name != "" {
+			query.Set("name", name)
+		}
+		if platform != "" {
+			query.Set("platform", platform)
+		}
+		return request("POST", "/containers/create", query, body)
+
+	case "exec":
+		container, body, err := execCreateBody(args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		return request("POST", "/containers/"+container+"/exec", nil, body)
+
+	case "start", "stop", "restart", "kill", "pause", "unpause":
+		container, err := singleOperand(command, args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		return request("POST", "/containers/"+container+"/"+command, nil, nil)
+
+	case "rm":
+		flags, operands := splitFlags(args)
+		if len(operands) == 0 {
+			return authorization.Request{}, fmt.Errorf("docker rm requires a container")
+		}
+		query := url.Values{}
+		if flags["f"] || flags["force"] {
+			query.Set("force", "1")
+		}
+		if flags["v"] || flags["volumes"] {
+			query.Set("v", "1")
+		}
+		return request("DELETE", "/containers/"+operands[0], query, nil)
+
+	case "logs", "inspect", "top", "port", "stats", "diff":
+		container, err := singleOperand(command, args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		endpoint := map[string]string{"inspect": "json", "port": "json"}[command]
+		if endpoint == "" {
+			endpoint = command
+		}
+		return request("GET", "/containers/"+container+"/"+endpoint, nil, nil)
+
+	case "ps":
+		flags, _ := splitFlags(args)
+		query := url.Values{}
+		if flags["a"] || flags["all"] {
+			query.Set("all", "1")
+		}
+		return request("GET", "/containers/json", query, nil)
+
+	case "images":
+		return request("GET", "/images/json", nil, nil)
+
+	case "pull":
+		image, err := singleOperand(command, args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		ref := parseImageReference(image)
+		if ref == nil {
+			return authorization.Request{}, fmt.Errorf("invalid image reference %q", image)
+		}
+		query := url.Values{"fromImage": {strings.TrimSuffix(strings.TrimSuffix(image, "@"+ref.Digest), ":"+ref.Tag)}}
+		switch {
+		case ref.Digest != "":
+			query.Set("tag", ref.Digest)
+		case ref.Tag != "":
+			query.Set("tag", ref.Tag)
+		default:
+			query.Set("tag", "latest")
+		}
+		return request("POST", "/images/create", query, nil)
+
+	case "push":
+		image, err := singleOperand(command, args)
+		if err != nil {
+			return authorization.Request{}, err
+		}
+		ref := parseImageReference(image)
+		if ref == nil {
+			return authorization.Request{}, fmt.Errorf("invalid image reference %q", image)
+		}
+		query := url.Values{}
+		if ref.Tag != "" {
+			query.Set("tag", ref.Tag)
+		}
+		return request("POST", "/images/"+strings.TrimSuffix(image, ":"+ref.Tag)+"/push", query, nil)
+
+	case "rmi":
+		flags, operands := splitFlags(args)
+		if len(operands) == 0 {
+			return authorization.Request{}, fmt.Errorf("docker rmi requires an image")
+		}
+		query := url.Values{}
+		if flags["f"] || flags["force"] {
+			query.Set("force", "1")
+		}
+		return request("DELETE", "/images/"+operands[0], query, nil)
+
+	case "build":
+		query := url.Values{}
+		for i := 0; i < len(args); i++ {
+			if (args[i] == "-t" || args[i] == "--tag") && i+1 < len(args) {
+				query.Add("t", args[i+1])
+				i++
+			} else if strings.HasPrefix(args[i], "--tag=") {
+				query.Add("t", strings.TrimPrefix(args[i], "--tag="))
+			}
+		}
+		return request("POST", "/build", query, nil)
+	}
+
+	return authorization.Request{}, fmt.Errorf("unsupported docker command %q", command)
+}
+
+// splitFlags separates the boolean flags of args, long or combined short
+// ones, from its operands.
+func splitFlags(args []string) (map[string]bool, []string) {
+
+	flags := map[string]bool{}
+	var operands []string
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			flags[strings.TrimPrefix(arg, "--")] = true
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for _, c := range arg[1:] {
+				flags[string(c)] = true
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+
+	return flags, operands
+}
+
+func singleOperand(command string, args []string) (string, error) {
+
+	_, operands := splitFlags(args)
+	if len(operands) == 0 {
+		return "", fmt.Errorf("docker %s requires an argument", command)
+	}
+
+	return operands[0], nil
+}
+
+// dockerShortFlags maps the short flags of docker run to their long form.
+var dockerShortFlags = map[byte]string{
+	'a': "attach",
+	'c': "cpu-shares",
+	'd': "detach",
+	'e': "env",
+	'h': "hostname",
+	'i': "interactive",
+	'l': "label",
+	'm': "memory",
+	'p': "publish",
+	'P': "publish-all",
+	't': "tty",
+	'u': "user",
+	'v': "volume",
+	'w': "workdir",
+}
+
+// dockerBoolFlags are the flags of docker run that do not take a value.
+var dockerBoolFlags = map[string]bool{
+	"detach":           true,
+	"init":             true,
+	"interactive":      true,
+	"no-healthcheck":   true,
+	"oom-kill-disable": true,
+	"privileged":       true,
+	"publish-all":      true,
+	"quiet":            true,
+	"read-only":        true,
+	"rm":               true,
+	"sig-proxy":        true,
+	"tty":              true,
+}
+
+// parseCLIFlags parses the flags of args up to the first operand, calling fn
+// with each flag in its long form. The remaining operands are returned.
+func parseCLIFlags(args []string, fn func(name, value string) error) ([]string, error) {
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return args[i+1:], nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return args[i:], nil
+		}
+
+		var names []string
+		var value string
+		hasValue := false
+
+		if strings.HasPrefix(arg, "--") {
+			name := strings.TrimPrefix(arg, "--")
+			name, value, hasValue = strings.Cut(name, "=")
+			names = []string{name}
+		} else {
+			// Short flags may be combined, e.g. -it, and the last one may
+			// carry its value, e.g. -p8080:80.
+			short := arg[1:]
+			for j := 0; j < len(short); j++ {
+				long, ok := dockerShortFlags[short[j]]
+				if !ok {
+					return nil, fmt.Errorf("unsupported flag -%c", short[j])
+				}
+				names = append(names, long)
+				if !dockerBoolFlags[long] && j+1 < len(short) {
+					value, hasValue = strings.TrimPrefix(short[j+1:], "="), true
+					break
+				}
+			}
+		}
+
+		for _, name := range names {
+			switch {
+			case dockerBoolFlags[name]:
+				if !hasValue {
+					value = "true"
+				}
+			case !hasValue:
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("flag --%s requires a value", name)
+				}
+				i++
+				value = args[i]
+			}
+			if err := fn(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// containerCreateBody returns the name, platform and container
+// configuration of a docker run or docker create invocation.
+func containerCreateBody(args []string) (string, string, map[string]interface{}, error) {
+
+	var name, platform string
+	body := map[string]interface{}{}
+	hostConfig := map[string]interface{}{}
+
+	appendString := func(m map[string]interface{}, key, value string) {
+		list, _ := m[key].([]string)
+		m[key] = append(list, value)
+	}
+	setKeyValue := func(m map[string]interface{}, key, value string) {
+		kv, _ := m[key].(map[string]string)
+		if kv == nil {
+			kv = map[string]string{}
+			m[key] = kv
+		}
+		k, v, _ := strings.Cut(value, "=")
+		kv[k] = v
+	}
+
+	operands, err := parseCLIFlags(args, func(flag, value string) error {
+
+		enabled := value == "true"
+
+		switch flag {
+		case "name":
+			name = value
+		case "platform":
+			platform = value
+		case "detach", "quiet", "sig-proxy", "no-healthcheck":
+		case "interactive":
+			body["OpenStdin"] = enabled
+			body["AttachStdin"] = enabled
+		case "tty":
+			body["Tty"] = enabled
+		case "attach":
+			stream := map[string]string{"stdin": "AttachStdin", "stdout": "AttachStdout", "stderr": "AttachStderr"}[strings.ToLower(value)]
+			if stream == "" {
+				return fmt.Errorf("invalid --attach %q", value)
+			}
+			body[stream] = true
+		case "env":
+			appendString(body, "Env", value)
+		case "label":
+			setKeyValue(body, "Labels", value)
+		case "user":
+			body["User"] = value
+		case "workdir":
+			body["WorkingDir"] = value
+		case "hostname":
+			body["Hostname"] = value
+		case "entrypoint":
+			body["Entrypoint"] = []string{value}
+		case "privileged":
+			hostConfig["Privileged"] = enabled
+		case "read-only":
+			hostConfig["ReadonlyRootfs"] = enabled
+		case "rm":
+			hostConfig["AutoRemove"] = enabled
+		case "init":
+			hostConfig["Init"] = enabled
+		case "oom-kill-disable":
+			hostConfig["OomKillDisable"] = enabled
+		case "publish-all":
+			hostConfig["PublishAllPorts"] = enabled
+		case "volume":
+			appendString(hostConfig, "Binds", value)
+		case "mount":
+			mounts, _ := hostConfig["Mounts"].([]map[string]interface{})
+			hostConfig["Mounts"] = append(mounts, parseMountFlag(value))
+		case "tmpfs":
+			path, options, _ := strings.Cut(value, ":")
+			tmpfs, _ := hostConfig["Tmpfs"].(map[string]string)
+			if tmpfs == nil {
+				tmpfs = map[string]string{}
+				hostConfig["Tmpfs"] = tmpfs
+			}
+			tmpfs[path] = options
+		case "volumes-from":
+			appendString(hostConfig, "VolumesFrom", value)
+		case "publish":
+			if err := addPortBinding(body, hostConfig, value); err != nil {
+				return err
+			}
+		case "network", "net":
+			hostConfig["NetworkMode"] = value
+		case "security-opt":
+			appendString(hostConfig, "SecurityOpt", value)
+		case "cap-add":
+			appendString(hostConfig, "CapAdd", value)
+		case "cap-drop":
+			appendString(hostConfig, "CapDrop", value)
+		case "device":
+			devices, _ := hostConfig["Devices"].([]map[string]interface{})
+			hostConfig["Devices"] = append(devices, parseDeviceFlag(value))
+		case "device-cgroup-rule":
+			appendString(hostConfig, "DeviceCgroupRules", value)
+		case "gpus":
+			requests, _ := hostConfig["DeviceRequests"].([]map[string]interface{})
+			hostConfig["DeviceRequests"] = append(requests, parseGPUsFlag(value))
+		case "group-add":
+			appendString(hostConfig, "GroupAdd", value)
+		case "pid":
+			hostConfig["PidMode"] = value
+		case "ipc":
+			hostConfig["IpcMode"] = value
+		case "uts":
+			hostConfig["UTSMode"] = value
+		case "userns":
+			hostConfig["UsernsMode"] = value
+		case "cgroupns":
+			hostConfig["CgroupnsMode"] = value
+		case "runtime":
+			hostConfig["Runtime"] = value
+		case "restart":
+			policy, retries, _ := strings.Cut(value, ":")
+			restart := map[string]interface{}{"Name": policy}
+			if n, err := strconv.Atoi(retries); err == nil {
+				restart["MaximumRetryCount"] = n
+			}
+			hostConfig["RestartPolicy"] = restart
+		case "sysctl":
+			setKeyValue(hostConfig, "Sysctls", value)
+		case "dns":
+			appendString(hostConfig, "Dns", value)
+		case "add-host":
+			appendString(hostConfig, "ExtraHosts", value)
+		case "log-driver":
+			logConfig, _ := hostConfig["LogConfig"].(map[string]interface{})
+			if logConfig == nil {
+				logConfig = map[string]interface{}{}
+				hostConfig["LogConfig"] = logConfig
+			}
+			logConfig["Type"] = value
+		case "memory", "memory-reservation", "memory-swap", "shm-size":
+			n, err := parseByteSize(value)
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", flag, err)
+			}
+			key := map[string]string{
+				"memory":             "Memory",
+				"memory-reservation": "MemoryReservation",
+				"memory-swap":        "MemorySwap",
+				"shm-size":           "ShmSize",
+			}[flag]
+			hostConfig[key] = n
+		case "cpus":
+			cpus, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid --cpus: %w", err)
+			}
+			hostConfig["NanoCpus"] = int64(cpus * 1e9)
+		case "cpu-shares", "pids-limit", "cpu-quota", "cpu-period":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", flag, err)
+			}
+			key := map[string]string{
+				"cpu-shares": "CpuShares",
+				"pids-limit": "PidsLimit",
+				"cpu-quota":  "CpuQuota",
+				"cpu-period": "CpuPeriod",
+			}[flag]
+			hostConfig[key] = n
+		case "cpuset-cpus":
+			hostConfig["CpusetCpus"] = value
+		default:
+			return fmt.Errorf("unsupported flag --%s", flag)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if len(operands) == 0 {
+		return "", "", nil, fmt.Errorf("docker run requires an image")
+	}
+
+	body["Image"] = operands[0]
+	if len(operands) > 1 {
+		body["Cmd"] = operands[1:]
+	}
+	body["HostConfig"] = hostConfig
+
+	return name, platform, body, nil
+}
+
+// execCreateBody returns the container and exec configuration of a docker
+// exec invocation.
+func execCreateBody(args []string) (string, map[string]interface{}, error) {
+
+	body := map[string]interface{}{"AttachStdout": true, "AttachStderr": true}
+
+	operands, err := parseCLIFlags(args, func(flag, value string) error {
+
+		enabled := value == "true"
+
+		switch flag {
+		case "detach":
+			body["AttachStdout"] = !enabled
+			body["AttachStderr"] = !enabled
+		case "interactive":
+			body["AttachStdin"] = enabled
+		case "tty":
+			body["Tty"] = enabled
+		case "privileged":
+			body["Privileged"] = enabled
+		case "user":
+			body["User"] = value
+		case "workdir":
+			body["WorkingDir"] = value
+		case "env":
+			env, _ := body["Env"].([]string)
+			body["Env"] = append(env, value)
+		default:
+			return fmt.Errorf("unsupported flag --%s", flag)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(operands) < 2 {
+		return "", nil, fmt.Errorf("docker exec requires a container and a command")
+	}
+
+	body["Cmd"] = operands[1:]
+
+	return operands[0], body, nil
+}
+
+// parseMountFlag parses the value of --mount, e.g.
+// type=bind,source=/srv,target=/data,readonly.
+func parseMountFlag(value string) map[string]interface{} {
+
+	mount := map[string]interface{}{"Type": "volume"}
+
+	for _, field := range strings.Split(value, ",") {
+		key, v, hasValue := strings.Cut(field, "=")
+		switch key {
+		case "type":
+			mount["Type"] = v
+		case "source", "src":
+			mount["Source"] = v
+		case "target", "destination", "dst":
+			mount["Target"] = v
+		case "readonly", "ro":
+			mount["ReadOnly"] = !hasValue || v == "true" || v == "1"
+		}
+	}
+
+	return mount
+}
+
+// parseDeviceFlag parses the value of --device, e.g. /dev/sda:/dev/xvda:rwm.
+func parseDeviceFlag(value string) map[string]interface{} {
+
+	parts := strings.Split(value, ":")
+	device := map[string]interface{}{
+		"PathOnHost":        parts[0],
+		"PathInContainer":   parts[0],
+		"CgroupPermissions": "rwm",
+	}
+
+	if len(parts) > 1 {
+		device["PathInContainer"] = parts[1]
+	}
+	if len(parts) > 2 {
+		device["CgroupPermissions"] = parts[2]
+	}
+
+	return device
+}
+
+// parseGPUsFlag parses the value of --gpus, e.g. all, 2 or
+// "device=0,1,capabilities=compute".
+func parseGPUsFlag(value string) map[string]interface{} {
+
+	request := map[string]interface{}{"Capabilities": [][]string{{"gpu"}}}
+
+	if value == "all" {
+		request["Count"] = -1
+		return request
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		request["Count"] = n
+		return request
+	}
+
+	var devices []string
+	for _, field := range strings.Split(strings.Trim(value, `"`), ",") {
+		key, v, ok := strings.Cut(field, "=")
+		switch {
+		case key == "count" && v == "all":
+			request["Count"] = -1
+		case key == "count":
+			request["Count"], _ = strconv.Atoi(v)
+		case key == "driver":
+			request["Driver"] = v
+		case key == "device":
+			devices = append(devices, v)
+		case key == "capabilities":
+			request["Capabilities"] = [][]string{{"gpu", v}}
+		case !ok && len(devices) > 0:
+			// Device IDs are separated by commas as well.
+			devices = append(devices, key)
+		}
+	}
+	if len(devices) > 0 {
+		request["DeviceIDs"] = devices
+	}
+
+	return request
+}
+
+// addPortBinding adds the port published with --publish, e.g. 8080:80,
+// 127.0.0.1:8080:80/udp or 80.
+func addPortBinding(body, hostConfig map[string]interface{}, value string) error {
+
+	spec, proto, ok := strings.Cut(value, "/")
+	if !ok {
+		proto = "tcp"
+	}
+
+	var hostIP, hostPort, containerPort string
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		containerPort = parts[0]
+	case 2:
+		hostPort, containerPort = parts[0], parts[1]
+	case 3:
+		hostIP, hostPort, containerPort = parts[0], parts[1], parts[2]
+	default:
+		return fmt.Errorf("invalid --publish %q", value)
+	}
+
+	port := containerPort + "/" + proto
+
+	exposed, _ := body["ExposedPorts"].(map[string]interface{})
+	if exposed == nil {
+		exposed = map[string]interface{}{}
+		body["ExposedPorts"] = exposed
+	}
+	exposed[port] = map[string]interface{}{}
+
+	bindings, _ := hostConfig["PortBindings"].(map[string][]map[string]string)
+	if bindings == nil {
+		bindings = map[string][]map[string]string{}
+		hostConfig["PortBindings"] = bindings
+	}
+	bindings[port] = append(bindings[port], map[string]string{"HostIp": hostIP, "HostPort": hostPort})
+
+	return nil
+}
+
+// parseByteSize parses sizes such as 512m or 2g, as accepted by the docker
+// CLI, into a number of bytes.
+func parseByteSize(value string) (int64, error) {
+
+	s := strings.TrimSuffix(strings.ToLower(value), "b")
+
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+func TestDockerCommandRequest(t *testing.T) {
+
+	tests := []struct {
+		command string
+		method  string
+		uri     string
+		body    string
+	}{
+		{
+			command: "docker run -it --rm --privileged --name web -v /srv:/srv:ro -p 8080:80 -e A=1 -m 512m nginx:1.25 sh -c true",
+			method:  "POST",
+			uri:     "/v1.41/containers/create?name=web",
+			body:    `{"AttachStdin":true,"Cmd":["sh","-c","true"],"Env":["A=1"],"ExposedPorts":{"80/tcp":{}},"HostConfig":{"AutoRemove":true,"Binds":["/srv:/srv:ro"],"Memory":536870912,"PortBindings":{"80/tcp":[{"HostIp":"","HostPort":"8080"}]},"Privileged":true},"Image":"nginx:1.25","OpenStdin":true,"Tty":true}`,
+		},
+		{
+			command: "docker container create --mount type=bind,source=/data,target=/data,readonly --gpus all busybox",
+			method:  "POST",
+			uri:     "/v1.41/containers/create",
+			body:    `{"HostConfig":{"DeviceRequests":[{"Capabilities":[["gpu"]],"Count":-1}],"Mounts":[{"ReadOnly":true,"Source":"/data","Target":"/data","Type":"bind"}]},"Image":"busybox"}`,
+		},
+		{
+			command: "docker exec -u root --privileged web id",
+			method:  "POST",
+			uri:     "/v1.41/containers/web/exec",
+			body:    `{"AttachStderr":true,"AttachStdout":true,"Cmd":["id"],"Privileged":true,"User":"root"}`,
+		},
+		{
+			command: "docker rm -fv web",
+			method:  "DELETE",
+			uri:     "/v1.41/containers/web?force=1&v=1",
+		},
+		{
+			command: "docker pull alpine",
+			method:  "POST",
+			uri:     "/v1.41/images/create?fromImage=alpine&tag=latest",
+		},
+		{
+			command: "docker image ls",
+			method:  "GET",
+			uri:     "/v1.41/images/json",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.command, func(t *testing.T) {
+
+			r, err := dockerCommandRequest(strings.Fields(tc.command), "1.41")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.RequestMethod != tc.method || r.RequestURI != tc.uri {
+				t.Fatalf("Expected %s %s, got %s %s", tc.method, tc.uri, r.RequestMethod, r.RequestURI)
+			}
+			if tc.body == "" {
+				if len(r.RequestBody) > 0 {
+					t.Fatalf("Expected no body, got %s", r.RequestBody)
+				}
+				return
+			}
+
+			var expected, actual interface{}
+			if err := json.Unmarshal([]byte(tc.body), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(r.RequestBody, &actual); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("Expected %s, got %s", tc.body, r.RequestBody)
+			}
+		})
+	}
+
+	if _, err := dockerCommandRequest([]string{"docker", "run", "--no-such-flag", "nginx"}, "1.41"); err == nil {
+		t.Fatal("Expected unsupported flag to be rejected")
+	}
+}
+
+func TestPrintFailures(t *testing.T) {
+
+	policy := `package docker.authz
+
+allow {
+	not deny
+}
+
+deny {
+	input.Body.HostConfig.Privileged
+}
+`
+
+	buf := topdown.NewBufferTracer()
+	rs, err := rego.New(
+		rego.Query("data.docker.authz.allow"),
+		rego.Module("authz.rego", policy),
+		rego.Input(map[string]interface{}{"Body": map[string]interface{}{"HostConfig": map[string]interface{}{"Privileged": true}}}),
+		rego.QueryTracer(buf),
+	).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 0 {
+		t.Fatalf("Expected allow to be undefined, got %v", rs)
+	}
+
+	var out bytes.Buffer
+	printFailures(&out, ast.MustParseRef("data.docker.authz.allow"), *buf)
+
+	expected := `Failed: data.docker.authz.allow (authz.rego:3)
+  not deny (authz.rego:4)
+    satisfied: data.docker.authz.deny (authz.rego:7)
+`
+	if out.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, out.String())
+	}
+}
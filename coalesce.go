@@ -0,0 +1,76 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedDecision is the result shared by concurrent identical requests.
+type coalescedDecision struct {
+	decision decision
+}
+
+// inputHash returns the hash of the canonical JSON encoding of the input.
+// Object keys are sorted by encoding/json, so equal inputs hash equally.
+func inputHash(input interface{}) (string, error) {
+
+	bs, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(bs)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// evaluateCoalesced evaluates r, sharing a single evaluation between all
+// identical requests that are in flight at the same time. Requests that
+// joined an evaluation are still recorded as decisions of their own.
+func (p *DockerAuthZPlugin) evaluateCoalesced(ctx context.Context, r authorization.Request) (decision, error) {
+
+	if p.inflight == nil {
+		return p.evaluate(ctx, r)
+	}
+
+	input, err := p.buildInput(ctx, r)
+	if err != nil {
+		return p.evaluate(ctx, r)
+	}
+
+	key, err := inputHash(input)
+	if err != nil {
+		return p.evaluateInput(ctx, r, input)
+	}
+
+	leader := false
+	v, err, _ := p.inflight.Do(key, func() (interface{}, error) {
+		leader = true
+		d, err := p.evaluateInput(ctx, r, input)
+		return coalescedDecision{decision: d}, err
+	})
+
+	d := v.(coalescedDecision).decision
+
+	if !leader {
+		decisionID, _ := uuid4()
+		p.recordDecision(ctx, decisionID, r, input, d, err)
+	}
+
+	return d, err
+}
+
+func newInflightGroup(enabled bool) *singleflight.Group {
+	if !enabled {
+		return nil
+	}
+	return &singleflight.Group{}
+}
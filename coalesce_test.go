@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa-docker-authz/extension"
+)
+
+func TestInputHash(t *testing.T) {
+	a := map[string]interface{}{"Method": "POST", "Headers": map[string]string{"A": "1", "B": "2"}}
+	b := map[string]interface{}{"Headers": map[string]string{"B": "2", "A": "1"}, "Method": "POST"}
+	c := map[string]interface{}{"Headers": map[string]string{"B": "2", "A": "1"}, "Method": "GET"}
+
+	ha, _ := inputHash(a)
+	hb, _ := inputHash(b)
+	hc, _ := inputHash(c)
+
+	if ha != hb {
+		t.Error("Expected equal inputs to hash equally")
+	}
+	if ha == hc {
+		t.Error("Expected different inputs to hash differently")
+	}
+}
+
+func TestEvaluateCoalesced(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	err := os.WriteFile(policyFile, []byte(`package docker.authz
+allow { input.User == "alice" }`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var enriched int32
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		history:    newDecisionHistory(decisionHistorySize),
+		inflight:   newInflightGroup(true),
+		enrichers: []namedEnricher{{name: "count", Enricher: extension.EnricherFunc(func(context.Context, *authorization.Request, map[string]interface{}) error {
+			atomic.AddInt32(&enriched, 1)
+			return nil
+		})}},
+	}
+
+	var wg sync.WaitGroup
+	results := make([]decision, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.40/containers/create", User: "alice"}
+			results[i], _ = p.evaluateCoalesced(context.Background(), r)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, d := range results {
+		if !d.Allowed {
+			t.Errorf("Expected request %d to be allowed", i)
+		}
+	}
+
+	if n := len(p.history.list()); n != len(results) {
+		t.Errorf("Expected every request to be recorded, got %d records", n)
+	}
+
+	if n := atomic.LoadInt32(&enriched); int(n) != len(results) {
+		t.Errorf("Expected the input of every request to be enriched once, got %d enrichments", n)
+	}
+}
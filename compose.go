@@ -0,0 +1,60 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+const composeLabelPrefix = "com.docker.compose."
+
+// Compose is the input.compose document, describing the Compose project a
+// container, network or volume is created for.
+type Compose struct {
+	Project    string `json:"project"`
+	Service    string `json:"service,omitempty"`
+	Version    string `json:"version,omitempty"`
+	WorkingDir string `json:"working_dir,omitempty"`
+	OneOff     bool   `json:"oneoff"`
+
+	// Labels holds all com.docker.compose.* labels, without the prefix.
+	Labels map[string]string `json:"labels"`
+}
+
+// composeProject returns the Compose project of container, network and
+// volume create requests sent by Compose, or nil for any other request.
+func composeProject(method, path string, body map[string]interface{}) *Compose {
+
+	switch trimAPIVersion(path) {
+	case "/containers/create", "/networks/create", "/volumes/create":
+	default:
+		return nil
+	}
+
+	if method != "POST" {
+		return nil
+	}
+
+	labels, _ := body["Labels"].(map[string]interface{})
+
+	c := &Compose{Labels: map[string]string{}}
+	for k, v := range labels {
+		if s, ok := v.(string); ok && strings.HasPrefix(k, composeLabelPrefix) {
+			c.Labels[strings.TrimPrefix(k, composeLabelPrefix)] = s
+		}
+	}
+
+	c.Project = c.Labels["project"]
+	if c.Project == "" {
+		return nil
+	}
+
+	c.Service = c.Labels["service"]
+	c.Version = c.Labels["version"]
+	c.WorkingDir = c.Labels["project.working_dir"]
+	c.OneOff = strings.EqualFold(c.Labels["oneoff"], "true")
+
+	return c
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComposeProject(t *testing.T) {
+	body := map[string]interface{}{
+		"Labels": map[string]interface{}{
+			"com.docker.compose.project":             "shop",
+			"com.docker.compose.service":             "web",
+			"com.docker.compose.version":             "2.17.2",
+			"com.docker.compose.oneoff":              "False",
+			"com.docker.compose.project.working_dir": "/srv/shop",
+			"maintainer":                             "ops",
+		},
+	}
+
+	expected := &Compose{
+		Project:    "shop",
+		Service:    "web",
+		Version:    "2.17.2",
+		WorkingDir: "/srv/shop",
+		Labels: map[string]string{
+			"project":             "shop",
+			"service":             "web",
+			"version":             "2.17.2",
+			"oneoff":              "False",
+			"project.working_dir": "/srv/shop",
+		},
+	}
+
+	if result := composeProject("POST", "/v1.41/containers/create", body); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	if result := composeProject("POST", "/v1.41/containers/create", map[string]interface{}{}); result != nil {
+		t.Errorf("Expected no project, got %+v", result)
+	}
+
+	if result := composeProject("POST", "/v1.41/networks/create", body); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	if result := composeProject("POST", "/v1.41/containers/abc/start", body); result != nil {
+		t.Errorf("Expected no project, got %+v", result)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/config"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// configProblem is a problem found in an OPA configuration, at the path of
+// keys and [i] indices leading to the offending value.
+type configProblem struct {
+	path []string
+	msg  string
+}
+
+func (p configProblem) String() string {
+
+	if len(p.path) == 0 {
+		return p.msg
+	}
+
+	var b strings.Builder
+	for i, key := range p.path {
+		if i > 0 && !strings.HasPrefix(key, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(key)
+	}
+
+	return b.String() + ": " + p.msg
+}
+
+// configCredentialMethods are the credentials of OPA services, of which at most
+// one may be configured per service.
+var configCredentialMethods = []string{"bearer", "client_tls", "oauth2", "s3_signing", "gcp_metadata", "azure_managed_identity", "plugin"}
+
+// configExclusiveKeys lists the top-level keys of the OPA configuration that
+// must not be set together.
+var configExclusiveKeys = [][2]string{
+	{"bundle", "bundles"},
+}
+
+var (
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// checkConfigFile checks the OPA configuration file at path, interpolated as
+// on this host, returning an error listing the problems found, each prefixed
+// with its file and line.
+func checkConfigFile(path string) error {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if bs, err = interpolateConfig(bs); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	problems, err := checkConfigBytes(bs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	lines := make([]string, 0, len(problems))
+	for _, p := range problems {
+		if line := configLine(bs, p.path); line > 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d: %v", path, line, p))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: %v", path, p))
+		}
+	}
+
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// checkConfigBytes checks an OPA configuration given as YAML or JSON.
+func checkConfigBytes(bs []byte) ([]configProblem, error) {
+
+	js, err := yaml.YAMLToJSON(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := util.UnmarshalJSON(js, &doc); err != nil {
+		return nil, err
+	}
+
+	return checkConfig(doc), nil
+}
+
+// checkConfig returns the unknown keys, mistyped values and conflicting
+// options of an OPA configuration. The sections of OPA are checked down to
+// their top-level keys, and the section of the plugin entirely.
+func checkConfig(doc interface{}) []configProblem {
+
+	var problems []configProblem
+	if doc == nil {
+		return nil
+	}
+
+	checkValue(nil, doc, reflect.TypeOf(config.Config{}), &problems)
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return problems
+	}
+
+	for _, keys := range configExclusiveKeys {
+		if m[keys[0]] != nil && m[keys[1]] != nil {
+			problems = append(problems, configProblem{path: []string{keys[1]}, msg: fmt.Sprintf("%s and %s are mutually exclusive", keys[0], keys[1])})
+		}
+	}
+
+	if services, ok := m["services"]; ok {
+		checkServices(services, &problems)
+	}
+
+	if plugins, ok := m["plugins"].(map[string]interface{}); ok {
+		if section, ok := plugins[authzPluginName]; ok {
+			checkValue([]string{"plugins", authzPluginName}, section, reflect.TypeOf(authzPluginConfig{}), &problems)
+		}
+	}
+
+	return problems
+}
+
+// checkServices reports services configuring more than one credential method.
+// Services are given as an object keyed by name, or as a list.
+func checkServices(services interface{}, problems *[]configProblem) {
+
+	check := func(path []string, service interface{}) {
+		svc, _ := service.(map[string]interface{})
+		creds, _ := svc["credentials"].(map[string]interface{})
+		var methods []string
+		for _, method := range configCredentialMethods {
+			if _, ok := creds[method]; ok {
+				methods = append(methods, method)
+			}
+		}
+		if len(methods) > 1 {
+			*problems = append(*problems, configProblem{path: append(path, "credentials"), msg: fmt.Sprintf("%s are mutually exclusive", strings.Join(methods, " and "))})
+		}
+	}
+
+	switch s := services.(type) {
+	case map[string]interface{}:
+		for _, name := range sortedKeys(s) {
+			check([]string{"services", name}, s[name])
+		}
+	case []interface{}:
+		for i, service := range s {
+			check([]string{"services", "[" + strconv.Itoa(i) + "]"}, service)
+		}
+	}
+}
+
+// checkValue checks that v, found at path, can be decoded into a value of
+// type t, reporting unknown keys of structs.
+func checkValue(path []string, v interface{}, t reflect.Type, problems *[]configProblem) {
+
+	report := func(format string, args ...interface{}) {
+		*problems = append(*problems, configProblem{path: path, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if t == rawMessageType || v == nil {
+		return
+	}
+
+	// Types decoding themselves, such as durations and timestamps, are
+	// checked by decoding the value.
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		bs, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(bs, reflect.New(t).Interface())
+		}
+		if err != nil {
+			report("invalid value %s: %v", bs, err)
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		checkValue(path, v, t.Elem(), problems)
+
+	case reflect.Interface:
+
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			report("expected an object, got %s", jsonKind(v))
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = f.Type
+		}
+		for _, key := range sortedKeys(m) {
+			ft, ok := fields[key]
+			if !ok {
+				msg := fmt.Sprintf("unknown key %q", key)
+				if s := closestKey(key, fields); s != "" {
+					msg += fmt.Sprintf(", did you mean %q?", s)
+				}
+				*problems = append(*problems, configProblem{path: append(path[:len(path):len(path)], key), msg: msg})
+				continue
+			}
+			checkValue(append(path[:len(path):len(path)], key), m[key], ft, problems)
+		}
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			report("expected an object, got %s", jsonKind(v))
+			return
+		}
+		for _, key := range sortedKeys(m) {
+			checkValue(append(path[:len(path):len(path)], key), m[key], t.Elem(), problems)
+		}
+
+	case reflect.Slice, reflect.Array:
+		a, ok := v.([]interface{})
+		if !ok {
+			report("expected a list, got %s", jsonKind(v))
+			return
+		}
+		for i, e := range a {
+			checkValue(append(path[:len(path):len(path)], "["+strconv.Itoa(i)+"]"), e, t.Elem(), problems)
+		}
+
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			report("expected a string, got %s", jsonKind(v))
+		}
+
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			report("expected a boolean, got %s", jsonKind(v))
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			report("expected an integer, got %s", jsonKind(v))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if _, err := strconv.ParseUint(string(n), 10, 64); !ok || err != nil {
+			report("expected a non-negative integer, got %s", jsonKind(v))
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(json.Number); !ok {
+			report("expected a number, got %s", jsonKind(v))
+		}
+	}
+}
+
+// jsonKind describes the JSON type of v, including the value of scalars.
+func jsonKind(v interface{}) string {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case json.Number:
+		return "number " + string(v)
+	case bool:
+		return fmt.Sprintf("boolean %v", v)
+	}
+
+	return "null"
+}
+
+// closestKey returns the key of fields closest to key, when it is close
+// enough to be a likely typo.
+func closestKey(key string, fields map[string]reflect.Type) string {
+
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDistance || d == bestDistance && name < best {
+			best, bestDistance = name, d
+		}
+	}
+
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// configLine returns the line of the configuration file holding the value at
+// path, found by looking for each key after the line of the previous one. It
+// returns 0 when a key is not found.
+func configLine(bs []byte, path []string) int {
+
+	lines := strings.Split(string(bs), "\n")
+	line := 0
+
+	for _, key := range path {
+		if strings.HasPrefix(key, "[") {
+			continue
+		}
+		found := false
+		for i := line; i < len(lines); i++ {
+			if configLineHasKey(lines[i], key) {
+				line, found = i, true
+				break
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+
+	return line + 1
+}
+
+func configLineHasKey(line, key string) bool {
+
+	s := strings.TrimLeft(line, " \t-{,")
+	for _, quoted := range []string{key, `"` + key + `"`, `'` + key + `'`} {
+		if rest := strings.TrimPrefix(s, quoted); rest != s && strings.HasPrefix(strings.TrimSpace(rest), ":") {
+			return true
+		}
+	}
+
+	return false
+}
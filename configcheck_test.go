@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+
+	config := `services:
+  acme:
+    url: https://example.com
+    credentials:
+      bearer:
+        token: secret
+      client_tls:
+        cert: /cert.pem
+bundles:
+  authz:
+    service: acme
+bundle:
+  name: authz
+plugins:
+  envoy_ext_authz_grpc:
+    anything: goes
+  opa_docker_authz:
+    shadow: "yes"
+    canary:
+      precent: 10
+      interval: soon
+    activation:
+      windows:
+        - start: "02:00"
+          end: 4
+decison_logs:
+  console: true
+`
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkConfigFile(path)
+	if err == nil {
+		t.Fatal("Expected configuration to be rejected")
+	}
+
+	expected := []string{
+		path + `:9: bundles: bundle and bundles are mutually exclusive`,
+		path + `:4: services.acme.credentials: bearer and client_tls are mutually exclusive`,
+		path + `:25: plugins.opa_docker_authz.activation.windows[0].end: expected a string, got number 4`,
+		path + `:21: plugins.opa_docker_authz.canary.interval: invalid value "soon": time: invalid duration "soon"`,
+		path + `:20: plugins.opa_docker_authz.canary.precent: unknown key "precent", did you mean "percent"?`,
+		path + `:18: plugins.opa_docker_authz.shadow: expected a boolean, got string "yes"`,
+		path + `:26: decison_logs: unknown key "decison_logs", did you mean "decision_logs"?`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("Expected %q in:\n%v", e, err)
+		}
+	}
+	if n := strings.Count(err.Error(), "\n"); n != len(expected) {
+		t.Errorf("Expected %d problems, got:\n%v", len(expected), err)
+	}
+
+	if err := os.WriteFile(path, []byte("services:\n  - name: acme\n    url: https://example.com\nplugins:\n  opa_docker_authz:\n    canary:\n      percent: 10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfigFile(path); err != nil {
+		t.Fatalf("Expected valid configuration, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configPublicKey is the base64 encoded PKIX public key the configuration
+// file must be signed with, set at build time with
+//
+//	-ldflags "-X main.configPublicKey=MCowBQYDK2VwAyEA..."
+//
+// Binaries built with a key refuse to start with an unsigned or tampered
+// configuration file, or without one. Being compiled in, the requirement
+// cannot be lifted by changing the flags or the files of the host.
+var configPublicKey string
+
+// configSignatureSuffix is appended to the path of the configuration file
+// to locate its signature, unless -config-signature-file is set.
+const configSignatureSuffix = ".sig"
+
+// bakedConfigPublicKey returns the public key compiled into the binary, or
+// nil when configuration files are not required to be signed.
+func bakedConfigPublicKey() (crypto.PublicKey, error) {
+
+	if configPublicKey == "" {
+		return nil, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(configPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration public key: %w", err)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration public key: %w", err)
+	}
+
+	return pub, nil
+}
+
+// verifyConfigSignature checks the detached signature at sigFile, the base64
+// encoded signature of the SHA-256 digest of bs, against pub.
+func verifyConfigSignature(bs []byte, sigFile string, pub crypto.PublicKey) error {
+
+	encoded, err := os.ReadFile(sigFile)
+	if err != nil {
+		return fmt.Errorf("the configuration file must be signed: %w", err)
+	}
+
+	return verifyConfigSignatureBytes(bs, encoded, sigFile, pub)
+}
+
+// verifyConfigSignatureBytes checks encoded, the detached signature of bs
+// read from name, against pub.
+func verifyConfigSignatureBytes(bs, encoded []byte, name string, pub crypto.PublicKey) error {
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	digest := sha256.Sum256(bs)
+	if !verifyDigest(pub, digest[:], sig) {
+		return fmt.Errorf("%s: the signature does not match the configuration", name)
+	}
+
+	return nil
+}
+
+// checkConfigSignature verifies bs, the configuration file at path, when the
+// binary requires configuration files to be signed.
+func checkConfigSignature(bs []byte, path, sigFile string) error {
+
+	pub, err := bakedConfigPublicKey()
+	if err != nil || pub == nil {
+		return err
+	}
+
+	if fipsMode {
+		if err := checkFIPSKey(pub); err != nil {
+			return fmt.Errorf("configuration public key: %w", err)
+		}
+	}
+
+	if sigFile == "" {
+		sigFile = path + configSignatureSuffix
+	}
+
+	return verifyConfigSignature(bs, sigFile, pub)
+}
+
+// checkSignedMode fails when the binary requires configuration files to be
+// signed and fs does not set -config-file: the other modes evaluate a policy
+// file, data documents or only the policy library, none of which is signed,
+// and allow every request without a policy.
+func checkSignedMode(fs *flag.FlagSet) error {
+
+	if configPublicKey == "" {
+		return nil
+	}
+
+	if f := fs.Lookup("config-file"); f != nil && f.Value.String() != "" {
+		return nil
+	}
+
+	if f := fs.Lookup("policy-file"); f != nil && f.Value.String() != "" {
+		return fmt.Errorf("this binary requires a signed -config-file, -policy-file is not signed")
+	}
+
+	return fmt.Errorf("this binary requires a signed -config-file")
+}
+
+// checkRemoteConfigSignature verifies bs, a configuration read from a remote
+// configuration source, against sig, the value of its signature key, when
+// the binary requires configurations to be signed. sig is nil when the key
+// is absent.
+func checkRemoteConfigSignature(bs, sig []byte) error {
+
+	pub, err := bakedConfigPublicKey()
+	if err != nil || pub == nil {
+		return err
+	}
+
+	if fipsMode {
+		if err := checkFIPSKey(pub); err != nil {
+			return fmt.Errorf("configuration public key: %w", err)
+		}
+	}
+
+	if sig == nil {
+		return fmt.Errorf("the configuration must be signed, in the %q key", remoteConfigSignatureKey)
+	}
+
+	return verifyConfigSignatureBytes(bs, sig, remoteConfigSignatureKey, pub)
+}
+
+// runSignConfig implements the sign-config subcommand, which writes the
+// detached signature of a configuration file, next to it unless -o is set.
+func runSignConfig(args []string) int {
+
+	fs := flag.NewFlagSet("sign-config", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "sets the path of the PEM encoded PKCS #8 private key to sign with")
+	output := fs.String("o", "", "sets the path of the signature file (default: <config-file>.sig)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *keyFile == "" || fs.NArg() != 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: opa-docker-authz sign-config -key <private-key> [-o <signature-file>] <config-file>")
+		return 2
+	}
+
+	signer, err := loadSigner(*keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	bs, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	digest := sha256.Sum256(bs)
+	sig, err := signDigest(signer, digest[:])
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	path := *output
+	if path == "" {
+		path = fs.Arg(0) + configSignatureSuffix
+	}
+
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0644); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
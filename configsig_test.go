@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSignature(t *testing.T) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := filepath.Join(dir, "config.yaml")
+	config := []byte("plugins:\n  opa_docker_authz:\n    shadow: true\n")
+	if err := os.WriteFile(configFile, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a baked-in key, configuration files are not required to be
+	// signed.
+	if err := checkConfigSignature(config, configFile, ""); err != nil {
+		t.Fatalf("Expected no signature to be required, got %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPublicKey = base64.StdEncoding.EncodeToString(pubDER)
+	defer func() { configPublicKey = "" }()
+
+	if err := checkConfigSignature(config, configFile, ""); err == nil {
+		t.Fatal("Expected an unsigned configuration file to be rejected")
+	}
+
+	if code := runSignConfig([]string{"-key", keyFile, configFile}); code != 0 {
+		t.Fatalf("Expected sign-config to succeed, got exit code %d", code)
+	}
+	if err := checkConfigSignature(config, configFile, ""); err != nil {
+		t.Fatalf("Expected the signature to be verified, got %v", err)
+	}
+
+	tampered := []byte("plugins:\n  opa_docker_authz:\n    shadow: false\n")
+	if err := checkConfigSignature(tampered, configFile, ""); err == nil {
+		t.Fatal("Expected a tampered configuration file to be rejected")
+	}
+
+	sigFile := filepath.Join(dir, "elsewhere.sig")
+	if code := runSignConfig([]string{"-key", keyFile, "-o", sigFile, configFile}); code != 0 {
+		t.Fatalf("Expected sign-config to succeed, got exit code %d", code)
+	}
+	if err := checkConfigSignature(config, configFile, sigFile); err != nil {
+		t.Fatalf("Expected the signature given to be verified, got %v", err)
+	}
+}
+
+func TestRemoteConfigSignature(t *testing.T) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte("plugins:\n  opa_docker_authz:\n    shadow: true\n")
+
+	// Without a baked-in key, remote configurations are not required to be
+	// signed.
+	if err := checkRemoteConfigSignature(config, nil); err != nil {
+		t.Fatalf("Expected no signature to be required, got %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPublicKey = base64.StdEncoding.EncodeToString(pubDER)
+	defer func() { configPublicKey = "" }()
+
+	if err := checkRemoteConfigSignature(config, nil); err == nil {
+		t.Fatal("Expected an unsigned remote configuration to be rejected")
+	}
+
+	digest := sha256.Sum256(config)
+	sig, err := signDigest(priv, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := []byte(base64.StdEncoding.EncodeToString(sig) + "\n")
+
+	if err := checkRemoteConfigSignature(config, encoded); err != nil {
+		t.Fatalf("Expected the signature to be verified, got %v", err)
+	}
+
+	tampered := []byte("plugins:\n  opa_docker_authz:\n    shadow: false\n")
+	if err := checkRemoteConfigSignature(tampered, encoded); err == nil {
+		t.Fatal("Expected a tampered remote configuration to be rejected")
+	}
+}
+
+func TestSignedMode(t *testing.T) {
+
+	newFlags := func(args ...string) *flag.FlagSet {
+		fs := flag.NewFlagSet("opa-docker-authz", flag.ContinueOnError)
+		fs.String("config-file", "", "")
+		fs.String("policy-file", "", "")
+		fs.String("data-url", "", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+
+	// Without a baked-in key, every mode is allowed.
+	if err := checkSignedMode(newFlags("-policy-file", "/etc/docker/opa/authz.rego")); err != nil {
+		t.Fatalf("Expected -policy-file to be allowed, got %v", err)
+	}
+
+	configPublicKey = "MCowBQYDK2VwAyEA"
+	defer func() { configPublicKey = "" }()
+
+	tests := map[string]struct {
+		args    []string
+		allowed bool
+	}{
+		"config file": {[]string{"-config-file", "/etc/docker/opa/config.yaml"}, true},
+		"policy file": {[]string{"-policy-file", "/etc/docker/opa/authz.rego"}, false},
+		"data url":    {[]string{"-data-url", "https://data.example.com/users.json"}, false},
+		"no policy":   {nil, false},
+	}
+
+	for note, tc := range tests {
+		if err := checkSignedMode(newFlags(tc.args...)); (err == nil) != tc.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", note, tc.allowed, err)
+		}
+	}
+}
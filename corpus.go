@@ -0,0 +1,288 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+const (
+	corpusInputSuffix    = ".input.json"
+	corpusExpectedSuffix = ".expected.json"
+)
+
+// Explain modes of failing corpus cases, named after those of opa eval.
+const (
+	explainOff   = "off"
+	explainNotes = "notes"
+	explainFails = "fails"
+	explainFull  = "full"
+)
+
+// corpusCase is a recorded input paired with the decision expected for it.
+type corpusCase struct {
+	name     string
+	input    interface{}
+	expected interface{}
+}
+
+// corpusResult is the outcome of evaluating a corpus case.
+type corpusResult struct {
+	corpusCase
+	actual    interface{}
+	undefined bool
+	err       error
+
+	// explanation is the trace of a failing case.
+	explanation string
+}
+
+func (r corpusResult) passed() bool {
+
+	if r.err != nil || r.undefined {
+		return false
+	}
+
+	expected, err := ast.InterfaceToValue(r.expected)
+	if err != nil {
+		return false
+	}
+	actual, err := ast.InterfaceToValue(r.actual)
+	if err != nil {
+		return false
+	}
+
+	return expected.Compare(actual) == 0
+}
+
+// loadCorpus reads the cases below dir. Each case is a file named
+// <name>.input.json holding a recorded input document, next to a file named
+// <name>.expected.json holding the decision expected for it.
+func loadCorpus(dir string) ([]corpusCase, error) {
+
+	var cases []corpusCase
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, corpusInputSuffix) {
+			return nil
+		}
+
+		base := strings.TrimSuffix(path, corpusInputSuffix)
+		name, err := filepath.Rel(dir, base)
+		if err != nil {
+			return err
+		}
+
+		c := corpusCase{name: filepath.ToSlash(name)}
+		if err := readJSONFile(path, &c.input); err != nil {
+			return err
+		}
+		if err := readJSONFile(base+corpusExpectedSuffix, &c.expected); err != nil {
+			return err
+		}
+
+		cases = append(cases, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(cases, func(i, j int) bool { return cases[i].name < cases[j].name })
+
+	return cases, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := util.UnmarshalJSON(bs, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// runCorpus evaluates every case with query.
+func runCorpus(ctx context.Context, query rego.PreparedEvalQuery, cases []corpusCase) []corpusResult {
+
+	results := make([]corpusResult, 0, len(cases))
+
+	for _, c := range cases {
+		result := corpusResult{corpusCase: c}
+
+		rs, err := query.Eval(ctx, rego.EvalInput(c.input))
+		switch {
+		case err != nil:
+			result.err = err
+		case len(rs) == 0:
+			result.undefined = true
+		default:
+			result.actual = rs[0].Expressions[0].Value
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// explainCorpus evaluates the failing cases again with tracing, and keeps
+// the part of the trace selected by mode. In notes mode, cases whose trace has
+// no notes are explained by the expressions that failed in the rule at path.
+func explainCorpus(ctx context.Context, query rego.PreparedEvalQuery, results []corpusResult, mode string, path ast.Ref) {
+
+	if mode == explainOff {
+		return
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.passed() {
+			continue
+		}
+
+		buf := topdown.NewBufferTracer()
+		if _, err := query.Eval(ctx, rego.EvalInput(r.input), rego.EvalQueryTracer(buf)); err != nil && r.err == nil {
+			r.err = err
+		}
+
+		trace := []*topdown.Event(*buf)
+		switch mode {
+		case explainNotes:
+			trace = lineage.Notes(trace)
+		case explainFails:
+			trace = lineage.Fails(trace)
+		}
+
+		var out bytes.Buffer
+		if len(trace) > 0 {
+			topdown.PrettyTraceWithLocation(&out, trace)
+		} else if mode == explainNotes {
+			printFailures(&out, path, *buf)
+		}
+		r.explanation = out.String()
+	}
+}
+
+// reportCorpus writes the mismatching cases, or every case when verbose, and
+// returns the number of mismatches.
+func reportCorpus(w io.Writer, results []corpusResult, verbose bool) int {
+
+	failed := 0
+
+	for _, r := range results {
+		if r.passed() {
+			if verbose {
+				fmt.Fprintf(w, "PASS %s\n", r.name)
+			}
+			continue
+		}
+
+		failed++
+		expected := util.MustMarshalJSON(r.expected)
+		switch {
+		case r.err != nil:
+			fmt.Fprintf(w, "FAIL %s: expected %s, got error: %v\n", r.name, expected, r.err)
+		case r.undefined:
+			fmt.Fprintf(w, "FAIL %s: expected %s, got undefined\n", r.name, expected)
+		default:
+			fmt.Fprintf(w, "FAIL %s: expected %s, got %s\n", r.name, expected, util.MustMarshalJSON(r.actual))
+		}
+		if r.explanation != "" {
+			for _, line := range strings.Split(strings.TrimRight(r.explanation, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%d cases, %d failed\n", len(results), failed)
+
+	return failed
+}
+
+// runTestCorpus implements the test-corpus subcommand, which evaluates a
+// policy against a directory of recorded inputs and reports the decisions
+// that differ from the expected ones. The exit code is 0 when every decision
+// matches, 1 when some do not and 2 on errors.
+func runTestCorpus(args []string) int {
+
+	fs := flag.NewFlagSet("test-corpus", flag.ContinueOnError)
+	policyFile := fs.String("policy-file", "", "sets the path of the policy file to evaluate")
+	dataDir := fs.String("data-dir", "", "sets the path of data files to load")
+	allowPath := fs.String("allowPath", "data.docker.authz.allow", "sets the path of the allow decision in OPA")
+	verbose := fs.Bool("v", false, "report passing cases as well")
+	explain := fs.String("explain", explainNotes, "sets the trace reported for failing cases (off, notes, fails, full)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch *explain {
+	case explainOff, explainNotes, explainFails, explainFull:
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "invalid -explain %q\n", *explain)
+		return 2
+	}
+
+	if *policyFile == "" || fs.NArg() != 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: opa-docker-authz test-corpus -policy-file <file> [-data-dir <dir>] <corpus-dir>")
+		return 2
+	}
+
+	cases, err := loadCorpus(fs.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(cases) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "no *%s files found in %s\n", corpusInputSuffix, fs.Arg(0))
+		return 2
+	}
+
+	ctx := context.Background()
+	query, err := prepareOfflinePolicy(ctx, *policyFile, *dataDir, *allowPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	path, err := ast.ParseRef(normalizeAllowPath(*allowPath, false))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	results := runCorpus(ctx, query, cases)
+	explainCorpus(ctx, query, results, *explain, path)
+
+	if reportCorpus(os.Stdout, results, *verbose) > 0 {
+		return 1
+	}
+
+	return 0
+}
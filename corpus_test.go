@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestCorpus(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"read.input.json":                     `{"Method": "GET"}`,
+		"read.expected.json":                  `true`,
+		"containers/create.input.json":        `{"Method": "POST"}`,
+		"containers/create.expected.json":     `true`,
+		"containers/privileged.input.json":    `{"Method": "POST", "Body": {"HostConfig": {"Privileged": true}}}`,
+		"containers/privileged.expected.json": `false`,
+		"README.md":                           `ignored`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases, err := loadCorpus(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 3 || cases[0].name != "containers/create" {
+		t.Fatalf("Expected 3 cases sorted by name, got %v", cases)
+	}
+
+	// The policy only allows reads, so the create case does not match.
+	query, err := rego.New(
+		rego.Query("data.docker.authz.allow"),
+		rego.Module("authz.rego", `package docker.authz
+
+default allow = false
+
+allow {
+	input.Method == "GET"
+}
+`),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if failed := reportCorpus(&out, runCorpus(context.Background(), query, cases), false); failed != 1 {
+		t.Fatalf("Expected 1 mismatch, got %d", failed)
+	}
+
+	expected := "FAIL containers/create: expected true, got false\n3 cases, 1 failed\n"
+	if out.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestCorpusMissingExpectation(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "read.input.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadCorpus(dir); err == nil {
+		t.Fatal("Expected an error for a case without expected decision")
+	}
+}
+
+func TestCorpusExplain(t *testing.T) {
+
+	query, err := rego.New(
+		rego.Query("data.docker.authz.allow"),
+		rego.Module("authz.rego", `package docker.authz
+
+default allow = false
+
+allow {
+	not deny
+}
+
+deny {
+	input.Body.HostConfig.Privileged
+	trace("privileged containers are denied")
+}
+`),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []corpusCase{
+		{name: "privileged", input: map[string]interface{}{"Body": map[string]interface{}{"HostConfig": map[string]interface{}{"Privileged": true}}}, expected: true},
+		{name: "plain", input: map[string]interface{}{}, expected: true},
+	}
+
+	results := runCorpus(context.Background(), query, cases)
+	explainCorpus(context.Background(), query, results, explainNotes, ast.MustParseRef("data.docker.authz.allow"))
+
+	var out bytes.Buffer
+	reportCorpus(&out, results, false)
+
+	if !strings.Contains(out.String(), "Note \"privileged containers are denied\"") {
+		t.Fatalf("Expected the note in the report, got:\n%s", out.String())
+	}
+	if results[1].explanation != "" {
+		t.Fatalf("Expected no explanation of a passing case, got %q", results[1].explanation)
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// dataSnapshot is an immutable view of the data documents used by
+// evaluations. A refresh builds a new snapshot and swaps it in, so in-flight
+// evaluations keep reading the store they started with.
+type dataSnapshot struct {
+	store          storage.Store
+	modules        map[string]*ast.Module
+	modulesHash    string
+	overlayVersion uint64
+	stateVersion   uint64
+	loaded         time.Time
+}
+
+const (
+	// dataRetryDelay is the delay before the first retry of a failed refresh,
+	// growing exponentially on each further failure.
+	dataRetryDelay = time.Second
+
+	// defaultDataRetryMaxDelay caps the delay between retries of failed
+	// refreshes unless -data-retry-max-delay is given.
+	defaultDataRetryMaxDelay = 5 * time.Minute
+
+	// dataRequestTimeout bounds a request for a data document, on top of the
+	// time the server may hold a long poll.
+	dataRequestTimeout = 30 * time.Second
+)
+
+// dataRefresher reloads the data documents from the data directory and data
+// URLs on its own schedule, independently of the policies.
+type dataRefresher struct {
+	dirs     []string
+	urls     []string
+	interval time.Duration
+	overlay  *runtimeOverlay
+	state    *stateDocuments
+	client   *http.Client
+
+	// maxRetryDelay caps the exponential backoff of failed refreshes.
+	maxRetryDelay time.Duration
+
+	// longPoll, when set, asks the data URL to hold each request for up to
+	// this long until the document changes, refreshing again as soon as it
+	// answers rather than on the interval.
+	longPoll time.Duration
+
+	fetched map[string]*dataDocument
+
+	mu      sync.Mutex
+	docs    map[string]interface{}
+	modules map[string]*ast.Module
+	hash    string
+	current *dataSnapshot
+}
+
+func newDataRefresher(dirs, urls []string, interval time.Duration, overlay *runtimeOverlay, state *stateDocuments) *dataRefresher {
+	return &dataRefresher{
+		dirs:     dirs,
+		urls:     urls,
+		interval: interval,
+		overlay:  overlay,
+		state:    state,
+		client:   &http.Client{},
+
+		maxRetryDelay: defaultDataRetryMaxDelay,
+		fetched:       map[string]*dataDocument{},
+	}
+}
+
+// dataDocument is the last document fetched from a data URL, sent back as
+// unchanged when the server answers a conditional request with 304.
+type dataDocument struct {
+	etag string
+	doc  map[string]interface{}
+}
+
+// start performs the initial load and, when an interval or long polling is
+// configured, refreshes the documents in the background until ctx is
+// cancelled.
+func (d *dataRefresher) start(ctx context.Context) error {
+
+	if d.longPoll > 0 && len(d.urls) != 1 {
+		return fmt.Errorf("long polling requires exactly one data URL, got %d", len(d.urls))
+	}
+
+	if err := d.refresh(ctx); err != nil {
+		return err
+	}
+
+	if d.interval <= 0 && d.longPoll <= 0 {
+		return nil
+	}
+
+	go func() {
+		retries := 0
+		for {
+			sleepContext(ctx, d.delay(retries))
+			if ctx.Err() != nil {
+				return
+			}
+			if err := d.refresh(ctx); err != nil {
+				retries++
+				log.Printf("Failed to refresh data documents, keeping previous revision: %v", err)
+				continue
+			}
+			retries = 0
+		}
+	}()
+
+	return nil
+}
+
+// delay returns how long to wait before the next refresh. Failed refreshes
+// are retried with a capped exponential backoff, and successful ones are
+// followed by the interval, both randomized so that hosts recovering from
+// the same outage do not poll the data URLs in lockstep. Long polls are
+// renewed immediately, since the server paces them.
+func (d *dataRefresher) delay(retries int) time.Duration {
+
+	if retries > 0 {
+		return util.DefaultBackoff(float64(dataRetryDelay), float64(d.maxRetryDelay), retries)
+	}
+
+	if d.longPoll > 0 {
+		return 0
+	}
+
+	return time.Duration(float64(d.interval) * (0.9 + 0.2*rand.Float64()))
+}
+
+// refresh loads all data sources and swaps in a new snapshot. On failure the
+// previous snapshot remains active.
+func (d *dataRefresher) refresh(ctx context.Context) error {
+
+	result, err := loader.NewFileLoader().Filtered(d.dirs, nil)
+	if err != nil {
+		return err
+	}
+
+	docs := result.Documents
+	if docs == nil {
+		docs = map[string]interface{}{}
+	}
+
+	for _, u := range d.urls {
+		doc, err := d.fetch(ctx, u)
+		if err != nil {
+			return err
+		}
+		mergeDocuments(docs, doc)
+	}
+
+	modules := result.ParsedModules()
+	hash := hashModules(result)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.docs = docs
+	d.modules = modules
+	d.hash = hash
+	return d.rebuild()
+}
+
+// rebuild creates a snapshot from the last loaded documents, the current
+// overlay and the state documents. Callers must hold d.mu.
+func (d *dataRefresher) rebuild() error {
+
+	version := d.overlay.version()
+	stateVersion := d.state.currentVersion()
+
+	doc, err := copyDocument(d.docs)
+	if err != nil {
+		return err
+	}
+
+	if err := d.overlay.applyData(doc); err != nil {
+		return err
+	}
+
+	if err := d.state.apply(doc); err != nil {
+		return err
+	}
+
+	d.current = &dataSnapshot{
+		store:          inmem.NewFromObject(doc),
+		modules:        d.modules,
+		modulesHash:    d.hash,
+		overlayVersion: version,
+		stateVersion:   stateVersion,
+		loaded:         time.Now(),
+	}
+
+	return nil
+}
+
+// snapshot returns the active snapshot, rebuilding it first if documents
+// were uploaded through the admin API or state documents changed since it
+// was created.
+func (d *dataRefresher) snapshot() (*dataSnapshot, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.current == nil || d.current.overlayVersion != d.overlay.version() || d.current.stateVersion != d.state.currentVersion() {
+		if err := d.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.current, nil
+}
+
+// fetch returns the document served at u, sending the ETag of the last
+// document fetched so that an unchanged document is not transferred again.
+func (d *dataRefresher) fetch(ctx context.Context, u string) (map[string]interface{}, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, dataRequestTimeout+d.longPoll)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	last := d.fetched[u]
+	if last != nil && last.etag != "" {
+		req.Header.Set("If-None-Match", last.etag)
+		if d.longPoll > 0 {
+			req.Header.Set("Prefer", "wait="+strconv.Itoa(int(d.longPoll.Seconds())))
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && last != nil {
+		return copyDocument(last.doc)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching data from %s: unexpected status %s", u, resp.Status)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := util.UnmarshalJSON(bs, &doc); err != nil {
+		return nil, fmt.Errorf("fetching data from %s: %w", u, err)
+	}
+
+	d.fetched[u] = &dataDocument{etag: resp.Header.Get("ETag"), doc: doc}
+
+	return copyDocument(doc)
+}
+
+// mergeDocuments deep merges src into dst, with src taking precedence.
+func mergeDocuments(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcObj, ok1 := v.(map[string]interface{})
+		dstObj, ok2 := dst[k].(map[string]interface{})
+		if ok1 && ok2 {
+			mergeDocuments(dstObj, srcObj)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// hashModules returns a digest of the Rego files found in the data
+// directories, used to tell whether the compiled policy is still current.
+func hashModules(result *loader.Result) string {
+
+	names := make([]string, 0, len(result.Modules))
+	for name := range result.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write(result.Modules[name].Raw)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// copyDocument returns a deep copy of doc so that it can be modified without
+// affecting snapshots that share the original.
+func copyDocument(doc map[string]interface{}) (map[string]interface{}, error) {
+
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	if err := util.UnmarshalJSON(bs, &result); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+
+	return result, nil
+}
+
+// policyCache holds the compiled policy used together with refreshed data
+// snapshots. The policy is only recompiled when the policy file, the uploaded
+// modules or the Rego files in the data directories change.
+type policyCache struct {
+	mu       sync.Mutex
+	key      string
+	compiler *ast.Compiler
+
+	// schemaCheck type checks the policy whenever it is recompiled.
+	schemaCheck schemaCheckConfig
+}
+
+func (c *policyCache) get(policyFile string, src []byte, overlay *runtimeOverlay, snap *dataSnapshot) (*ast.Compiler, error) {
+
+	h := sha256.Sum256(src)
+	key := fmt.Sprintf("%x/%d/%s", h, overlay.version(), snap.modulesHash)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.compiler != nil && c.key == key {
+		return c.compiler, nil
+	}
+
+	modules := map[string]*ast.Module{}
+	for name, m := range snap.modules {
+		modules[name] = m
+	}
+
+	sources := overlay.moduleSources()
+	sources[policyFile] = string(src)
+	for name, s := range sources {
+		m, err := ast.ParseModule(name, s)
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = m
+	}
+
+	compiler := ast.NewCompiler()
+	if compiler.Compile(modules); compiler.Failed() {
+		return nil, compiler.Errors
+	}
+
+	if err := c.schemaCheck.report(c.schemaCheck.check(compiler.Modules)); err != nil {
+		return nil, err
+	}
+
+	c.key, c.compiler = key, compiler
+	return compiler, nil
+}
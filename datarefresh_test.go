@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestDataRefresh(t *testing.T) {
+	var allowed atomic.Value
+	allowed.Store(`{"allowed_users": ["alice"]}`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(allowed.Load().(string)))
+	}))
+	defer srv.Close()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	err := os.WriteFile(policyFile, []byte(`package docker.authz
+allow { data.allowed_users[_] == input.User }`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overlay := newRuntimeOverlay()
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		overlay:    overlay,
+		refresher:  newDataRefresher(nil, []string{srv.URL}, 0, overlay, nil),
+		policies:   &policyCache{},
+	}
+
+	ctx := context.Background()
+	if err := p.refresher.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.40/info", User: "bob"}
+	if d, _ := p.evaluate(ctx, bob); d.Allowed {
+		t.Fatal("Expected bob to be denied before refresh")
+	}
+
+	compiler := p.policies.compiler
+
+	allowed.Store(`{"allowed_users": ["alice", "bob"]}`)
+	if err := p.refresher.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := p.evaluate(ctx, bob); !d.Allowed || err != nil {
+		t.Fatalf("Expected bob to be allowed after refresh, got %v (%v)", d.Allowed, err)
+	}
+
+	if p.policies.compiler != compiler {
+		t.Error("Expected policy not to be recompiled on data refresh")
+	}
+
+	allowed.Store(`not json`)
+	if err := p.refresher.refresh(ctx); err == nil {
+		t.Fatal("Expected refresh of invalid document to fail")
+	}
+
+	if d, _ := p.evaluate(ctx, bob); !d.Allowed {
+		t.Error("Expected previous data revision to remain active after failed refresh")
+	}
+}
+
+func TestDataRefreshDelay(t *testing.T) {
+
+	d := newDataRefresher(nil, nil, time.Minute, newRuntimeOverlay(), nil)
+	d.maxRetryDelay = 10 * time.Second
+
+	for i := 0; i < 100; i++ {
+		if delay := d.delay(0); delay < 54*time.Second || delay > 66*time.Second {
+			t.Fatalf("Expected the interval within 10%%, got %v", delay)
+		}
+		if delay := d.delay(1); delay <= 0 || delay > 2*time.Second {
+			t.Fatalf("Expected a short first retry, got %v", delay)
+		}
+		if delay := d.delay(50); delay < 8*time.Second || delay > 12*time.Second {
+			t.Fatalf("Expected retries capped at the maximum delay, got %v", delay)
+		}
+	}
+
+	d.longPoll = time.Minute
+	if delay := d.delay(0); delay != 0 {
+		t.Fatalf("Expected long polls to be renewed immediately, got %v", delay)
+	}
+}
+
+func TestDataRefreshLongPoll(t *testing.T) {
+
+	var mu sync.Mutex
+	version, changed := 1, make(chan struct{})
+	var waits int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		etag, ch := strconv.Itoa(version), changed
+		mu.Unlock()
+		if r.Header.Get("If-None-Match") == etag {
+			if r.Header.Get("Prefer") != "wait=60" {
+				t.Errorf("Expected long poll preference, got %q", r.Header.Get("Prefer"))
+			}
+			atomic.AddInt32(&waits, 1)
+			select {
+			case <-ch:
+			case <-r.Context().Done():
+				return
+			}
+			mu.Lock()
+			etag = strconv.Itoa(version)
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = fmt.Fprintf(w, `{"version": %s}`, etag)
+	}))
+	defer srv.Close()
+
+	d := newDataRefresher(nil, []string{srv.URL}, 0, newRuntimeOverlay(), nil)
+	d.longPoll = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := d.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	current := func() interface{} {
+		snap, err := d.snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := snap.store.Read(ctx, storage.NewTransactionOrDie(ctx, snap.store), storage.MustParsePath("/version"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	if v := current(); fmt.Sprint(v) != "1" {
+		t.Fatalf("Expected version 1, got %v", v)
+	}
+
+	for atomic.LoadInt32(&waits) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	version++
+	close(changed)
+	changed = make(chan struct{})
+	mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fmt.Sprint(current()) != "2" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the long poll to deliver version 2")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	several := newDataRefresher(nil, []string{srv.URL, srv.URL}, 0, newRuntimeOverlay(), nil)
+	several.longPoll = time.Minute
+	if err := several.start(ctx); err == nil {
+		t.Fatal("Expected long polling of several URLs to be rejected")
+	}
+}
+
+func TestDataRefreshClientTLS(t *testing.T) {
+
+	dir := t.TempDir()
+	writePEM := func(name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+		bs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if key != nil {
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".pem"), bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server, serverKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "authz"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	writePEM("ca", ca, nil)
+	writePEM("client", client, clientKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"client": %q}`, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	d := newDataRefresher(nil, []string{srv.URL}, 0, newRuntimeOverlay(), nil)
+
+	ctx := context.Background()
+	if _, err := d.fetch(ctx, srv.URL); err == nil {
+		t.Fatal("Expected the server certificate not to be trusted without the CA")
+	}
+
+	transport, err := clientTransport(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.Proxy == nil {
+		t.Fatal("Expected the transport to honor proxy environment variables")
+	}
+	d.client.Transport = transport
+
+	doc, err := d.fetch(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["client"] != "authz" {
+		t.Fatalf("Expected client authz, got %v", doc["client"])
+	}
+
+	if _, err := clientTransport(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), ""); err == nil {
+		t.Fatal("Expected a client certificate without a key to be rejected")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// decisionHistorySize is the number of recent decisions kept in memory for
+// inspection through the admin API.
+const decisionHistorySize = 100
+
+// decisionRecord is a compact summary of an authorization decision.
+type decisionRecord struct {
+	DecisionID string `json:"decision_id"`
+	Timestamp  string `json:"timestamp"`
+	User       string `json:"user"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Result     bool   `json:"result"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newDecisionRecord(decisionID string, r authorization.Request, d decision, err error) decisionRecord {
+
+	rec := decisionRecord{
+		DecisionID: decisionID,
+		Timestamp:  time.Now().Format(time.RFC3339Nano),
+		User:       r.User,
+		Method:     r.RequestMethod,
+		Path:       r.RequestURI,
+		Result:     d.Allowed,
+		Code:       d.Code,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	return rec
+}
+
+// decisionHistory is a fixed size ring of the most recent decisions.
+type decisionHistory struct {
+	mu      sync.Mutex
+	records []decisionRecord
+	next    int
+	full    bool
+
+	// The decisions are written to bucket by a goroutine, off the request
+	// path. seq numbers the decisions added, written those persisted, and
+	// wake signals the writer.
+	bucket  *storeBucket
+	seq     uint64
+	written uint64
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newDecisionHistory(size int) *decisionHistory {
+	return &decisionHistory{records: make([]decisionRecord, size)}
+}
+
+func (h *decisionHistory) add(rec decisionRecord) {
+
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.push(rec)
+
+	if h.wake != nil {
+		h.seq++
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// push adds rec to the ring. Callers must hold h.mu.
+func (h *decisionHistory) push(rec decisionRecord) {
+	h.records[h.next] = rec
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// persist keeps the history in bucket, so that it survives restarts. The
+// decisions already in bucket are loaded first.
+func (h *decisionHistory) persist(bucket *storeBucket) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.bucket = bucket
+
+	var keys []string
+	err := bucket.forEach(func(key string, value json.RawMessage) error {
+		var rec decisionRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return err
+		}
+		h.push(rec)
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		h.seq, err = strconv.ParseUint(keys[len(keys)-1], 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Drop the records that did not fit into the ring.
+	for len(keys) > len(h.records) {
+		if err := bucket.delete(keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+
+	h.written = h.seq
+	h.wake = make(chan struct{}, 1)
+	h.done = make(chan struct{})
+	go h.write(h.wake)
+
+	return nil
+}
+
+// write persists the decisions added since the last write whenever woken,
+// until wake is closed.
+func (h *decisionHistory) write(wake <-chan struct{}) {
+
+	for range wake {
+		h.flush()
+	}
+	h.flush()
+	close(h.done)
+}
+
+// flush persists the decisions added since the last flush that are still in
+// the ring, and drops those that fell out of it.
+func (h *decisionHistory) flush() {
+
+	h.mu.Lock()
+	seq, written, size := h.seq, h.written, uint64(len(h.records))
+	n := seq - written
+	if n > size {
+		n = size
+	}
+	recs := make([]decisionRecord, n)
+	for i := uint64(0); i < n; i++ {
+		recs[i] = h.records[(uint64(h.next)+size-n+i)%size]
+	}
+	h.written = seq
+	h.mu.Unlock()
+
+	var err error
+	for i, rec := range recs {
+		if err = h.bucket.put(decisionHistoryKey(seq-n+uint64(i)+1), rec); err != nil {
+			break
+		}
+	}
+
+	// Of the decisions persisted before, those up to seq-size no longer fit
+	// into the ring.
+	key := uint64(1)
+	if written > size {
+		key = written - size + 1
+	}
+	for ; err == nil && key <= written && key+size <= seq; key++ {
+		err = h.bucket.delete(decisionHistoryKey(key))
+	}
+	if err != nil {
+		log.Printf("Failed to persist decision history: %v", err)
+	}
+}
+
+// close persists the pending decisions and stops the writer.
+func (h *decisionHistory) close() {
+
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	wake := h.wake
+	h.wake = nil
+	h.mu.Unlock()
+
+	if wake != nil {
+		close(wake)
+		<-h.done
+	}
+}
+
+// decisionHistoryKey returns the key of the seq-th decision, padded so that
+// keys sort in the order of the decisions.
+func decisionHistoryKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// list returns the recorded decisions, most recent first.
+func (h *decisionHistory) list() []decisionRecord {
+
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.next
+	if h.full {
+		n = len(h.records)
+	}
+
+	result := make([]decisionRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, h.records[(h.next-i+len(h.records))%len(h.records)])
+	}
+
+	return result
+}
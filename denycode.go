@@ -0,0 +1,83 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// defaultDenyMessage is returned to the client for denials without a message.
+const defaultDenyMessage = "request rejected by administrative policy"
+
+// decision is the outcome of a policy evaluation. Policies decide with a
+// boolean, or with an object attaching a stable code and a message to the
+// decision, e.g. {"allow": false, "code": "privileged_container"}.
+type decision struct {
+	Allowed bool
+	Code    string
+	Message string
+}
+
+// errInvalidDecision is returned for allow paths evaluating to neither a
+// boolean nor a decision object.
+var errInvalidDecision = errors.New("administrative policy decision invalid")
+
+// parseDecision returns the decision of the value the allow path evaluated to.
+func parseDecision(value interface{}) (decision, error) {
+
+	switch v := value.(type) {
+	case bool:
+		return decision{Allowed: v}, nil
+	case map[string]interface{}:
+		allowed, ok := v["allow"].(bool)
+		if !ok {
+			return decision{}, fmt.Errorf("%w: missing boolean allow", errInvalidDecision)
+		}
+		d := decision{Allowed: allowed}
+		if d.Code, ok = stringField(v, "code"); !ok {
+			return decision{}, fmt.Errorf("%w: code is not a string", errInvalidDecision)
+		}
+		if d.Message, ok = stringField(v, "message"); !ok {
+			return decision{}, fmt.Errorf("%w: message is not a string", errInvalidDecision)
+		}
+		return d, nil
+	}
+
+	return decision{}, errInvalidDecision
+}
+
+// stringField returns the value of key in m, reporting false when it is set
+// to something other than a string.
+func stringField(m map[string]interface{}, key string) (string, bool) {
+
+	v, ok := m[key]
+	if !ok || v == nil {
+		return "", true
+	}
+
+	s, ok := v.(string)
+	return s, ok
+}
+
+// response returns the response to the Docker daemon for the decision.
+func (d decision) response() authorization.Response {
+
+	if d.Allowed {
+		return authorization.Response{Allow: true}
+	}
+
+	msg := d.Message
+	if msg == "" {
+		msg = defaultDenyMessage
+	}
+	if d.Code != "" {
+		msg += " (code: " + d.Code + ")"
+	}
+
+	return authorization.Response{Msg: msg}
+}
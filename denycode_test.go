@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestParseDecision(t *testing.T) {
+
+	tests := []struct {
+		value    interface{}
+		expected decision
+		err      bool
+	}{
+		{value: true, expected: decision{Allowed: true}},
+		{value: false, expected: decision{}},
+		{
+			value:    map[string]interface{}{"allow": false, "code": "privileged_container", "message": "privileged containers are not allowed"},
+			expected: decision{Code: "privileged_container", Message: "privileged containers are not allowed"},
+		},
+		{value: map[string]interface{}{"allow": true}, expected: decision{Allowed: true}},
+		{value: map[string]interface{}{"code": "missing_allow"}, err: true},
+		{value: map[string]interface{}{"allow": false, "code": 42}, err: true},
+		{value: "yes", err: true},
+	}
+
+	for _, tc := range tests {
+		d, err := parseDecision(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for %v", tc.value)
+			}
+			continue
+		}
+		if err != nil || d != tc.expected {
+			t.Errorf("Expected %v, got %v (%v)", tc.expected, d, err)
+		}
+	}
+}
+
+func TestDenyCodeResponse(t *testing.T) {
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	err := os.WriteFile(policyFile, []byte(`package docker.authz
+
+default decision = {"allow": true}
+
+decision = {"allow": false, "code": "privileged_container", "message": "privileged containers are not allowed"} {
+	input.Body.HostConfig.Privileged
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.decision",
+		quiet:      true,
+		overlay:    newRuntimeOverlay(),
+		history:    newDecisionHistory(decisionHistorySize),
+	}
+
+	resp := p.AuthZReq(authorization.Request{
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.41/containers/create",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(`{"HostConfig": {"Privileged": true}}`),
+	})
+
+	expected := "privileged containers are not allowed (code: privileged_container)"
+	if resp.Allow || resp.Msg != expected {
+		t.Fatalf("Expected denial with %q, got %+v", expected, resp)
+	}
+
+	if records := p.history.list(); len(records) != 1 || records[0].Code != "privileged_container" {
+		t.Fatalf("Expected the code in the decision history, got %+v", records)
+	}
+
+	resp = p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"})
+	if !resp.Allow {
+		t.Fatalf("Expected request to be allowed, got %+v", resp)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+// Device kinds of the input.devices list.
+const (
+	deviceKindMapping   = "mapping"
+	deviceKindCgroup    = "cgroup_rule"
+	deviceKindRequested = "request"
+)
+
+// Device is an entry of the input.devices list, normalized from the Devices,
+// DeviceCgroupRules and DeviceRequests fields of HostConfig.
+type Device struct {
+	Kind string `json:"kind"`
+
+	// HostPath and ContainerPath are set for device mappings.
+	HostPath      string `json:"host_path,omitempty"`
+	ContainerPath string `json:"container_path,omitempty"`
+
+	// Permissions is a combination of r (read), w (write) and m (mknod).
+	Permissions string `json:"permissions,omitempty"`
+
+	// Type, Major and Minor are set for cgroup rules, where "*" matches all
+	// devices of the type, or all major or minor numbers.
+	Type  string `json:"type,omitempty"`
+	Major string `json:"major,omitempty"`
+	Minor string `json:"minor,omitempty"`
+	Rule  string `json:"rule,omitempty"`
+
+	// Driver, Count, DeviceIDs and Capabilities are set for device requests,
+	// such as GPUs. A count of -1 requests all devices.
+	Driver       string     `json:"driver,omitempty"`
+	Count        int        `json:"count,omitempty"`
+	DeviceIDs    []string   `json:"device_ids,omitempty"`
+	Capabilities [][]string `json:"capabilities,omitempty"`
+}
+
+func listDevices(body map[string]interface{}) []Device {
+	var result []Device
+
+	hostConfig, ok := body["HostConfig"].(map[string]interface{})
+	if !ok {
+		return result
+	}
+
+	devices, _ := hostConfig["Devices"].([]interface{})
+	for _, v := range devices {
+		device, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hostPath, _ := device["PathOnHost"].(string)
+		containerPath, _ := device["PathInContainer"].(string)
+		permissions, _ := device["CgroupPermissions"].(string)
+		if containerPath == "" {
+			containerPath = hostPath
+		}
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		result = append(result, Device{
+			Kind:          deviceKindMapping,
+			HostPath:      hostPath,
+			ContainerPath: containerPath,
+			Permissions:   permissions,
+		})
+	}
+
+	rules, _ := hostConfig["DeviceCgroupRules"].([]interface{})
+	for _, v := range rules {
+		rule, ok := v.(string)
+		if !ok {
+			continue
+		}
+		result = append(result, parseDeviceCgroupRule(rule))
+	}
+
+	requests, _ := hostConfig["DeviceRequests"].([]interface{})
+	for _, v := range requests {
+		request, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		device := Device{Kind: deviceKindRequested}
+		device.Driver, _ = request["Driver"].(string)
+		if count, ok := request["Count"].(float64); ok {
+			device.Count = int(count)
+		}
+		device.DeviceIDs = stringList(request["DeviceIDs"])
+		capabilities, _ := request["Capabilities"].([]interface{})
+		for _, c := range capabilities {
+			device.Capabilities = append(device.Capabilities, stringList(c))
+		}
+		result = append(result, device)
+	}
+
+	return result
+}
+
+// parseDeviceCgroupRule parses a rule such as "c 1:3 mr" or "a *:* rwm".
+// Rules that cannot be parsed are returned with the rule only, so that
+// policies can still deny them.
+func parseDeviceCgroupRule(rule string) Device {
+
+	device := Device{Kind: deviceKindCgroup, Rule: rule}
+
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return device
+	}
+
+	device.Type = fields[0]
+	if device.Type == "a" {
+		device.Major, device.Minor, device.Permissions = "*", "*", "rwm"
+	}
+
+	if len(fields) > 1 {
+		numbers := strings.SplitN(fields[1], ":", 2)
+		device.Major = numbers[0]
+		if len(numbers) == 2 {
+			device.Minor = numbers[1]
+		}
+	}
+
+	if len(fields) > 2 {
+		device.Permissions = fields[2]
+	}
+
+	return device
+}
+
+func stringList(v interface{}) []string {
+	var result []string
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestListDevices(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []Device
+	}{
+		{
+			name: "mappings",
+			body: `{"HostConfig": {"Devices": [
+				{"PathOnHost": "/dev/fuse", "PathInContainer": "/dev/fuse", "CgroupPermissions": "rwm"},
+				{"PathOnHost": "/dev/snd"}
+			]}}`,
+			expected: []Device{
+				{Kind: deviceKindMapping, HostPath: "/dev/fuse", ContainerPath: "/dev/fuse", Permissions: "rwm"},
+				{Kind: deviceKindMapping, HostPath: "/dev/snd", ContainerPath: "/dev/snd", Permissions: "rwm"},
+			},
+		},
+		{
+			name: "cgroup rules",
+			body: `{"HostConfig": {"DeviceCgroupRules": ["c 1:3 mr", "a", "b 8:* r"]}}`,
+			expected: []Device{
+				{Kind: deviceKindCgroup, Rule: "c 1:3 mr", Type: "c", Major: "1", Minor: "3", Permissions: "mr"},
+				{Kind: deviceKindCgroup, Rule: "a", Type: "a", Major: "*", Minor: "*", Permissions: "rwm"},
+				{Kind: deviceKindCgroup, Rule: "b 8:* r", Type: "b", Major: "8", Minor: "*", Permissions: "r"},
+			},
+		},
+		{
+			name: "requests",
+			body: `{"HostConfig": {"DeviceRequests": [
+				{"Driver": "nvidia", "Count": -1, "Capabilities": [["gpu"]]},
+				{"DeviceIDs": ["0", "1"], "Capabilities": [["gpu", "compute"]]}
+			]}}`,
+			expected: []Device{
+				{Kind: deviceKindRequested, Driver: "nvidia", Count: -1, Capabilities: [][]string{{"gpu"}}},
+				{Kind: deviceKindRequested, DeviceIDs: []string{"0", "1"}, Capabilities: [][]string{{"gpu", "compute"}}},
+			},
+		},
+		{
+			name: "none",
+			body: `{"HostConfig": {}}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			result := listDevices(body)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
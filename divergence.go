@@ -0,0 +1,99 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	compareModeCanary = "canary"
+	compareModeShadow = "shadow"
+)
+
+// divergenceConfig controls the sampling of requests for which two bundle
+// revisions returned different decisions.
+type divergenceConfig struct {
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	MaxSamples int     `json:"max_samples,omitempty"`
+}
+
+func (c *divergenceConfig) validate() error {
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("divergence sample_rate must be between 0 and 1")
+	}
+
+	if c.MaxSamples < 0 {
+		return fmt.Errorf("divergence max_samples must not be negative")
+	}
+
+	if c.MaxSamples == 0 {
+		c.MaxSamples = 100
+	}
+
+	return nil
+}
+
+// divergenceSample is an example of a request decided differently by the
+// enforced and the compared revision.
+type divergenceSample struct {
+	Timestamp        string      `json:"timestamp"`
+	Mode             string      `json:"mode"`
+	EnforcedRevision string      `json:"enforced_revision"`
+	EnforcedResult   bool        `json:"enforced_result"`
+	ComparedRevision string      `json:"compared_revision"`
+	ComparedResult   bool        `json:"compared_result"`
+	Input            interface{} `json:"input"`
+}
+
+// divergenceLog counts comparisons and keeps the most recent samples of
+// divergent decisions.
+type divergenceLog struct {
+	mu      sync.Mutex
+	samples []divergenceSample
+}
+
+func (l *divergenceLog) record(cfg divergenceConfig, sample divergenceSample) {
+
+	revisionComparisons.WithLabelValues(sample.Mode).Inc()
+
+	if sample.EnforcedResult == sample.ComparedResult {
+		return
+	}
+
+	revisionDivergences.WithLabelValues(sample.Mode, decisionLabel(sample.EnforcedResult)).Inc()
+
+	if cfg.SampleRate <= 0 || rand.Float64() >= cfg.SampleRate { // #nosec G404
+		return
+	}
+
+	sample.Timestamp = time.Now().Format(time.RFC3339Nano)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples = append(l.samples, sample)
+	if over := len(l.samples) - cfg.MaxSamples; over > 0 {
+		l.samples = append([]divergenceSample(nil), l.samples[over:]...)
+	}
+}
+
+// list returns the samples, most recent first.
+func (l *divergenceLog) list() []divergenceSample {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]divergenceSample, 0, len(l.samples))
+	for i := len(l.samples) - 1; i >= 0; i-- {
+		result = append(result, l.samples[i])
+	}
+
+	return result
+}
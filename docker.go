@@ -0,0 +1,317 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// dockerLookupHeader marks the requests the plugin itself sends to the Docker
+// daemon. These requests are passed to the plugin for authorization like any
+// other, and must not trigger further lookups.
+const dockerLookupHeader = "X-Opa-Docker-Authz-Lookup"
+
+var errDockerNotFound = errors.New("not found")
+
+// dockerClient is a minimal client of the Docker Engine API, used to look up
+// objects referenced by requests.
+type dockerClient struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+// newDockerClient returns a client for host, given as unix:///path/to/socket
+// or tcp://host:port.
+func newDockerClient(host, token string) (*dockerClient, error) {
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dockerClient{token: token}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		c.base = "http://docker"
+		c.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	case "tcp", "http":
+		c.base = "http://" + u.Host
+		c.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+
+	c.client.Timeout = 5 * time.Second
+
+	return c, nil
+}
+
+// get decodes the JSON response of a GET request for path into v.
+func (c *dockerClient) get(ctx context.Context, path string, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "opa-docker-authz")
+	req.Header.Set(dockerLookupHeader, c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errDockerNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// isLookup reports whether r was sent by c.
+func (c *dockerClient) isLookup(headers map[string]string) bool {
+
+	if c == nil {
+		return false
+	}
+
+	v, ok := headerValue(headers, dockerLookupHeader)
+	return ok && v == c.token
+}
+
+type lookupCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// persistedCacheEntry is the form of a cache entry in the state store.
+type persistedCacheEntry struct {
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires"`
+}
+
+// lookupCache caches the results of lookups against the daemon for ttl.
+// Concurrent lookups of the same key share a single request.
+type lookupCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]lookupCacheEntry
+	group   singleflight.Group
+
+	bucket *storeBucket
+	decode func(json.RawMessage) (interface{}, error)
+}
+
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{ttl: ttl, entries: map[string]lookupCacheEntry{}}
+}
+
+// persist keeps the entries of the cache in bucket, so that they survive
+// restarts. decode converts a persisted value back to the type returned by
+// the lookups. Entries already in bucket are loaded, unless expired.
+func (c *lookupCache) persist(bucket *storeBucket, decode func(json.RawMessage) (interface{}, error)) error {
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.bucket, c.decode = bucket, decode
+
+	return bucket.forEach(func(key string, value json.RawMessage) error {
+		var entry persistedCacheEntry
+		if err := json.Unmarshal(value, &entry); err != nil || now.After(entry.Expires) {
+			return bucket.delete(key)
+		}
+		v, err := decode(entry.Value)
+		if err != nil {
+			return bucket.delete(key)
+		}
+		c.entries[key] = lookupCacheEntry{value: v, expires: entry.Expires}
+		return nil
+	})
+}
+
+// decodeString decodes persisted cache values of lookups returning strings.
+func decodeString(bs json.RawMessage) (interface{}, error) {
+	var v string
+	err := json.Unmarshal(bs, &v)
+	return v, err
+}
+
+// decodeStrings decodes persisted cache values of lookups returning string
+// slices.
+func decodeStrings(bs json.RawMessage) (interface{}, error) {
+	var v []string
+	err := json.Unmarshal(bs, &v)
+	return v, err
+}
+
+// get returns the cached value of key, calling fetch when there is none or
+// it has expired. Errors are not cached.
+func (c *lookupCache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	v, err, _ := c.group.Do(key, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = lookupCacheEntry{value: v, expires: now.Add(c.ttl)}
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			if err := c.bucket.delete(k); err != nil {
+				log.Printf("Failed to persist lookup cache: %v", err)
+			}
+		}
+	}
+
+	if c.bucket != nil {
+		bs, err := json.Marshal(v)
+		if err == nil {
+			err = c.bucket.put(key, persistedCacheEntry{Value: bs, Expires: now.Add(c.ttl)})
+		}
+		if err != nil {
+			log.Printf("Failed to persist lookup cache: %v", err)
+		}
+	}
+
+	return v, nil
+}
+
+// dockerEvent is an event of the daemon's GET /events stream.
+type dockerEvent struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID         string
+		Attributes map[string]string
+	}
+	TimeNano int64 `json:"timeNano"`
+}
+
+// events streams the events of the daemon matching filters, starting at
+// since when it is set, to fn until the stream ends or ctx is done.
+func (c *dockerClient) events(ctx context.Context, since time.Time, filters map[string][]string, fn func(dockerEvent)) error {
+
+	bs, err := json.Marshal(filters)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"filters": {string(bs)}}
+	if !since.IsZero() {
+		query.Set("since", fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "opa-docker-authz")
+	req.Header.Set(dockerLookupHeader, c.token)
+
+	// The stream stays open, so the timeout of lookups does not apply.
+	client := &http.Client{Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /events: %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		fn(event)
+	}
+}
+
+// watchContainers lists the containers of the daemon and passes them to
+// reconcile with the time of the listing, then streams the container events
+// with the given actions to handle until ctx is done, reconnecting from the
+// time returned by since when the stream ends. The daemon authorizes the
+// plugin's requests through the plugin, so they fail until it serves, and are
+// retried.
+func (c *dockerClient) watchContainers(ctx context.Context, actions []string, reconcile func([]dockerContainer, time.Time), since func() time.Time, handle func(dockerEvent)) {
+
+	for {
+		start := time.Now()
+
+		var containers []dockerContainer
+		err := c.get(ctx, "/containers/json?all=1", &containers)
+		if err == nil {
+			reconcile(containers, start)
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			log.Printf("Failed to list the containers of the daemon, retrying: %v", err)
+		}
+	}
+
+	filters := map[string][]string{
+		"type":  {"container"},
+		"event": actions,
+	}
+
+	for {
+		err := c.events(ctx, since(), filters, handle)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			log.Printf("Docker event stream ended, reconnecting: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// parseDockerfileBuiltin is the name of the builtin returning the structured
+// instructions of a Dockerfile.
+const parseDockerfileBuiltin = "docker.parse_dockerfile"
+
+func init() {
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:    parseDockerfileBuiltin,
+		Decl:    types.NewFunction(types.Args(types.S), types.A),
+		Memoize: true,
+	}, func(_ rego.BuiltinContext, content *ast.Term) (*ast.Term, error) {
+
+		s, ok := content.Value.(ast.String)
+		if !ok {
+			return nil, nil
+		}
+
+		v, err := ast.InterfaceToValue(parseDockerfile(string(s)))
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(v), nil
+	})
+}
+
+// DockerfileInstruction is a single instruction of a Dockerfile.
+type DockerfileInstruction struct {
+	Cmd   string   `json:"cmd"`
+	Flags []string `json:"flags"`
+	Args  []string `json:"args"`
+	Line  int      `json:"line"`
+}
+
+// DockerfileStage is a build stage started by a FROM instruction.
+type DockerfileStage struct {
+	Image    string `json:"image"`
+	Name     string `json:"name,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// DockerfileCopy is an ADD or COPY instruction.
+type DockerfileCopy struct {
+	Cmd     string   `json:"cmd"`
+	Sources []string `json:"sources"`
+	Dest    string   `json:"dest"`
+	From    string   `json:"from,omitempty"`
+	Remote  bool     `json:"remote"`
+	Line    int      `json:"line"`
+}
+
+// Dockerfile is the result of docker.parse_dockerfile.
+type Dockerfile struct {
+	Instructions []DockerfileInstruction `json:"instructions"`
+	From         []DockerfileStage       `json:"from"`
+	Users        []string                `json:"users"`
+	Expose       []string                `json:"expose"`
+	Copies       []DockerfileCopy        `json:"copies"`
+}
+
+var dockerfileDirective = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// parseDockerfile parses the instructions of a Dockerfile. It follows the
+// rules of the Docker builder for comments, parser directives and line
+// continuations, but does not expand variables or heredocs.
+func parseDockerfile(content string) Dockerfile {
+
+	df := Dockerfile{
+		Instructions: []DockerfileInstruction{},
+		From:         []DockerfileStage{},
+		Users:        []string{},
+		Expose:       []string{},
+		Copies:       []DockerfileCopy{},
+	}
+
+	escape := `\`
+	directives := true
+
+	var current strings.Builder
+	start := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxDockerfileSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if directives {
+			if m := dockerfileDirective.FindStringSubmatch(line); m != nil {
+				if strings.EqualFold(m[1], "escape") && (m[2] == "`" || m[2] == `\`) {
+					escape = m[2]
+				}
+				continue
+			}
+			directives = false
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current.Len() == 0 {
+			start = n
+		}
+
+		if strings.HasSuffix(line, escape) {
+			current.WriteString(strings.TrimSuffix(line, escape))
+			current.WriteString(" ")
+			continue
+		}
+
+		current.WriteString(line)
+		df.add(parseDockerfileInstruction(current.String(), start))
+		current.Reset()
+	}
+
+	if current.Len() > 0 {
+		df.add(parseDockerfileInstruction(current.String(), start))
+	}
+
+	return df
+}
+
+func parseDockerfileInstruction(line string, n int) DockerfileInstruction {
+
+	cmd, rest, _ := strings.Cut(line, " ")
+	inst := DockerfileInstruction{
+		Cmd:   strings.ToUpper(cmd),
+		Flags: []string{},
+		Args:  []string{},
+		Line:  n,
+	}
+
+	rest = strings.TrimSpace(rest)
+
+	// Flags such as --from=builder precede the arguments.
+	for strings.HasPrefix(rest, "--") {
+		flag, tail, _ := strings.Cut(rest, " ")
+		inst.Flags = append(inst.Flags, flag)
+		rest = strings.TrimSpace(tail)
+	}
+
+	// Arguments in exec form are a JSON array; anything else is split on
+	// whitespace.
+	if strings.HasPrefix(rest, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(rest), &args); err == nil {
+			inst.Args = args
+			return inst
+		}
+	}
+
+	if rest != "" {
+		inst.Args = strings.Fields(rest)
+	}
+
+	return inst
+}
+
+func (df *Dockerfile) add(inst DockerfileInstruction) {
+
+	df.Instructions = append(df.Instructions, inst)
+
+	switch inst.Cmd {
+	case "FROM":
+		stage := DockerfileStage{}
+		if len(inst.Args) > 0 {
+			stage.Image = inst.Args[0]
+		}
+		if len(inst.Args) == 3 && strings.EqualFold(inst.Args[1], "AS") {
+			stage.Name = inst.Args[2]
+		}
+		stage.Platform = flagValue(inst.Flags, "platform")
+		df.From = append(df.From, stage)
+	case "USER":
+		if len(inst.Args) > 0 {
+			df.Users = append(df.Users, inst.Args[0])
+		}
+	case "EXPOSE":
+		df.Expose = append(df.Expose, inst.Args...)
+	case "ADD", "COPY":
+		c := DockerfileCopy{Cmd: inst.Cmd, Sources: []string{}, From: flagValue(inst.Flags, "from"), Line: inst.Line}
+		if len(inst.Args) > 0 {
+			c.Sources = inst.Args[:len(inst.Args)-1]
+			c.Dest = inst.Args[len(inst.Args)-1]
+		}
+		for _, src := range c.Sources {
+			if strings.Contains(src, "://") || strings.HasPrefix(src, "git@") {
+				c.Remote = true
+			}
+		}
+		df.Copies = append(df.Copies, c)
+	}
+}
+
+// flagValue returns the value of a --name=value flag.
+func flagValue(flags []string, name string) string {
+	for _, f := range flags {
+		if v := strings.TrimPrefix(f, "--"+name+"="); v != f {
+			return v
+		}
+	}
+	return ""
+}
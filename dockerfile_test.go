@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+const testDockerfile = `# syntax=docker/dockerfile:1
+# escape=\
+
+FROM --platform=linux/amd64 golang:1.19 AS build
+# build the binary
+RUN go build \
+    -o /app .
+COPY --from=build /src/a /src/b /dst/
+
+FROM alpine:3.17
+ADD https://example.com/tool.tar.gz /opt/
+EXPOSE 80/tcp 443
+USER nobody
+CMD ["/app", "--serve"]
+`
+
+func TestParseDockerfile(t *testing.T) {
+	df := parseDockerfile(testDockerfile)
+
+	expectedFrom := []DockerfileStage{
+		{Image: "golang:1.19", Name: "build", Platform: "linux/amd64"},
+		{Image: "alpine:3.17"},
+	}
+	if !reflect.DeepEqual(df.From, expectedFrom) {
+		t.Errorf("Expected %+v, got %+v", expectedFrom, df.From)
+	}
+
+	expectedCopies := []DockerfileCopy{
+		{Cmd: "COPY", Sources: []string{"/src/a", "/src/b"}, Dest: "/dst/", From: "build", Line: 8},
+		{Cmd: "ADD", Sources: []string{"https://example.com/tool.tar.gz"}, Dest: "/opt/", Remote: true, Line: 11},
+	}
+	if !reflect.DeepEqual(df.Copies, expectedCopies) {
+		t.Errorf("Expected %+v, got %+v", expectedCopies, df.Copies)
+	}
+
+	if !reflect.DeepEqual(df.Users, []string{"nobody"}) {
+		t.Errorf("Expected [nobody], got %v", df.Users)
+	}
+
+	if !reflect.DeepEqual(df.Expose, []string{"80/tcp", "443"}) {
+		t.Errorf("Expected [80/tcp 443], got %v", df.Expose)
+	}
+
+	run := df.Instructions[1]
+	if run.Cmd != "RUN" || run.Line != 6 || !reflect.DeepEqual(run.Args, []string{"go", "build", "-o", "/app", "."}) {
+		t.Errorf("Unexpected RUN instruction %+v", run)
+	}
+
+	cmd := df.Instructions[len(df.Instructions)-1]
+	if !reflect.DeepEqual(cmd.Args, []string{"/app", "--serve"}) {
+		t.Errorf("Expected exec form arguments, got %v", cmd.Args)
+	}
+}
+
+func TestParseDockerfileBuiltin(t *testing.T) {
+	rs, err := rego.New(
+		rego.Query(`df := docker.parse_dockerfile(input); remote := [c | c := df.copies[_]; c.remote]`),
+		rego.Input(testDockerfile),
+	).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := rs[0].Bindings["remote"].([]interface{})
+	if len(remote) != 1 {
+		t.Errorf("Expected 1 remote source, got %v", remote)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultElasticsearchIndex names one index per day.
+const defaultElasticsearchIndex = "opa-docker-authz-{year}.{month}.{day}"
+
+// elasticsearchSink batches decision records and indexes them through the
+// bulk API of Elasticsearch or OpenSearch.
+type elasticsearchSink struct {
+	client   *http.Client
+	endpoint string
+	index    string
+	host     string
+	username string
+	password string
+	batch    decisionBatch
+}
+
+// newElasticsearchSink returns a sink indexing into the cluster at endpoint.
+// caFile, when set, replaces the system roots used to verify the cluster's
+// certificate, and certFile and keyFile, when set, are presented as the client
+// certificate.
+func newElasticsearchSink(endpoint, index, username, password, caFile, certFile, keyFile string) (*elasticsearchSink, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported Elasticsearch URL %q", endpoint)
+	}
+
+	transport, err := clientTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticsearchSink{
+		client:   &http.Client{Transport: transport, Timeout: time.Minute},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		index:    index,
+		host:     host,
+		username: username,
+		password: password,
+		batch:    decisionBatch{name: "Elasticsearch"},
+	}, nil
+}
+
+// record adds entry to the next bulk request, in the index named after the
+// time the decision was made.
+func (s *elasticsearchSink) record(entry interface{}) {
+
+	if s == nil {
+		return
+	}
+
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": expandTimeLayout(s.index, time.Now().UTC(), s.host)},
+	})
+	if err != nil {
+		log.Printf("Failed to encode decision for Elasticsearch: %v", err)
+		return
+	}
+
+	doc, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode decision for Elasticsearch: %v", err)
+		return
+	}
+
+	s.batch.add(append(append(append(action, '\n'), doc...), '\n'))
+}
+
+// start indexes the batch on every interval until ctx is done.
+func (s *elasticsearchSink) start(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, "Elasticsearch", interval, s.flush)
+}
+
+// bulkResponse is the part of a bulk API response needed to report
+// decisions that were rejected.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// flush sends the pending decisions in a single bulk request. When the
+// request fails, the decisions are kept for the next attempt; decisions
+// rejected individually by the cluster are logged and dropped.
+func (s *elasticsearchSink) flush(ctx context.Context) error {
+
+	if s == nil {
+		return nil
+	}
+
+	batch := s.batch.take()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/_bulk", bytes.NewReader(bytes.Join(batch, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.batch.requeue(batch)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s.batch.requeue(batch)
+		return fmt.Errorf("POST /_bulk: %s", resp.Status)
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	if result.Errors {
+		failed := 0
+		var reason string
+		for _, item := range result.Items {
+			for _, r := range item {
+				if r.Status >= 300 {
+					failed++
+					reason = r.Error.Type + ": " + r.Error.Reason
+				}
+			}
+		}
+		return fmt.Errorf("%d of %d decisions were rejected (%s)", failed, len(batch), reason)
+	}
+
+	return nil
+}
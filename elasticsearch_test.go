@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchSinkFlush(t *testing.T) {
+
+	var lines []string
+	response := `{"errors":false,"items":[]}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("Unexpected request %v %v", r.URL.Path, r.Header)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "elastic" || pass != "changeme" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		w.Write([]byte(response))
+	}))
+	defer srv.Close()
+
+	s, err := newElasticsearchSink(srv.URL+"/", "decisions-{year}.{month}", "elastic", "changeme", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.record(map[string]interface{}{"decision_id": "1"})
+	s.record(map[string]interface{}{"decision_id": "2"})
+
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	index := "decisions-" + time.Now().UTC().Format("2006.01")
+	action, _ := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": index}})
+	expected := []string{string(action), `{"decision_id":"1"}`, string(action), `{"decision_id":"2"}`}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected %v, got %v", expected, lines)
+	}
+
+	// Rejected decisions are reported, and not sent again.
+	lines = nil
+	response = `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`
+	s.record(map[string]interface{}{"decision_id": "3"})
+	s.record(map[string]interface{}{"decision_id": "4"})
+
+	err = s.flush(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 decisions were rejected (mapper_parsing_exception") {
+		t.Fatalf("Expected rejected decisions, got %v", err)
+	}
+	if len(s.batch.take()) != 0 {
+		t.Fatal("Expected rejected decisions to be dropped")
+	}
+
+	// Decisions are kept when the request fails.
+	s.password = "wrong"
+	s.record(map[string]interface{}{"decision_id": "5"})
+	if err := s.flush(context.Background()); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if n := len(s.batch.take()); n != 1 {
+		t.Fatalf("Expected 1 pending decision, got %v", n)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// apiVersionPrefix matches the optional API version prefix of request paths,
+// e.g. /v1.40.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)*`)
+
+// ContainerEndpoint describes a request addressed to a single container, e.g.
+// /containers/{id}/archive.
+type ContainerEndpoint struct {
+	ID     string
+	Action string
+
+	// Name and Labels are resolved from the daemon when container
+	// resolution is enabled. Name has no leading slash.
+	Name   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+
+	// Owner is the record of the creator of the container, when ownership
+	// tracking is enabled and the container is known.
+	Owner *ContainerOwner `json:",omitempty"`
+
+	// ArchivePath is the path inside the container read or written by
+	// /containers/{id}/archive (docker cp), and ArchiveDirection is "out" when
+	// files are copied out of the container and "in" when copied into it.
+	ArchivePath      string `json:",omitempty"`
+	ArchiveDirection string `json:",omitempty"`
+
+	// Streams lists the streams requested by attach and logs requests.
+	Streams []string `json:",omitempty"`
+
+	// Checkpoint is the CRIU checkpoint created, listed or deleted by
+	// /containers/{id}/checkpoints requests, or restored by start requests.
+	Checkpoint *Checkpoint `json:",omitempty"`
+}
+
+// Checkpoint describes a request to the experimental checkpoint endpoints, or
+// a start restoring a checkpoint.
+type Checkpoint struct {
+	// Operation is create, list, delete or restore.
+	Operation string
+
+	// ID is the name of the checkpoint, empty when listing checkpoints.
+	ID string
+
+	// Dir is the host directory the checkpoint is written to or read from,
+	// empty for the default directory of the daemon.
+	Dir string
+
+	// Exit is true when the container is stopped once checkpointed.
+	Exit bool
+}
+
+// trimAPIVersion removes the API version prefix from path.
+func trimAPIVersion(path string) string {
+	return apiVersionPrefix.ReplaceAllString(path, "")
+}
+
+// parseContainerEndpoint returns the parameters of requests to container
+// endpoints, or nil for any other request.
+func parseContainerEndpoint(method, path string, query url.Values, body map[string]interface{}) *ContainerEndpoint {
+
+	parts := strings.Split(strings.Trim(trimAPIVersion(path), "/"), "/")
+	if len(parts) < 2 || parts[0] != "containers" || parts[1] == "" {
+		return nil
+	}
+
+	// Collection endpoints such as /containers/json and /containers/create
+	// do not address a container.
+	if len(parts) == 2 && (parts[1] == "json" || parts[1] == "create" || parts[1] == "prune") {
+		return nil
+	}
+
+	endpoint := &ContainerEndpoint{
+		ID:     parts[1],
+		Action: strings.Join(parts[2:], "/"),
+	}
+
+	switch endpoint.Action {
+	case "archive":
+		endpoint.ArchivePath = query.Get("path")
+		if method == "PUT" {
+			endpoint.ArchiveDirection = "in"
+		} else {
+			endpoint.ArchiveDirection = "out"
+		}
+	case "attach", "attach/ws", "logs":
+		for _, stream := range []string{"stdin", "stdout", "stderr"} {
+			if queryFlag(query, stream) {
+				endpoint.Streams = append(endpoint.Streams, stream)
+			}
+		}
+	default:
+		endpoint.Checkpoint = parseCheckpoint(method, parts[2:], query, body)
+	}
+
+	return endpoint
+}
+
+// parseCheckpoint returns the checkpoint of the checkpoint endpoints of a
+// container, given the path after its id, and of starts restoring one, or nil
+// for any other request.
+func parseCheckpoint(method string, action []string, query url.Values, body map[string]interface{}) *Checkpoint {
+
+	if len(action) == 0 {
+		return nil
+	}
+
+	switch {
+	case action[0] == "start" && len(action) == 1 && method == "POST":
+		if query.Get("checkpoint") == "" {
+			return nil
+		}
+		return &Checkpoint{Operation: "restore", ID: query.Get("checkpoint"), Dir: query.Get("checkpoint-dir")}
+	case action[0] != "checkpoints":
+		return nil
+	case len(action) == 1 && method == "POST":
+		checkpoint := &Checkpoint{Operation: "create"}
+		checkpoint.ID, _ = body["CheckpointID"].(string)
+		checkpoint.Dir, _ = body["CheckpointDir"].(string)
+		checkpoint.Exit, _ = body["Exit"].(bool)
+		return checkpoint
+	case len(action) == 1 && method == "GET":
+		return &Checkpoint{Operation: "list", Dir: query.Get("dir")}
+	case len(action) == 2 && method == "DELETE":
+		return &Checkpoint{Operation: "delete", ID: action[1], Dir: query.Get("dir")}
+	}
+
+	return nil
+}
+
+// queryFlag reports whether a boolean query parameter is set, using the same
+// rules as the Docker daemon.
+func queryFlag(query url.Values, key string) bool {
+	v := strings.ToLower(strings.TrimSpace(query.Get(key)))
+	return !(v == "" || v == "0" || v == "no" || v == "false" || v == "none")
+}
+
+// containerInfo is the part of a container inspect response exposed in input.
+type containerInfo struct {
+	Name   string
+	Config struct {
+		Labels map[string]string
+	}
+}
+
+// containerResolver looks up the name and labels of containers referenced by
+// requests.
+type containerResolver struct {
+	docker *dockerClient
+	cache  *lookupCache
+}
+
+func newContainerResolver(docker *dockerClient, ttl time.Duration) *containerResolver {
+	return &containerResolver{docker: docker, cache: newLookupCache(ttl)}
+}
+
+// resolve fills in the name and labels of endpoint. Lookup failures are
+// logged and leave the endpoint unchanged.
+func (c *containerResolver) resolve(ctx context.Context, endpoint *ContainerEndpoint) {
+
+	if c == nil || endpoint == nil {
+		return
+	}
+
+	info, err := c.lookup(ctx, endpoint.ID)
+	if err != nil {
+		log.Printf("Failed to resolve container %s: %v", endpoint.ID, err)
+		return
+	}
+
+	if info != nil {
+		endpoint.Name = strings.TrimPrefix(info.Name, "/")
+		endpoint.Labels = info.Config.Labels
+	}
+}
+
+// lookup returns the container with the given ID or name, or nil when it does
+// not exist. Missing containers are cached as well, as IDs of removed
+// containers keep appearing in requests.
+func (c *containerResolver) lookup(ctx context.Context, id string) (*containerInfo, error) {
+
+	v, err := c.cache.get(id, func() (interface{}, error) {
+		var info containerInfo
+		err := c.docker.get(ctx, "/containers/"+url.PathEscape(id)+"/json", &info)
+		if err == errDockerNotFound {
+			return (*containerInfo)(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &info, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*containerInfo), nil
+}
+
+// containerAction returns "create" for container create requests, the action
+// of requests addressed to a single container, and "" for any other request.
+func containerAction(path string) string {
+
+	parts := strings.Split(strings.Trim(trimAPIVersion(path), "/"), "/")
+	if len(parts) < 2 || parts[0] != "containers" {
+		return ""
+	}
+
+	if len(parts) == 2 && parts[1] == "create" {
+		return "create"
+	}
+
+	return strings.Join(parts[2:], "/")
+}
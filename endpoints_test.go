@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestParseContainerEndpoint(t *testing.T) {
+	tests := []struct {
+		method   string
+		uri      string
+		body     map[string]interface{}
+		expected *ContainerEndpoint
+	}{
+		{
+			method:   "GET",
+			uri:      "/v1.40/containers/abc123/archive?path=%2Fetc%2Fshadow",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "archive", ArchivePath: "/etc/shadow", ArchiveDirection: "out"},
+		},
+		{
+			method:   "PUT",
+			uri:      "/containers/web/archive?path=/tmp&noOverwriteDirNonDir=true",
+			expected: &ContainerEndpoint{ID: "web", Action: "archive", ArchivePath: "/tmp", ArchiveDirection: "in"},
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/containers/abc123/attach?stream=1&stdin=1&stdout=1&stderr=0",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "attach", Streams: []string{"stdin", "stdout"}},
+		},
+		{
+			method:   "GET",
+			uri:      "/v1.41/containers/abc123/logs?stdout=true&stderr=true&follow=1",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "logs", Streams: []string{"stdout", "stderr"}},
+		},
+		{
+			method:   "DELETE",
+			uri:      "/v1.41/containers/abc123?force=1",
+			expected: &ContainerEndpoint{ID: "abc123"},
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/containers/abc123/checkpoints",
+			body:     map[string]interface{}{"CheckpointID": "cp1", "CheckpointDir": "/etc/cron.d", "Exit": true},
+			expected: &ContainerEndpoint{ID: "abc123", Action: "checkpoints", Checkpoint: &Checkpoint{Operation: "create", ID: "cp1", Dir: "/etc/cron.d", Exit: true}},
+		},
+		{
+			method:   "GET",
+			uri:      "/v1.41/containers/abc123/checkpoints?dir=/srv/checkpoints",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "checkpoints", Checkpoint: &Checkpoint{Operation: "list", Dir: "/srv/checkpoints"}},
+		},
+		{
+			method:   "DELETE",
+			uri:      "/v1.41/containers/abc123/checkpoints/cp1",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "checkpoints/cp1", Checkpoint: &Checkpoint{Operation: "delete", ID: "cp1"}},
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/containers/abc123/start?checkpoint=cp1&checkpoint-dir=/srv/checkpoints",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "start", Checkpoint: &Checkpoint{Operation: "restore", ID: "cp1", Dir: "/srv/checkpoints"}},
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/containers/abc123/start",
+			expected: &ContainerEndpoint{ID: "abc123", Action: "start"},
+		},
+		{
+			method: "POST",
+			uri:    "/v1.41/containers/create?name=web",
+		},
+		{
+			method: "GET",
+			uri:    "/v1.41/images/json",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.uri, func(t *testing.T) {
+			u, err := url.Parse(tc.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := parseContainerEndpoint(tc.method, u.Path, u.Query(), tc.body)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestContainerResolver(t *testing.T) {
+
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.Header.Get(dockerLookupHeader) != "secret" {
+			t.Errorf("Expected lookup header, got %q", r.Header.Get(dockerLookupHeader))
+		}
+		if r.URL.Path != "/containers/abc123/json" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"Name": "/vault", "Config": {"Labels": {"tier": "secrets"}}}`))
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{
+		docker:     docker,
+		containers: newContainerResolver(docker, time.Minute),
+	}
+
+	for i := 0; i < 2; i++ {
+		input, err := p.buildInput(context.Background(), authorization.Request{
+			RequestMethod: "GET",
+			RequestURI:    "/v1.41/containers/abc123/archive?path=/etc",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := input.(map[string]interface{})["Container"].(*ContainerEndpoint)
+		if endpoint.Name != "vault" || endpoint.Labels["tier"] != "secrets" {
+			t.Errorf("Expected vault with tier label, got %+v", endpoint)
+		}
+	}
+
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, got %d", lookups)
+	}
+
+	// Unknown containers are left unresolved, and the plugin's own lookups
+	// are not resolved again.
+	for _, headers := range []map[string]string{nil, {dockerLookupHeader: "secret"}} {
+		input, err := p.buildInput(context.Background(), authorization.Request{
+			RequestMethod:  "GET",
+			RequestURI:     "/v1.41/containers/missing/json",
+			RequestHeaders: headers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := input.(map[string]interface{})["Container"].(*ContainerEndpoint)
+		if endpoint.Name != "" {
+			t.Errorf("Expected no name, got %v", endpoint.Name)
+		}
+	}
+
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups, got %d", lookups)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// endpointTLS is the CA and client certificate used to connect to a class of
+// outbound endpoints, e.g. bundle servers or decision sinks, which may live in
+// different PKI domains. caFile, when set, replaces the system roots.
+type endpointTLS struct {
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+// or returns t, with the CA and the client certificate it does not set taken
+// from defaults.
+func (t endpointTLS) or(defaults endpointTLS) endpointTLS {
+
+	if t.caFile == "" {
+		t.caFile = defaults.caFile
+	}
+	if t.certFile == "" && t.keyFile == "" {
+		t.certFile, t.keyFile = defaults.certFile, defaults.keyFile
+	}
+
+	return t
+}
+
+func (t endpointTLS) empty() bool {
+	return t.caFile == "" && t.certFile == "" && t.keyFile == ""
+}
+
+// serviceTLS is the endpointTLS of the services of the OPA configuration, by
+// the class of the endpoints they are used for.
+type serviceTLS struct {
+	// bundles applies to the services bundles, discovery and the failover
+	// sources of the plugin are downloaded from.
+	bundles endpointTLS
+
+	// decisionLogs applies to the service decisions are uploaded to.
+	decisionLogs endpointTLS
+}
+
+// apply sets the CA and client certificate of the services of the OPA
+// configuration bs by class. Services configuring their own CA, or their own
+// credentials, keep them. Services used for several classes must be given the
+// same settings for all of them.
+func (s serviceTLS) apply(bs []byte) ([]byte, error) {
+
+	if s.bundles.empty() && s.decisionLogs.empty() {
+		return bs, nil
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return bs, nil
+	}
+
+	services, names := configServices(doc["services"])
+	if len(services) == 0 {
+		return bs, nil
+	}
+
+	// OPA defaults to the first service when sections do not name theirs,
+	// which is only well defined for a list of services, or a single one.
+	service := func(section string, v interface{}) (string, error) {
+		name, _ := v.(string)
+		if name != "" {
+			return name, nil
+		}
+		if names[0] == "" {
+			return "", fmt.Errorf("%s: the service must be named when several services are configured", section)
+		}
+		return names[0], nil
+	}
+
+	classes := map[string]endpointTLS{}
+	sections := map[string]string{}
+	use := func(section string, v interface{}, t endpointTLS) error {
+		if t.empty() {
+			return nil
+		}
+		name, err := service(section, v)
+		if err != nil {
+			return err
+		}
+		if prev, ok := classes[name]; ok && prev != t {
+			return fmt.Errorf("service %s is used by %s and %s, which are given different TLS settings", name, sections[name], section)
+		}
+		classes[name], sections[name] = t, section
+		return nil
+	}
+
+	bundles, _ := doc["bundles"].(map[string]interface{})
+	for _, name := range sortedKeys(bundles) {
+		b, _ := bundles[name].(map[string]interface{})
+		if resource, _ := b["resource"].(string); strings.HasPrefix(resource, "file://") {
+			continue
+		}
+		if err := use("bundles."+name, b["service"], s.bundles); err != nil {
+			return nil, err
+		}
+	}
+
+	if d, ok := doc["discovery"].(map[string]interface{}); ok {
+		if err := use("discovery", d["service"], s.bundles); err != nil {
+			return nil, err
+		}
+	}
+
+	plugins, _ := doc["plugins"].(map[string]interface{})
+	if raw, ok := plugins[authzPluginName]; ok {
+		bs, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		var plugin authzPluginConfig
+		if err := json.Unmarshal(bs, &plugin); err != nil {
+			return nil, err
+		}
+		for _, name := range sortedFailoverBundles(plugin.Failover) {
+			f := plugin.Failover[name]
+			if f == nil {
+				continue
+			}
+			for _, source := range f.Sources {
+				if source.file() {
+					continue
+				}
+				if err := use(fmt.Sprintf("plugins.%s.failover.%s", authzPluginName, name), source.Service, s.bundles); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Decisions are only uploaded to the default service unless logged to
+	// the console, as for OPA.
+	if l, ok := doc["decision_logs"].(map[string]interface{}); ok {
+		if name, _ := l["service"].(string); name != "" || l["console"] != true {
+			if err := use("decision_logs", l["service"], s.decisionLogs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, t := range classes {
+		svc := services[name]
+		if svc == nil {
+			// Unknown services are reported by OPA.
+			continue
+		}
+		if t.caFile != "" {
+			tlsConfig, _ := svc["tls"].(map[string]interface{})
+			if tlsConfig == nil {
+				tlsConfig = map[string]interface{}{}
+				svc["tls"] = tlsConfig
+			}
+			if _, ok := tlsConfig["ca_cert"]; !ok {
+				tlsConfig["ca_cert"] = t.caFile
+			}
+		}
+		if t.certFile != "" || t.keyFile != "" {
+			if _, ok := svc["credentials"]; !ok {
+				svc["credentials"] = map[string]interface{}{
+					"client_tls": map[string]interface{}{
+						"cert":        t.certFile,
+						"private_key": t.keyFile,
+					},
+				}
+			}
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// configServices returns the services of the OPA configuration by name, and
+// their names in the order OPA considers them: the order of the list, or a
+// single empty name when services are an object of several services, whose
+// order is not defined.
+func configServices(v interface{}) (map[string]map[string]interface{}, []string) {
+
+	services := map[string]map[string]interface{}{}
+	var names []string
+
+	switch s := v.(type) {
+	case []interface{}:
+		for _, svc := range s {
+			svc, _ := svc.(map[string]interface{})
+			if name, _ := svc["name"].(string); name != "" {
+				services[name] = svc
+				names = append(names, name)
+			}
+		}
+	case map[string]interface{}:
+		for name, svc := range s {
+			if svc, ok := svc.(map[string]interface{}); ok {
+				services[name] = svc
+				names = append(names, name)
+			}
+		}
+		if len(names) > 1 {
+			names = []string{""}
+		}
+	}
+
+	return services, names
+}
+
+// httpSendTLS, set by the -http-send-* flags, is the CA and client certificate
+// of the requests policies send with http.send, e.g. to fetch the JWKS
+// verifying tokens, unless the requests set their own.
+var httpSendTLS endpointTLS
+
+// httpSendCAParams and httpSendClientParams are the parameters of http.send
+// setting the CA and the client certificate of requests.
+var (
+	httpSendCAParams     = []string{"tls_ca_cert", "tls_ca_cert_file", "tls_ca_cert_env_variable", "tls_use_system_certs", "tls_insecure_skip_verify"}
+	httpSendClientParams = []string{"tls_client_cert", "tls_client_cert_file", "tls_client_cert_env_variable", "tls_client_key", "tls_client_key_file", "tls_client_key_env_variable"}
+)
+
+func init() {
+
+	send := topdown.GetBuiltin(ast.HTTPSend.Name)
+	topdown.RegisterBuiltinFunc(ast.HTTPSend.Name, func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+		if req, ok := operands[0].Value.(ast.Object); ok && !httpSendTLS.empty() {
+			operands = []*ast.Term{ast.NewTerm(httpSendRequest(req, httpSendTLS))}
+		}
+		return send(bctx, operands, iter)
+	})
+}
+
+// httpSendRequest returns the http.send request req, with the CA and client
+// certificate of t when it sets none.
+func httpSendRequest(req ast.Object, t endpointTLS) ast.Object {
+
+	has := func(params []string) bool {
+		for _, p := range params {
+			if req.Get(ast.StringTerm(p)) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := req.Copy()
+	if t.caFile != "" && !has(httpSendCAParams) {
+		result.Insert(ast.StringTerm("tls_ca_cert_file"), ast.StringTerm(t.caFile))
+	}
+	if t.certFile != "" && t.keyFile != "" && !has(httpSendClientParams) {
+		result.Insert(ast.StringTerm("tls_client_cert_file"), ast.StringTerm(t.certFile))
+		result.Insert(ast.StringTerm("tls_client_key_file"), ast.StringTerm(t.keyFile))
+	}
+
+	return result
+}
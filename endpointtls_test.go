@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestServiceTLSApply(t *testing.T) {
+
+	bundles := endpointTLS{caFile: "/etc/pki/bundles.pem", certFile: "/etc/pki/client.pem", keyFile: "/etc/pki/client-key.pem"}
+	decisions := endpointTLS{caFile: "/etc/pki/logs.pem"}
+
+	tests := []struct {
+		note     string
+		config   string
+		services serviceTLS
+		expected map[string]interface{}
+		err      string
+	}{
+		{
+			note:     "no settings",
+			config:   "services:\n  acme:\n    url: https://acme.example.com\n",
+			services: serviceTLS{},
+		},
+		{
+			note: "by class",
+			config: `services:
+  - name: bundles
+    url: https://bundles.example.com
+  - name: logs
+    url: https://logs.example.com
+  - name: other
+    url: https://other.example.com
+bundles:
+  authz:
+    service: bundles
+    resource: authz.tar.gz
+decision_logs:
+  service: logs
+`,
+			services: serviceTLS{bundles: bundles, decisionLogs: decisions},
+			expected: map[string]interface{}{
+				"bundles": map[string]interface{}{
+					"name": "bundles",
+					"url":  "https://bundles.example.com",
+					"tls":  map[string]interface{}{"ca_cert": "/etc/pki/bundles.pem"},
+					"credentials": map[string]interface{}{
+						"client_tls": map[string]interface{}{"cert": "/etc/pki/client.pem", "private_key": "/etc/pki/client-key.pem"},
+					},
+				},
+				"logs": map[string]interface{}{
+					"name": "logs",
+					"url":  "https://logs.example.com",
+					"tls":  map[string]interface{}{"ca_cert": "/etc/pki/logs.pem"},
+				},
+				"other": map[string]interface{}{"name": "other", "url": "https://other.example.com"},
+			},
+		},
+		{
+			note: "own settings kept",
+			config: `services:
+  acme:
+    url: https://acme.example.com
+    tls:
+      ca_cert: /etc/pki/acme.pem
+    credentials:
+      bearer:
+        token: secret
+bundles:
+  authz:
+    resource: authz.tar.gz
+`,
+			services: serviceTLS{bundles: bundles},
+			expected: map[string]interface{}{
+				"acme": map[string]interface{}{
+					"url":         "https://acme.example.com",
+					"tls":         map[string]interface{}{"ca_cert": "/etc/pki/acme.pem"},
+					"credentials": map[string]interface{}{"bearer": map[string]interface{}{"token": "secret"}},
+				},
+			},
+		},
+		{
+			note: "failover and console decision logs",
+			config: `services:
+  primary:
+    url: https://primary.example.com
+  mirror:
+    url: https://mirror.example.com
+bundles:
+  authz:
+    service: primary
+    resource: authz.tar.gz
+decision_logs:
+  console: true
+plugins:
+  opa_docker_authz:
+    failover:
+      authz:
+        sources:
+          - service: mirror
+            resource: authz.tar.gz
+          - resource: file:///var/lib/authz.tar.gz
+`,
+			services: serviceTLS{bundles: endpointTLS{caFile: "/etc/pki/bundles.pem"}, decisionLogs: decisions},
+			expected: map[string]interface{}{
+				"primary": map[string]interface{}{"url": "https://primary.example.com", "tls": map[string]interface{}{"ca_cert": "/etc/pki/bundles.pem"}},
+				"mirror":  map[string]interface{}{"url": "https://mirror.example.com", "tls": map[string]interface{}{"ca_cert": "/etc/pki/bundles.pem"}},
+			},
+		},
+		{
+			note: "shared service",
+			config: `services:
+  acme:
+    url: https://acme.example.com
+bundles:
+  authz:
+    resource: authz.tar.gz
+decision_logs: {}
+`,
+			services: serviceTLS{bundles: bundles, decisionLogs: decisions},
+			err:      "service acme is used by bundles.authz and decision_logs, which are given different TLS settings",
+		},
+		{
+			note: "unnamed default service",
+			config: `services:
+  a:
+    url: https://a.example.com
+  b:
+    url: https://b.example.com
+bundles:
+  authz:
+    resource: authz.tar.gz
+`,
+			services: serviceTLS{bundles: bundles},
+			err:      "bundles.authz: the service must be named when several services are configured",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			bs, err := tc.services.apply([]byte(tc.config))
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Expected %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.services.bundles.empty() && tc.services.decisionLogs.empty() {
+				if string(bs) != tc.config {
+					t.Fatalf("Expected the configuration to be unchanged, got %s", bs)
+				}
+				return
+			}
+
+			var doc map[string]interface{}
+			if err := yaml.Unmarshal(bs, &doc); err != nil {
+				t.Fatal(err)
+			}
+			services, _ := configServices(doc["services"])
+			actual := map[string]interface{}{}
+			for name, svc := range services {
+				actual[name] = svc
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("Expected services %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHTTPSendTLS(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"keys": []}`))
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(params string) (int, error) {
+		rs, err := rego.New(
+			rego.Query(`resp := http.send({"method": "get", "url": "`+srv.URL+`"`+params+`}); status := resp.status_code`),
+			rego.StrictBuiltinErrors(true),
+		).Eval(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		status, _ := rs[0].Bindings["status"].(json.Number).Int64()
+		return int(status), nil
+	}
+
+	if _, err := send(""); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected the certificate of the server not to be trusted, got %v", err)
+	}
+
+	httpSendTLS = endpointTLS{caFile: caFile}
+	defer func() { httpSendTLS = endpointTLS{} }()
+
+	if status, err := send(""); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected the -http-send-ca-file CA to be used, got %v, %v", status, err)
+	}
+
+	// Calls setting their own CA keep it.
+	if _, err := send(`, "tls_ca_cert_file": "/nonexistent.pem"`); err == nil {
+		t.Fatal("Expected the CA of the call to be used")
+	}
+}
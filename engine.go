@@ -0,0 +1,103 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// EngineInfo identifies the Docker daemon, and the version of its engine,
+// in input.engine.
+type EngineInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	APIVersion    string `json:"api_version"`
+	MinAPIVersion string `json:"min_api_version"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+}
+
+// dockerVersion is the part of the response of GET /version read by the
+// plugin.
+type dockerVersion struct {
+	Version       string
+	APIVersion    string
+	MinAPIVersion string
+	OS            string
+	Arch          string
+}
+
+// engineInfoSource looks up the engine information from the daemon once.
+// Failed lookups are retried with the next request.
+type engineInfoSource struct {
+	docker *dockerClient
+
+	mu   sync.Mutex
+	info *EngineInfo
+}
+
+func newEngineInfoSource(docker *dockerClient) *engineInfoSource {
+	return &engineInfoSource{docker: docker}
+}
+
+func (s *engineInfoSource) get(ctx context.Context) (*EngineInfo, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.info != nil {
+		return s.info, nil
+	}
+
+	var version dockerVersion
+	if err := s.docker.get(ctx, "/version", &version); err != nil {
+		return nil, err
+	}
+
+	var info struct {
+		ID   string
+		Name string
+	}
+	if err := s.docker.get(ctx, "/info", &info); err != nil {
+		return nil, err
+	}
+
+	s.info = &EngineInfo{
+		ID:            info.ID,
+		Name:          info.Name,
+		Version:       version.Version,
+		APIVersion:    version.APIVersion,
+		MinAPIVersion: version.MinAPIVersion,
+		OS:            version.OS,
+		Arch:          version.Arch,
+	}
+
+	return s.info, nil
+}
+
+// enrichEngine adds the engine information. It is null for the plugin's own
+// lookups, which would otherwise wait on themselves, and when the lookup
+// fails.
+func (p *DockerAuthZPlugin) enrichEngine(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	doc["engine"] = (*EngineInfo)(nil)
+	if p.docker.isLookup(r.RequestHeaders) {
+		return nil
+	}
+
+	info, err := p.engine.get(ctx)
+	if err != nil {
+		log.Printf("Failed to look up the engine information: %v", err)
+		return nil
+	}
+	doc["engine"] = info
+
+	return nil
+}
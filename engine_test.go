@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestEngineInfo(t *testing.T) {
+
+	lookups, fail := 0, true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"Version": "24.0.7", "ApiVersion": "1.43", "MinAPIVersion": "1.12", "Os": "linux", "Arch": "amd64"}`))
+		case "/info":
+			_, _ = w.Write([]byte(`{"ID": "7TRN:IPZB:QYBB:VPBQ", "Name": "node-1"}`))
+		default:
+			t.Errorf("Unexpected lookup %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{docker: docker, engine: newEngineInfoSource(docker)}
+
+	engine := func(headers map[string]string) *EngineInfo {
+		input, err := p.buildInput(context.Background(), authorization.Request{
+			RequestMethod:  "GET",
+			RequestURI:     "/v1.43/containers/json",
+			RequestHeaders: headers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input.(map[string]interface{})["engine"].(*EngineInfo)
+	}
+
+	// Failed lookups leave engine null, and are retried.
+	if info := engine(nil); info != nil {
+		t.Fatalf("Expected no engine information, got %+v", info)
+	}
+
+	fail = false
+	for i := 0; i < 2; i++ {
+		info := engine(nil)
+		expected := EngineInfo{ID: "7TRN:IPZB:QYBB:VPBQ", Name: "node-1", Version: "24.0.7", APIVersion: "1.43", MinAPIVersion: "1.12", OS: "linux", Arch: "amd64"}
+		if info == nil || *info != expected {
+			t.Fatalf("Expected %+v, got %+v", expected, info)
+		}
+	}
+
+	if lookups != 3 {
+		t.Fatalf("Expected the engine information to be looked up once, got %d lookups", lookups)
+	}
+
+	if info := engine(map[string]string{dockerLookupHeader: "secret"}); info != nil {
+		t.Fatalf("Expected no engine information for lookups, got %+v", info)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa-docker-authz/extension"
+)
+
+// namedEnricher is an enricher of the input document, named in errors.
+type namedEnricher struct {
+	name string
+	extension.Enricher
+}
+
+// builtinEnrichers returns the enrichers of the lookups enabled on the plugin,
+// in the order they are applied.
+func (p *DockerAuthZPlugin) builtinEnrichers() []namedEnricher {
+
+	var result []namedEnricher
+
+	add := func(enabled bool, name string, fn extension.EnricherFunc) {
+		if enabled {
+			result = append(result, namedEnricher{name: name, Enricher: fn})
+		}
+	}
+
+	add(p.spiffe != nil, "spiffe", p.enrichSPIFFE)
+	add(p.identities != nil, "identity", p.enrichIdentity)
+	add(p.groups != nil, "user_groups", p.enrichUserGroups)
+	add(p.mounts != nil, "bind_mounts", p.enrichBindMounts)
+	add(p.apparmor != nil, "apparmor", p.enrichAppArmor)
+	add(p.builds != nil, "build_context", p.enrichBuildContext)
+	add(p.containers != nil, "containers", p.enrichContainer)
+	add(p.images != nil, "image_digests", p.enrichImage)
+	add(p.trust != nil, "content_trust", p.enrichTrust)
+	add(p.engine != nil, "engine", p.enrichEngine)
+	add(p.runtimes != nil, "runtime", p.enrichRuntime)
+	add(p.ownership != nil, "ownership", p.enrichOwner)
+	add(p.usage != nil, "user_resources", p.enrichUserResources)
+
+	return result
+}
+
+// enrich applies the enrichers of the plugin, followed by those of
+// extensions, to the input document of r.
+func (p *DockerAuthZPlugin) enrich(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	for _, enrichers := range [][]namedEnricher{p.builtinEnrichers(), p.enrichers} {
+		for _, e := range enrichers {
+			if err := e.Enrich(ctx, r, doc); err != nil {
+				return fmt.Errorf("enricher %s: %w", e.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichSPIFFE(_ context.Context, r *authorization.Request, doc map[string]interface{}) error {
+	doc["spiffe"] = p.spiffe.identify(r.RequestPeerCertificates)
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichIdentity(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+	p.resolveIdentity(ctx, doc, r.User)
+	return nil
+}
+
+// enrichUserGroups adds the groups of the requesting user, named by its
+// canonical identity when one was resolved.
+func (p *DockerAuthZPlugin) enrichUserGroups(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	name := r.User
+	if id, ok := doc["identity"].(*Identity); ok && id != nil {
+		name = id.Name
+	}
+
+	doc["user_groups"] = p.groups.groups(ctx, name)
+
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichAppArmor(_ context.Context, _ *authorization.Request, doc map[string]interface{}) error {
+	if profile, ok := doc["AppArmor"].(*AppArmorProfile); ok {
+		p.apparmor.resolve(profile)
+	}
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichBuildContext(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	u, err := url.Parse(r.RequestURI)
+	if err != nil {
+		return err
+	}
+
+	if isBuildRequest(r.RequestMethod, u.Path) {
+		doc["BuildContext"] = p.builds.inspect(ctx, u.Query(), r.RequestBody)
+	}
+
+	return nil
+}
+
+// enrichContainer resolves the container a request refers to. The plugin's
+// own lookups are authorized like any other request, and must not recurse
+// into further lookups.
+func (p *DockerAuthZPlugin) enrichContainer(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+	if endpoint, ok := doc["Container"].(*ContainerEndpoint); ok && !p.docker.isLookup(r.RequestHeaders) {
+		p.containers.resolve(ctx, endpoint)
+	}
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichImage(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+	if image, ok := doc["Image"].(*ImageReference); ok && !p.docker.isLookup(r.RequestHeaders) {
+		p.images.resolve(ctx, image)
+	}
+	return nil
+}
+
+func (p *DockerAuthZPlugin) enrichTrust(ctx context.Context, _ *authorization.Request, doc map[string]interface{}) error {
+	if image, ok := doc["Image"].(*ImageReference); ok {
+		p.trust.resolve(ctx, image)
+	}
+	return nil
+}
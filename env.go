@@ -0,0 +1,91 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EnvFinding flags an environment variable that looks like it carries a
+// credential.
+type EnvFinding struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// envValuePatterns match values that look like cloud or service credentials.
+var envValuePatterns = []struct {
+	reason string
+	re     *regexp.Regexp
+}{
+	{"aws_access_key_id", regexp.MustCompile(`\b(AKIA|ASIA|A3T[A-Z0-9])[A-Z0-9]{16}\b`)},
+	{"gcp_service_account_key", regexp.MustCompile(`"type"\s*:\s*"service_account"`)},
+	{"azure_storage_key", regexp.MustCompile(`AccountKey=[A-Za-z0-9+/=]{20,}`)},
+	{"github_token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"slack_token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"private_key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// envNamePattern matches names of variables that conventionally carry
+// secrets.
+var envNamePattern = regexp.MustCompile(`(?i)(SECRET|PASSWORD|PASSWD|TOKEN|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY|CREDENTIAL)`)
+
+// requestedEnv returns the environment of container create and exec requests
+// as a map. Variables given without a value map to the empty string, and
+// later definitions of a variable override earlier ones, as in Docker.
+func requestedEnv(method, path string, body map[string]interface{}) map[string]string {
+
+	if method != "POST" {
+		return nil
+	}
+
+	switch containerAction(path) {
+	case "create", "exec":
+	default:
+		return nil
+	}
+
+	vars := stringList(body["Env"])
+	if len(vars) == 0 {
+		return nil
+	}
+
+	env := make(map[string]string, len(vars))
+	for _, v := range vars {
+		name, value, _ := strings.Cut(v, "=")
+		env[name] = value
+	}
+
+	return env
+}
+
+// envFindings flags the variables of env that look like credentials, either
+// by value or, for non-empty values, by name.
+func envFindings(env map[string]string) []EnvFinding {
+
+	var findings []EnvFinding
+
+	for name, value := range env {
+		reason := ""
+		for _, p := range envValuePatterns {
+			if p.re.MatchString(value) {
+				reason = p.reason
+				break
+			}
+		}
+		if reason == "" && value != "" && envNamePattern.MatchString(name) {
+			reason = "sensitive_name"
+		}
+		if reason != "" {
+			findings = append(findings, EnvFinding{Name: name, Reason: reason})
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Name < findings[j].Name })
+
+	return findings
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpiredContainer is a container that outlived the expiry label it was
+// created with, as reported by the expiry reporter.
+type ExpiredContainer struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	User    string    `json:"user,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// expiryReporter periodically reports the containers of the daemon that
+// outlived their expiry label, holding either a time to live counted from
+// the creation of the container, e.g. 8h, or an RFC 3339 time. Expired
+// containers are logged, counted by a metric and posted to a webhook.
+type expiryReporter struct {
+	docker  *dockerClient
+	label   string
+	webhook string
+	client  *http.Client
+
+	// owners, when set, gives the creators of expired containers.
+	owners *ownershipTracker
+}
+
+func newExpiryReporter(docker *dockerClient, label, webhook string) *expiryReporter {
+	return &expiryReporter{
+		docker:  docker,
+		label:   label,
+		webhook: webhook,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// run reports the expired containers every interval until ctx is done.
+func (e *expiryReporter) run(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := e.report(ctx, now); err != nil {
+				log.Printf("Failed to report expired containers: %v", err)
+			}
+		}
+	}
+}
+
+// report reports the containers expired at now.
+func (e *expiryReporter) report(ctx context.Context, now time.Time) error {
+
+	var containers []dockerContainer
+	if err := e.docker.get(ctx, "/containers/json?all=1", &containers); err != nil {
+		return err
+	}
+
+	expired := e.expired(containers, now)
+	expiredContainers.Set(float64(len(expired)))
+
+	for _, c := range expired {
+		log.Printf("Container %s (%s) of user %q expired at %s.", c.Name, c.ID, c.User, c.Expires.Format(time.RFC3339))
+	}
+
+	if e.webhook == "" || len(expired) == 0 {
+		return nil
+	}
+
+	bs, err := json.Marshal(map[string]interface{}{"expired": expired})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.webhook, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("expiry webhook: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// expired returns the containers expired at now, oldest expiry first.
+// Containers without the label, or with an invalid one, are not reported.
+func (e *expiryReporter) expired(containers []dockerContainer, now time.Time) []ExpiredContainer {
+
+	result := []ExpiredContainer{}
+	for _, c := range containers {
+		value, ok := c.Labels[e.label]
+		if !ok {
+			continue
+		}
+
+		expires, err := parseExpiry(value, time.Unix(c.Created, 0))
+		if err != nil || !now.After(expires) {
+			continue
+		}
+
+		expired := ExpiredContainer{ID: c.ID, Expires: expires.UTC()}
+		if len(c.Names) > 0 {
+			expired.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if e.owners != nil {
+			if owner := e.owners.lookup(c.ID); owner != nil {
+				expired.User = owner.User
+			}
+		}
+		result = append(result, expired)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Expires.Before(result[j].Expires)
+	})
+
+	return result
+}
+
+// parseExpiry returns the time a container created at created expires at,
+// given the value of its expiry label.
+func parseExpiry(value string, created time.Time) (time.Time, error) {
+
+	if ttl, err := time.ParseDuration(value); err == nil {
+		return created.Add(ttl), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q, expected a duration or an RFC 3339 time", value)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseExpiry(t *testing.T) {
+
+	created := time.Date(2024, 2, 14, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"8h":                   created.Add(8 * time.Hour),
+		"2024-03-01T00:00:00Z": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for value, expected := range tests {
+		expires, err := parseExpiry(value, created)
+		if err != nil || !expires.Equal(expected) {
+			t.Errorf("Expected %v for %s, got %v (error: %v)", expected, value, expires, err)
+		}
+	}
+
+	if _, err := parseExpiry("next week", created); err == nil {
+		t.Error("Expected an invalid expiry to be rejected")
+	}
+}
+
+func TestExpiryReporter(t *testing.T) {
+
+	now := time.Now()
+	created := now.Add(-48 * time.Hour).Unix()
+	containers := []dockerContainer{
+		{ID: "aaa111", Names: []string{"/web"}, Created: created, Labels: map[string]string{"expires": "24h"}},
+		{ID: "bbb111", Names: []string{"/db"}, Created: created, Labels: map[string]string{"expires": "72h"}},
+		{ID: "ccc111", Names: []string{"/cron"}, Created: created, Labels: map[string]string{"expires": now.Add(-time.Hour).Format(time.RFC3339)}},
+		{ID: "ddd111", Names: []string{"/job"}, Created: created, Labels: map[string]string{"expires": "soon"}},
+		{ID: "eee111", Names: []string{"/tmp"}, Created: created},
+	}
+
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" || r.URL.Query().Get("all") != "1" {
+			t.Errorf("Unexpected lookup %v", r.URL)
+		}
+		_ = json.NewEncoder(w).Encode(containers)
+	}))
+	defer docker.Close()
+
+	var posted struct{ Expired []ExpiredContainer }
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer webhook.Close()
+
+	client, err := newDockerClient(strings.Replace(docker.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners, err := newOwnershipTracker(nil, nil, newStateDocuments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners.reconcile(containers, now)
+	owners.containers["aaa111"].User = "alice"
+
+	e := newExpiryReporter(client, "expires", webhook.URL)
+	e.owners = owners
+	if err := e.report(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posted.Expired) != 2 || posted.Expired[0].ID != "aaa111" || posted.Expired[0].User != "alice" || posted.Expired[1].Name != "cron" {
+		t.Fatalf("Expected web and cron to be reported, got %+v", posted.Expired)
+	}
+
+	var m dto.Metric
+	if err := expiredContainers.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.GetGauge().GetValue(); v != 2 {
+		t.Fatalf("Expected 2 expired containers, got %v", v)
+	}
+}
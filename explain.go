@@ -0,0 +1,166 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+)
+
+const defaultExplanationHistorySize = 100
+
+type explainTraceKey struct{}
+
+// explanation is the trace of the evaluation of a sampled decision.
+type explanation struct {
+	decisionRecord
+	Mode  string   `json:"mode"`
+	Trace []string `json:"trace"`
+}
+
+// explanationStore traces a sample of the evaluations of the plugin, and
+// keeps the explanations of the most recent ones by decision ID, so that
+// denials can be explained after the fact.
+type explanationStore struct {
+	rate float64
+	mode string
+
+	mu    sync.Mutex
+	ids   []string
+	next  int
+	byID  map[string]*explanation
+	float func() float64
+}
+
+// newExplanationStore returns a store tracing the fraction rate of the
+// evaluations, and keeping the explanations of the last size of them in mode,
+// one of full, fails and notes. It returns nil when rate is 0.
+func newExplanationStore(rate float64, size int, mode string) (*explanationStore, error) {
+
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid explanation sample rate %v, expected 0 to 1", rate)
+	}
+
+	switch mode {
+	case explainFull, explainFails, explainNotes:
+	default:
+		return nil, fmt.Errorf("invalid explanation mode %q, expected full, fails or notes", mode)
+	}
+
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid explanation history size %d", size)
+	}
+
+	if rate == 0 {
+		return nil, nil
+	}
+
+	return &explanationStore{
+		rate:  rate,
+		mode:  mode,
+		ids:   make([]string, size),
+		byID:  map[string]*explanation{},
+		float: rand.Float64,
+	}, nil
+}
+
+// sample returns a context tracing the evaluations run with it when the
+// request is sampled, and ctx otherwise.
+func (s *explanationStore) sample(ctx context.Context) context.Context {
+
+	if s == nil || s.float() >= s.rate {
+		return ctx
+	}
+
+	return context.WithValue(ctx, explainTraceKey{}, topdown.NewBufferTracer())
+}
+
+// explainTrace returns the tracer of the evaluations of ctx, if sampled.
+func explainTrace(ctx context.Context) *topdown.BufferTracer {
+	buf, _ := ctx.Value(explainTraceKey{}).(*topdown.BufferTracer)
+	return buf
+}
+
+// explainOptions returns the options tracing an evaluation when ctx is
+// sampled.
+func explainOptions(ctx context.Context) []func(*rego.Rego) {
+
+	if buf := explainTrace(ctx); buf != nil {
+		return []func(*rego.Rego){rego.QueryTracer(buf)}
+	}
+
+	return nil
+}
+
+// explainEvalOptions is explainOptions for prepared queries.
+func explainEvalOptions(ctx context.Context) []rego.EvalOption {
+
+	if buf := explainTrace(ctx); buf != nil {
+		return []rego.EvalOption{rego.EvalQueryTracer(buf)}
+	}
+
+	return nil
+}
+
+// add keeps the trace of the evaluations of ctx as the explanation of rec,
+// evicting the oldest explanation when the store is full. Decisions made
+// without evaluating, or not sampled, are not kept.
+func (s *explanationStore) add(ctx context.Context, rec decisionRecord) {
+
+	buf := explainTrace(ctx)
+	if s == nil || buf == nil || len(*buf) == 0 || rec.DecisionID == "" {
+		return
+	}
+
+	trace := []*topdown.Event(*buf)
+	switch s.mode {
+	case explainNotes:
+		if notes := lineage.Notes(trace); len(notes) > 0 {
+			trace = notes
+			break
+		}
+		trace = lineage.Fails(trace)
+	case explainFails:
+		trace = lineage.Fails(trace)
+	}
+
+	var out bytes.Buffer
+	topdown.PrettyTraceWithLocation(&out, trace)
+
+	e := &explanation{decisionRecord: rec, Mode: s.mode, Trace: []string{}}
+	if out.Len() > 0 {
+		e.Trace = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.byID, s.ids[s.next])
+	s.ids[s.next] = rec.DecisionID
+	s.next = (s.next + 1) % len(s.ids)
+	s.byID[rec.DecisionID] = e
+}
+
+// get returns the explanation of the decision with the given ID, or nil when
+// it was not sampled or has been evicted.
+func (s *explanationStore) get(decisionID string) *explanation {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.byID[decisionID]
+}
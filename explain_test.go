@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestExplanationStore(t *testing.T) {
+
+	if s, err := newExplanationStore(0, 10, explainFull); err != nil || s != nil {
+		t.Fatalf("Expected no store when disabled, got %v (error: %v)", s, err)
+	}
+
+	for _, tc := range []struct {
+		rate float64
+		size int
+		mode string
+	}{{1.5, 10, explainFull}, {0.5, 0, explainFull}, {0.5, 10, explainOff}} {
+		if _, err := newExplanationStore(tc.rate, tc.size, tc.mode); err == nil {
+			t.Errorf("Expected rate %v, size %d and mode %q to be rejected", tc.rate, tc.size, tc.mode)
+		}
+	}
+
+	s, err := newExplanationStore(0.5, 1, explainFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.float = func() float64 { return 0.7 }
+	if explainTrace(s.sample(context.Background())) != nil {
+		t.Fatal("Expected the request not to be sampled")
+	}
+
+	s.float = func() float64 { return 0.2 }
+	ctx := s.sample(context.Background())
+	if explainTrace(ctx) == nil {
+		t.Fatal("Expected the request to be sampled")
+	}
+
+	// Decisions made without evaluating are not kept.
+	s.add(ctx, decisionRecord{DecisionID: "a"})
+	if s.get("a") != nil {
+		t.Fatal("Expected no explanation without a trace")
+	}
+}
+
+func TestExplainDecision(t *testing.T) {
+
+	p, srv := newTestAdminServer(t, `package docker.authz
+
+allow {
+	input.User == "alice"
+}
+`)
+	var err error
+	if p.explanations, err = newExplanationStore(1, 1, explainFull); err != nil {
+		t.Fatal(err)
+	}
+
+	explain := func(user string) string {
+		if resp := p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info", User: user}); resp.Allow != (user == "alice") {
+			t.Fatalf("Unexpected response for %s: %+v", user, resp)
+		}
+		records := p.history.list()
+		return records[len(records)-1].DecisionID
+	}
+
+	denied := explain("bob")
+
+	req, _ := http.NewRequest("GET", srv.URL+"/admin/decisions/"+denied+"/explain", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		DecisionID string   `json:"decision_id"`
+		Result     bool     `json:"result"`
+		Mode       string   `json:"mode"`
+		Trace      []string `json:"trace"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.DecisionID != denied || e.Result || e.Mode != explainFull {
+		t.Fatalf("Unexpected explanation: %+v", e)
+	}
+	if !strings.Contains(strings.Join(e.Trace, "\n"), "Fail data.docker.authz.allow") {
+		t.Fatalf("Expected the trace to show the failed query, got %v", e.Trace)
+	}
+
+	if code := adminRequest(t, "GET", srv.URL+"/admin/decisions/"+denied+"/explain", "viewer", ""); code != http.StatusForbidden {
+		t.Fatalf("Expected explanations to require the write role, got %d", code)
+	}
+
+	// The store keeps a single explanation.
+	explain("alice")
+	if code := adminRequest(t, "GET", srv.URL+"/admin/decisions/"+denied+"/explain", "secret", ""); code != http.StatusNotFound {
+		t.Fatalf("Expected the explanation to be evicted, got %d", code)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+// Package extension is the registry of the extensions compiled into
+// opa-docker-authz: builtins callable from policies, enrichers adding to the
+// input document of requests, and sinks receiving decision events.
+//
+// Like database/sql drivers, extensions register themselves from the init
+// function of their package, which is compiled into the plugin with a blank
+// import:
+//
+//	import _ "example.com/authz/cmdb"
+package extension
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// Enricher adds to the input document of a request before the policy is
+// evaluated. Errors fail the evaluation, denying the request.
+type Enricher interface {
+	Enrich(ctx context.Context, r *authorization.Request, input map[string]interface{}) error
+}
+
+// EnricherFunc adapts a function to the Enricher interface.
+type EnricherFunc func(ctx context.Context, r *authorization.Request, input map[string]interface{}) error
+
+// Enrich calls f.
+func (f EnricherFunc) Enrich(ctx context.Context, r *authorization.Request, input map[string]interface{}) error {
+	return f(ctx, r, input)
+}
+
+// Sink receives the decision events of the plugin. Record is called on the
+// request path, so sinks sending events over the network should buffer them,
+// and send them when flushed or in the background between Start and Stop.
+type Sink interface {
+	Start(ctx context.Context) error
+	Record(event map[string]interface{}) error
+	Flush(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+var (
+	mu        sync.RWMutex
+	builtins  = map[string]struct{}{}
+	enrichers = map[string]Enricher{}
+	sinks     = map[string]Sink{}
+)
+
+// RegisterBuiltin makes a builtin available to policies. It panics if a
+// builtin of the same name is already registered, or impl is nil.
+func RegisterBuiltin(decl *rego.Function, impl rego.BuiltinDyn) {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if decl == nil || impl == nil {
+		panic("extension: RegisterBuiltin declaration or implementation is nil")
+	}
+	if _, dup := builtins[decl.Name]; dup {
+		panic(fmt.Sprintf("extension: RegisterBuiltin called twice for %s", decl.Name))
+	}
+
+	builtins[decl.Name] = struct{}{}
+	rego.RegisterBuiltinDyn(decl, impl)
+}
+
+// RegisterEnricher makes an enricher available by name. It panics if an
+// enricher of the same name is already registered, or e is nil.
+func RegisterEnricher(name string, e Enricher) {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e == nil {
+		panic("extension: RegisterEnricher enricher is nil")
+	}
+	if _, dup := enrichers[name]; dup {
+		panic(fmt.Sprintf("extension: RegisterEnricher called twice for %s", name))
+	}
+
+	enrichers[name] = e
+}
+
+// Builtins returns the sorted names of the registered builtins.
+func Builtins() []string {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Enrichers returns the sorted names of the registered enrichers.
+func Enrichers() []string {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(enrichers))
+	for name := range enrichers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LookupEnricher returns the enricher registered under name.
+func LookupEnricher(name string) (Enricher, bool) {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	e, ok := enrichers[name]
+	return e, ok
+}
+
+// RegisterSink adds a sink receiving every decision event. It panics if a
+// sink of the same name is already registered, or s is nil.
+func RegisterSink(name string, s Sink) {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if s == nil {
+		panic("extension: RegisterSink sink is nil")
+	}
+	if _, dup := sinks[name]; dup {
+		panic(fmt.Sprintf("extension: RegisterSink called twice for %s", name))
+	}
+
+	sinks[name] = s
+}
+
+// Sinks returns the sorted names of the registered sinks.
+func Sinks() []string {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LookupSink returns the sink registered under name.
+func LookupSink(name string) (Sink, bool) {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	s, ok := sinks[name]
+	return s, ok
+}
@@ -0,0 +1,38 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/opa-docker-authz/extension"
+)
+
+// Extensions are compiled into the plugin by importing their packages for
+// their side effects, from a file added next to this one, e.g.
+//
+//	package main
+//
+//	import _ "example.com/authz/cmdb"
+
+// loadEnrichers returns the registered enrichers named by names, in order,
+// or every registered enricher in name order when names is empty.
+func loadEnrichers(names []string) ([]namedEnricher, error) {
+
+	if len(names) == 0 {
+		names = extension.Enrichers()
+	}
+
+	result := make([]namedEnricher, 0, len(names))
+	for _, name := range names {
+		e, ok := extension.LookupEnricher(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown enricher %q, compiled in: %v", name, extension.Enrichers())
+		}
+		result = append(result, namedEnricher{name: name, Enricher: e})
+	}
+
+	return result, nil
+}
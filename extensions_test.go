@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa-docker-authz/extension"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+func init() {
+	extension.RegisterEnricher("test.owner", extension.EnricherFunc(func(_ context.Context, r *authorization.Request, input map[string]interface{}) error {
+		if r.User == "mallory" {
+			return errors.New("unknown user")
+		}
+		input["owner"] = r.User + "@example.com"
+		return nil
+	}))
+	extension.RegisterEnricher("test.team", extension.EnricherFunc(func(_ context.Context, _ *authorization.Request, input map[string]interface{}) error {
+		input["team"] = input["owner"] == "alice@example.com"
+		return nil
+	}))
+	extension.RegisterBuiltin(&rego.Function{
+		Name: "test.double",
+		Decl: types.NewFunction(types.Args(types.N), types.N),
+	}, func(_ rego.BuiltinContext, args []*ast.Term) (*ast.Term, error) {
+		n, _ := args[0].Value.(ast.Number).Int()
+		return ast.IntNumberTerm(2 * n), nil
+	})
+}
+
+func TestExtensionEnrichers(t *testing.T) {
+
+	enrichers, err := loadEnrichers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &DockerAuthZPlugin{enrichers: enrichers}
+
+	input, err := p.buildInput(context.Background(), authorization.Request{User: "alice", RequestMethod: "GET", RequestURI: "/v1.41/info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := input.(map[string]interface{})
+	if doc["owner"] != "alice@example.com" || doc["team"] != true {
+		t.Fatalf("Expected input to be enriched in name order, got %v and %v", doc["owner"], doc["team"])
+	}
+
+	if _, err := p.buildInput(context.Background(), authorization.Request{User: "mallory", RequestMethod: "GET", RequestURI: "/v1.41/info"}); err == nil || err.Error() != "enricher test.owner: unknown user" {
+		t.Fatalf("Expected enricher error, got %v", err)
+	}
+
+	if _, err := loadEnrichers([]string{"test.team", "test.missing"}); err == nil {
+		t.Fatal("Expected unknown enricher to be rejected")
+	}
+}
+
+func TestBuiltinEnrichers(t *testing.T) {
+
+	p := &DockerAuthZPlugin{
+		groups:     newGroupResolver(time.Minute),
+		identities: &nssIdentityResolver{cache: newLookupCache(time.Minute)},
+		images:     &imageResolver{},
+	}
+
+	var names []string
+	for _, e := range p.builtinEnrichers() {
+		names = append(names, e.name)
+	}
+
+	expected := []string{"identity", "user_groups", "image_digests"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+}
+
+func TestExtensionBuiltin(t *testing.T) {
+
+	rs, err := rego.New(rego.Query(`x := test.double(21)`)).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Bindings["x"].(json.Number) != "42" {
+		t.Fatalf("Expected 42, got %v", rs)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/plugins"
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+const (
+	defaultFailoverFailures = 3
+	defaultFailBackInterval = 5 * time.Minute
+)
+
+// bundleFailover lists the sources a bundle fails over to, in order, once
+// its source has failed AfterFailures times in a row. The source configured
+// under bundles comes first, and is failed back to, as are the sources
+// preceding the one in use, as soon as they answer again.
+type bundleFailover struct {
+	Sources          []failoverSource `json:"sources"`
+	AfterFailures    int              `json:"after_failures,omitempty"`
+	FailBackInterval duration         `json:"fail_back_interval,omitempty"`
+}
+
+// failoverSource is a service, with the resource of the bundle on it, or a
+// file:// resource.
+type failoverSource struct {
+	Service  string `json:"service,omitempty"`
+	Resource string `json:"resource,omitempty"`
+}
+
+func (s failoverSource) String() string {
+
+	if s.Service == "" {
+		return s.Resource
+	}
+	if s.Resource == "" {
+		return s.Service
+	}
+
+	return s.Service + "/" + strings.TrimPrefix(s.Resource, "/")
+}
+
+func (s failoverSource) file() bool {
+	return strings.HasPrefix(s.Resource, "file://")
+}
+
+// validateFailover checks the failover of each bundle against the services
+// of the OPA configuration, and sets the defaults.
+func validateFailover(failover map[string]*bundleFailover, services []string) error {
+
+	known := map[string]bool{}
+	for _, s := range services {
+		known[s] = true
+	}
+
+	for name, f := range failover {
+		if f == nil || len(f.Sources) == 0 {
+			return fmt.Errorf("failover of bundle %s: sources are required", name)
+		}
+		for i, s := range f.Sources {
+			switch {
+			case s.file():
+				if _, err := url.Parse(s.Resource); err != nil {
+					return fmt.Errorf("failover of bundle %s: source %d: %v", name, i, err)
+				}
+			case s.Service == "":
+				return fmt.Errorf("failover of bundle %s: source %d: a service or a file:// resource is required", name, i)
+			case !known[s.Service]:
+				return fmt.Errorf("failover of bundle %s: source %d: unknown service %q", name, i, s.Service)
+			}
+		}
+		if f.AfterFailures < 0 || f.FailBackInterval < 0 {
+			return fmt.Errorf("failover of bundle %s: after_failures and fail_back_interval must not be negative", name)
+		}
+		if f.AfterFailures == 0 {
+			f.AfterFailures = defaultFailoverFailures
+		}
+		if f.FailBackInterval == 0 {
+			f.FailBackInterval = duration(defaultFailBackInterval)
+		}
+	}
+
+	return nil
+}
+
+// failoverState tracks the source of a bundle in use, 0 being the source
+// configured under bundles, and the consecutive failures of that source.
+type failoverState struct {
+	primary     failoverSource
+	current     int
+	failures    int
+	lastRequest time.Time
+	switched    time.Time
+}
+
+// sources returns the sources of the bundle, the configured one first.
+func (s *failoverState) sources(f *bundleFailover) []failoverSource {
+	return append([]failoverSource{s.primary}, f.Sources...)
+}
+
+// failoverSwitch changes the source of a bundle.
+type failoverSwitch struct {
+	bundle string
+	source failoverSource
+	index  int
+	reason string
+}
+
+// observeFailover counts the failures of the sources in use in statuses, and
+// returns the bundles to fail over. Callers must hold t.mu.
+func (t *revisionTracker) observeFailover(statuses map[string]*bundlePlugin.Status, configured map[string]*bundlePlugin.Source, now time.Time) []failoverSwitch {
+
+	var switches []failoverSwitch
+
+	for _, name := range sortedFailoverBundles(t.config.Failover) {
+		f := t.config.Failover[name]
+		status, source := statuses[name], configured[name]
+		if status == nil || source == nil {
+			continue
+		}
+
+		state := t.failover[name]
+		if state == nil {
+			state = &failoverState{primary: failoverSource{Service: source.Service, Resource: source.Resource}}
+			t.failover[name] = state
+		}
+
+		if status.LastRequest.IsZero() || !status.LastRequest.After(state.lastRequest) {
+			continue
+		}
+		state.lastRequest = status.LastRequest
+
+		if status.Code == "" {
+			state.failures = 0
+			continue
+		}
+
+		state.failures++
+		sources := state.sources(f)
+		if state.failures < f.AfterFailures || state.current+1 >= len(sources) {
+			continue
+		}
+
+		next := state.current + 1
+		switches = append(switches, failoverSwitch{
+			bundle: name,
+			source: resolveSource(name, sources[next], state.primary),
+			index:  next,
+			reason: fmt.Sprintf("%s failed %d times in a row: %s", sources[state.current], state.failures, status.Message),
+		})
+		state.current, state.failures, state.switched = next, 0, now
+	}
+
+	return switches
+}
+
+// resolveSource gives the resource of the configured source of the bundle to
+// the sources of a service that do not set it, or the default resource of OPA
+// when the bundle is configured with a file.
+func resolveSource(bundle string, s, primary failoverSource) failoverSource {
+
+	if s.Service == "" || s.Resource != "" {
+		return s
+	}
+
+	s.Resource = primary.Resource
+	if primary.file() || primary.Resource == "" {
+		s.Resource = "bundles/" + bundle
+	}
+
+	return s
+}
+
+// failBack probes the sources preceding the one in use of the bundles that
+// failed over at least fail_back_interval ago, and returns the bundles to
+// switch back to the first source answering.
+func (t *revisionTracker) failBack(ctx context.Context, now time.Time) []failoverSwitch {
+
+	type candidate struct {
+		name    string
+		sources []failoverSource
+		current int
+	}
+
+	t.mu.Lock()
+	var candidates []candidate
+	for _, name := range sortedFailoverBundles(t.config.Failover) {
+		f, state := t.config.Failover[name], t.failover[name]
+		if state == nil || state.current == 0 || now.Sub(state.switched) < time.Duration(f.FailBackInterval) {
+			continue
+		}
+		state.switched = now
+		candidates = append(candidates, candidate{name: name, sources: state.sources(f), current: state.current})
+	}
+	t.mu.Unlock()
+
+	var switches []failoverSwitch
+	for _, c := range candidates {
+		for i := 0; i < c.current; i++ {
+			source := resolveSource(c.name, c.sources[i], c.sources[0])
+			if err := t.probe(ctx, source); err != nil {
+				log.Printf("Bundle %s: source %s is still unavailable: %v", c.name, source, err)
+				continue
+			}
+			switches = append(switches, failoverSwitch{bundle: c.name, source: source, index: i, reason: fmt.Sprintf("%s is available again", c.sources[i])})
+			break
+		}
+	}
+
+	t.mu.Lock()
+	for _, s := range switches {
+		if state := t.failover[s.bundle]; state != nil {
+			state.current, state.failures, state.switched = s.index, 0, now
+		}
+	}
+	t.mu.Unlock()
+
+	return switches
+}
+
+// probe downloads the bundle of source, without activating it.
+func (t *revisionTracker) probe(ctx context.Context, source failoverSource) error {
+
+	if source.file() {
+		u, err := url.Parse(source.Resource)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(u.Path)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := t.manager.Client(source.Service).Do(ctx, http.MethodGet, source.Resource)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server replied with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// switchSources reconfigures the bundle plugin with the sources of switches.
+// The bundle plugin restarts the loaders of those bundles only.
+func switchSources(ctx context.Context, manager *plugins.Manager, switches []failoverSwitch) {
+
+	p := bundlePlugin.Lookup(manager)
+	if p == nil || len(switches) == 0 {
+		return
+	}
+
+	cfg := *p.Config()
+	cfg.Bundles = make(map[string]*bundlePlugin.Source, len(cfg.Bundles))
+	for name, source := range p.Config().Bundles {
+		cfg.Bundles[name] = source
+	}
+
+	for _, s := range switches {
+		source, ok := cfg.Bundles[s.bundle]
+		if !ok {
+			continue
+		}
+		copied := *source
+		copied.Service, copied.Resource = s.source.Service, s.source.Resource
+		cfg.Bundles[s.bundle] = &copied
+
+		bundleSource.WithLabelValues(s.bundle).Set(float64(s.index))
+		log.Printf("Bundle %s: switching to source %s, as %s", s.bundle, s.source, s.reason)
+	}
+
+	p.Reconfigure(ctx, &cfg)
+}
+
+func sortedFailoverBundles(failover map[string]*bundleFailover) []string {
+
+	names := make([]string, 0, len(failover))
+	for name := range failover {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+func TestValidateFailover(t *testing.T) {
+
+	failover := map[string]*bundleFailover{
+		"authz": {Sources: []failoverSource{{Service: "secondary"}, {Resource: "file:///var/lib/authz.tar.gz"}}},
+	}
+	if err := validateFailover(failover, []string{"primary", "secondary"}); err != nil {
+		t.Fatal(err)
+	}
+	if f := failover["authz"]; f.AfterFailures != defaultFailoverFailures || time.Duration(f.FailBackInterval) != defaultFailBackInterval {
+		t.Fatalf("Expected the defaults to be set, got %+v", f)
+	}
+
+	for _, invalid := range []map[string]*bundleFailover{
+		{"authz": {}},
+		{"authz": {Sources: []failoverSource{{Service: "tertiary"}}}},
+		{"authz": {Sources: []failoverSource{{Resource: "bundles/authz"}}}},
+		{"authz": {Sources: []failoverSource{{Service: "secondary"}}, AfterFailures: -1}},
+	} {
+		if err := validateFailover(invalid, []string{"primary", "secondary"}); err == nil {
+			t.Fatalf("Expected %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRevisionTrackerFailover(t *testing.T) {
+
+	dir := t.TempDir()
+	fallback := filepath.Join(dir, "authz.tar.gz")
+
+	tracker := &revisionTracker{
+		config: authzPluginConfig{Failover: map[string]*bundleFailover{
+			"authz": {Sources: []failoverSource{{Service: "secondary"}, {Resource: "file://" + fallback}}, AfterFailures: 2},
+		}},
+		failover: map[string]*failoverState{},
+	}
+	if err := validateFailover(tracker.config.Failover, []string{"primary", "secondary"}); err != nil {
+		t.Fatal(err)
+	}
+	configured := map[string]*bundlePlugin.Source{"authz": {Service: "primary", Resource: "bundles/authz.tar.gz"}}
+
+	start := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	attempt := func(i int, failed bool) []failoverSwitch {
+		status := &bundlePlugin.Status{LastRequest: start.Add(time.Duration(i) * time.Minute)}
+		if failed {
+			status.Code, status.Message = "bundle_error", "server replied with Bad Gateway"
+		}
+		return tracker.observeFailover(map[string]*bundlePlugin.Status{"authz": status}, configured, status.LastRequest)
+	}
+
+	if switches := attempt(1, true); len(switches) != 0 {
+		t.Fatalf("Expected no failover after one failure, got %+v", switches)
+	}
+
+	// A success resets the count.
+	attempt(2, false)
+	attempt(3, true)
+
+	switches := attempt(4, true)
+	if len(switches) != 1 || switches[0].index != 1 || switches[0].source != (failoverSource{Service: "secondary", Resource: "bundles/authz.tar.gz"}) {
+		t.Fatalf("Expected a failover to the secondary service, got %+v", switches)
+	}
+	configured["authz"] = &bundlePlugin.Source{Service: "secondary", Resource: "bundles/authz.tar.gz"}
+
+	attempt(5, true)
+	switches = attempt(6, true)
+	if len(switches) != 1 || switches[0].index != 2 || switches[0].source.Resource != "file://"+fallback {
+		t.Fatalf("Expected a failover to the file, got %+v", switches)
+	}
+
+	// The last source is kept, however often it fails.
+	attempt(7, true)
+	if switches := attempt(8, true); len(switches) != 0 {
+		t.Fatalf("Expected no failover past the last source, got %+v", switches)
+	}
+
+	// The services cannot be probed without a manager, so fail back is tested
+	// with a file fallback preceding the source in use.
+	tracker.config.Failover["authz"].Sources = []failoverSource{{Resource: "file://" + fallback}, {Service: "secondary"}}
+	tracker.failover["authz"].primary = failoverSource{Resource: "file://" + filepath.Join(dir, "missing.tar.gz")}
+
+	now := start.Add(6 * time.Minute)
+	if switches := tracker.failBack(context.Background(), now.Add(time.Minute)); len(switches) != 0 {
+		t.Fatalf("Expected no fail back before the interval, got %+v", switches)
+	}
+
+	if err := os.WriteFile(fallback, []byte("bundle"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	switches = tracker.failBack(context.Background(), now.Add(defaultFailBackInterval))
+	if len(switches) != 1 || switches[0].index != 1 || tracker.failover["authz"].current != 1 {
+		t.Fatalf("Expected a fail back to the first source available, got %+v", switches)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// fipsMode, set by -fips, restricts the keys verifying signatures, the JWT
+// keys and secrets of policies and the TLS listeners of the plugin to FIPS
+// 140 approved algorithms. It does not replace the implementation of the
+// algorithms with a validated module.
+var fipsMode bool
+
+// fipsMinRSABits is the smallest RSA modulus approved by NIST SP 800-131A.
+const fipsMinRSABits = 2048
+
+// fipsHMACKeySizes are the smallest keys of the HMAC JWT algorithms, the size
+// of their hash (RFC 7518, section 3.2).
+var fipsHMACKeySizes = map[string]int{
+	"HS256": 32,
+	"HS384": 48,
+	"HS512": 64,
+}
+
+// fipsCurves are the curves of the ECDSA JWT algorithms.
+var fipsCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// fipsCipherSuites are the TLS 1.2 cipher suites served in FIPS mode.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// checkFIPSKey fails unless pub is an RSA key of at least 2048 bits, or an
+// ECDSA key on a NIST curve.
+func checkFIPSKey(pub crypto.PublicKey) error {
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < fipsMinRSABits {
+			return fmt.Errorf("%d bit RSA keys are not FIPS approved", k.N.BitLen())
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("ECDSA keys on %s are not FIPS approved", k.Curve.Params().Name)
+	}
+
+	return fmt.Errorf("%s keys are not FIPS approved", keyTypeName(pub))
+}
+
+func keyTypeName(pub crypto.PublicKey) string {
+	return strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%T", pub), "*"), ".PublicKey")
+}
+
+// fipsTLSConfig restricts cfg to TLS 1.2, whose cipher suites, unlike those
+// of TLS 1.3, can be limited to AES-GCM, and to key exchanges on NIST curves.
+func fipsTLSConfig(cfg *tls.Config) *tls.Config {
+
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = fipsCipherSuites
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+	return cfg
+}
+
+// checkFIPSConfig fails when the keys section of the OPA configuration bs,
+// which verifies the signatures of bundles, holds keys that are not FIPS
+// approved: algorithms other than RSA, ECDSA and HMAC with SHA-2, RSA keys
+// below 2048 bits, ECDSA keys on another curve than the algorithm's, and HMAC
+// secrets shorter than their hash.
+func checkFIPSConfig(bs []byte) error {
+
+	var cfg struct {
+		Keys map[string]struct {
+			Algorithm string `json:"algorithm"`
+			Key       string `json:"key"`
+		} `json:"keys"`
+	}
+	if err := yaml.Unmarshal(bs, &cfg); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(cfg.Keys))
+	for name := range cfg.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		key := cfg.Keys[name]
+		if err := checkFIPSJWTKey(key.Algorithm, key.Key); err != nil {
+			problems = append(problems, fmt.Sprintf("keys.%s: %v", name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("FIPS mode: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// checkFIPSJWTKey fails unless key, a PEM encoded public key or certificate,
+// or an HMAC secret, is FIPS approved for the JWT algorithm alg, RS256 when
+// empty, as for OPA.
+func checkFIPSJWTKey(alg, key string) error {
+
+	if alg == "" {
+		alg = "RS256"
+	}
+
+	if size, ok := fipsHMACKeySizes[alg]; ok {
+		if len(key) < size {
+			return fmt.Errorf("%s secrets must be at least %d bytes long", alg, size)
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") && fipsCurves[alg] == nil {
+		return fmt.Errorf("the %s algorithm is not FIPS approved", alg)
+	}
+
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return fmt.Errorf("no PEM encoded public key found")
+	}
+
+	var pub crypto.PublicKey
+	var err error
+	if block.Type == "CERTIFICATE" {
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	} else {
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	return checkFIPSAlgorithmKey(alg, pub)
+}
+
+// checkFIPSAlgorithmKey fails unless pub is FIPS approved, and of the type,
+// and for ECDSA the curve, of the JWT algorithm alg.
+func checkFIPSAlgorithmKey(alg string, pub crypto.PublicKey) error {
+
+	if err := checkFIPSKey(pub); err != nil {
+		return err
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if fipsCurves[alg] != nil {
+			return fmt.Errorf("%s requires an ECDSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		curve := fipsCurves[alg]
+		if curve == nil {
+			return fmt.Errorf("%s requires an RSA key", alg)
+		}
+		if curve != k.Curve {
+			return fmt.Errorf("%s requires an ECDSA key on %s", alg, curve.Params().Name)
+		}
+	}
+
+	return nil
+}
+
+// checkFIPSVerifyKey fails unless key, a PEM encoded public key or
+// certificate, or a JWK or JWK set, as taken by the JWT builtins, holds keys
+// FIPS approved for the JWT algorithm alg.
+func checkFIPSVerifyKey(alg, key string) error {
+
+	if !strings.HasPrefix(strings.TrimSpace(key), "{") {
+		return checkFIPSJWTKey(alg, key)
+	}
+
+	type jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(key), &set); err != nil {
+		return err
+	}
+	if len(set.Keys) == 0 {
+		var k jwk
+		if err := json.Unmarshal([]byte(key), &k); err != nil {
+			return err
+		}
+		set.Keys = []jwk{k}
+	}
+
+	for _, k := range set.Keys {
+		var pub crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+			if err != nil {
+				return err
+			}
+			pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n)}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				return fmt.Errorf("ECDSA keys on %s are not FIPS approved", k.Crv)
+			}
+			pub = &ecdsa.PublicKey{Curve: curve}
+		default:
+			return fmt.Errorf("%s keys are not FIPS approved", k.Kty)
+		}
+		if err := checkFIPSAlgorithmKey(alg, pub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The JWT builtins check, in FIPS mode, that their key is FIPS approved for
+// their algorithm: that HMAC secrets are as long as their hash, RSA keys at
+// least 2048 bits long, and ECDSA keys on the curve of the algorithm.
+func init() {
+
+	for _, b := range []struct {
+		builtin *ast.Builtin
+		alg     string
+	}{
+		{ast.JWTVerifyHS256, "HS256"},
+		{ast.JWTVerifyHS384, "HS384"},
+		{ast.JWTVerifyHS512, "HS512"},
+	} {
+		verify, alg := topdown.GetBuiltin(b.builtin.Name), b.alg
+		topdown.RegisterBuiltinFunc(b.builtin.Name, func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			if fipsMode {
+				if secret, ok := operands[1].Value.(ast.String); ok && len(secret) < fipsHMACKeySizes[alg] {
+					return fmt.Errorf("FIPS mode: %s secrets must be at least %d bytes long", alg, fipsHMACKeySizes[alg])
+				}
+			}
+			return verify(bctx, operands, iter)
+		})
+	}
+
+	for _, b := range []struct {
+		builtin *ast.Builtin
+		alg     string
+	}{
+		{ast.JWTVerifyRS256, "RS256"},
+		{ast.JWTVerifyRS384, "RS384"},
+		{ast.JWTVerifyRS512, "RS512"},
+		{ast.JWTVerifyPS256, "PS256"},
+		{ast.JWTVerifyPS384, "PS384"},
+		{ast.JWTVerifyPS512, "PS512"},
+		{ast.JWTVerifyES256, "ES256"},
+		{ast.JWTVerifyES384, "ES384"},
+		{ast.JWTVerifyES512, "ES512"},
+	} {
+		verify, alg := topdown.GetBuiltin(b.builtin.Name), b.alg
+		topdown.RegisterBuiltinFunc(b.builtin.Name, func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			if fipsMode {
+				if key, ok := operands[1].Value.(ast.String); ok {
+					if err := checkFIPSVerifyKey(alg, string(key)); err != nil {
+						return fmt.Errorf("FIPS mode: %w", err)
+					}
+				}
+			}
+			return verify(bctx, operands, iter)
+		})
+	}
+
+	decodeVerify := topdown.GetBuiltin(ast.JWTDecodeVerify.Name)
+	topdown.RegisterBuiltinFunc(ast.JWTDecodeVerify.Name, func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+		if fipsMode {
+			if err := checkFIPSDecodeVerify(operands); err != nil {
+				return err
+			}
+		}
+		return decodeVerify(bctx, operands, iter)
+	})
+}
+
+// checkFIPSDecodeVerify checks the secret or the certificate given to
+// io.jwt.decode_verify against the algorithm of the token.
+func checkFIPSDecodeVerify(operands []*ast.Term) error {
+
+	token, ok := operands[0].Value.(ast.String)
+	if !ok {
+		return nil
+	}
+	constraints, ok := operands[1].Value.(ast.Object)
+	if !ok {
+		return nil
+	}
+
+	encoded, _, _ := strings.Cut(string(token), ".")
+	bs, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(bs, &header); err != nil {
+		return nil
+	}
+
+	if term := constraints.Get(ast.StringTerm("secret")); term != nil {
+		secret, ok := term.Value.(ast.String)
+		if size, hmac := fipsHMACKeySizes[header.Alg]; ok && hmac && len(secret) < size {
+			return fmt.Errorf("FIPS mode: %s secrets must be at least %d bytes long", header.Alg, size)
+		}
+	}
+
+	if term := constraints.Get(ast.StringTerm("cert")); term != nil {
+		cert, ok := term.Value.(ast.String)
+		if _, hmac := fipsHMACKeySizes[header.Alg]; ok && !hmac {
+			if err := checkFIPSVerifyKey(header.Alg, string(cert)); err != nil {
+				return fmt.Errorf("FIPS mode: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
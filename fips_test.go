@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func testPublicKeyPEM(t *testing.T, pub interface{}) string {
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestCheckFIPSKey(t *testing.T) {
+
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		note string
+		pub  interface{}
+		ok   bool
+	}{
+		{"rsa 1024", &rsa1024.PublicKey, false},
+		{"rsa 2048", &rsa2048.PublicKey, true},
+		{"p-256", &p256.PublicKey, true},
+		{"p-224", &p224.PublicKey, false},
+		{"ed25519", ed, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			if err := checkFIPSKey(tc.pub); (err == nil) != tc.ok {
+				t.Fatalf("Expected ok %v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckFIPSConfig(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM, ecPEM := testPublicKeyPEM(t, &rsaKey.PublicKey), testPublicKeyPEM(t, &p256.PublicKey)
+
+	keys := func(alg, key string) []byte {
+		return []byte(fmt.Sprintf("keys:\n  global:\n    algorithm: %s\n    key: %q\n", alg, key))
+	}
+
+	tests := []struct {
+		note    string
+		config  []byte
+		problem string
+	}{
+		{"no keys", []byte("bundles: {}\n"), ""},
+		{"rs256", keys("RS256", rsaPEM), ""},
+		{"default algorithm", []byte(fmt.Sprintf("keys:\n  global:\n    key: %q\n", rsaPEM)), ""},
+		{"es256", keys("ES256", ecPEM), ""},
+		{"hs256", keys("HS256", strings.Repeat("s", 32)), ""},
+		{"short hs256 secret", keys("HS256", "secret"), "HS256 secrets must be at least 32 bytes long"},
+		{"eddsa", keys("EdDSA", ecPEM), "the EdDSA algorithm is not FIPS approved"},
+		{"wrong curve", keys("ES384", ecPEM), "ES384 requires an ECDSA key on P-384"},
+		{"ecdsa key for rsa", keys("RS256", ecPEM), "RS256 requires an RSA key"},
+		{"rsa key for ecdsa", keys("ES256", rsaPEM), "ES256 requires an ECDSA key"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			err := checkFIPSConfig(tc.config)
+			if tc.problem == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "keys.global: "+tc.problem) {
+				t.Fatalf("Expected %q, got %v", tc.problem, err)
+			}
+		})
+	}
+}
+
+func TestFIPSJWTBuiltins(t *testing.T) {
+
+	fipsMode = true
+	defer func() { fipsMode = false }()
+
+	long := strings.Repeat("s", 32)
+
+	tests := []struct {
+		note  string
+		query string
+		err   string
+	}{
+		{
+			note:  "short secret",
+			query: `io.jwt.verify_hs256("a.b.c", "secret")`,
+			err:   "HS256 secrets must be at least 32 bytes long",
+		},
+		{
+			note:  "short secret hs512",
+			query: fmt.Sprintf(`io.jwt.verify_hs512("a.b.c", %q)`, long),
+			err:   "HS512 secrets must be at least 64 bytes long",
+		},
+		{
+			note:  "long secret",
+			query: fmt.Sprintf(`t := io.jwt.encode_sign({"alg": "HS256"}, {"sub": "alice"}, {"kty": "oct", "k": base64url.encode_no_pad(%q)}); io.jwt.verify_hs256(t, %q)`, long, long),
+		},
+		{
+			note:  "decode_verify short secret",
+			query: `t := io.jwt.encode_sign({"alg": "HS256"}, {"sub": "alice"}, {"kty": "oct", "k": base64url.encode_no_pad("secret")}); io.jwt.decode_verify(t, {"secret": "secret"})`,
+			err:   "HS256 secrets must be at least 32 bytes long",
+		},
+		{
+			note:  "decode_verify long secret",
+			query: fmt.Sprintf(`t := io.jwt.encode_sign({"alg": "HS256"}, {"sub": "alice"}, {"kty": "oct", "k": base64url.encode_no_pad(%q)}); [true, _, _] = io.jwt.decode_verify(t, {"secret": %q})`, long, long),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			rs, err := rego.New(rego.Query(tc.query), rego.StrictBuiltinErrors(true)).Eval(context.Background())
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs) != 1 {
+				t.Fatalf("Expected the token to be verified, got %v", rs)
+			}
+		})
+	}
+}
+
+// testJWT returns a token signed by sign, given the SHA-256 digest of its
+// signing input.
+func testJWT(t *testing.T, alg string, sign func(digest []byte) ([]byte, error)) string {
+
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`))
+	digest := sha256.Sum256([]byte(input))
+	sig, err := sign(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestFIPSJWTAsymmetricBuiltins(t *testing.T) {
+
+	fipsMode = true
+	defer func() { fipsMode = false }()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256 := testJWT(t, "RS256", func(digest []byte) ([]byte, error) {
+		return rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+	})
+	es256 := testJWT(t, "ES256", func(digest []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest)
+		if err != nil {
+			return nil, err
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), nil
+	})
+
+	ecJWKS := fmt.Sprintf(`{"keys": [{"kty": "EC", "crv": "P-256", "x": %q, "y": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))))
+	weakJWK := fmt.Sprintf(`{"kty": "RSA", "n": %q, "e": "AQAB"}`, base64.RawURLEncoding.EncodeToString(weakKey.N.Bytes()))
+
+	tests := []struct {
+		note  string
+		query string
+		err   string
+	}{
+		{
+			note:  "rsa",
+			query: fmt.Sprintf(`io.jwt.verify_rs256(%q, %q)`, rs256, testPublicKeyPEM(t, &rsaKey.PublicKey)),
+		},
+		{
+			note:  "weak rsa",
+			query: fmt.Sprintf(`io.jwt.verify_rs256(%q, %q)`, rs256, testPublicKeyPEM(t, &weakKey.PublicKey)),
+			err:   "1024 bit RSA keys are not FIPS approved",
+		},
+		{
+			note:  "weak rsa jwk",
+			query: fmt.Sprintf(`io.jwt.verify_ps512(%q, %q)`, rs256, weakJWK),
+			err:   "1024 bit RSA keys are not FIPS approved",
+		},
+		{
+			note:  "ed25519",
+			query: fmt.Sprintf(`io.jwt.verify_ps256(%q, %q)`, rs256, testPublicKeyPEM(t, edPub)),
+			err:   "ed25519 keys are not FIPS approved",
+		},
+		{
+			note:  "ecdsa jwks",
+			query: fmt.Sprintf(`io.jwt.verify_es256(%q, %q)`, es256, ecJWKS),
+		},
+		{
+			note:  "ecdsa curve",
+			query: fmt.Sprintf(`io.jwt.verify_es256(%q, %q)`, es256, testPublicKeyPEM(t, &p384Key.PublicKey)),
+			err:   "ES256 requires an ECDSA key on P-256",
+		},
+		{
+			note:  "ecdsa rsa key",
+			query: fmt.Sprintf(`io.jwt.verify_es384(%q, %q)`, es256, testPublicKeyPEM(t, &rsaKey.PublicKey)),
+			err:   "ES384 requires an ECDSA key",
+		},
+		{
+			note:  "decode_verify weak rsa",
+			query: fmt.Sprintf(`io.jwt.decode_verify(%q, {"cert": %q})`, rs256, testPublicKeyPEM(t, &weakKey.PublicKey)),
+			err:   "1024 bit RSA keys are not FIPS approved",
+		},
+		{
+			note:  "decode_verify rsa",
+			query: fmt.Sprintf(`[true, _, _] = io.jwt.decode_verify(%q, {"cert": %q})`, rs256, testPublicKeyPEM(t, &rsaKey.PublicKey)),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			rs, err := rego.New(rego.Query(tc.query), rego.StrictBuiltinErrors(true)).Eval(context.Background())
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rs) != 1 || fmt.Sprint(rs[0].Expressions[0].Value) != "true" {
+				t.Fatalf("Expected the token to be verified, got %v", rs)
+			}
+		})
+	}
+}
+
+func TestFIPSTLSConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestKeyPair(t, certFile, keyFile, 1, time.Now())
+
+	files, err := newTLSFiles(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg := files.config(); cfg.MaxVersion != 0 || cfg.CipherSuites != nil {
+		t.Fatalf("Expected the default configuration outside FIPS mode, got %v, %v", cfg.MaxVersion, cfg.CipherSuites)
+	}
+
+	fipsMode = true
+	defer func() { fipsMode = false }()
+
+	cfg := files.config()
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("Expected TLS 1.2 only, got %v-%v", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) != len(fipsCipherSuites) {
+		t.Fatalf("Expected the FIPS cipher suites, got %v", cfg.CipherSuites)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/format"
+)
+
+// regoFiles returns the .rego files found at paths, which are files or
+// directories walked recursively, in lexical order.
+func regoFiles(paths []string) ([]string, error) {
+
+	var files []string
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == root && !d.IsDir() || !d.IsDir() && strings.HasSuffix(path, ".rego") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// runFmt implements the fmt subcommand, which formats policies as opa fmt
+// does. Given -w, files not formatted are rewritten, and given -check, they
+// are listed and the exit code is 1. Otherwise the formatted source of every
+// file is printed.
+func runFmt(args []string) int {
+	return formatPolicies(os.Stdout, os.Stderr, args)
+}
+
+func formatPolicies(stdout, stderr io.Writer, args []string) int {
+
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	write := fs.Bool("w", false, "rewrite the files not formatted, listing them")
+	check := fs.Bool("check", false, "list the files not formatted without rewriting them, exiting with 1 if any")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 || *write && *check {
+		_, _ = fmt.Fprintln(stderr, "usage: opa-docker-authz fmt [-w | -check] <file or directory>...")
+		return 2
+	}
+
+	files, err := regoFiles(fs.Args())
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	failed, unformatted := false, false
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			failed = true
+			continue
+		}
+
+		formatted, err := format.Source(file, src)
+		if err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			failed = true
+			continue
+		}
+
+		switch {
+		case *write:
+			if bytes.Equal(src, formatted) {
+				continue
+			}
+			if err := os.WriteFile(file, formatted, 0644); err != nil {
+				_, _ = fmt.Fprintln(stderr, err)
+				failed = true
+				continue
+			}
+			_, _ = fmt.Fprintln(stdout, file)
+		case *check:
+			if !bytes.Equal(src, formatted) {
+				_, _ = fmt.Fprintln(stdout, file)
+				unformatted = true
+			}
+		default:
+			_, _ = stdout.Write(formatted)
+		}
+	}
+
+	switch {
+	case failed:
+		return 2
+	case unformatted:
+		return 1
+	}
+
+	return 0
+}
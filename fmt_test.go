@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const unformattedPolicy = `package docker.authz
+default allow=false
+allow { input.User=="alice" }
+`
+
+const formattedPolicy = `package docker.authz
+
+default allow = false
+
+allow {
+	input.User == "alice"
+}
+`
+
+func TestFmt(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "team"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"authz.rego":      formattedPolicy,
+		"team/authz.rego": unformattedPolicy,
+		"data.json":       "{}",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unformatted := filepath.Join(dir, "team", "authz.rego")
+
+	var stdout, stderr bytes.Buffer
+	if code := formatPolicies(&stdout, &stderr, []string{"-check", dir}); code != 1 {
+		t.Fatalf("Expected exit code 1, got %d: %s", code, stderr.String())
+	}
+	if got := strings.TrimSpace(stdout.String()); got != unformatted {
+		t.Fatalf("Expected %s to be listed, got %q", unformatted, got)
+	}
+
+	stdout.Reset()
+	if code := formatPolicies(&stdout, &stderr, []string{unformatted}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if got := stdout.String(); got != formattedPolicy {
+		t.Fatalf("Expected the formatted source, got %q", got)
+	}
+
+	stdout.Reset()
+	if code := formatPolicies(&stdout, &stderr, []string{"-w", dir}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if got := strings.TrimSpace(stdout.String()); got != unformatted {
+		t.Fatalf("Expected %s to be rewritten, got %q", unformatted, got)
+	}
+	bs, err := os.ReadFile(unformatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != formattedPolicy {
+		t.Fatalf("Expected %q, got %q", formattedPolicy, bs)
+	}
+
+	stdout.Reset()
+	if code := formatPolicies(&stdout, &stderr, []string{"-check", dir}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stdout.String())
+	}
+}
+
+func TestFmtLibrary(t *testing.T) {
+
+	var stdout, stderr bytes.Buffer
+	if code := formatPolicies(&stdout, &stderr, []string{"-check", "library"}); code != 0 {
+		t.Fatalf("Expected the policy library to be formatted, got exit code %d: %s%s", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestFmtErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.rego"), []byte("package\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{nil, {"-w", "-check", dir}, {"-check", dir}, {filepath.Join(dir, "missing")}} {
+		if code := formatPolicies(&stdout, &stderr, args); code != 2 {
+			t.Errorf("Expected exit code 2 for %v, got %d", args, code)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// GPU request sources of the input.gpus document.
+const (
+	gpuSourceDeviceRequest = "device_request"
+	gpuSourceRuntime       = "nvidia_runtime"
+	gpuSourceDeviceMapping = "device_mapping"
+)
+
+// cdiGPUPrefix is the prefix of the Container Device Interface names of
+// NVIDIA GPUs.
+const cdiGPUPrefix = "nvidia.com/gpu="
+
+// nvidiaDevicePath matches the device nodes of NVIDIA GPUs, e.g.
+// /dev/nvidia0, as opposed to control nodes such as /dev/nvidiactl.
+var nvidiaDevicePath = regexp.MustCompile(`^/dev/nvidia([0-9]+)$`)
+
+// GPURequest is the input.gpus document, normalizing the GPUs a container
+// create request asks for, whichever way they are requested: --gpus, which
+// sends DeviceRequests, the NVIDIA container runtime with
+// NVIDIA_VISIBLE_DEVICES, or device mappings of /dev/nvidiaN.
+type GPURequest struct {
+	// All is true when all GPUs of the host are requested.
+	All bool `json:"all"`
+
+	// Count is the number of GPUs requested, or -1 when All is true.
+	Count int `json:"count"`
+
+	// DeviceIDs lists the GPUs requested by index or UUID, e.g. 0 or
+	// GPU-3a23c669-1f69-c64e-cf85-44e9b07e7a2a.
+	DeviceIDs []string `json:"device_ids"`
+
+	// Capabilities lists the driver capabilities requested, e.g. compute,
+	// utility or video.
+	Capabilities []string `json:"capabilities"`
+
+	// Drivers lists the device drivers named by device requests.
+	Drivers []string `json:"drivers"`
+
+	// Sources lists the ways the GPUs are requested.
+	Sources []string `json:"sources"`
+}
+
+// requestedGPUs returns the GPUs requested by container create requests, or
+// nil when none are.
+func requestedGPUs(method, path string, body map[string]interface{}, env map[string]string) *GPURequest {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+
+	gpus := &GPURequest{DeviceIDs: []string{}, Capabilities: []string{}, Drivers: []string{}, Sources: []string{}}
+	ids := map[string]bool{}
+	capabilities := map[string]bool{}
+	drivers := map[string]bool{}
+	sources := map[string]bool{}
+
+	for _, device := range listDevices(body) {
+		switch {
+		case device.Kind == deviceKindRequested && isGPURequest(device):
+			sources[gpuSourceDeviceRequest] = true
+			if device.Driver != "" {
+				drivers[device.Driver] = true
+			}
+			for _, set := range device.Capabilities {
+				for _, c := range set {
+					if c != "gpu" {
+						capabilities[c] = true
+					}
+				}
+			}
+			switch {
+			case len(device.DeviceIDs) > 0:
+				for _, id := range device.DeviceIDs {
+					// CDI names GPUs nvidia.com/gpu=<index, UUID or all>.
+					if strings.HasPrefix(id, cdiGPUPrefix) {
+						id = strings.TrimPrefix(id, cdiGPUPrefix)
+					}
+					if id == "all" {
+						gpus.All = true
+					} else {
+						ids[id] = true
+					}
+				}
+			case device.Count < 0:
+				gpus.All = true
+			default:
+				gpus.Count += device.Count
+			}
+		case device.Kind == deviceKindMapping:
+			if m := nvidiaDevicePath.FindStringSubmatch(device.HostPath); m != nil {
+				sources[gpuSourceDeviceMapping] = true
+				ids[m[1]] = true
+			}
+		}
+	}
+
+	if runtime, _ := hostConfig["Runtime"].(string); runtime == "nvidia" {
+		switch visible := strings.TrimSpace(env["NVIDIA_VISIBLE_DEVICES"]); visible {
+		case "", "none", "void":
+		case "all":
+			sources[gpuSourceRuntime] = true
+			gpus.All = true
+		default:
+			sources[gpuSourceRuntime] = true
+			for _, id := range splitList(visible) {
+				ids[id] = true
+			}
+		}
+		if sources[gpuSourceRuntime] {
+			for _, c := range splitList(env["NVIDIA_DRIVER_CAPABILITIES"]) {
+				capabilities[c] = true
+			}
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	gpus.DeviceIDs = sortedSet(ids)
+	gpus.Capabilities = sortedSet(capabilities)
+	gpus.Drivers = sortedSet(drivers)
+	gpus.Sources = sortedSet(sources)
+
+	gpus.Count += len(gpus.DeviceIDs)
+	if gpus.All {
+		gpus.Count = -1
+	}
+
+	return gpus
+}
+
+// isGPURequest reports whether a device request asks for GPUs: it names the
+// gpu capability, as --gpus does, the nvidia driver, or NVIDIA GPUs through
+// the Container Device Interface.
+func isGPURequest(device Device) bool {
+
+	if device.Driver == "nvidia" {
+		return true
+	}
+
+	for _, set := range device.Capabilities {
+		for _, c := range set {
+			if c == "gpu" {
+				return true
+			}
+		}
+	}
+
+	for _, id := range device.DeviceIDs {
+		if strings.HasPrefix(id, cdiGPUPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedSet(set map[string]bool) []string {
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRequestedGPUs(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected *GPURequest
+	}{
+		{
+			name:     "none",
+			body:     `{"HostConfig": {"Devices": [{"PathOnHost": "/dev/fuse"}]}}`,
+			expected: nil,
+		},
+		{
+			name: "all gpus",
+			body: `{"HostConfig": {"DeviceRequests": [{"Driver": "", "Count": -1, "Capabilities": [["gpu"]]}]}}`,
+			expected: &GPURequest{
+				All: true, Count: -1, DeviceIDs: []string{}, Capabilities: []string{}, Drivers: []string{},
+				Sources: []string{gpuSourceDeviceRequest},
+			},
+		},
+		{
+			name: "count and capabilities",
+			body: `{"HostConfig": {"DeviceRequests": [{"Driver": "nvidia", "Count": 2, "Capabilities": [["gpu", "compute", "utility"]]}]}}`,
+			expected: &GPURequest{
+				Count: 2, DeviceIDs: []string{}, Capabilities: []string{"compute", "utility"}, Drivers: []string{"nvidia"},
+				Sources: []string{gpuSourceDeviceRequest},
+			},
+		},
+		{
+			name: "device ids",
+			body: `{"HostConfig": {"DeviceRequests": [{"DeviceIDs": ["0", "GPU-3a23c669"], "Capabilities": [["gpu"]]}]}}`,
+			expected: &GPURequest{
+				Count: 2, DeviceIDs: []string{"0", "GPU-3a23c669"}, Capabilities: []string{}, Drivers: []string{},
+				Sources: []string{gpuSourceDeviceRequest},
+			},
+		},
+		{
+			name: "cdi",
+			body: `{"HostConfig": {"DeviceRequests": [{"Driver": "cdi", "DeviceIDs": ["nvidia.com/gpu=1"]}]}}`,
+			expected: &GPURequest{
+				Count: 1, DeviceIDs: []string{"1"}, Capabilities: []string{}, Drivers: []string{"cdi"},
+				Sources: []string{gpuSourceDeviceRequest},
+			},
+		},
+		{
+			name:     "other device request",
+			body:     `{"HostConfig": {"DeviceRequests": [{"Driver": "cdi", "DeviceIDs": ["vendor.com/fpga=0"]}]}}`,
+			expected: nil,
+		},
+		{
+			name: "nvidia runtime",
+			body: `{"Env": ["NVIDIA_VISIBLE_DEVICES=0,1", "NVIDIA_DRIVER_CAPABILITIES=compute,utility"], "HostConfig": {"Runtime": "nvidia"}}`,
+			expected: &GPURequest{
+				Count: 2, DeviceIDs: []string{"0", "1"}, Capabilities: []string{"compute", "utility"}, Drivers: []string{},
+				Sources: []string{gpuSourceRuntime},
+			},
+		},
+		{
+			name:     "nvidia runtime without devices",
+			body:     `{"Env": ["NVIDIA_VISIBLE_DEVICES=none"], "HostConfig": {"Runtime": "nvidia"}}`,
+			expected: nil,
+		},
+		{
+			name: "device mappings and runtime",
+			body: `{"Env": ["NVIDIA_VISIBLE_DEVICES=all"], "HostConfig": {"Runtime": "nvidia", "Devices": [{"PathOnHost": "/dev/nvidia3"}, {"PathOnHost": "/dev/nvidiactl"}]}}`,
+			expected: &GPURequest{
+				All: true, Count: -1, DeviceIDs: []string{"3"}, Capabilities: []string{}, Drivers: []string{},
+				Sources: []string{gpuSourceDeviceMapping, gpuSourceRuntime},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			env := requestedEnv("POST", "/v1.41/containers/create", body)
+			got := requestedGPUs("POST", "/v1.41/containers/create", body, env)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	if got := requestedGPUs("POST", "/v1.41/containers/abc/exec", map[string]interface{}{"Env": []interface{}{"NVIDIA_VISIBLE_DEVICES=all"}}, nil); got != nil {
+		t.Fatalf("Expected no GPUs for other requests, got %+v", got)
+	}
+}
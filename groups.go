@@ -0,0 +1,164 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+)
+
+// groupResolver looks up the groups of requesting users in the host's group
+// database, caching results for ttl.
+//
+// Static builds of the plugin resolve users from /etc/passwd and /etc/group
+// only. Users that are not found there are looked up with getent, when it is
+// available, so that directory-backed users (e.g. through SSSD) resolve too.
+type groupResolver struct {
+	cache  *lookupCache
+	getent string
+}
+
+func newGroupResolver(ttl time.Duration) *groupResolver {
+	g := &groupResolver{cache: newLookupCache(ttl)}
+	if path, err := exec.LookPath("getent"); err == nil {
+		g.getent = path
+	}
+	return g
+}
+
+// groups returns the sorted names of the groups of name, or nil when the
+// user is unknown or the lookup failed.
+func (g *groupResolver) groups(ctx context.Context, name string) []string {
+
+	if g == nil || name == "" {
+		return nil
+	}
+
+	v, err := g.cache.get(name, func() (interface{}, error) {
+		groups, err := lookupUserGroups(name)
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) && g.getent != "" {
+			groups, err = g.lookupGetent(ctx, name)
+		}
+		if errors.As(err, &unknown) {
+			return []string(nil), nil
+		}
+		return groups, err
+	})
+	if err != nil {
+		log.Printf("Failed to look up groups of user %s: %v", name, err)
+		return nil
+	}
+
+	return v.([]string)
+}
+
+func lookupUserGroups(name string) ([]string, error) {
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if grp, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, grp.Name)
+		}
+	}
+
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// lookupGetent resolves the groups of name with "getent initgroups", which
+// lists the user's group IDs, and "getent group", which names them.
+func (g *groupResolver) lookupGetent(ctx context.Context, name string) ([]string, error) {
+
+	// initgroups does not fail for unknown users, and leaves out the
+	// primary group.
+	passwd, err := runGetent(ctx, g.getent, "passwd", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var primary string
+	if fields := strings.Split(strings.TrimSpace(passwd), ":"); len(fields) > 3 {
+		primary = fields[3]
+	}
+
+	out, err := runGetent(ctx, g.getent, "initgroups", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return nil, user.UnknownUserError(name)
+	}
+
+	gids := fields[1:]
+	if primary != "" {
+		gids = append(gids, primary)
+	}
+	if len(gids) == 0 {
+		return []string{}, nil
+	}
+
+	// Groups that no longer exist are left out of the output.
+	out, err = runGetent(ctx, g.getent, append([]string{"group"}, gids...)...)
+	var unknown user.UnknownUserError
+	if err != nil && !errors.As(err, &unknown) {
+		return nil, err
+	}
+
+	groups := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if grp, _, ok := strings.Cut(line, ":"); ok && !seen[grp] {
+			seen[grp] = true
+			groups = append(groups, grp)
+		}
+	}
+
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// runGetent runs getent with args. Keys that are not found are reported as
+// user.UnknownUserError, along with the output for the keys that were.
+func runGetent(ctx context.Context, getent string, args ...string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, getent, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		// getent exits with 2 when a key is not found.
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 2 {
+			return stdout.String(), user.UnknownUserError(args[len(args)-1])
+		}
+		return "", fmt.Errorf("getent %s: %w", args[0], err)
+	}
+
+	return stdout.String(), nil
+}
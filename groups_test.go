@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"os/user"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupResolver(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	expected, err := lookupUserGroups(current.Username)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	g := newGroupResolver(time.Minute)
+
+	if groups := g.groups(context.Background(), current.Username); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected %v, got %v", expected, groups)
+	}
+
+	if groups := g.groups(context.Background(), "no-such-user-opa-docker-authz"); groups != nil {
+		t.Errorf("Expected no groups, got %v", groups)
+	}
+
+	if groups := g.groups(context.Background(), ""); groups != nil {
+		t.Errorf("Expected no groups, got %v", groups)
+	}
+}
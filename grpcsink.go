@@ -0,0 +1,282 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// grpcExportMethod is the method of the DecisionExport service defined in
+	// proto/decision_export.proto.
+	grpcExportMethod = "/opa_docker_authz.export.v1.DecisionExport/Export"
+
+	// grpcExportMessageSize bounds the size of an ExportRequest, below the
+	// default 4MB limit of gRPC servers. Larger batches are split into
+	// several requests of the same stream.
+	grpcExportMessageSize = 1 << 20
+
+	// grpcExportTimeout bounds a call of Export.
+	grpcExportTimeout = time.Minute
+)
+
+// grpcSink batches decision records and streams them to a collector
+// implementing the DecisionExport service. The events are encoded by hand,
+// as for the SPIFFE Workload API, so that no generated stubs are needed.
+type grpcSink struct {
+	conn  *grpc.ClientConn
+	batch decisionBatch
+}
+
+// grpcSinkConfig holds the settings of the gRPC decision exporter.
+type grpcSinkConfig struct {
+	addr     string
+	insecure bool
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+// newGRPCSink returns a sink exporting decisions to the collector at
+// cfg.addr, e.g. collector.example.com:4317. The connection is established
+// lazily and kept across flushes.
+func newGRPCSink(cfg grpcSinkConfig) (*grpcSink, error) {
+
+	creds := insecure.NewCredentials()
+	if !cfg.insecure {
+		tlsConfig, err := clientTLSConfig(cfg.caFile, cfg.certFile, cfg.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.Dial(cfg.addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcSink{conn: conn, batch: decisionBatch{name: "gRPC collector"}}, nil
+}
+
+// record adds entry to the next batch.
+func (s *grpcSink) record(entry interface{}) {
+
+	if s == nil {
+		return
+	}
+
+	bs, err := encodeDecisionEvent(entry)
+	if err != nil {
+		log.Printf("Failed to encode decision for gRPC collector: %v", err)
+		return
+	}
+
+	s.batch.add(bs)
+}
+
+// start sends the batch on every interval until ctx is done.
+func (s *grpcSink) start(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, "gRPC collector", interval, s.flush)
+}
+
+// flush streams the pending decisions in a single call of Export. When the
+// call fails, the decisions are kept for the next flush. Decisions rejected
+// by a collector that answers are not sent again.
+func (s *grpcSink) flush(ctx context.Context) error {
+
+	if s == nil {
+		return nil
+	}
+
+	batch := s.batch.take()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	accepted, err := s.export(ctx, batch)
+	if err != nil {
+		s.batch.requeue(batch)
+		return err
+	}
+
+	if accepted < uint64(len(batch)) {
+		log.Printf("gRPC collector accepted %d of %d decisions", accepted, len(batch))
+	}
+
+	return nil
+}
+
+// export calls Export with the encoded events, returning the number of
+// events the collector accepted.
+func (s *grpcSink) export(ctx context.Context, events [][]byte) (uint64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, grpcExportTimeout)
+	defer cancel()
+
+	stream, err := s.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, grpcExportMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return 0, err
+	}
+
+	var req []byte
+	for i, event := range events {
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, event)
+		if i == len(events)-1 || len(req)+len(events[i+1])+16 > grpcExportMessageSize {
+			if err := stream.SendMsg(&req); err != nil {
+				return 0, err
+			}
+			req = nil
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return 0, err
+	}
+
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		return 0, err
+	}
+
+	return parseExportResponse(resp)
+}
+
+// stop closes the connection to the collector.
+func (s *grpcSink) stop() error {
+
+	if s == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
+// grpcSinkAdapter adapts the gRPC sink to the Sink interface, closing the
+// connection when stopped.
+type grpcSinkAdapter struct {
+	intervalSink
+	sink *grpcSink
+}
+
+func (s grpcSinkAdapter) Stop(ctx context.Context) error {
+
+	err := s.intervalSink.Stop(ctx)
+	if closeErr := s.sink.stop(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// encodeDecisionEvent encodes a decision record as a DecisionEvent message.
+func encodeDecisionEvent(entry interface{}) ([]byte, error) {
+
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		DecisionID string            `json:"decision_id"`
+		Timestamp  string            `json:"timestamp"`
+		Labels     map[string]string `json:"labels"`
+		Result     bool              `json:"result"`
+		Code       string            `json:"code"`
+		Error      string            `json:"error"`
+		Input      json.RawMessage   `json:"input"`
+	}
+	if err := json.Unmarshal(bs, &event); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	appendString := func(num protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+
+	appendString(1, event.DecisionID)
+
+	if t, err := time.Parse(time.RFC3339Nano, event.Timestamp); err == nil {
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+		ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(t.Nanosecond()))
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	keys := make([]string, 0, len(event.Labels))
+	for k := range event.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		kv = protowire.AppendString(kv, event.Labels[k])
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, kv)
+	}
+
+	if event.Result {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+
+	appendString(5, event.Code)
+	appendString(6, event.Error)
+
+	if len(event.Input) > 0 && string(event.Input) != "null" {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, event.Input)
+	}
+
+	return b, nil
+}
+
+// parseExportResponse returns the accepted field of an ExportResponse.
+func parseExportResponse(bs []byte) (uint64, error) {
+
+	var accepted uint64
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(bs)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			accepted, bs = v, bs[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, bs)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		bs = bs[n:]
+	}
+
+	return accepted, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestGRPCSink(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var received []map[protowire.Number]string
+	fail := true
+
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != grpcExportMethod {
+			t.Errorf("Unexpected method %v", method)
+		}
+		var count uint64
+		for {
+			var req []byte
+			err := stream.RecvMsg(&req)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			err = forEachField(req, func(_ protowire.Number, event []byte) error {
+				fields := map[protowire.Number]string{}
+				err := forEachField(event, func(num protowire.Number, v []byte) error {
+					fields[num] = string(v)
+					return nil
+				})
+				count++
+				mu.Lock()
+				received = append(received, fields)
+				mu.Unlock()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			fail = false
+			received = nil
+			return io.ErrUnexpectedEOF
+		}
+		resp := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), count)
+		return stream.SendMsg(&resp)
+	}))
+	go func() { _ = server.Serve(l) }()
+	defer server.Stop()
+
+	sink, err := newGRPCSink(grpcSinkConfig{addr: l.Addr().String(), insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.stop()
+
+	sink.record(map[string]interface{}{
+		"decision_id": "d1",
+		"timestamp":   "2023-02-01T10:00:00.5Z",
+		"labels":      map[string]string{"id": "host-1"},
+		"input":       map[string]interface{}{"User": "alice"},
+		"result":      true,
+	})
+	sink.record(map[string]interface{}{
+		"decision_id": "d2",
+		"timestamp":   "2023-02-01T10:00:01Z",
+		"result":      false,
+		"code":        "privileged",
+	})
+
+	ctx := context.Background()
+	if err := sink.flush(ctx); err == nil {
+		t.Fatal("Expected the first export to fail")
+	}
+	if err := sink.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 decisions, got %d", len(received))
+	}
+	if received[0][1] != "d1" || received[0][7] != `{"User":"alice"}` {
+		t.Fatalf("Unexpected first decision %v", received[0])
+	}
+	if received[1][1] != "d2" || received[1][5] != "privileged" {
+		t.Fatalf("Unexpected second decision %v", received[1])
+	}
+
+	// Timestamp{seconds: 1, nanos: 2}, each preceded by a one byte tag.
+	ts := []byte(received[0][2])
+	seconds, n := protowire.ConsumeVarint(ts[1:])
+	nanos, _ := protowire.ConsumeVarint(ts[1+n+1:])
+	if seconds != 1675245600 || nanos != 500000000 {
+		t.Fatalf("Expected timestamp 1675245600.5, got %d.%d", seconds, nanos)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// headerValue returns the value of the named header, matched regardless of
+// case.
+func headerValue(headers map[string]string, name string) (string, bool) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// queryParams returns the value of each query parameter the Docker daemon
+// acts on: the first one given for the parameter.
+func queryParams(query url.Values) map[string]string {
+
+	result := make(map[string]string, len(query))
+	for key, values := range query {
+		if len(values) > 0 {
+			result[key] = values[0]
+		}
+	}
+
+	return result
+}
+
+// isJSON reports whether the Content-Type header of headers, matched
+// regardless of case, is application/json, with or without parameters.
+func isJSON(headers map[string]string) bool {
+
+	value, ok := headerValue(headers, "Content-Type")
+	if !ok {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(value)
+	return err == nil && mediaType == "application/json"
+}
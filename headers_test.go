@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestInputHeadersAndParams(t *testing.T) {
+
+	r := authorization.Request{
+		RequestMethod: "POST",
+		RequestURI:    "/v1.41/containers/web?force=0&force=1&v=1",
+		RequestHeaders: map[string]string{
+			"content-type": "application/json; charset=utf-8",
+			"user-agent":   "Docker-Client/24.0.7 (linux)",
+		},
+		RequestBody: []byte(`{"Image": "nginx"}`),
+	}
+
+	input, err := (&DockerAuthZPlugin{}).buildInput(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := input.(map[string]interface{})
+
+	if got := doc["Headers"]; !reflect.DeepEqual(got, r.RequestHeaders) {
+		t.Errorf("Expected headers %v, got %v", r.RequestHeaders, got)
+	}
+	if got := doc["params"]; !reflect.DeepEqual(got, map[string]string{"force": "0", "v": "1"}) {
+		t.Errorf("Expected the first value of each parameter, got %v", got)
+	}
+	if doc["Body"] == nil {
+		t.Errorf("Expected the body to be parsed despite the parameters of its media type")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const hostInfoBuiltin = "docker.host_info"
+
+var errHostInfoUnavailable = errors.New("host information is not enabled, see -host-info")
+
+// HostInfo is the result of docker.host_info: the characteristics of the
+// host reported by the daemon's GET /info.
+type HostInfo struct {
+	Name            string   `json:"name"`
+	ServerVersion   string   `json:"server_version"`
+	OperatingSystem string   `json:"operating_system"`
+	OSType          string   `json:"os_type"`
+	Architecture    string   `json:"architecture"`
+	KernelVersion   string   `json:"kernel_version"`
+	NCPU            int      `json:"ncpu"`
+	MemTotal        int64    `json:"mem_total"`
+	StorageDriver   string   `json:"storage_driver"`
+	CgroupVersion   string   `json:"cgroup_version"`
+	CgroupDriver    string   `json:"cgroup_driver"`
+	DefaultRuntime  string   `json:"default_runtime"`
+	Runtimes        []string `json:"runtimes"`
+	Rootless        bool     `json:"rootless"`
+	Swarm           bool     `json:"swarm"`
+
+	// SecurityOptions maps the names of the security features enabled on
+	// the daemon, e.g. seccomp, apparmor, selinux or userns, to their
+	// options.
+	SecurityOptions map[string]map[string]string `json:"security_options"`
+}
+
+// dockerInfo is the part of the response of GET /info read by the plugin.
+type dockerInfo struct {
+	Name            string
+	ServerVersion   string
+	OperatingSystem string
+	OSType          string
+	Architecture    string
+	KernelVersion   string
+	NCPU            int
+	MemTotal        int64
+	Driver          string
+	CgroupVersion   string
+	CgroupDriver    string
+	DefaultRuntime  string
+	Runtimes        map[string]interface{}
+	SecurityOptions []string
+	Swarm           struct {
+		LocalNodeState string
+	}
+}
+
+// hostInfoSource looks up the host information from the daemon, caching it
+// for ttl.
+type hostInfoSource struct {
+	docker *dockerClient
+	cache  *builtinCacheView
+}
+
+func newHostInfoSource(docker *dockerClient, ttl time.Duration) *hostInfoSource {
+	return &hostInfoSource{docker: docker, cache: builtinResults.view(hostInfoBuiltin, ttl)}
+}
+
+func (s *hostInfoSource) get(ctx context.Context) (HostInfo, error) {
+
+	v, err := s.cache.get("info", func() (interface{}, error) {
+		var info dockerInfo
+		if err := s.docker.get(ctx, "/info", &info); err != nil {
+			return nil, err
+		}
+		return newHostInfo(info), nil
+	})
+	if err != nil {
+		return HostInfo{}, err
+	}
+
+	return v.(HostInfo), nil
+}
+
+func newHostInfo(info dockerInfo) HostInfo {
+
+	result := HostInfo{
+		Name:            info.Name,
+		ServerVersion:   info.ServerVersion,
+		OperatingSystem: info.OperatingSystem,
+		OSType:          info.OSType,
+		Architecture:    info.Architecture,
+		KernelVersion:   info.KernelVersion,
+		NCPU:            info.NCPU,
+		MemTotal:        info.MemTotal,
+		StorageDriver:   info.Driver,
+		CgroupVersion:   info.CgroupVersion,
+		CgroupDriver:    info.CgroupDriver,
+		DefaultRuntime:  info.DefaultRuntime,
+		Runtimes:        []string{},
+		Swarm:           info.Swarm.LocalNodeState == "active",
+		SecurityOptions: map[string]map[string]string{},
+	}
+
+	for name := range info.Runtimes {
+		result.Runtimes = append(result.Runtimes, name)
+	}
+	sort.Strings(result.Runtimes)
+
+	// Security options are reported as comma separated key=value pairs,
+	// e.g. name=seccomp,profile=default.
+	for _, opt := range info.SecurityOptions {
+		var name string
+		options := map[string]string{}
+		for _, field := range strings.Split(opt, ",") {
+			k, v, _ := strings.Cut(field, "=")
+			if k == "name" {
+				name = v
+			} else {
+				options[k] = v
+			}
+		}
+		if name != "" {
+			result.SecurityOptions[name] = options
+		}
+	}
+	_, result.Rootless = result.SecurityOptions["rootless"]
+
+	return result
+}
+
+// hostInfo is the source of docker.host_info, set when -host-info is given.
+var hostInfo *hostInfoSource
+
+// lookupRequestKey marks the context of evaluations authorizing the plugin's
+// own requests to the daemon.
+type lookupRequestKey struct{}
+
+// withLookupRequest returns a context marking the evaluation as authorizing
+// one of the plugin's own requests. Builtins calling the daemon are
+// unavailable in such evaluations, since they would wait on themselves.
+func withLookupRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lookupRequestKey{}, true)
+}
+
+func isLookupRequest(ctx context.Context) bool {
+	v, _ := ctx.Value(lookupRequestKey{}).(bool)
+	return v
+}
+
+func init() {
+	rego.RegisterBuiltinDyn(&rego.Function{
+		Name:    hostInfoBuiltin,
+		Decl:    types.NewFunction(nil, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		Memoize: true,
+	}, func(bctx rego.BuiltinContext, _ []*ast.Term) (*ast.Term, error) {
+
+		source := hostInfo
+		if source == nil {
+			return nil, errHostInfoUnavailable
+		}
+		if isLookupRequest(bctx.Context) {
+			return nil, nil
+		}
+
+		info, err := source.get(bctx.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ast.InterfaceToValue(info)
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(v), nil
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestHostInfoBuiltin(t *testing.T) {
+
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/info" {
+			t.Errorf("Unexpected lookup %v", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{
+			"Name": "node-1",
+			"Driver": "overlay2",
+			"CgroupVersion": "2",
+			"Runtimes": {"runc": {}, "runsc": {}},
+			"SecurityOptions": ["name=seccomp,profile=builtin", "name=rootless", "name=cgroupns"],
+			"Swarm": {"LocalNodeState": "inactive"}
+		}`))
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostInfo = newHostInfoSource(docker, time.Minute)
+	defer func() { hostInfo = nil }()
+
+	eval := func(ctx context.Context) rego.ResultSet {
+		rs, err := rego.New(rego.Query(`info := docker.host_info()`)).Eval(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	for i := 0; i < 2; i++ {
+		rs := eval(context.Background())
+		if len(rs) != 1 {
+			t.Fatalf("Expected a result, got %v", rs)
+		}
+		info := rs[0].Bindings["info"].(map[string]interface{})
+		if info["storage_driver"] != "overlay2" || info["cgroup_version"] != "2" || info["rootless"] != true || info["swarm"] != false {
+			t.Fatalf("Unexpected host information %v", info)
+		}
+		seccomp := info["security_options"].(map[string]interface{})["seccomp"].(map[string]interface{})
+		if seccomp["profile"] != "builtin" {
+			t.Fatalf("Expected seccomp profile builtin, got %v", seccomp)
+		}
+	}
+
+	if lookups != 1 {
+		t.Fatalf("Expected the host information to be cached, got %d lookups", lookups)
+	}
+
+	if rs := eval(withLookupRequest(context.Background())); len(rs) != 0 {
+		t.Fatalf("Expected docker.host_info to be undefined for lookup requests, got %v", rs)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// maxSymlinks bounds the symbolic links followed resolving a path, as
+// the kernel does, so that loops fail instead of spinning.
+const maxSymlinks = 40
+
+// hostPaths canonicalizes bind mount sources as the daemon will see them on
+// the host, whose root filesystem is mounted at root in the plugin.
+//
+// Like the daemon, which binds path.Clean(source), it removes the .. of the
+// path lexically before following symbolic links, while the .. of link
+// targets apply to the directory the link resolved to, as in the kernel.
+// Unlike filepath.EvalSymlinks, which fills BindMount.Resolved, it resolves
+// paths that do not exist yet, which the daemon creates for binds, up to their
+// longest existing prefix, and restores the case of names on
+// case-insensitive filesystems.
+type hostPaths struct {
+	root string
+}
+
+func newHostPaths(root string) *hostPaths {
+	return &hostPaths{root: root}
+}
+
+// resolve fills the Canonical path of each bind mount. Mounts whose source
+// cannot be resolved, for lack of permissions or because of a symbolic link
+// loop, are left empty.
+func (h *hostPaths) resolve(mounts []BindMount) {
+	for i := range mounts {
+		canonical, err := h.canonical(mounts[i].Source)
+		if err != nil {
+			log.Printf("Failed to canonicalize bind mount source %q: %v", mounts[i].Source, err)
+			continue
+		}
+		mounts[i].Canonical = canonical
+	}
+}
+
+// canonical returns the canonical host path of the absolute path p.
+func (h *hostPaths) canonical(p string) (string, error) {
+
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("not an absolute path")
+	}
+
+	resolved := "/"
+	pending := strings.Split(path.Clean(p), "/")
+	links := 0
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		candidate := path.Join(resolved, name)
+		info, err := os.Lstat(h.hostPath(candidate))
+		if errors.Is(err, fs.ErrNotExist) {
+			// The daemon creates the missing directory; the components
+			// after it are still resolved.
+			resolved = candidate
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = path.Join(resolved, h.caseOf(resolved, name, info))
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+
+		target, err := os.Readlink(h.hostPath(candidate))
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return resolved, nil
+}
+
+// caseOf returns the name of the entry of the directory dir that name refers
+// to, which differs from name only on case-insensitive filesystems.
+func (h *hostPaths) caseOf(dir, name string, info fs.FileInfo) string {
+
+	swapped := swapCase(name)
+	if swapped == name {
+		return name
+	}
+
+	other, err := os.Lstat(h.hostPath(path.Join(dir, swapped)))
+	if err != nil || !os.SameFile(info, other) {
+		return name
+	}
+
+	entries, err := os.ReadDir(h.hostPath(dir))
+	if err != nil {
+		return name
+	}
+	for _, e := range entries {
+		if e.Name() == name {
+			return name
+		}
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return e.Name()
+		}
+	}
+
+	return name
+}
+
+func (h *hostPaths) hostPath(p string) string {
+	return filepath.Join(h.root, filepath.FromSlash(p))
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+func (p *DockerAuthZPlugin) enrichBindMounts(_ context.Context, _ *authorization.Request, doc map[string]interface{}) error {
+	if mounts, ok := doc["BindMounts"].([]BindMount); ok {
+		p.mounts.resolve(mounts)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostPathsCanonical(t *testing.T) {
+
+	root := t.TempDir()
+	for _, dir := range []string{"run", "var", "srv/data/app", "home/bob"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "run/docker.sock"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"var/run":       "../run",
+		"home/bob/root": "/",
+		"home/bob/app":  "/srv/data/app",
+		"home/bob/loop": "loop",
+		"home/bob/up":   "app/../../run",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{path: "/srv/data/app", expected: "/srv/data/app"},
+		{path: "/var/run/docker.sock", expected: "/run/docker.sock"},
+		{path: "/var/run/../run/docker.sock", expected: "/run/docker.sock"},
+		{path: "/srv/./data//app/", expected: "/srv/data/app"},
+		{path: "/../../run", expected: "/run"},
+		{path: "/home/bob/root", expected: "/"},
+		{path: "/home/bob/root/var/run", expected: "/run"},
+		// The .. of a link target applies to the directory the link
+		// resolves to, not to the link.
+		{path: "/home/bob/up", expected: "/srv/run"},
+		// The .. of the path applies before links are followed, as the
+		// daemon cleans the source it binds.
+		{path: "/home/bob/app/../../run", expected: "/home/run"},
+		{path: "/var/run/../lib/docker", expected: "/var/lib/docker"},
+		// Paths the daemon would create are resolved up to their longest
+		// existing prefix, and beyond it.
+		{path: "/var/run/new/../docker.sock", expected: "/run/docker.sock"},
+		{path: "/home/bob/app/cache/../../data", expected: "/home/bob/data"},
+		{path: "/missing/../var/run/docker.sock", expected: "/run/docker.sock"},
+		{path: "/home/bob/new/app/data", expected: "/home/bob/new/app/data"},
+		{path: "/home/bob/loop", err: true},
+		{path: "relative", err: true},
+	}
+
+	h := newHostPaths(root)
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			got, err := h.canonical(tc.path)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEnrichBindMounts(t *testing.T) {
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "run"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/run", filepath.Join(root, "var")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{mounts: newHostPaths(root)}
+	req := containerCreate("bob", `{"HostConfig": {"Binds": ["/var/../var/docker.sock:/var/run/docker.sock"]}}`)
+
+	input, err := makeInput(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := input.(map[string]interface{})
+	if err := p.enrich(context.Background(), &req, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := doc["BindMounts"].([]BindMount)
+	if len(mounts) != 1 || mounts[0].Canonical != "/run/docker.sock" || mounts[0].Source != "/var/../var/docker.sock" {
+		t.Fatalf("Expected the canonical path /run/docker.sock, got %+v", mounts)
+	}
+}
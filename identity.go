@@ -0,0 +1,132 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+const identityResolverNSS = "nss"
+
+// Identity is the input.identity document: the canonical identity of the
+// requesting user and its attributes.
+type Identity struct {
+	Name     string `json:"name"`
+	UID      string `json:"uid"`
+	GID      string `json:"gid"`
+	FullName string `json:"full_name,omitempty"`
+	Home     string `json:"home,omitempty"`
+	Shell    string `json:"shell,omitempty"`
+}
+
+// identityResolver maps the user of a request to its canonical identity. It
+// returns nil for unknown users.
+type identityResolver interface {
+	resolve(ctx context.Context, name string) (*Identity, error)
+}
+
+func newIdentityResolver(kind string, ttl time.Duration) (identityResolver, error) {
+
+	switch kind {
+	case "":
+		return nil, nil
+	case identityResolverNSS:
+		r := &nssIdentityResolver{cache: newLookupCache(ttl)}
+		if path, err := exec.LookPath("getent"); err == nil {
+			r.getent = path
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown identity resolver %q", kind)
+	}
+}
+
+// nssIdentityResolver resolves users through the host's name service switch
+// with getent, so that users provided by modules such as SSSD, including
+// Active Directory users, resolve to the canonical name the module reports.
+// Without getent, users are resolved from /etc/passwd only.
+type nssIdentityResolver struct {
+	cache  *lookupCache
+	getent string
+}
+
+func (r *nssIdentityResolver) resolve(ctx context.Context, name string) (*Identity, error) {
+
+	v, err := r.cache.get(name, func() (interface{}, error) {
+		id, err := r.lookup(ctx, name)
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return (*Identity)(nil), nil
+		}
+		return id, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Identity), nil
+}
+
+func (r *nssIdentityResolver) lookup(ctx context.Context, name string) (*Identity, error) {
+
+	if r.getent == "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Name: u.Username, UID: u.Uid, GID: u.Gid, FullName: u.Name, Home: u.HomeDir}, nil
+	}
+
+	out, err := runGetent(ctx, r.getent, "passwd", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// name:password:uid:gid:gecos:home:shell
+	fields := strings.Split(strings.TrimSpace(out), ":")
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("unexpected passwd entry for %s", name)
+	}
+
+	fullName, _, _ := strings.Cut(fields[4], ",")
+
+	return &Identity{
+		Name:     fields[0],
+		UID:      fields[2],
+		GID:      fields[3],
+		FullName: fullName,
+		Home:     fields[5],
+		Shell:    fields[6],
+	}, nil
+}
+
+// resolveIdentity adds the identity of the requesting user to doc, and
+// returns the name its groups are looked up by.
+func (p *DockerAuthZPlugin) resolveIdentity(ctx context.Context, doc map[string]interface{}, name string) string {
+
+	if p.identities == nil || name == "" {
+		return name
+	}
+
+	id, err := p.identities.resolve(ctx, name)
+	if err != nil {
+		log.Printf("Failed to resolve identity of user %s: %v", name, err)
+		return name
+	}
+
+	doc["identity"] = id
+	if id == nil {
+		return name
+	}
+
+	return id.Name
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os/user"
+	"testing"
+	"time"
+)
+
+func TestNSSIdentityResolver(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	r, err := newIdentityResolver(identityResolverNSS, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{identities: r}
+
+	doc := map[string]interface{}{}
+	if name := p.resolveIdentity(context.Background(), doc, current.Username); name != current.Username {
+		t.Errorf("Expected %v, got %v", current.Username, name)
+	}
+
+	id, ok := doc["identity"].(*Identity)
+	if !ok || id == nil {
+		t.Fatalf("Expected identity, got %v", doc["identity"])
+	}
+	if id.UID != current.Uid || id.GID != current.Gid {
+		t.Errorf("Expected uid %v and gid %v, got %+v", current.Uid, current.Gid, id)
+	}
+
+	doc = map[string]interface{}{}
+	p.resolveIdentity(context.Background(), doc, "no-such-user-opa-docker-authz")
+	if id := doc["identity"].(*Identity); id != nil {
+		t.Errorf("Expected no identity, got %+v", id)
+	}
+
+	if _, err := newIdentityResolver("pam", time.Minute); err == nil {
+		t.Errorf("Expected unknown resolver error")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ImageReference describes the image referenced by a request that creates a
+// container or service, or pulls an image.
+type ImageReference struct {
+	Reference string
+	Name      string `json:",omitempty"`
+	Domain    string `json:",omitempty"`
+	Path      string `json:",omitempty"`
+	Tag       string `json:",omitempty"`
+	Digest    string `json:",omitempty"`
+
+	// Pinned is true when the reference includes a digest, or is an image ID.
+	Pinned bool
+
+	// ResolvedDigest is the digest the reference currently resolves to in
+	// its registry, when digest resolution is enabled and the reference is
+	// not pinned.
+	ResolvedDigest string `json:",omitempty"`
+
+	// NotaryClaims is the unverified content trust data of the reference,
+	// when content trust lookups are enabled.
+	NotaryClaims *NotaryClaims `json:",omitempty"`
+}
+
+// requestedImage returns the image reference given in a request, if any.
+func requestedImage(method, path string, query url.Values, body map[string]interface{}) string {
+
+	if method != "POST" {
+		return ""
+	}
+
+	switch trimAPIVersion(path) {
+	case "/containers/create":
+		s, _ := body["Image"].(string)
+		return s
+	case "/images/create":
+		image, tag := query.Get("fromImage"), query.Get("tag")
+		if image == "" || tag == "" {
+			return image
+		}
+		if strings.Contains(tag, ":") {
+			return image + "@" + tag
+		}
+		return image + ":" + tag
+	}
+
+	if spec := serviceContainerSpec(method, path, body); spec != nil {
+		s, _ := spec["Image"].(string)
+		return s
+	}
+
+	return ""
+}
+
+// parseImageReference parses ref, returning nil when it is empty or invalid.
+func parseImageReference(ref string) *ImageReference {
+
+	if ref == "" {
+		return nil
+	}
+
+	parsed, err := reference.ParseAnyReference(ref)
+	if err != nil {
+		return nil
+	}
+
+	image := &ImageReference{Reference: ref}
+
+	if named, ok := parsed.(reference.Named); ok {
+		image.Name = named.Name()
+		image.Domain = reference.Domain(named)
+		image.Path = reference.Path(named)
+	}
+	if tagged, ok := parsed.(reference.Tagged); ok {
+		image.Tag = tagged.Tag()
+	}
+	if digested, ok := parsed.(reference.Digested); ok {
+		image.Digest = digested.Digest().String()
+		image.Pinned = true
+	}
+
+	// Untagged references resolve to the latest tag.
+	if !image.Pinned && image.Tag == "" {
+		image.Tag = "latest"
+	}
+
+	return image
+}
+
+// distributionInspect is the part of a distribution inspect response exposed
+// in input.
+type distributionInspect struct {
+	Descriptor struct {
+		Digest string `json:"digest"`
+	}
+}
+
+// imageResolver looks up the digest that unpinned image references currently
+// resolve to, using the registry credentials of the daemon.
+type imageResolver struct {
+	docker *dockerClient
+	cache  *lookupCache
+}
+
+func newImageResolver(docker *dockerClient, ttl time.Duration) *imageResolver {
+	return &imageResolver{docker: docker, cache: newLookupCache(ttl)}
+}
+
+// resolve fills in the resolved digest of image. Lookup failures are logged
+// and leave the image unchanged.
+func (c *imageResolver) resolve(ctx context.Context, image *ImageReference) {
+
+	if c == nil || image == nil || image.Pinned {
+		return
+	}
+
+	ref := image.Name + ":" + image.Tag
+
+	v, err := c.cache.get(ref, func() (interface{}, error) {
+		var inspect distributionInspect
+		if err := c.docker.get(ctx, "/distribution/"+ref+"/json", &inspect); err != nil {
+			return nil, err
+		}
+		return inspect.Descriptor.Digest, nil
+	})
+	if err != nil {
+		log.Printf("Failed to resolve digest of image %s: %v", ref, err)
+		return
+	}
+
+	image.ResolvedDigest = v.(string)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		ref      string
+		expected *ImageReference
+	}{
+		{
+			ref:      "nginx",
+			expected: &ImageReference{Reference: "nginx", Name: "docker.io/library/nginx", Domain: "docker.io", Path: "library/nginx", Tag: "latest"},
+		},
+		{
+			ref:      "registry.example.com:5000/team/app:1.2",
+			expected: &ImageReference{Reference: "registry.example.com:5000/team/app:1.2", Name: "registry.example.com:5000/team/app", Domain: "registry.example.com:5000", Path: "team/app", Tag: "1.2"},
+		},
+		{
+			ref:      "nginx@" + digest,
+			expected: &ImageReference{Reference: "nginx@" + digest, Name: "docker.io/library/nginx", Domain: "docker.io", Path: "library/nginx", Digest: digest, Pinned: true},
+		},
+		{
+			ref:      digest,
+			expected: &ImageReference{Reference: digest, Digest: digest, Pinned: true},
+		},
+		{
+			ref: "",
+		},
+		{
+			ref: "Invalid Reference",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ref, func(t *testing.T) {
+			result := parseImageReference(tc.ref)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestRequestedImage(t *testing.T) {
+	tests := []struct {
+		method   string
+		uri      string
+		body     map[string]interface{}
+		expected string
+	}{
+		{
+			method:   "POST",
+			uri:      "/v1.41/containers/create",
+			body:     map[string]interface{}{"Image": "nginx:1.23"},
+			expected: "nginx:1.23",
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/images/create?fromImage=nginx&tag=1.23",
+			expected: "nginx:1.23",
+		},
+		{
+			method:   "POST",
+			uri:      "/v1.41/images/create?fromImage=nginx&tag=sha256:abc",
+			expected: "nginx@sha256:abc",
+		},
+		{
+			method: "POST",
+			uri:    "/v1.41/services/abc/update?version=3",
+			body: map[string]interface{}{
+				"TaskTemplate": map[string]interface{}{
+					"ContainerSpec": map[string]interface{}{"Image": "app:2"},
+				},
+			},
+			expected: "app:2",
+		},
+		{
+			method: "GET",
+			uri:    "/v1.41/containers/json",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.uri, func(t *testing.T) {
+			u, _ := url.Parse(tc.uri)
+			result := requestedImage(tc.method, u.Path, u.Query(), tc.body)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestImageResolver(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/distribution/docker.io/library/nginx:latest/json" {
+			t.Errorf("Unexpected lookup %v", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"Descriptor": {"digest": "` + digest + `"}}`))
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newImageResolver(docker, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		image := parseImageReference("nginx")
+		resolver.resolve(context.Background(), image)
+		if image.ResolvedDigest != digest {
+			t.Errorf("Expected %v, got %v", digest, image.ResolvedDigest)
+		}
+	}
+
+	pinned := parseImageReference("nginx@" + digest)
+	resolver.resolve(context.Background(), pinned)
+	if pinned.ResolvedDigest != "" {
+		t.Errorf("Expected pinned image to be left unresolved, got %v", pinned.ResolvedDigest)
+	}
+
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, got %d", lookups)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+)
+
+// latestInputVersion is the version of the shape of the input document built
+// by makeInput and the enrichers.
+const latestInputVersion = 1
+
+// defaultInputVersion is the version emitted unless -input-schema-version
+// selects another, so that upgrades of the plugin do not change the shape of
+// the input under existing policies.
+const defaultInputVersion = 1
+
+// inputDowngrades convert the input document from the shape of the version
+// above to that of its key, for policies written against older versions.
+var inputDowngrades = map[int]func(doc map[string]interface{}){}
+
+// validInputVersion returns an error unless the version is one the plugin can
+// emit.
+func validInputVersion(version int) error {
+
+	if version < 1 || version > latestInputVersion {
+		return fmt.Errorf("unsupported input schema version %d, expected 1 to %d", version, latestInputVersion)
+	}
+
+	return nil
+}
+
+// versionInput converts the input document to the shape of version, and
+// records the version as input.schema_version.
+func versionInput(doc map[string]interface{}, version int) {
+
+	for v := latestInputVersion - 1; v >= version; v-- {
+		if downgrade := inputDowngrades[v]; downgrade != nil {
+			downgrade(doc)
+		}
+	}
+
+	doc["schema_version"] = version
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestInputVersion(t *testing.T) {
+
+	for _, version := range []int{0, latestInputVersion + 1} {
+		if err := validInputVersion(version); err == nil {
+			t.Errorf("Expected version %d to be rejected", version)
+		}
+	}
+
+	for version := 1; version <= latestInputVersion; version++ {
+		if err := validInputVersion(version); err != nil {
+			t.Errorf("Expected version %d to be accepted, got %v", version, err)
+		}
+
+		p := &DockerAuthZPlugin{inputVersion: version}
+		input, err := p.buildInput(context.Background(), authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := input.(map[string]interface{})["schema_version"]; got != version {
+			t.Errorf("Expected schema_version %v, got %v", version, got)
+		}
+	}
+
+	// Plugins built without -input-schema-version emit the default version.
+	input, err := (&DockerAuthZPlugin{}).buildInput(context.Background(), authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := input.(map[string]interface{})["schema_version"]; got != defaultInputVersion {
+		t.Errorf("Expected schema_version %v, got %v", defaultInputVersion, got)
+	}
+}
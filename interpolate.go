@@ -0,0 +1,156 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+var (
+	interpolationPattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+	envVarName           = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+const interpolationFilePrefix = "file:"
+
+// interpolateConfig returns the OPA configuration bs with its placeholders
+// replaced: ${NAME} by the environment variable NAME, and ${file:/path} by the
+// content of the file, without its trailing newline. $${ is kept as ${. The
+// placeholders are replaced in the string values of the parsed document, so
+// that a value cannot add or override keys, and the result is JSON. A string
+// made of a single placeholder takes the type of its value when that is a
+// number, a boolean or null, so that placeholders may stand for them.
+func interpolateConfig(bs []byte) ([]byte, error) {
+
+	if !interpolationPattern.Match(bs) {
+		return bs, nil
+	}
+
+	js, err := yaml.YAMLToJSON(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	doc = interpolateValue(doc, &errs)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("interpolation failed: %s", strings.Join(errs, "; "))
+	}
+
+	return json.Marshal(doc)
+}
+
+// interpolateValue replaces the placeholders of the string values of v,
+// appending failures to errs.
+func interpolateValue(v interface{}, errs *[]string) interface{} {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = interpolateValue(value, errs)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = interpolateValue(value, errs)
+		}
+		return v
+	case string:
+		return interpolateString(v, errs)
+	}
+
+	return v
+}
+
+func interpolateString(s string, errs *[]string) interface{} {
+
+	whole := false
+	result := interpolationPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+
+		value, err := interpolate(m[2 : len(m)-1])
+		if err != nil {
+			*errs = append(*errs, err.Error())
+			return m
+		}
+
+		whole = m == s
+		return value
+	})
+
+	if whole {
+		if scalar, ok := parseScalar(result); ok {
+			return scalar
+		}
+	}
+
+	return result
+}
+
+// parseScalar returns the number, boolean or null s reads as in YAML.
+func parseScalar(s string) (interface{}, bool) {
+
+	if s == "" {
+		return nil, false
+	}
+
+	js, err := yaml.YAMLToJSON([]byte(s))
+	if err != nil {
+		return nil, false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+
+	switch v.(type) {
+	case json.Number, bool, nil:
+		return v, true
+	}
+
+	return nil, false
+}
+
+func interpolate(ref string) (string, error) {
+
+	if strings.HasPrefix(ref, interpolationFilePrefix) {
+		path := strings.TrimPrefix(ref, interpolationFilePrefix)
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(bs), "\r\n"), nil
+	}
+
+	if !envVarName.MatchString(ref) {
+		return "", fmt.Errorf("invalid placeholder ${%s}", ref)
+	}
+
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestInterpolateConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	regionFile := filepath.Join(dir, "region")
+	if err := os.WriteFile(regionFile, []byte("eu-west-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BUNDLE_SERVER", "https://bundles.example.com")
+	t.Setenv("CANARY_PERCENT", "10")
+
+	config := []byte(`services:
+  bundles:
+    url: ${BUNDLE_SERVER}
+bundles:
+  authz:
+    service: bundles
+    resource: bundles/${file:` + regionFile + `}/authz.tar.gz
+labels:
+  literal: $${NOT_INTERPOLATED}
+plugins:
+  opa_docker_authz:
+    canary:
+      percent: ${CANARY_PERCENT}
+`)
+
+	bs, err := interpolateConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `services:
+  bundles:
+    url: https://bundles.example.com
+bundles:
+  authz:
+    service: bundles
+    resource: bundles/eu-west-1/authz.tar.gz
+labels:
+  literal: ${NOT_INTERPOLATED}
+plugins:
+  opa_docker_authz:
+    canary:
+      percent: 10
+`
+	var got, want interface{}
+	if err := yaml.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, bs)
+	}
+
+	// The interpolated configuration is checked, so that placeholders may
+	// stand for numbers.
+	problems, err := checkConfigBytes(bs)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Expected no problems, got %v, %v", problems, err)
+	}
+
+	for _, invalid := range []string{
+		"url: ${UNSET_BUNDLE_SERVER}",
+		"url: ${file:" + filepath.Join(dir, "missing") + "}",
+		"url: ${not a name}",
+	} {
+		if _, err := interpolateConfig([]byte(invalid)); err == nil {
+			t.Fatalf("Expected %q to fail", invalid)
+		}
+	}
+}
+
+func TestInterpolateConfigInjection(t *testing.T) {
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEA\n-----END PUBLIC KEY-----\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BUNDLE_SERVER", "https://bundles.example.com\ndecision_logs:\n  service: evil")
+	t.Setenv("BUNDLE_TOKEN", `x", "url": "https://evil.example.com`)
+
+	config := []byte(`services:
+  bundles:
+    url: ${BUNDLE_SERVER}
+    credentials:
+      bearer:
+        token: "${BUNDLE_TOKEN}"
+keys:
+  global:
+    key: ${file:` + keyFile + `}
+`)
+
+	bs, err := interpolateConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Services map[string]struct {
+			URL         string `json:"url"`
+			Credentials struct {
+				Bearer struct {
+					Token string `json:"token"`
+				} `json:"bearer"`
+			} `json:"credentials"`
+		} `json:"services"`
+		Keys map[string]struct {
+			Key string `json:"key"`
+		} `json:"keys"`
+		DecisionLogs interface{} `json:"decision_logs"`
+	}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.DecisionLogs != nil {
+		t.Fatalf("Expected no decision logs to be injected, got %v", doc.DecisionLogs)
+	}
+	if s := doc.Services["bundles"]; s.URL != os.Getenv("BUNDLE_SERVER") || s.Credentials.Bearer.Token != os.Getenv("BUNDLE_TOKEN") {
+		t.Fatalf("Expected the values as strings, got %+v", s)
+	}
+	if key := doc.Keys["global"].Key; !strings.Contains(key, "\nMCowBQYDK2VwAyEA\n") {
+		t.Fatalf("Expected the key file as a string, got %q", key)
+	}
+}
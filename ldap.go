@@ -0,0 +1,708 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const ldapQueryBuiltin = "ldap.query"
+
+// ldapMessageLimit bounds the size of messages read from the directory.
+const ldapMessageLimit = 16 << 20
+
+var errLDAPUnavailable = errors.New("LDAP queries are not enabled, see -ldap-url")
+
+// BER tags of the LDAP protocol operations used by the client (RFC 4511).
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapSimpleAuth       = 0x80
+	ldapScopeSubtree     = 2
+	ldapNeverDerefAlias  = 0
+	ldapResultSuccess    = 0
+	ldapResultSizeLimit  = 4
+	ldapResultTimeLimit  = 3
+	ldapProtocolVersion3 = 3
+)
+
+// LDAPEntry is an entry returned by ldap.query.
+type LDAPEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+type ldapConfig struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	caFile       string
+	timeout      time.Duration
+	sizeLimit    int
+}
+
+// ldapClient searches the configured directory, caching the results of
+// searches for the TTL of its cache. Each search uses a new connection, bound
+// with the configured DN, and must complete within the configured timeout.
+type ldapClient struct {
+	cfg   ldapConfig
+	addr  string
+	tls   *tls.Config
+	cache *builtinCacheView
+}
+
+func newLDAPClient(cfg ldapConfig, ttl time.Duration) (*ldapClient, error) {
+
+	u, err := url.Parse(cfg.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("LDAP URL %q has no host", cfg.url)
+	}
+
+	c := &ldapClient{cfg: cfg, addr: u.Host, cache: builtinResults.view(ldapQueryBuiltin, ttl)}
+
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "636")
+		}
+		transport, err := clientTransport(cfg.caFile, "", "")
+		if err != nil {
+			return nil, err
+		}
+		c.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		if transport.TLSClientConfig != nil {
+			c.tls = transport.TLSClientConfig.Clone()
+		}
+		c.tls.ServerName = u.Hostname()
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q, must be ldap or ldaps", u.Scheme)
+	}
+
+	return c, nil
+}
+
+// query returns the entries below the base DN matching filter, with the
+// attributes named by attrs.
+func (c *ldapClient) query(ctx context.Context, filter string, attrs []string) ([]LDAPEntry, error) {
+
+	key := filter + "\x00" + strings.Join(attrs, "\x00")
+
+	v, err := c.cache.get(key, func() (interface{}, error) {
+		return c.search(ctx, filter, attrs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]LDAPEntry), nil
+}
+
+func (c *ldapClient) search(ctx context.Context, filter string, attrs []string) ([]LDAPEntry, error) {
+
+	encodedFilter, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if c.tls != nil {
+		tlsConn := tls.Client(conn, c.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	r := bufio.NewReader(conn)
+	id := 0
+
+	if c.cfg.bindDN != "" {
+		id++
+		bind := berEncode(ldapBindRequest,
+			berInt(berInteger, ldapProtocolVersion3),
+			berString(berOctetString, c.cfg.bindDN),
+			berString(ldapSimpleAuth, c.cfg.bindPassword))
+		if _, err := conn.Write(ldapMessage(id, bind)); err != nil {
+			return nil, err
+		}
+		op, err := readLDAPResponse(r, id)
+		if err != nil {
+			return nil, err
+		}
+		if op.tag != ldapBindResponse {
+			return nil, fmt.Errorf("LDAP bind: unexpected response 0x%x", op.tag)
+		}
+		if err := ldapResultError("LDAP bind", op); err != nil {
+			return nil, err
+		}
+	}
+
+	attributes := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		attributes = append(attributes, berString(berOctetString, attr))
+	}
+
+	id++
+	search := berEncode(ldapSearchRequest,
+		berString(berOctetString, c.cfg.baseDN),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, ldapNeverDerefAlias),
+		berInt(berInteger, c.cfg.sizeLimit),
+		berInt(berInteger, int((c.cfg.timeout+time.Second-1)/time.Second)),
+		berBool(false),
+		encodedFilter,
+		berEncode(berSequence, attributes...))
+	if _, err := conn.Write(ldapMessage(id, search)); err != nil {
+		return nil, err
+	}
+
+	entries := []LDAPEntry{}
+
+	for {
+		op, err := readLDAPResponse(r, id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// Referrals to other directories are not followed.
+		case ldapSearchDone:
+			if err := ldapResultError("LDAP search", op); err != nil {
+				return nil, err
+			}
+			_, _ = conn.Write(ldapMessage(id+1, berEncode(ldapUnbindRequest)))
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("LDAP search: unexpected response 0x%x", op.tag)
+		}
+	}
+}
+
+func ldapMessage(id int, op []byte) []byte {
+	return berEncode(berSequence, berInt(berInteger, id), op)
+}
+
+// readLDAPResponse reads the next message from the directory, returning its
+// protocol operation.
+func readLDAPResponse(r *bufio.Reader, id int) (berElement, error) {
+
+	msg, err := readBER(r)
+	if err != nil {
+		return berElement{}, err
+	}
+	if msg.tag != berSequence {
+		return berElement{}, fmt.Errorf("invalid LDAP message")
+	}
+
+	children, err := msg.children()
+	if err != nil || len(children) < 2 || children[0].tag != berInteger {
+		return berElement{}, fmt.Errorf("invalid LDAP message")
+	}
+	if got := children[0].int(); got != id {
+		return berElement{}, fmt.Errorf("unexpected LDAP message ID %d, expected %d", got, id)
+	}
+
+	return children[1], nil
+}
+
+// ldapResultError returns the error reported by an LDAPResult, or nil when it
+// reports success. Partial results are errors as well, since policies cannot
+// tell them from complete ones.
+func ldapResultError(op string, result berElement) error {
+
+	children, err := result.children()
+	if err != nil || len(children) < 3 || children[0].tag != berEnumerated {
+		return fmt.Errorf("%s: invalid result", op)
+	}
+
+	switch code := children[0].int(); code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultSizeLimit:
+		return fmt.Errorf("%s: size limit exceeded", op)
+	case ldapResultTimeLimit:
+		return fmt.Errorf("%s: time limit exceeded", op)
+	default:
+		if msg := string(children[2].content); msg != "" {
+			return fmt.Errorf("%s: result code %d: %s", op, code, msg)
+		}
+		return fmt.Errorf("%s: result code %d", op, code)
+	}
+}
+
+func parseLDAPEntry(op berElement) (LDAPEntry, error) {
+
+	children, err := op.children()
+	if err != nil || len(children) < 2 {
+		return LDAPEntry{}, fmt.Errorf("invalid LDAP search entry")
+	}
+
+	entry := LDAPEntry{DN: string(children[0].content), Attributes: map[string][]string{}}
+
+	attributes, err := children[1].children()
+	if err != nil {
+		return LDAPEntry{}, fmt.Errorf("invalid LDAP search entry")
+	}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil || len(parts) < 2 {
+			return LDAPEntry{}, fmt.Errorf("invalid LDAP search entry")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return LDAPEntry{}, fmt.Errorf("invalid LDAP search entry")
+		}
+		vals := make([]string, 0, len(values))
+		for _, v := range values {
+			vals = append(vals, string(v.content))
+		}
+		entry.Attributes[string(parts[0].content)] = vals
+	}
+
+	return entry, nil
+}
+
+// berElement is a BER encoded element. Only the low tag numbers used by LDAP
+// are supported.
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func (e berElement) children() ([]berElement, error) {
+
+	var result []berElement
+
+	for b := e.content; len(b) > 0; {
+		child, rest, err := parseBER(b)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, child)
+		b = rest
+	}
+
+	return result, nil
+}
+
+func (e berElement) int() int {
+
+	v := 0
+	for i, b := range e.content {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(b)
+	}
+
+	return v
+}
+
+func parseBER(b []byte) (berElement, []byte, error) {
+
+	if len(b) < 2 {
+		return berElement{}, nil, io.ErrUnexpectedEOF
+	}
+
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return berElement{}, nil, fmt.Errorf("invalid BER length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+
+	if n > len(b) {
+		return berElement{}, nil, io.ErrUnexpectedEOF
+	}
+
+	return berElement{tag: tag, content: b[:n]}, b[n:], nil
+}
+
+func readBER(r *bufio.Reader) (berElement, error) {
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return berElement{}, err
+	}
+
+	n := int(header[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return berElement{}, fmt.Errorf("invalid BER length")
+		}
+		bs := make([]byte, size)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return berElement{}, err
+		}
+		n = 0
+		for _, c := range bs {
+			n = n<<8 | int(c)
+		}
+	}
+
+	if n > ldapMessageLimit {
+		return berElement{}, fmt.Errorf("LDAP message of %d bytes exceeds limit", n)
+	}
+
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElement{}, err
+	}
+
+	return berElement{tag: header[0], content: content}, nil
+}
+
+func berEncode(tag byte, content ...[]byte) []byte {
+
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+
+	result := []byte{tag}
+	if n < 0x80 {
+		result = append(result, byte(n))
+	} else {
+		var length []byte
+		for v := n; v > 0; v >>= 8 {
+			length = append([]byte{byte(v)}, length...)
+		}
+		result = append(result, 0x80|byte(len(length)))
+		result = append(result, length...)
+	}
+
+	for _, c := range content {
+		result = append(result, c...)
+	}
+
+	return result
+}
+
+func berInt(tag byte, v int) []byte {
+
+	bs := []byte{byte(v)}
+	for v >>= 8; v != 0 && v != -1; v >>= 8 {
+		bs = append([]byte{byte(v)}, bs...)
+	}
+	// Keep the sign of values whose high bit is set.
+	if v == 0 && bs[0]&0x80 != 0 {
+		bs = append([]byte{0}, bs...)
+	}
+
+	return berEncode(tag, bs)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berBoolean, []byte{0xff})
+	}
+	return berEncode(berBoolean, []byte{0x00})
+}
+
+// LDAP filter choices (RFC 4511 section 4.5.1).
+const (
+	ldapFilterAnd            = 0xa0
+	ldapFilterOr             = 0xa1
+	ldapFilterNot            = 0xa2
+	ldapFilterEquality       = 0xa3
+	ldapFilterSubstrings     = 0xa4
+	ldapFilterGreaterOrEqual = 0xa5
+	ldapFilterLessOrEqual    = 0xa6
+	ldapFilterPresent        = 0x87
+	ldapFilterApprox         = 0xa8
+)
+
+// encodeLDAPFilter encodes the string representation of a search filter
+// (RFC 4515), e.g. (&(objectClass=person)(uid=alice)). Extensible match
+// filters are not supported.
+func encodeLDAPFilter(s string) ([]byte, error) {
+
+	p := &ldapFilterParser{s: s}
+
+	f, err := p.filter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP filter %q: %w", s, err)
+	}
+	if p.pos != len(s) {
+		return nil, fmt.Errorf("invalid LDAP filter %q: unexpected %q", s, s[p.pos:])
+	}
+
+	return f, nil
+}
+
+type ldapFilterParser struct {
+	s   string
+	pos int
+}
+
+func (p *ldapFilterParser) filter() ([]byte, error) {
+
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return nil, fmt.Errorf("expected ( at offset %d", p.pos)
+	}
+	p.pos++
+
+	if p.pos >= len(p.s) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var result []byte
+	var err error
+
+	switch p.s[p.pos] {
+	case '&':
+		p.pos++
+		result, err = p.list(ldapFilterAnd)
+	case '|':
+		p.pos++
+		result, err = p.list(ldapFilterOr)
+	case '!':
+		p.pos++
+		var f []byte
+		if f, err = p.filter(); err == nil {
+			result = berEncode(ldapFilterNot, f)
+		}
+	default:
+		result, err = p.item()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+		return nil, fmt.Errorf("expected ) at offset %d", p.pos)
+	}
+	p.pos++
+
+	return result, nil
+}
+
+func (p *ldapFilterParser) list(tag byte) ([]byte, error) {
+
+	var filters [][]byte
+	for p.pos < len(p.s) && p.s[p.pos] == '(' {
+		f, err := p.filter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("empty filter list at offset %d", p.pos)
+	}
+
+	return berEncode(tag, filters...), nil
+}
+
+func (p *ldapFilterParser) item() ([]byte, error) {
+
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	item := p.s[p.pos : p.pos+end]
+	if strings.IndexByte(item, '(') >= 0 {
+		return nil, fmt.Errorf("unexpected ( at offset %d", p.pos+strings.IndexByte(item, '('))
+	}
+	p.pos += end
+
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("missing attribute or = in %q", item)
+	}
+
+	attr, raw := item[:eq], item[eq+1:]
+	tag := byte(ldapFilterEquality)
+
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = ldapFilterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = ldapFilterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = ldapFilterApprox, attr[:len(attr)-1]
+	case ':':
+		return nil, fmt.Errorf("extensible match filters are not supported")
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("missing attribute in %q", item)
+	}
+
+	if tag != ldapFilterEquality || !strings.Contains(raw, "*") {
+		value, err := unescapeLDAPValue(raw)
+		if err != nil {
+			return nil, err
+		}
+		return berEncode(tag, berString(berOctetString, attr), berString(berOctetString, value)), nil
+	}
+
+	if raw == "*" {
+		return berString(ldapFilterPresent, attr), nil
+	}
+
+	parts := strings.Split(raw, "*")
+	var substrings [][]byte
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := unescapeLDAPValue(part)
+		if err != nil {
+			return nil, err
+		}
+		choice := byte(0x81)
+		switch i {
+		case 0:
+			choice = 0x80
+		case len(parts) - 1:
+			choice = 0x82
+		}
+		substrings = append(substrings, berString(choice, value))
+	}
+
+	return berEncode(ldapFilterSubstrings, berString(berOctetString, attr), berEncode(berSequence, substrings...)), nil
+}
+
+// unescapeLDAPValue decodes the \XX escapes of a filter value.
+func unescapeLDAPValue(s string) (string, error) {
+
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		bs, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(bs)
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// ldapDirectory is the client of ldap.query, set when -ldap-url is given.
+var ldapDirectory *ldapClient
+
+func init() {
+	rego.RegisterBuiltin2(&rego.Function{
+		Name:    ldapQueryBuiltin,
+		Decl:    types.NewFunction(types.Args(types.S, types.NewArray(nil, types.S)), types.NewArray(nil, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A)))),
+		Memoize: true,
+	}, func(bctx rego.BuiltinContext, filter, attrs *ast.Term) (*ast.Term, error) {
+
+		client := ldapDirectory
+		if client == nil {
+			return nil, errLDAPUnavailable
+		}
+
+		s, ok := filter.Value.(ast.String)
+		if !ok {
+			return nil, nil
+		}
+		arr, ok := attrs.Value.(*ast.Array)
+		if !ok {
+			return nil, nil
+		}
+		names := make([]string, 0, arr.Len())
+		for i := 0; i < arr.Len(); i++ {
+			name, ok := arr.Elem(i).Value.(ast.String)
+			if !ok {
+				return nil, nil
+			}
+			names = append(names, string(name))
+		}
+
+		entries, err := client.query(bctx.Context, string(s), names)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ast.InterfaceToValue(entries)
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(v), nil
+	})
+}
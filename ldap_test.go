@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestEncodeLDAPFilter(t *testing.T) {
+
+	tests := []struct {
+		filter   string
+		expected []byte
+	}{
+		{
+			filter:   "(uid=alice)",
+			expected: berEncode(ldapFilterEquality, berString(berOctetString, "uid"), berString(berOctetString, "alice")),
+		},
+		{
+			filter:   "(mail=*)",
+			expected: berString(ldapFilterPresent, "mail"),
+		},
+		{
+			filter: "(&(objectClass=person)(!(cn=a*b*c)))",
+			expected: berEncode(ldapFilterAnd,
+				berEncode(ldapFilterEquality, berString(berOctetString, "objectClass"), berString(berOctetString, "person")),
+				berEncode(ldapFilterNot,
+					berEncode(ldapFilterSubstrings, berString(berOctetString, "cn"), berEncode(berSequence,
+						berString(0x80, "a"), berString(0x81, "b"), berString(0x82, "c"))))),
+		},
+		{
+			filter:   `(|(uidNumber>=1000)(cn=\28x\29))`,
+			expected: berEncode(ldapFilterOr, berEncode(ldapFilterGreaterOrEqual, berString(berOctetString, "uidNumber"), berString(berOctetString, "1000")), berEncode(ldapFilterEquality, berString(berOctetString, "cn"), berString(berOctetString, "(x)"))),
+		},
+	}
+
+	for _, tc := range tests {
+		actual, err := encodeLDAPFilter(tc.filter)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.filter, err)
+		}
+		if !bytes.Equal(actual, tc.expected) {
+			t.Fatalf("%v: expected %x, got %x", tc.filter, tc.expected, actual)
+		}
+	}
+
+	for _, filter := range []string{"uid=alice", "(uid=alice", "(&)", "(cn:dn:=x)", `(cn=\2)`, "(uid=a)(uid=b)"} {
+		if _, err := encodeLDAPFilter(filter); err == nil {
+			t.Fatalf("Expected %v to be rejected", filter)
+		}
+	}
+}
+
+func TestLDAPQueryBuiltin(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	searches := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				msg, err := readBER(r)
+				if err != nil {
+					break
+				}
+				children, _ := msg.children()
+				id, op := children[0].int(), children[1]
+				switch op.tag {
+				case ldapBindRequest:
+					fields, _ := op.children()
+					code := ldapResultSuccess
+					if string(fields[1].content) != "cn=authz,dc=example,dc=com" || string(fields[2].content) != "secret" {
+						code = 49
+					}
+					_, _ = conn.Write(ldapMessage(id, berEncode(ldapBindResponse, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))))
+				case ldapSearchRequest:
+					searches++
+					fields, _ := op.children()
+					if string(fields[0].content) != "dc=example,dc=com" {
+						t.Errorf("Unexpected base DN %s", fields[0].content)
+					}
+					entry := berEncode(ldapSearchEntry,
+						berString(berOctetString, "uid=alice,ou=people,dc=example,dc=com"),
+						berEncode(berSequence,
+							berEncode(berSequence, berString(berOctetString, "department"), berEncode(0x31, berString(berOctetString, "platform"))),
+							berEncode(berSequence, berString(berOctetString, "employeeType"), berEncode(0x31, berString(berOctetString, "contractor")))))
+					_, _ = conn.Write(ldapMessage(id, entry))
+					_, _ = conn.Write(ldapMessage(id, berEncode(ldapSearchDone, berInt(berEnumerated, ldapResultSuccess), berString(berOctetString, ""), berString(berOctetString, ""))))
+				default:
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	client, err := newLDAPClient(ldapConfig{
+		url:          "ldap://" + ln.Addr().String(),
+		bindDN:       "cn=authz,dc=example,dc=com",
+		bindPassword: "secret",
+		baseDN:       "dc=example,dc=com",
+		timeout:      time.Second,
+		sizeLimit:    10,
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ldapDirectory = client
+	defer func() { ldapDirectory = nil }()
+
+	for i := 0; i < 2; i++ {
+		rs, err := rego.New(rego.Query(`entries := ldap.query("(uid=alice)", ["department", "employeeType"])`)).Eval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 {
+			t.Fatalf("Expected a result, got %v", rs)
+		}
+		entries := rs[0].Bindings["entries"].([]interface{})
+		if len(entries) != 1 {
+			t.Fatalf("Expected 1 entry, got %v", entries)
+		}
+		attributes := entries[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		if attributes["employeeType"].([]interface{})[0] != "contractor" {
+			t.Fatalf("Unexpected entry %v", entries[0])
+		}
+	}
+
+	if searches != 1 {
+		t.Fatalf("Expected 1 search, got %d", searches)
+	}
+
+	client.cfg.bindPassword = "wrong"
+	if _, err := client.search(context.Background(), "(uid=bob)", nil); err == nil {
+		t.Fatal("Expected bind with invalid credentials to fail")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+// libraryFS holds the baseline rules of the policy library, one module per
+// rule, in package library.<rule>.
+//
+//go:embed library/*.rego
+var libraryFS embed.FS
+
+// libraryRequiredParams lists the parameters rules of the library cannot do
+// without.
+var libraryRequiredParams = map[string][]string{
+	"registry_allowlist": {"registries"},
+}
+
+// policyLibraryConfig selects the rules of the library enforced, with their
+// parameters.
+type policyLibraryConfig struct {
+	Rules map[string]map[string]interface{} `json:"rules"`
+}
+
+// policyLibrary enforces the baseline rules selected from the library before
+// the policy of the plugin is evaluated. A request denied by a rule is denied
+// with the name of the rule as deny code.
+type policyLibrary struct {
+	rules []libraryRule
+}
+
+type libraryRule struct {
+	name  string
+	query rego.PreparedEvalQuery
+}
+
+// libraryRules returns the names of the rules of the library.
+func libraryRules() []string {
+
+	entries, _ := libraryFS.ReadDir("library")
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".rego"))
+	}
+
+	return names
+}
+
+// loadPolicyLibrary reads the rules enabled, and their parameters, from the
+// YAML or JSON file at path.
+func loadPolicyLibrary(ctx context.Context, path string) (*policyLibrary, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg policyLibraryConfig
+	if err := yaml.Unmarshal(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	l, err := newPolicyLibrary(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+func newPolicyLibrary(ctx context.Context, cfg policyLibraryConfig) (*policyLibrary, error) {
+
+	names := make([]string, 0, len(cfg.Rules))
+	for name := range cfg.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	l := &policyLibrary{}
+	for _, name := range names {
+		src, err := libraryFS.ReadFile(path.Join("library", name+".rego"))
+		if err != nil {
+			return nil, fmt.Errorf("unknown rule %q, expected one of %s", name, strings.Join(libraryRules(), ", "))
+		}
+
+		params := cfg.Rules[name]
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		for _, key := range libraryRequiredParams[name] {
+			if _, ok := params[key]; !ok {
+				return nil, fmt.Errorf("rule %s: missing parameter %s", name, key)
+			}
+		}
+
+		query, err := rego.New(
+			rego.Query(fmt.Sprintf("data.library.%s.deny", name)),
+			rego.Module(name+".rego", string(src)),
+			rego.Store(inmem.NewFromObject(map[string]interface{}{"params": params})),
+		).PrepareForEval(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+
+		l.rules = append(l.rules, libraryRule{name: name, query: query})
+	}
+
+	return l, nil
+}
+
+// eval returns the denial of the first rule denying input, or an allowing
+// decision when none does.
+func (l *policyLibrary) eval(ctx context.Context, input interface{}) (decision, error) {
+
+	if l == nil {
+		return decision{Allowed: true}, nil
+	}
+
+	for _, rule := range l.rules {
+		rs, err := rule.query.Eval(ctx, append([]rego.EvalOption{rego.EvalInput(input)}, explainEvalOptions(ctx)...)...)
+		if err != nil {
+			return decision{}, fmt.Errorf("policy library rule %s: %w", rule.name, err)
+		}
+		if len(rs) == 0 {
+			continue
+		}
+
+		msgs, _ := rs[0].Expressions[0].Value.([]interface{})
+		if len(msgs) == 0 {
+			continue
+		}
+
+		var reasons []string
+		for _, msg := range msgs {
+			reasons = append(reasons, fmt.Sprint(msg))
+		}
+		sort.Strings(reasons)
+
+		return decision{Code: rule.name, Message: strings.Join(reasons, "; ")}, nil
+	}
+
+	return decision{Allowed: true}, nil
+}
@@ -0,0 +1,53 @@
+# Denies creating containers without a valid expiry label, holding either
+# the time to live of the container, e.g. 8h, or the time it expires at, in
+# RFC 3339 format. Expired containers are reported with -expiry-label.
+#
+# Parameters:
+#   label   - the name of the expiry label (default: expires)
+#   max_ttl - the longest time to live allowed, e.g. 168h (default: none)
+package library.expiry_label
+
+label := object.get(data.params, "label", "expires")
+
+deny[msg] {
+	container_create
+	not input.Body.Labels[label]
+	msg := sprintf("containers must have a %s label", [label])
+}
+
+deny[msg] {
+	container_create
+	value := input.Body.Labels[label]
+	not ttl_ns(value)
+	msg := sprintf("invalid %s label %q, expected a duration such as 8h or an RFC 3339 time", [label, value])
+}
+
+deny[msg] {
+	container_create
+	ttl_ns(input.Body.Labels[label]) <= 0
+	msg := sprintf("the %s label is in the past", [label])
+}
+
+deny[msg] {
+	container_create
+	ttl_ns(input.Body.Labels[label]) > time.parse_duration_ns(data.params.max_ttl)
+	msg := sprintf("the %s label exceeds the maximum time to live of %s", [label, data.params.max_ttl])
+}
+
+deny["request bodies exceeding their limit can not be checked for labels"] {
+	container_create
+	input.BodyTruncated
+}
+
+container_create {
+	input.Method == "POST"
+	endswith(input.PathPlain, "/containers/create")
+}
+
+ttl_ns(value) = ns {
+	ns := time.parse_duration_ns(value)
+}
+
+ttl_ns(value) = ns {
+	ns := time.parse_rfc3339_ns(value) - time.now_ns()
+}
@@ -0,0 +1,32 @@
+# Denies bind mounts of the Docker daemon socket, or of a directory holding
+# it, which would grant the container full control of the host. The source
+# is matched as cleaned by the daemon, and as resolved and canonicalized.
+#
+# Parameters:
+#   paths - the paths of the socket (default: /var/run/docker.sock and
+#           /run/docker.sock)
+package library.no_docker_socket
+
+default_paths = ["/var/run/docker.sock", "/run/docker.sock"]
+
+deny[msg] {
+	mount := input.BindMounts[_]
+	source := {mount.Source, mount.Cleaned, mount.Resolved, mount.Canonical}[_]
+	source != ""
+	exposes(source)
+	msg := sprintf("bind mounts of the Docker socket are not allowed: %s", [mount.Source])
+}
+
+deny["request bodies exceeding their limit can not be checked for bind mounts"] {
+	input.BodyTruncated
+	endswith(input.PathPlain, "/containers/create")
+}
+
+exposes(source) {
+	object.get(data.params, "paths", default_paths)[_] == source
+}
+
+exposes(source) {
+	path := object.get(data.params, "paths", default_paths)[_]
+	startswith(path, concat("", [trim_right(source, "/"), "/"]))
+}
@@ -0,0 +1,34 @@
+# Denies privileged containers, and exec sessions with extended privileges.
+#
+# Parameters:
+#   exempt_users - users allowed to run privileged containers (default: none)
+package library.no_privileged
+
+deny["privileged containers are not allowed"] {
+	input.Body.HostConfig.Privileged == true
+	not exempt(input.User)
+}
+
+deny["privileged exec sessions are not allowed"] {
+	endswith(input.PathPlain, "/exec")
+	input.Body.Privileged == true
+	not exempt(input.User)
+}
+
+deny["request bodies exceeding their limit can not be checked for privileges"] {
+	input.BodyTruncated
+	checked
+	not exempt(input.User)
+}
+
+checked {
+	endswith(input.PathPlain, "/containers/create")
+}
+
+checked {
+	endswith(input.PathPlain, "/exec")
+}
+
+exempt(user) {
+	data.params.exempt_users[_] == user
+}
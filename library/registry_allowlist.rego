@@ -0,0 +1,35 @@
+# Denies pulling images, and creating containers and services, from
+# registries other than the allowed ones. Images referenced by ID are not
+# checked, as they are already present on the host.
+#
+# Parameters:
+#   registries - the allowed registries, e.g. registry.example.com or
+#                docker.io for Docker Hub (required)
+package library.registry_allowlist
+
+deny[msg] {
+	domain := input.Image.Domain
+	not allowed(domain)
+	msg := sprintf("images from %s are not allowed", [domain])
+}
+
+deny["request bodies exceeding their limit can not be checked for images"] {
+	input.BodyTruncated
+	checked
+}
+
+checked {
+	endswith(input.PathPlain, "/containers/create")
+}
+
+checked {
+	endswith(input.PathPlain, "/services/create")
+}
+
+checked {
+	regex.match(`/services/[^/]+/update$`, input.PathPlain)
+}
+
+allowed(domain) {
+	data.params.registries[_] == domain
+}
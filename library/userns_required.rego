@@ -0,0 +1,12 @@
+# Denies containers opting out of the user namespace remapping of the daemon
+# with --userns=host, which would run them as the real root user of the host.
+package library.userns_required
+
+deny["containers may not opt out of user namespaces"] {
+	input.namespaces.userns.host
+}
+
+deny["request bodies exceeding their limit can not be checked for user namespaces"] {
+	input.BodyTruncated
+	endswith(input.PathPlain, "/containers/create")
+}
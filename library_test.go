@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestPolicyLibrary(t *testing.T) {
+
+	l, err := newPolicyLibrary(context.Background(), policyLibraryConfig{Rules: map[string]map[string]interface{}{
+		"no_privileged":      {"exempt_users": []interface{}{"alice"}},
+		"registry_allowlist": {"registries": []interface{}{"registry.example.com"}},
+		"no_docker_socket":   nil,
+		"userns_required":    {},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		note string
+		req  authorization.Request
+		code string
+	}{
+		{
+			note: "allowed",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {}}`),
+		},
+		{
+			note: "privileged",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Privileged": true}}`),
+			code: "no_privileged",
+		},
+		{
+			note: "privileged exempt",
+			req:  containerCreate("alice", `{"Image": "registry.example.com/app:1", "HostConfig": {"Privileged": true}}`),
+		},
+		{
+			note: "registry",
+			req:  containerCreate("bob", `{"Image": "alpine", "HostConfig": {}}`),
+			code: "registry_allowlist",
+		},
+		{
+			note: "docker socket",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Binds": ["/var/run/docker.sock:/var/run/docker.sock"]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "socket directory",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Binds": ["/var/run:/host/run"]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "docker socket double slash",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Binds": ["/run//docker.sock:/var/run/docker.sock"]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "docker socket dot",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Binds": ["/var/run/./docker.sock:/var/run/docker.sock"]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "docker socket dot dot",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Mounts": [{"Type": "bind", "Source": "/var/run/../run/docker.sock", "Target": "/var/run/docker.sock"}]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "socket directory trailing slash",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"Binds": ["/var/run/:/host/run"]}}`),
+			code: "no_docker_socket",
+		},
+		{
+			note: "userns",
+			req:  containerCreate("bob", `{"Image": "registry.example.com/app:1", "HostConfig": {"UsernsMode": "host"}}`),
+			code: "userns_required",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			input, err := makeInput(tc.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := l.eval(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != (tc.code == "") || d.Code != tc.code {
+				t.Fatalf("Expected code %q, got %+v", tc.code, d)
+			}
+			if !d.Allowed && d.Message == "" {
+				t.Fatal("Expected a message")
+			}
+		})
+	}
+}
+
+func TestPolicyLibraryExpiryLabel(t *testing.T) {
+
+	l, err := newPolicyLibrary(context.Background(), policyLibraryConfig{Rules: map[string]map[string]interface{}{
+		"expiry_label": {"label": "ttl", "max_ttl": "168h"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	yesterday := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
+
+	tests := map[string]struct {
+		req     authorization.Request
+		allowed bool
+	}{
+		"duration":    {containerCreate("bob", `{"Labels": {"ttl": "8h"}}`), true},
+		"time":        {containerCreate("bob", `{"Labels": {"ttl": "`+tomorrow+`"}}`), true},
+		"missing":     {containerCreate("bob", `{"Labels": {"team": "a"}}`), false},
+		"no labels":   {containerCreate("bob", `{}`), false},
+		"invalid":     {containerCreate("bob", `{"Labels": {"ttl": "tomorrow"}}`), false},
+		"past":        {containerCreate("bob", `{"Labels": {"ttl": "`+yesterday+`"}}`), false},
+		"too long":    {containerCreate("bob", `{"Labels": {"ttl": "720h"}}`), false},
+		"volume":      {authorization.Request{RequestMethod: "POST", RequestURI: "/v1.41/volumes/create", RequestBody: []byte(`{}`)}, true},
+		"other label": {containerCreate("bob", `{"Labels": {"expires": "8h"}}`), false},
+	}
+
+	for note, tc := range tests {
+		input, err := makeInput(tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := l.eval(context.Background(), input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != tc.allowed {
+			t.Errorf("%s: expected allowed %v, got %+v", note, tc.allowed, d)
+		}
+	}
+}
+
+func TestPolicyLibraryTruncatedBody(t *testing.T) {
+
+	create := containerCreate("bob", "")
+	exec := authorization.Request{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/abc/exec"}
+	update := authorization.Request{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/services/web/update?version=3"}
+	volume := authorization.Request{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/volumes/create"}
+
+	tests := []struct {
+		rule    string
+		params  map[string]interface{}
+		req     authorization.Request
+		allowed bool
+	}{
+		{"no_privileged", nil, create, false},
+		{"no_privileged", nil, exec, false},
+		{"no_privileged", map[string]interface{}{"exempt_users": []interface{}{"bob"}}, create, true},
+		{"no_privileged", nil, volume, true},
+		{"no_docker_socket", nil, create, false},
+		{"no_docker_socket", nil, volume, true},
+		{"userns_required", nil, create, false},
+		{"userns_required", nil, volume, true},
+		{"registry_allowlist", map[string]interface{}{"registries": []interface{}{"docker.io"}}, create, false},
+		{"registry_allowlist", map[string]interface{}{"registries": []interface{}{"docker.io"}}, update, false},
+		{"registry_allowlist", map[string]interface{}{"registries": []interface{}{"docker.io"}}, volume, true},
+		{"expiry_label", nil, create, false},
+		{"expiry_label", nil, volume, true},
+	}
+
+	for _, tc := range tests {
+		l, err := newPolicyLibrary(context.Background(), policyLibraryConfig{Rules: map[string]map[string]interface{}{tc.rule: tc.params}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		input, err := makeInput(tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.(map[string]interface{})["BodyTruncated"] = true
+
+		d, err := l.eval(context.Background(), input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != tc.allowed || (!d.Allowed && d.Code != tc.rule) {
+			t.Errorf("%s %s %s: expected allowed %v, got %+v", tc.rule, tc.params, tc.req.RequestURI, tc.allowed, d)
+		}
+	}
+}
+
+func TestPolicyLibraryConfig(t *testing.T) {
+
+	if _, err := newPolicyLibrary(context.Background(), policyLibraryConfig{Rules: map[string]map[string]interface{}{"no_root": {}}}); err == nil {
+		t.Error("Expected error for unknown rule")
+	}
+
+	if _, err := newPolicyLibrary(context.Background(), policyLibraryConfig{Rules: map[string]map[string]interface{}{"registry_allowlist": {}}}); err == nil {
+		t.Error("Expected error for missing parameter")
+	}
+}
+
+func TestPolicyLibraryWithoutPolicy(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "library.yaml")
+	if err := os.WriteFile(file, []byte("rules:\n  no_privileged: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := loadPolicyLibrary(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{
+		allowPath: "data.docker.authz.allow",
+		quiet:     true,
+		overlay:   newRuntimeOverlay(),
+		history:   newDecisionHistory(decisionHistorySize),
+		library:   l,
+	}
+
+	resp := p.AuthZReq(containerCreate("bob", `{"HostConfig": {"Privileged": true}}`))
+	if resp.Allow || resp.Msg != "privileged containers are not allowed (code: no_privileged)" {
+		t.Fatalf("Expected denial by the library, got %+v", resp)
+	}
+
+	if resp := p.AuthZReq(containerCreate("bob", `{"HostConfig": {}}`)); !resp.Allow {
+		t.Fatalf("Expected request to be allowed, got %+v", resp)
+	}
+}
+
+func containerCreate(user, body string) authorization.Request {
+	return authorization.Request{
+		User:           user,
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.41/containers/create",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(body),
+	}
+}
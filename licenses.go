@@ -0,0 +1,261 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ImageLicenses is the entry of an image in data.licenses, keyed by the
+// digest the image was pulled by.
+type ImageLicenses struct {
+	// References are the repository digests of the image, e.g.
+	// docker.io/library/nginx@sha256:....
+	References []string `json:"references"`
+
+	// SBOMs is the number of SBOMs attached to the image. Images without
+	// SBOMs have no packages nor licenses.
+	SBOMs    int           `json:"sboms"`
+	Licenses []string      `json:"licenses"`
+	Packages []SBOMPackage `json:"packages"`
+	Indexed  time.Time     `json:"indexed"`
+}
+
+// dockerImage is the part of an image listed by the daemon read by the
+// plugin.
+type dockerImage struct {
+	ID          string `json:"Id"`
+	RepoDigests []string
+}
+
+// licenseIndexer indexes the licenses of the packages of the images of the
+// daemon, read from the SBOMs attached to them in their registries, and
+// publishes the index to policies as data.licenses. Images are indexed when
+// they are pulled, and on an interval, which also looks up again the SBOMs of
+// the images that had none. The index is persisted in the state store, since
+// the SBOMs of a digest do not change once found.
+type licenseIndexer struct {
+	docker   *dockerClient
+	registry *registryClient
+	bucket   *storeBucket
+	state    *stateDocuments
+	interval time.Duration
+	pulled   chan struct{}
+
+	mu     sync.Mutex
+	images map[string]*ImageLicenses
+}
+
+func newLicenseIndexer(docker *dockerClient, registry *registryClient, store *stateStore, state *stateDocuments, interval time.Duration) (*licenseIndexer, error) {
+
+	x := &licenseIndexer{
+		docker:   docker,
+		registry: registry,
+		bucket:   store.bucket("licenses/images"),
+		state:    state,
+		interval: interval,
+		pulled:   make(chan struct{}, 1),
+		images:   map[string]*ImageLicenses{},
+	}
+
+	err := x.bucket.forEach(func(digest string, value json.RawMessage) error {
+		var image ImageLicenses
+		if err := json.Unmarshal(value, &image); err != nil {
+			return err
+		}
+		x.images[digest] = &image
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	x.publish()
+	x.mu.Unlock()
+
+	return x, nil
+}
+
+// run indexes the images of the daemon on the interval, and as soon as
+// images are pulled or tagged, until ctx is done.
+func (x *licenseIndexer) run(ctx context.Context) {
+
+	go x.watch(ctx)
+
+	for {
+		if err := x.scan(ctx); err != nil {
+			log.Printf("Failed to index the licenses of images: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-x.pulled:
+		case <-time.After(x.interval):
+		}
+	}
+}
+
+// watch wakes run up whenever the daemon reports an image pulled or tagged.
+func (x *licenseIndexer) watch(ctx context.Context) {
+
+	filters := map[string][]string{
+		"type":  {"image"},
+		"event": {"pull", "tag"},
+	}
+
+	for {
+		err := x.docker.events(ctx, time.Time{}, filters, func(dockerEvent) {
+			select {
+			case x.pulled <- struct{}{}:
+			default:
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			log.Printf("Docker event stream ended, reconnecting: %v", err)
+		}
+	}
+}
+
+// scan indexes the images of the daemon that are not indexed yet, or had no
+// SBOMs, and drops the images that were removed. Images whose SBOMs cannot be
+// fetched are logged and indexed on the next scan.
+func (x *licenseIndexer) scan(ctx context.Context) error {
+
+	var images []dockerImage
+	if err := x.docker.get(ctx, "/images/json", &images); err != nil {
+		return err
+	}
+
+	listed := map[string][]string{}
+	for _, image := range images {
+		for _, repoDigest := range image.RepoDigests {
+			named, err := reference.ParseNormalizedNamed(repoDigest)
+			if err != nil {
+				continue
+			}
+			digested, ok := named.(reference.Digested)
+			if !ok {
+				continue
+			}
+			digest := digested.Digest().String()
+			listed[digest] = append(listed[digest], named.String())
+		}
+	}
+
+	digests := make([]string, 0, len(listed))
+	for digest := range listed {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	for _, digest := range digests {
+		refs := listed[digest]
+		sort.Strings(refs)
+
+		x.mu.Lock()
+		image := x.images[digest]
+		x.mu.Unlock()
+		if image != nil && image.SBOMs > 0 {
+			continue
+		}
+
+		image, err := x.index(ctx, refs)
+		if err != nil {
+			log.Printf("Failed to index the licenses of %s: %v", refs[0], err)
+			continue
+		}
+
+		x.mu.Lock()
+		x.images[digest] = image
+		if err := x.bucket.put(digest, image); err != nil {
+			log.Printf("Failed to persist the licenses of %s: %v", refs[0], err)
+		}
+		x.publish()
+		x.mu.Unlock()
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	removed := false
+	for digest := range x.images {
+		if _, ok := listed[digest]; ok {
+			continue
+		}
+		delete(x.images, digest)
+		if err := x.bucket.delete(digest); err != nil {
+			log.Printf("Failed to persist the licenses of images: %v", err)
+		}
+		removed = true
+	}
+	if removed {
+		x.publish()
+	}
+
+	return nil
+}
+
+// index returns the licenses of the image at the repository digests refs,
+// from the SBOMs attached to it in the registry of the first one.
+func (x *licenseIndexer) index(ctx context.Context, refs []string) (*ImageLicenses, error) {
+
+	named, err := reference.ParseNormalizedNamed(refs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	sboms, err := x.registry.fetchSBOMs(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+
+	image := &ImageLicenses{
+		References: refs,
+		SBOMs:      len(sboms),
+		Licenses:   []string{},
+		Packages:   []SBOMPackage{},
+		Indexed:    time.Now().UTC(),
+	}
+
+	licenses := map[string]bool{}
+	for _, sbom := range sboms {
+		for _, pkg := range sbom.Packages {
+			image.Packages = append(image.Packages, pkg)
+			for _, license := range pkg.Licenses {
+				licenses[license] = true
+			}
+		}
+	}
+	for license := range licenses {
+		image.Licenses = append(image.Licenses, license)
+	}
+	sort.Strings(image.Licenses)
+
+	return image, nil
+}
+
+// publish sets data.licenses. Callers must hold x.mu.
+func (x *licenseIndexer) publish() {
+
+	images := make(map[string]interface{}, len(x.images))
+	for digest, image := range x.images {
+		images[digest] = image
+	}
+
+	x.state.set("licenses", images)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func licenseIndex(t *testing.T, state *stateDocuments) map[string]interface{} {
+
+	doc := map[string]interface{}{}
+	if err := state.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	return doc["licenses"].(map[string]interface{})
+}
+
+func TestLicenseIndexer(t *testing.T) {
+
+	app := "sha256:" + strings.Repeat("a", 64)
+	bare := "sha256:" + strings.Repeat("b", 64)
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/" + app:
+			w.Header().Set("Docker-Content-Digest", app)
+			_, _ = w.Write([]byte(`{"mediaType": "application/vnd.oci.image.manifest.v1+json"}`))
+		case "/v2/team/app/referrers/" + app:
+			_, _ = w.Write([]byte(`{"manifests": [{"digest": "sha256:spdx", "artifactType": "application/spdx+json"}]}`))
+		case "/v2/team/app/manifests/sha256:spdx":
+			_, _ = w.Write([]byte(`{"layers": [{"mediaType": "application/spdx+json", "digest": "sha256:doc"}]}`))
+		case "/v2/team/app/blobs/sha256:doc":
+			_, _ = w.Write([]byte(`{"packages": [
+				{"name": "busybox", "versionInfo": "1.36.1", "licenseConcluded": "GPL-2.0-only"},
+				{"name": "ghostscript", "versionInfo": "10.02.1", "licenseDeclared": "AGPL-3.0-or-later"},
+				{"name": "zlib", "versionInfo": "1.3.1", "licenseConcluded": "Zlib"},
+				{"name": "musl", "versionInfo": "1.2.4", "licenseConcluded": "MIT"},
+				{"name": "ssl_client", "versionInfo": "1.36.1", "licenseConcluded": "GPL-2.0-only"}
+			]}`))
+		case "/v2/team/bare/manifests/" + bare:
+			w.Header().Set("Docker-Content-Digest", bare)
+			_, _ = w.Write([]byte(`{"mediaType": "application/vnd.oci.image.manifest.v1+json"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "https://")
+	images := `[
+		{"Id": "sha256:1", "RepoDigests": ["` + host + `/team/app@` + app + `"]},
+		{"Id": "sha256:2", "RepoDigests": ["` + host + `/team/bare@` + bare + `"]},
+		{"Id": "sha256:3", "RepoDigests": []}
+	]`
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write([]byte(images))
+	}))
+	defer daemon.Close()
+
+	docker, err := newDockerClient(strings.Replace(daemon.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newRegistryClient("", "", "", nil, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.client = registry.Client()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := newStateDocuments()
+	x, err := newLicenseIndexer(docker, client, store, state, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := licenseIndex(t, state); len(index) != 0 {
+		t.Fatalf("Expected an empty index, got %v", index)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := x.scan(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := licenseIndex(t, state)
+	if len(index) != 2 {
+		t.Fatalf("Expected 2 images, got %v", index)
+	}
+	entry := index[app].(map[string]interface{})
+	if fmt.Sprint(entry["sboms"]) != "1" || len(entry["packages"].([]interface{})) != 5 {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+	licenses := entry["licenses"].([]interface{})
+	expected := []string{"AGPL-3.0-or-later", "GPL-2.0-only", "MIT", "Zlib"}
+	if len(licenses) != len(expected) {
+		t.Fatalf("Expected licenses %v, got %v", expected, licenses)
+	}
+	for i := range expected {
+		if licenses[i] != expected[i] {
+			t.Fatalf("Expected licenses %v, got %v", expected, licenses)
+		}
+	}
+	if entry := index[bare].(map[string]interface{}); fmt.Sprint(entry["sboms"]) != "0" || len(entry["licenses"].([]interface{})) != 0 {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+
+	// Indexed SBOMs are not fetched again, while images without SBOMs are
+	// looked up on every scan.
+	mu.Lock()
+	if n := requests["/v2/team/app/blobs/sha256:doc"]; n != 1 {
+		t.Fatalf("Expected 1 SBOM fetch, got %d", n)
+	}
+	if n := requests["/v2/team/bare/manifests/"+bare]; n != 2 {
+		t.Fatalf("Expected 2 lookups of the image without SBOMs, got %d", n)
+	}
+	images = `[{"Id": "sha256:1", "RepoDigests": ["` + host + `/team/app@` + app + `"]}]`
+	mu.Unlock()
+
+	// Removed images are dropped from the index.
+	if err := x.scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if index := licenseIndex(t, state); len(index) != 1 || index[app] == nil {
+		t.Fatalf("Expected the removed image to be dropped, got %v", index)
+	}
+
+	// The index survives a restart.
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = openStateStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	state = newStateDocuments()
+	if _, err := newLicenseIndexer(docker, client, store, state, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if index := licenseIndex(t, state); len(index) != 1 || index[app] == nil {
+		t.Fatalf("Expected the persisted index, got %v", index)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// RestartPolicy is the input.restart document: the restart policy of
+// a container being created or updated, or of the tasks of a service.
+type RestartPolicy struct {
+	// Name is no, always, on-failure or unless-stopped. The any and none
+	// conditions of services are reported as always and no.
+	Name string `json:"name"`
+
+	// MaxRetries bounds the restarts of the on-failure policy, or of
+	// services, and is 0 when unbounded.
+	MaxRetries int `json:"max_retries"`
+}
+
+// serviceRestartConditions maps the restart conditions of services to the
+// restart policies of containers.
+var serviceRestartConditions = map[string]string{
+	"":           "always",
+	"any":        "always",
+	"none":       "no",
+	"on-failure": "on-failure",
+}
+
+// Healthcheck is the input.healthcheck document: the healthcheck of a
+// container being created, or of the tasks of a service.
+type Healthcheck struct {
+	// Defined is true when the request defines a test. When it does not,
+	// the HEALTHCHECK of the image, if any, applies.
+	Defined bool `json:"defined"`
+
+	// Disabled is true when the request disables the healthcheck of the
+	// image, as --no-healthcheck does.
+	Disabled bool `json:"disabled"`
+
+	Test []string `json:"test"`
+
+	// The durations are 0 when the defaults apply.
+	IntervalSeconds    float64 `json:"interval_seconds"`
+	TimeoutSeconds     float64 `json:"timeout_seconds"`
+	StartPeriodSeconds float64 `json:"start_period_seconds"`
+	Retries            int     `json:"retries"`
+}
+
+// requestedRestartPolicy returns the restart policy of container create and
+// update requests, and of service create and update requests, or nil for any
+// other request. Container updates that leave the policy unchanged have none.
+func requestedRestartPolicy(method, path string, body map[string]interface{}) *RestartPolicy {
+
+	if task := serviceTaskTemplate(method, path, body); task != nil {
+		policy, _ := task["RestartPolicy"].(map[string]interface{})
+		condition, _ := policy["Condition"].(string)
+		attempts, _ := policy["MaxAttempts"].(float64)
+		name, ok := serviceRestartConditions[condition]
+		if !ok {
+			name = condition
+		}
+		return &RestartPolicy{Name: name, MaxRetries: int(attempts)}
+	}
+
+	if method != "POST" {
+		return nil
+	}
+
+	var policy map[string]interface{}
+	switch containerAction(path) {
+	case "create":
+		hostConfig, _ := body["HostConfig"].(map[string]interface{})
+		policy, _ = hostConfig["RestartPolicy"].(map[string]interface{})
+	case "update":
+		var ok bool
+		if policy, ok = body["RestartPolicy"].(map[string]interface{}); !ok {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	name, _ := policy["Name"].(string)
+	if name == "" {
+		name = "no"
+	}
+	retries, _ := policy["MaximumRetryCount"].(float64)
+
+	return &RestartPolicy{Name: name, MaxRetries: int(retries)}
+}
+
+// requestedHealthcheck returns the healthcheck of container create requests
+// and of service create and update requests, or nil for any other request.
+func requestedHealthcheck(method, path string, body map[string]interface{}) *Healthcheck {
+
+	var config map[string]interface{}
+	if task := serviceTaskTemplate(method, path, body); task != nil {
+		spec, _ := task["ContainerSpec"].(map[string]interface{})
+		config, _ = spec["Healthcheck"].(map[string]interface{})
+	} else if method == "POST" && containerAction(path) == "create" {
+		config, _ = body["Healthcheck"].(map[string]interface{})
+	} else {
+		return nil
+	}
+
+	seconds := func(key string) float64 {
+		ns, _ := config[key].(float64)
+		return time.Duration(ns).Seconds()
+	}
+	retries, _ := config["Retries"].(float64)
+
+	check := &Healthcheck{
+		Test:               append([]string{}, stringList(config["Test"])...),
+		IntervalSeconds:    seconds("Interval"),
+		TimeoutSeconds:     seconds("Timeout"),
+		StartPeriodSeconds: seconds("StartPeriod"),
+		Retries:            int(retries),
+	}
+	if len(check.Test) > 0 {
+		check.Disabled = check.Test[0] == "NONE"
+		check.Defined = !check.Disabled
+	}
+
+	return check
+}
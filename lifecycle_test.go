@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRequestedRestartPolicy(t *testing.T) {
+	tests := []struct {
+		path     string
+		body     string
+		expected *RestartPolicy
+	}{
+		{"/v1.41/containers/create", `{"HostConfig": {}}`, &RestartPolicy{Name: "no"}},
+		{"/v1.41/containers/create", `{"HostConfig": {"RestartPolicy": {"Name": "on-failure", "MaximumRetryCount": 3}}}`, &RestartPolicy{Name: "on-failure", MaxRetries: 3}},
+		{"/v1.41/containers/abc/update", `{"RestartPolicy": {"Name": "unless-stopped"}}`, &RestartPolicy{Name: "unless-stopped"}},
+		{"/v1.41/containers/abc/update", `{"Memory": 1024}`, nil},
+		{"/v1.41/services/create", `{"TaskTemplate": {"ContainerSpec": {}}}`, &RestartPolicy{Name: "always"}},
+		{"/v1.41/services/abc/update", `{"TaskTemplate": {"RestartPolicy": {"Condition": "none", "MaxAttempts": 2}}}`, &RestartPolicy{Name: "no", MaxRetries: 2}},
+		{"/v1.41/containers/abc/start", `{}`, nil},
+	}
+
+	for _, tc := range tests {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := requestedRestartPolicy("POST", tc.path, body); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %+v for %s %s, got %+v", tc.expected, tc.path, tc.body, got)
+		}
+	}
+}
+
+func TestRequestedHealthcheck(t *testing.T) {
+	tests := []struct {
+		path     string
+		body     string
+		expected *Healthcheck
+	}{
+		{"/v1.41/containers/create", `{}`, &Healthcheck{Test: []string{}}},
+		{
+			"/v1.41/containers/create",
+			`{"Healthcheck": {"Test": ["CMD-SHELL", "curl -f http://localhost/"], "Interval": 30000000000, "Timeout": 5000000000, "Retries": 3}}`,
+			&Healthcheck{Defined: true, Test: []string{"CMD-SHELL", "curl -f http://localhost/"}, IntervalSeconds: 30, TimeoutSeconds: 5, Retries: 3},
+		},
+		{"/v1.41/containers/create", `{"Healthcheck": {"Test": ["NONE"]}}`, &Healthcheck{Disabled: true, Test: []string{"NONE"}}},
+		{
+			"/v1.41/services/create",
+			`{"TaskTemplate": {"ContainerSpec": {"Healthcheck": {"Test": ["CMD", "/healthz"], "StartPeriod": 1500000000}}}}`,
+			&Healthcheck{Defined: true, Test: []string{"CMD", "/healthz"}, StartPeriodSeconds: 1.5},
+		},
+		{"/v1.41/containers/abc/update", `{"Healthcheck": {"Test": ["NONE"]}}`, nil},
+	}
+
+	for _, tc := range tests {
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := requestedHealthcheck("POST", tc.path, body); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %+v for %s %s, got %+v", tc.expected, tc.path, tc.body, got)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+)
+
+const (
+	// lintPathVersion reports request paths matched without allowing for
+	// the API version prefix.
+	lintPathVersion = "path-version"
+
+	// lintUntested reports rules not exercised by any test.
+	lintUntested = "untested-rule"
+)
+
+// lintFinding is a problem reported by lint, at a location of a module.
+type lintFinding struct {
+	location *ast.Location
+	rule     string
+	msg      string
+}
+
+func (f lintFinding) String() string {
+
+	prefix := ""
+	if f.location != nil {
+		prefix = fmt.Sprintf("%s:%d: ", f.location.File, f.location.Row)
+	}
+
+	return fmt.Sprintf("%swarning: %s (%s)", prefix, f.msg, f.rule)
+}
+
+// pathRefs are the fields of the input holding the request path with its API
+// version prefix.
+var pathRefs = []ast.Ref{
+	ast.MustParseRef("input.Path"),
+	ast.MustParseRef("input.PathPlain"),
+}
+
+// pathMatcher describes a builtin comparing the request path against a
+// string, given as the operand at index (any operand when -1), which does
+// not allow for the API version prefix when it matches unversioned.
+type pathMatcher struct {
+	operand     int
+	unversioned *regexp.Regexp
+}
+
+var (
+	unversionedPath    = regexp.MustCompile(`^/([^v_]|v[a-z_])`)
+	unversionedPattern = regexp.MustCompile(`^\^/([^v_]|v[a-z_])`)
+	unversionedGlob    = regexp.MustCompile(`^/([^v_*]|v[a-z_])`)
+)
+
+var pathMatchers = map[string]pathMatcher{
+	ast.Equality.Name:             {-1, unversionedPath},
+	ast.Equal.Name:                {-1, unversionedPath},
+	ast.StartsWith.Name:           {1, unversionedPath},
+	ast.RegexMatch.Name:           {0, unversionedPattern},
+	ast.RegexMatchDeprecated.Name: {0, unversionedPattern},
+	ast.GlobMatch.Name:            {0, unversionedGlob},
+}
+
+// lintPathVersions reports comparisons of the request path against literals
+// that do not allow for the API version prefix, which the Docker CLI always
+// sends. Such rules silently never match.
+func lintPathVersions(modules map[string]*ast.Module) []lintFinding {
+
+	var findings []lintFinding
+	for _, name := range sortedModuleNames(modules) {
+		ast.WalkExprs(modules[name], func(expr *ast.Expr) bool {
+			if !expr.IsCall() {
+				return false
+			}
+			matcher, ok := pathMatchers[expr.Operator().String()]
+			if !ok {
+				return false
+			}
+
+			operands := expr.Operands()
+			if !refersToPath(operands) {
+				return false
+			}
+
+			for i, term := range operands {
+				if matcher.operand >= 0 && i != matcher.operand {
+					continue
+				}
+				s, ok := term.Value.(ast.String)
+				if !ok || !matcher.unversioned.MatchString(string(s)) {
+					continue
+				}
+				findings = append(findings, lintFinding{
+					location: expr.Location,
+					rule:     lintPathVersion,
+					msg:      fmt.Sprintf("request path compared with %s, which does not allow for the API version prefix (e.g. /v1.41); use input.PathArr, or allow for the prefix", s),
+				})
+			}
+
+			return false
+		})
+	}
+
+	return findings
+}
+
+func refersToPath(terms []*ast.Term) bool {
+
+	for _, term := range terms {
+		ref, ok := term.Value.(ast.Ref)
+		if !ok {
+			continue
+		}
+		for _, path := range pathRefs {
+			if ref.Equal(path) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lintUntestedRules reports the rules of the compiled modules that no test
+// depends on, directly or through other rules.
+func lintUntestedRules(compiler *ast.Compiler) []lintFinding {
+
+	var tests []*ast.Rule
+	for _, name := range sortedModuleNames(compiler.Modules) {
+		for _, rule := range compiler.Modules[name].Rules {
+			if strings.HasPrefix(string(rule.Head.Name), "test_") {
+				tests = append(tests, rule)
+			}
+		}
+	}
+
+	if len(tests) == 0 {
+		return []lintFinding{{rule: lintUntested, msg: "no tests found, add test_ rules run with opa test"}}
+	}
+
+	covered := map[*ast.Rule]bool{}
+	queue := append([]*ast.Rule(nil), tests...)
+	for len(queue) > 0 {
+		rule := queue[0]
+		queue = queue[1:]
+		if covered[rule] {
+			continue
+		}
+		covered[rule] = true
+		ast.WalkRefs(rule, func(ref ast.Ref) bool {
+			if ref.HasPrefix(ast.DefaultRootRef) {
+				queue = append(queue, compiler.GetRules(ref)...)
+			}
+			return false
+		})
+	}
+
+	var findings []lintFinding
+	reported := map[string]bool{}
+	for _, name := range sortedModuleNames(compiler.Modules) {
+		for _, rule := range compiler.Modules[name].Rules {
+			path := rule.Path().String()
+			if covered[rule] || reported[path] || strings.HasPrefix(string(rule.Head.Name), "test_") {
+				continue
+			}
+			reported[path] = true
+			findings = append(findings, lintFinding{
+				location: rule.Location,
+				rule:     lintUntested,
+				msg:      fmt.Sprintf("rule %s is not exercised by any test", path),
+			})
+		}
+	}
+
+	return findings
+}
+
+func sortedModuleNames(modules map[string]*ast.Module) []string {
+
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// lintPolicy compiles the modules found at paths, checking their references
+// to the input against the input schema of the plugin unless noSchema, and
+// returns the compilation errors and the findings of the enabled lint rules.
+func lintPolicy(paths []string, noSchema bool, disabled map[string]bool) (ast.Errors, []lintFinding, error) {
+
+	result, err := loader.NewFileLoader().Filtered(paths, func(_ string, info os.FileInfo, _ int) bool {
+		return !info.IsDir() && !strings.HasSuffix(info.Name(), ".rego")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	modules := map[string]*ast.Module{}
+	for _, m := range result.Modules {
+		modules[m.Name] = m.Parsed
+	}
+	if len(modules) == 0 {
+		return nil, nil, fmt.Errorf("no .rego files found in %s", strings.Join(paths, ", "))
+	}
+
+	compiler := ast.NewCompiler().SetErrorLimit(0)
+	if !noSchema {
+		schemas := ast.NewSchemaSet()
+		schemas.Put(ast.SchemaRootRef, inputSchema(defaultInputVersion))
+		compiler = compiler.WithSchemas(schemas)
+	}
+
+	var findings []lintFinding
+	if !disabled[lintPathVersion] {
+		findings = append(findings, lintPathVersions(modules)...)
+	}
+
+	if compiler.Compile(modules); compiler.Failed() {
+		return compiler.Errors, findings, nil
+	}
+
+	if !disabled[lintUntested] {
+		findings = append(findings, lintUntestedRules(compiler)...)
+	}
+
+	return nil, findings, nil
+}
+
+// runLint implements the lint subcommand, which checks policies as opa check
+// does, and reports Docker-specific problems. The exit code is 0 when the
+// policy is clean, 1 when it has errors or warnings and 2 on usage errors.
+func runLint(args []string) int {
+	return lint(os.Stdout, os.Stderr, args)
+}
+
+func lint(stdout, stderr io.Writer, args []string) int {
+
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	noSchema := fs.Bool("no-schema", false, "do not check references to the input against the input schema of the plugin")
+	disable := fs.String("disable", "", fmt.Sprintf("comma separated lint rules not reported (%s, %s)", lintPathVersion, lintUntested))
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		_, _ = fmt.Fprintln(stderr, "usage: opa-docker-authz lint [-no-schema] [-disable <rules>] <file or directory>...")
+		return 2
+	}
+
+	disabled := map[string]bool{}
+	for _, rule := range splitList(*disable) {
+		if rule != lintPathVersion && rule != lintUntested {
+			_, _ = fmt.Fprintf(stderr, "unknown lint rule %q\n", rule)
+			return 2
+		}
+		disabled[rule] = true
+	}
+
+	errs, findings, err := lintPolicy(fs.Args(), *noSchema, disabled)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	for _, err := range errs {
+		_, _ = fmt.Fprintln(stdout, err)
+	}
+	for _, f := range findings {
+		_, _ = fmt.Fprintln(stdout, f)
+	}
+
+	if len(errs) > 0 || len(findings) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLintPolicy(t *testing.T, files map[string]string) string {
+
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestLintPathVersion(t *testing.T) {
+
+	dir := writeLintPolicy(t, map[string]string{"authz.rego": `package docker.authz
+
+deny_create {
+	input.PathPlain == "/containers/create"
+}
+
+deny_images {
+	regex.match("^/images/.*", input.Path)
+}
+
+deny_volumes {
+	startswith(input.PathPlain, "/volumes")
+}
+
+allowed {
+	input.PathPlain == "/v1.41/containers/create"
+}
+
+allowed {
+	regex.match("^(/v[0-9.]+)?/containers", input.Path)
+}
+
+allowed {
+	glob.match("/v*/volumes/*", ["/"], input.PathPlain)
+}
+
+allowed {
+	input.Path == "/_ping"
+}
+
+allowed {
+	input.PathArr[1] == "containers"
+}
+`})
+
+	var stdout, stderr bytes.Buffer
+	if code := lint(&stdout, &stderr, []string{"-disable", lintUntested, dir}); code != 1 {
+		t.Fatalf("Expected exit code 1, got %d: %s", code, stderr.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 findings, got %v", lines)
+	}
+	for i, want := range []string{`authz.rego:4: warning: request path compared with "/containers/create"`, `authz.rego:8: warning: request path compared with "^/images/.*"`, `authz.rego:12: warning: request path compared with "/volumes"`} {
+		if !strings.Contains(lines[i], want) || !strings.HasSuffix(lines[i], "(path-version)") {
+			t.Errorf("Expected %q, got %q", want, lines[i])
+		}
+	}
+}
+
+func TestLintUntestedRules(t *testing.T) {
+
+	dir := writeLintPolicy(t, map[string]string{
+		"authz.rego": `package docker.authz
+
+default allow = false
+
+allow {
+	not privileged
+}
+
+privileged {
+	input.Body.HostConfig.Privileged
+}
+
+unused {
+	input.User == "alice"
+}
+`,
+		"authz_test.rego": `package docker.authz
+
+test_allow {
+	allow with input as {"Body": {"HostConfig": {"Privileged": false}}}
+}
+`,
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := lint(&stdout, &stderr, []string{dir}); code != 1 {
+		t.Fatalf("Expected exit code 1, got %d: %s", code, stderr.String())
+	}
+
+	// privileged is exercised through allow.
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "rule data.docker.authz.unused is not exercised by any test (untested-rule)") {
+		t.Fatalf("Expected unused to be reported, got %v", lines)
+	}
+
+	stdout.Reset()
+	if code := lint(&stdout, &stderr, []string{"-disable", lintUntested, dir}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stdout.String())
+	}
+}
+
+func TestLintNoTests(t *testing.T) {
+
+	dir := writeLintPolicy(t, map[string]string{"authz.rego": "package docker.authz\n\nallow = true\n"})
+
+	var stdout, stderr bytes.Buffer
+	if code := lint(&stdout, &stderr, []string{dir}); code != 1 {
+		t.Fatalf("Expected exit code 1, got %d", code)
+	}
+	if got := stdout.String(); !strings.Contains(got, "no tests found") {
+		t.Fatalf("Expected missing tests to be reported, got %q", got)
+	}
+}
+
+func TestLintSchema(t *testing.T) {
+
+	dir := writeLintPolicy(t, map[string]string{"authz.rego": `package docker.authz
+
+allow {
+	input.Imagee.Domain == "docker.io"
+}
+`})
+
+	var stdout, stderr bytes.Buffer
+	if code := lint(&stdout, &stderr, []string{"-disable", lintUntested, dir}); code != 1 {
+		t.Fatalf("Expected exit code 1, got %d", code)
+	}
+	if got := stdout.String(); !strings.Contains(got, "undefined ref: input.Imagee.Domain") {
+		t.Fatalf("Expected a type error, got %q", got)
+	}
+
+	stdout.Reset()
+	if code := lint(&stdout, &stderr, []string{"-no-schema", "-disable", lintUntested, dir}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stdout.String())
+	}
+}
+
+func TestLintScaffold(t *testing.T) {
+
+	dir := t.TempDir()
+	if code := runInit([]string{"-dir", dir}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := lint(&stdout, &stderr, []string{dir}); code != 0 {
+		t.Fatalf("Expected the starter policy to be clean, got exit code %d: %s%s", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestLintUsage(t *testing.T) {
+
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{nil, {"-disable", "unknown", "."}, {t.TempDir()}} {
+		if code := lint(&stdout, &stderr, args); code != 2 {
+			t.Errorf("Expected exit code 2 for %v, got %d", args, code)
+		}
+	}
+}
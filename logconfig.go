@@ -0,0 +1,104 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// logEndpointOptions are the options of the log drivers of Docker naming the
+// remote endpoint logs are sent to.
+var logEndpointOptions = map[string]bool{
+	"syslog-address":   true,
+	"gelf-address":     true,
+	"fluentd-address":  true,
+	"splunk-url":       true,
+	"awslogs-endpoint": true,
+	"loki-url":         true,
+}
+
+// LogConfig is the input.log_config document: the log driver of a container
+// being created and its options.
+type LogConfig struct {
+	// Driver is the log driver, empty when the daemon's default applies.
+	Driver string `json:"driver"`
+
+	Options map[string]string `json:"options"`
+
+	// Endpoints lists the remote endpoints the options send logs to.
+	Endpoints []LogEndpoint `json:"endpoints"`
+}
+
+// LogEndpoint is a remote endpoint of a log driver.
+type LogEndpoint struct {
+	Option string `json:"option"`
+	URL    string `json:"url"`
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	Port   string `json:"port"`
+}
+
+// requestedLogConfig returns the log configuration of container create
+// requests, or nil for any other request.
+func requestedLogConfig(method, path string, body map[string]interface{}) *LogConfig {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	logConfig, _ := hostConfig["LogConfig"].(map[string]interface{})
+	options, _ := logConfig["Config"].(map[string]interface{})
+
+	result := &LogConfig{Options: map[string]string{}, Endpoints: []LogEndpoint{}}
+	result.Driver, _ = logConfig["Type"].(string)
+
+	for key, v := range options {
+		value, _ := v.(string)
+		result.Options[key] = value
+		if logEndpointOptions[key] && value != "" {
+			result.Endpoints = append(result.Endpoints, parseLogEndpoint(key, value))
+		}
+	}
+
+	sort.Slice(result.Endpoints, func(i, j int) bool {
+		return result.Endpoints[i].Option < result.Endpoints[j].Option
+	})
+
+	return result
+}
+
+// parseLogEndpoint parses the address of a log driver, e.g.
+// udp://192.168.0.42:514, or host:port for the fluentd driver.
+func parseLogEndpoint(option, value string) LogEndpoint {
+
+	endpoint := LogEndpoint{Option: option, URL: value}
+
+	if !strings.Contains(value, "://") {
+		endpoint.Host, endpoint.Port, _ = net.SplitHostPort(value)
+		if endpoint.Host == "" {
+			endpoint.Host = value
+		}
+		return endpoint
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return endpoint
+	}
+
+	endpoint.Scheme = u.Scheme
+	if u.Scheme == "unix" || u.Scheme == "unixgram" {
+		endpoint.Host = u.Path
+	} else {
+		endpoint.Host = u.Hostname()
+		endpoint.Port = u.Port()
+	}
+
+	return endpoint
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRequestedLogConfig(t *testing.T) {
+
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(`{"HostConfig": {"LogConfig": {"Type": "syslog", "Config": {
+		"syslog-address": "udp://192.168.0.42:514",
+		"tag": "app"
+	}}}}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &LogConfig{
+		Driver:  "syslog",
+		Options: map[string]string{"syslog-address": "udp://192.168.0.42:514", "tag": "app"},
+		Endpoints: []LogEndpoint{
+			{Option: "syslog-address", URL: "udp://192.168.0.42:514", Scheme: "udp", Host: "192.168.0.42", Port: "514"},
+		},
+	}
+	if got := requestedLogConfig("POST", "/v1.41/containers/create", body); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, got)
+	}
+
+	expected = &LogConfig{Options: map[string]string{}, Endpoints: []LogEndpoint{}}
+	if got := requestedLogConfig("POST", "/v1.41/containers/create", nil); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, got)
+	}
+
+	if got := requestedLogConfig("POST", "/v1.41/containers/abc/start", body); got != nil {
+		t.Fatalf("Expected no log config, got %+v", got)
+	}
+}
+
+func TestParseLogEndpoint(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected LogEndpoint
+	}{
+		{"tcp+tls://logs.example.com:6514", LogEndpoint{Scheme: "tcp+tls", Host: "logs.example.com", Port: "6514"}},
+		{"unix:///dev/log", LogEndpoint{Scheme: "unix", Host: "/dev/log"}},
+		{"fluentd.example.com:24224", LogEndpoint{Host: "fluentd.example.com", Port: "24224"}},
+		{"fluentd.example.com", LogEndpoint{Host: "fluentd.example.com"}},
+		{"https://splunk.example.com:8088", LogEndpoint{Scheme: "https", Host: "splunk.example.com", Port: "8088"}},
+	}
+
+	for _, tc := range tests {
+		tc.expected.Option, tc.expected.URL = "address", tc.value
+		if got := parseLogEndpoint("address", tc.value); got != tc.expected {
+			t.Errorf("Expected %+v, got %+v", tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+// logLevel is the verbosity of the plugin's logs, which can be changed at
+// runtime through the admin API or SIGUSR1.
+type logLevel int
+
+const (
+	// levelError logs failures and errored decisions only.
+	levelError logLevel = iota
+	// levelInfo additionally logs each decision, unless -quiet is given.
+	levelInfo
+	// levelDebug additionally logs the processing of each request, and the
+	// debug logs of OPA's plugins.
+	levelDebug
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelError:
+		return "error"
+	case levelDebug:
+		return "debug"
+	default:
+		return "info"
+	}
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "error":
+		return levelError, nil
+	case "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q, expected error, info or debug", s)
+	}
+}
+
+// logLevels holds the current log level, and the level given on the command
+// line, which a temporary change reverts to.
+type logLevels struct {
+	mu      sync.Mutex
+	base    logLevel
+	current logLevel
+	expires time.Time
+	revert  *time.Timer
+
+	// opa receives the logs of OPA's plugins in -config-file mode.
+	opa *logging.StandardLogger
+}
+
+// logs is the log level of the plugin.
+var logs = newLogLevels(levelInfo)
+
+func newLogLevels(base logLevel) *logLevels {
+
+	l := &logLevels{base: base, current: base, opa: logging.New()}
+	l.opa.SetLevel(base.opaLevel())
+
+	return l
+}
+
+func (l logLevel) opaLevel() logging.Level {
+	switch l {
+	case levelError:
+		return logging.Error
+	case levelDebug:
+		return logging.Debug
+	default:
+		return logging.Info
+	}
+}
+
+// enabled reports whether messages of the given level are logged.
+func (l *logLevels) enabled(level logLevel) bool {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return level <= l.current
+}
+
+// level returns the current level, and when it reverts to the base level.
+func (l *logLevels) level() (logLevel, time.Time) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current, l.expires
+}
+
+// setBase sets the level given on the command line.
+func (l *logLevels) setBase(level logLevel) {
+
+	l.mu.Lock()
+	l.base = level
+	l.mu.Unlock()
+
+	l.set(level, 0)
+}
+
+// set changes the current level, reverting to the base level after d unless
+// d is 0.
+func (l *logLevels) set(level logLevel, d time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.revert != nil {
+		l.revert.Stop()
+		l.revert = nil
+	}
+
+	l.current, l.expires = level, time.Time{}
+	l.opa.SetLevel(level.opaLevel())
+
+	if d > 0 && level != l.base {
+		l.expires = time.Now().Add(d)
+		l.revert = time.AfterFunc(d, func() {
+			l.mu.Lock()
+			base := l.base
+			l.mu.Unlock()
+			l.set(base, 0)
+			log.Printf("Log level reverted to %v.", base)
+		})
+	}
+}
+
+// toggleDebug switches between the debug level and the base level.
+func (l *logLevels) toggleDebug() logLevel {
+
+	level := levelDebug
+	if current, _ := l.level(); current == levelDebug {
+		l.mu.Lock()
+		level = l.base
+		l.mu.Unlock()
+	}
+	l.set(level, 0)
+
+	return level
+}
+
+// debugf logs a message at the debug level.
+func debugf(format string, args ...interface{}) {
+	if logs.enabled(levelDebug) {
+		log.Printf("[debug] "+format, args...)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/logging"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, s := range []string{"error", "info", "debug"} {
+		level, err := parseLogLevel(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level.String() != s {
+			t.Errorf("Expected %v, got %v", s, level)
+		}
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+}
+
+func TestLogLevelRevert(t *testing.T) {
+	l := newLogLevels(levelInfo)
+
+	if l.enabled(levelDebug) {
+		t.Fatal("Expected debug to be disabled")
+	}
+
+	l.set(levelDebug, 50*time.Millisecond)
+	if level, expires := l.level(); level != levelDebug || expires.IsZero() {
+		t.Fatalf("Expected debug until a deadline, got %v until %v", level, expires)
+	}
+	if !l.enabled(levelDebug) || l.opa.GetLevel() != logging.Debug {
+		t.Fatal("Expected debug to be enabled")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for l.enabled(levelDebug) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected level to revert to info")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if level, expires := l.level(); level != levelInfo || !expires.IsZero() {
+		t.Fatalf("Expected info without a deadline, got %v until %v", level, expires)
+	}
+}
+
+func TestLogLevelToggleDebug(t *testing.T) {
+	l := newLogLevels(levelError)
+
+	if level := l.toggleDebug(); level != levelDebug {
+		t.Fatalf("Expected debug, got %v", level)
+	}
+	if level := l.toggleDebug(); level != levelError {
+		t.Fatalf("Expected error, got %v", level)
+	}
+}
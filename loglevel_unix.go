@@ -0,0 +1,27 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignal toggles the debug level on SIGUSR1.
+func (l *logLevels) watchSignal() {
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	go func() {
+		for range ch {
+			log.Printf("Log level set to %v on SIGUSR1.", l.toggleDebug())
+		}
+	}()
+}
@@ -0,0 +1,11 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+// watchSignal does nothing, as there is no SIGUSR1 on Windows. The log level
+// can be changed through the admin API instead.
+func (l *logLevels) watchSignal() {}
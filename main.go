@@ -5,7 +5,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
@@ -16,16 +18,21 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa-docker-authz/extension"
 	version_pkg "github.com/open-policy-agent/opa-docker-authz/version"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/metrics"
+	"github.com/open-policy-agent/opa/plugins"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/sdk"
+	"golang.org/x/sync/singleflight"
 )
 
 // DockerAuthZPlugin implements the authorization.Plugin interface. Every
@@ -42,79 +49,169 @@ type DockerAuthZPlugin struct {
 	quiet         bool
 	logOnlyDenied bool
 	opa           *sdk.OPA
+	overlay       *runtimeOverlay
+	history       *decisionHistory
+	refresher     *dataRefresher
+	policies      *policyCache
+	sinks         []namedSink
+	scrubber      *scrubber
+	inflight      *singleflight.Group
+	docker        *dockerClient
+	containers    *containerResolver
+	images        *imageResolver
+	trust         *trustResolver
+	apparmor      *apparmorProfiles
+	builds        *buildContextInspector
+	groups        *groupResolver
+	identities    identityResolver
+	spiffe        *spiffeVerifier
+	state         *stateDocuments
+	quotas        *quotaTracker
+	enrichers     []namedEnricher
+	slowEval      time.Duration
+	profileEval   bool
+	bodyLimits    *bodyLimits
+	library       *policyLibrary
+	engine        *engineInfoSource
+	ownership     *ownershipTracker
+	usage         *resourceUsage
+	mounts        *hostPaths
+	runtimes      *hostInfoSource
+	inputVersion  int
+	sessions      string
+	explanations  *explanationStore
 }
 
 // AuthZReq is called when the Docker daemon receives an API request. AuthZReq
 // returns an authorization.Response that indicates whether the request should
 // be allowed or denied.
-func (p DockerAuthZPlugin) AuthZReq(r authorization.Request) authorization.Response {
+func (p *DockerAuthZPlugin) AuthZReq(r authorization.Request) authorization.Response {
 
 	ctx := context.Background()
+	if p.docker.isLookup(r.RequestHeaders) {
+		ctx = withLookupRequest(ctx)
+	}
+	ctx = p.explanations.sample(ctx)
+
+	var stats *evalStats
+	if p.slowEval > 0 {
+		stats = &evalStats{metrics: metrics.New()}
+		if p.profileEval {
+			stats.profile = newExprProfile()
+		}
+		ctx = withEvalStats(ctx, stats)
+	}
 
-	allowed, err := p.evaluate(ctx, r)
+	start := time.Now()
+	debugf("Authorizing %s %s for user %q.", r.RequestMethod, r.RequestURI, r.User)
 
-	if allowed {
-		return authorization.Response{Allow: true}
-	} else if err != nil {
+	d, err := p.evaluateCoalesced(ctx, r)
+
+	debugf("Authorized %s %s for user %q in %v: allowed: %v, code: %q, error: %v.", r.RequestMethod, r.RequestURI, r.User, time.Since(start), d.Allowed, d.Code, err)
+
+	if err != nil {
+		evaluationErrors.WithLabelValues(errorCategory(err)).Inc()
+	}
+
+	if elapsed := time.Since(start); stats != nil && elapsed > p.slowEval {
+		p.warnSlowEvaluation(r, elapsed, stats)
+	}
+
+	if !d.Allowed && err != nil {
 		return authorization.Response{Err: err.Error()}
 	}
 
-	return authorization.Response{Msg: "request rejected by administrative policy"}
+	return d.response()
 }
 
 // AuthZRes is called before the Docker daemon returns an API response. All responses
-// are allowed.
-func (DockerAuthZPlugin) AuthZRes(authorization.Request) authorization.Response {
+// are allowed; they are only observed to maintain the quota counters and the
+// ownership table.
+func (p *DockerAuthZPlugin) AuthZRes(r authorization.Request) authorization.Response {
+	p.quotas.observe(r)
+	p.ownership.observe(context.Background(), r)
 	return authorization.Response{Allow: true}
 }
 
-func (p DockerAuthZPlugin) evaluatePolicyFile(ctx context.Context, r authorization.Request) (bool, error) {
+func (p *DockerAuthZPlugin) evaluatePolicyFile(ctx context.Context, r authorization.Request, input interface{}) (decision, error) {
 
-	if _, err := os.Stat(p.policyFile); os.IsNotExist(err) {
-		log.Printf("OPA policy file %s does not exist, failing open and allowing request", p.policyFile)
-		return true, err
-	}
+	// Without a policy file, requests are only checked against the rules
+	// of the policy library.
+	var bs []byte
+	if p.policyFile != "" || p.library == nil {
+		if _, err := os.Stat(p.policyFile); os.IsNotExist(err) {
+			log.Printf("OPA policy file %s does not exist, failing open and allowing request", p.policyFile)
+			return decision{Allowed: true}, err
+		}
 
-	bs, err := os.ReadFile(p.policyFile)
-	if err != nil {
-		return false, err
+		var err error
+		if bs, err = os.ReadFile(p.policyFile); err != nil {
+			return decision{}, err
+		}
 	}
 
-	input, err := makeInput(r)
-	if err != nil {
-		return false, err
+	if input == nil {
+		var err error
+		if input, err = p.buildInput(ctx, r); err != nil {
+			return decision{}, err
+		}
 	}
 
-	allowed, err := func() (bool, error) {
+	d, err := func() (decision, error) {
+
+		if p.bodyLimits.deny(input) {
+			return truncatedBodyDecision, nil
+		}
+		if d, err := p.library.eval(ctx, input); err != nil || !d.Allowed {
+			return d, err
+		}
+		if p.policyFile == "" {
+			return decision{Allowed: true}, nil
+		}
+
+		var opts []func(*rego.Rego)
+
+		if p.refresher != nil {
+			snap, err := p.refresher.snapshot()
+			if err != nil {
+				return decision{}, err
+			}
+			compiler, err := p.policies.get(p.policyFile, bs, p.overlay, snap)
+			if err != nil {
+				return decision{}, err
+			}
+			opts = []func(*rego.Rego){rego.Compiler(compiler), rego.Store(snap.store)}
+		} else {
+			dataDirs := []string{}
+			if p.dataDir != "" {
+				dataDirs = []string{p.dataDir}
+			}
 
-		dataDirs := []string{}
-		if p.dataDir != "" {
-			dataDirs = []string{p.dataDir}
+			dataOpts, err := p.overlay.regoOptions(dataDirs, p.state)
+			if err != nil {
+				return decision{}, err
+			}
+			opts = append([]func(*rego.Rego){rego.Module(p.policyFile, string(bs))}, dataOpts...)
 		}
 
-		eval := rego.New(
+		opts = append(opts, evalStatsOptions(ctx)...)
+		opts = append(opts, explainOptions(ctx)...)
+		eval := rego.New(append([]func(*rego.Rego){
 			rego.Query(p.allowPath),
 			rego.Input(input),
-			rego.Module(p.policyFile, string(bs)),
-			rego.Load(dataDirs, nil),
-		)
+		}, opts...)...)
 
 		rs, err := eval.Eval(ctx)
 		if err != nil {
-			return false, err
+			return decision{}, err
 		}
 
 		if len(rs) == 0 {
 			// Decision is undefined. Fallback to deny.
-			return false, nil
+			return decision{}, nil
 		}
 
-		allowed, ok := rs[0].Expressions[0].Value.(bool)
-		if !ok {
-			return false, fmt.Errorf("administrative policy decision invalid")
-		}
-
-		return allowed, nil
+		return parseDecision(rs[0].Expressions[0].Value)
 
 	}()
 
@@ -131,64 +228,230 @@ func (p DockerAuthZPlugin) evaluatePolicyFile(ctx context.Context, r authorizati
 		"decision_id": decisionID,
 		"config_hash": hex.EncodeToString(configHash[:]),
 		"input":       input,
-		"result":      allowed,
+		"result":      d.Allowed,
 		"timestamp":   time.Now().Format(time.RFC3339Nano),
 	}
+	if d.Code != "" {
+		decisionLog["code"] = d.Code
+	}
+
+	p.recordDecision(ctx, decisionID, r, input, d, err)
 
 	if err != nil {
-		i, _ := json.Marshal(input)
-		log.Printf("Returning OPA policy decision: %v (error: %v; input: %v)", allowed, err, i)
+		i, _ := json.Marshal(p.scrubber.scrubInput(input))
+		log.Printf("Returning OPA policy decision: %v (error: %v; input: %v)", d.Allowed, err, i)
 	} else {
-		if !p.quiet {
-			if !(p.logOnlyDenied && allowed) {
-				dl, _ := json.Marshal(decisionLog)
-				log.Printf("Returning OPA policy decision: %v: %s", allowed, string(dl))
+		if !p.quiet && logs.enabled(levelInfo) {
+			if !(p.logOnlyDenied && d.Allowed) {
+				dl, _ := json.Marshal(p.scrubber.scrub(decisionLog))
+				log.Printf("Returning OPA policy decision: %v: %s", d.Allowed, string(dl))
 			}
 		}
 	}
 
-	return allowed, err
+	return d, err
+}
+
+func (p *DockerAuthZPlugin) evaluate(ctx context.Context, r authorization.Request) (decision, error) {
+	return p.evaluateInput(ctx, r, nil)
 }
 
-func (p DockerAuthZPlugin) evaluate(ctx context.Context, r authorization.Request) (bool, error) {
+// evaluateInput evaluates r with input, when already built by the caller, so
+// that the enrichers are not run again. The input is built when nil.
+func (p *DockerAuthZPlugin) evaluateInput(ctx context.Context, r authorization.Request, input interface{}) (decision, error) {
 
 	if p.skipPing && r.RequestMethod == "HEAD" && r.RequestURI == "/_ping" {
-		return true, nil
+		return decision{Allowed: true}, nil
+	}
+
+	// The gRPC streams of BuildKit sessions can not be inspected.
+	if u, err := url.Parse(r.RequestURI); err == nil && isSessionRequest(r.RequestMethod, u.Path) {
+		if d, ok := sessionDecision(p.sessions); ok {
+			return d, nil
+		}
 	}
 
 	if p.configFile != "" {
-		input, err := makeInput(r)
-		if err != nil {
-			return false, err
+		var err error
+		if input == nil {
+			if input, err = p.buildInput(ctx, r); err != nil {
+				return decision{}, err
+			}
 		}
 
-		decisionOptions := sdk.DecisionOptions{
-			Input: input,
-			Path:  p.allowPath,
+		if p.bodyLimits.deny(input) {
+			return p.libraryDenial(ctx, r, input, truncatedBodyDecision, nil, "body limits")
+		}
+		if d, err := p.library.eval(ctx, input); err != nil || !d.Allowed {
+			return p.libraryDenial(ctx, r, input, d, err, "policy library")
 		}
 
-		result, err := p.opa.Decision(ctx, decisionOptions)
-		if err != nil {
-			return false, err
+		route := p.tracker().route(time.Now(), r)
+
+		var d decision
+		if route.enforce != nil {
+			d, err = p.evaluateRevision(ctx, route.enforce, r, input)
+		} else {
+			d, err = p.evaluateLatest(ctx, r, input)
 		}
 
-		decision, ok := result.Result.(bool)
-		if !ok || !decision {
-			return false, nil
+		if route.compare != nil && err == nil {
+			go p.compareRevision(route, input, d.Allowed)
+		}
+
+		return d, err
+	}
+
+	return p.evaluatePolicyFile(ctx, r, input)
+}
+
+// recordDecision keeps the decision in the in-memory history, along with its
+// explanation when sampled, and passes it to the decision sinks.
+func (p *DockerAuthZPlugin) recordDecision(ctx context.Context, decisionID string, r authorization.Request, input interface{}, d decision, err error) {
+
+	rec := newDecisionRecord(decisionID, r, d, err)
+	p.history.add(rec)
+	p.explanations.add(ctx, rec)
+
+	if err == nil {
+		decisions.WithLabelValues(decisionLabel(d.Allowed), d.Code).Inc()
+	}
+
+	if len(p.sinks) == 0 {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"decision_id": rec.DecisionID,
+		"timestamp":   rec.Timestamp,
+		"labels": map[string]string{
+			"id":             p.instanceID,
+			"plugin_version": version_pkg.Version,
+		},
+		"input":  input,
+		"result": d.Allowed,
+	}
+	if d.Code != "" {
+		entry["code"] = d.Code
+	}
+	if rec.Error != "" {
+		entry["error"] = rec.Error
+	}
+
+	p.recordEvent(p.scrubber.scrub(entry))
+}
+
+// evaluateLatest evaluates the request through the SDK against the latest
+// activated bundles.
+func (p *DockerAuthZPlugin) evaluateLatest(ctx context.Context, r authorization.Request, input interface{}) (decision, error) {
+
+	decisionOptions := sdk.DecisionOptions{
+		Input: input,
+		Path:  p.allowPath,
+	}
+
+	result, err := p.opa.Decision(ctx, decisionOptions)
+	if err != nil {
+		p.recordDecision(ctx, "", r, input, decision{}, err)
+		return decision{}, err
+	}
+
+	// Invalid decisions deny the request.
+	d, _ := parseDecision(result.Result)
+
+	// The SDK can not trace evaluations: sampled decisions are explained by
+	// evaluating the snapshot of the latest bundles again.
+	if explainTrace(ctx) != nil {
+		if rev := p.tracker().latestRevision(); rev != nil {
+			_, _ = rev.eval(ctx, normalizeAllowPath(p.allowPath, false), input)
 		}
-		return true, nil
+	}
+
+	p.recordDecision(ctx, result.ID, r, input, d, nil)
+
+	return d, nil
+}
+
+// compareRevision evaluates the revision that did not enforce the decision
+// during a canary or in shadow mode, and records whether both revisions agreed.
+func (p *DockerAuthZPlugin) compareRevision(route revisionRoute, input interface{}, allowed bool) {
+
+	d, err := route.compare.eval(context.Background(), normalizeAllowPath(p.allowPath, false), input)
+	if err != nil {
+		log.Printf("Failed to evaluate bundle revision %v for comparison: %v", route.compare, err)
+		return
+	}
 
+	other := d.Allowed
+	if other != allowed {
+		input = p.scrubber.scrubInput(input)
 	}
 
-	return p.evaluatePolicyFile(ctx, r)
+	p.tracker().recordComparison(route, allowed, other, input)
+}
+
+// evaluateRevision evaluates the request against a bundle revision that is
+// held active by the activation schedule instead of the latest revision.
+func (p *DockerAuthZPlugin) evaluateRevision(ctx context.Context, rev *revision, r authorization.Request, input interface{}) (decision, error) {
+
+	decisionID, _ := uuid4()
+	d, err := rev.eval(ctx, normalizeAllowPath(p.allowPath, false), input)
+	p.recordDecision(ctx, decisionID, r, input, d, err)
+
+	if err != nil {
+		log.Printf("Returning OPA policy decision: %v (error: %v; revision: %v)", d.Allowed, err, rev)
+	} else if !p.quiet && logs.enabled(levelInfo) && !(p.logOnlyDenied && d.Allowed) {
+		log.Printf("Returning OPA policy decision: %v (decision_id: %s; code: %q; revision: %v)", d.Allowed, decisionID, d.Code, rev)
+	}
+
+	return d, err
+}
+
+// libraryDenial records and logs a request denied before the policy is
+// evaluated, by the policy library or the body limits named by source, in
+// -config-file mode, where the decision is not made by OPA.
+func (p *DockerAuthZPlugin) libraryDenial(ctx context.Context, r authorization.Request, input interface{}, d decision, err error, source string) (decision, error) {
+
+	decisionID, _ := uuid4()
+	p.recordDecision(ctx, decisionID, r, input, d, err)
+
+	if err != nil {
+		log.Printf("Returning OPA policy decision: %v (error: %v; %s)", d.Allowed, err, source)
+	} else if !p.quiet && logs.enabled(levelInfo) {
+		log.Printf("Returning OPA policy decision: %v (decision_id: %s; code: %q; %s)", d.Allowed, decisionID, d.Code, source)
+	}
+
+	return d, err
 }
 
 type BindMount struct {
 	Source   string
 	ReadOnly bool
 	Resolved string
+
+	// Canonical is the canonical host path of Source, with
+	// -canonicalize-mounts.
+	Canonical string
+
+	// Propagation is the mount propagation mode, rprivate unless the
+	// request sets one.
+	Propagation string
+
+	// Cleaned is Source with its redundant separators, . and .. removed
+	// lexically, which is the path the daemon binds before following
+	// symbolic links.
+	Cleaned string
 }
 
+// bindPropagationModes are the mount propagation modes of bind mounts.
+var bindPropagationModes = map[string]bool{
+	"private": true, "rprivate": true,
+	"shared": true, "rshared": true,
+	"slave": true, "rslave": true,
+}
+
+const defaultBindPropagation = "rprivate"
+
 func listBindMounts(body map[string]interface{}) []BindMount {
 	var result []BindMount
 
@@ -201,9 +464,15 @@ func listBindMounts(body map[string]interface{}) []BindMount {
 				if ok && strings.HasPrefix(bind, "/") {
 					bindParts := strings.Split(bind, ":")
 					hostPath := bindParts[0]
-					mount := BindMount{hostPath, false, ""}
-					if len(bindParts) == 3 && bindParts[2] == "ro" {
-						mount.ReadOnly = true
+					mount := BindMount{hostPath, false, "", "", defaultBindPropagation, ""}
+					if len(bindParts) == 3 {
+						for _, opt := range strings.Split(bindParts[2], ",") {
+							if opt == "ro" {
+								mount.ReadOnly = true
+							} else if bindPropagationModes[opt] {
+								mount.Propagation = opt
+							}
+						}
 					}
 					result = append(result, mount)
 				}
@@ -221,7 +490,13 @@ func listBindMounts(body map[string]interface{}) []BindMount {
 				source, srcOk := mount["Source"].(string)
 				if typeOk && srcOk && mountType == "bind" {
 					readonly, ok := mount["ReadOnly"].(bool)
-					result = append(result, BindMount{source, ok && readonly, ""})
+					propagation := defaultBindPropagation
+					if options, ok := mount["BindOptions"].(map[string]interface{}); ok {
+						if mode, ok := options["Propagation"].(string); ok && mode != "" {
+							propagation = mode
+						}
+					}
+					result = append(result, BindMount{source, ok && readonly, "", "", propagation, ""})
 				}
 			}
 		}
@@ -230,6 +505,7 @@ func listBindMounts(body map[string]interface{}) []BindMount {
 	// resolve bind mount paths to symlink targets
 	// and expand /example/../ to avoid bypassing rules
 	for idx, bindMount := range result {
+		result[idx].Cleaned = path.Clean(bindMount.Source)
 		resolved, err := filepath.EvalSymlinks(bindMount.Source)
 		if err == nil {
 			resolved = filepath.Clean(resolved)
@@ -245,35 +521,100 @@ func makeInput(r authorization.Request) (interface{}, error) {
 
 	var body map[string]interface{}
 
-	if r.RequestHeaders["Content-Type"] == "application/json" && len(r.RequestBody) > 0 {
-		if err := json.Unmarshal(r.RequestBody, &body); err != nil {
+	// Bodies are mostly objects, but the plugin endpoints take lists.
+	var raw interface{}
+	if isJSON(r.RequestHeaders) && len(r.RequestBody) > 0 {
+		if err := json.Unmarshal(r.RequestBody, &raw); err != nil {
 			return nil, err
 		}
+		body, _ = raw.(map[string]interface{})
 	}
 
 	u, err := url.Parse(r.RequestURI)
 	if err != nil {
 		return nil, err
 	}
+	query := u.Query()
 
 	bindMountList := listBindMounts(body)
+	image := parseImageReference(requestedImage(r.RequestMethod, u.Path, query, body))
+	env := requestedEnv(r.RequestMethod, u.Path, body)
+	namespaces := containerNamespaces(r.RequestMethod, u.Path, body)
+	sysctls := requestedSysctls(r.RequestMethod, u.Path, body)
+
+	var secrets, configs []ServiceFile
+	if spec := serviceContainerSpec(r.RequestMethod, u.Path, body); spec != nil {
+		secrets, configs = serviceFiles(spec, "Secrets"), serviceFiles(spec, "Configs")
+	}
 
 	input := map[string]interface{}{
-		"Headers":    r.RequestHeaders,
-		"Path":       r.RequestURI,
-		"PathPlain":  u.Path,
-		"PathArr":    strings.Split(u.Path, "/"),
-		"Query":      u.Query(),
-		"Method":     r.RequestMethod,
-		"Body":       body,
-		"User":       r.User,
-		"AuthMethod": r.UserAuthNMethod,
-		"BindMounts": bindMountList,
+		"Headers":      r.RequestHeaders,
+		"Path":         r.RequestURI,
+		"PathPlain":    u.Path,
+		"PathArr":      strings.Split(u.Path, "/"),
+		"Query":        query,
+		"params":       queryParams(query),
+		"Method":       r.RequestMethod,
+		"Body":         body,
+		"User":         r.User,
+		"AuthMethod":   r.UserAuthNMethod,
+		"BindMounts":   bindMountList,
+		"Container":    parseContainerEndpoint(r.RequestMethod, u.Path, query, body),
+		"Image":        image,
+		"devices":      listDevices(body),
+		"gpus":         requestedGPUs(r.RequestMethod, u.Path, body, env),
+		"namespaces":   namespaces,
+		"sysctls":      sysctls,
+		"sysctl_flags": sysctlFindings(sysctls, namespaces),
+		"Seccomp":      seccompSummary(body),
+		"AppArmor":     apparmorProfile(body),
+		"security_opt": securityOptions(r.RequestMethod, u.Path, body),
+		"runtime":      requestedRuntime(r.RequestMethod, u.Path, body),
+		"log_config":   requestedLogConfig(r.RequestMethod, u.Path, body),
+		"restart":      requestedRestartPolicy(r.RequestMethod, u.Path, body),
+		"healthcheck":  requestedHealthcheck(r.RequestMethod, u.Path, body),
+		"resources":    requestedResources(r.RequestMethod, u.Path, body),
+		"env":          env,
+		"env_flags":    envFindings(env),
+		"Secrets":      secrets,
+		"Configs":      configs,
+		"compose":      composeProject(r.RequestMethod, u.Path, body),
+		"plugin":       requestedPlugin(r.RequestMethod, u.Path, query, raw),
+		"session":      buildKitSession(r.RequestMethod, u.Path, r.RequestHeaders),
+		"buildkit":     buildKitBuild(r.RequestMethod, u.Path, query),
 	}
 
 	return input, nil
 }
 
+// buildInput returns the input document of r, enriched by the enrichers of
+// the plugin and of extensions.
+func (p *DockerAuthZPlugin) buildInput(ctx context.Context, r authorization.Request) (interface{}, error) {
+
+	truncated := p.bodyLimits.apply(&r)
+
+	input, err := makeInput(r)
+	if err != nil {
+		return nil, inputError{err}
+	}
+
+	if truncated {
+		input.(map[string]interface{})["BodyTruncated"] = true
+	}
+
+	if err := p.enrich(ctx, &r, input.(map[string]interface{})); err != nil {
+		return nil, err
+	}
+
+	version := p.inputVersion
+	if version == 0 {
+		version = defaultInputVersion
+	}
+	versionInput(input.(map[string]interface{}), version)
+
+	return input, nil
+}
+
 func uuid4() (string, error) {
 
 	bs := make([]byte, 16)
@@ -314,26 +655,104 @@ func regoSyntax(p string) int {
 	return 0
 }
 
-func initOPA(ctx context.Context, configFile string) (*sdk.OPA, error) {
+func initOPA(ctx context.Context, configFile, configSigFile, bundleCacheDir string, services serviceTLS, inputVersion int, offline bool) (*sdk.OPA, error) {
 
-	buf, err := os.Open(configFile)
+	bs, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		if err = buf.Close(); err != nil {
-			log.Fatal(err)
+	if err := checkConfigSignature(bs, configFile, configSigFile); err != nil {
+		return nil, err
+	}
+
+	if bs, err = interpolateConfig(bs); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	if bs, err = resolveSecretRefs(bs); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	if bs, err = services.apply(bs); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+
+	if offline {
+		if err := checkOffline(nil, bs); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
 		}
-	}()
+	}
+
+	if fipsMode {
+		if err := checkFIPSConfig(bs); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
+
+	if bundleCacheDir != "" {
+		if bs, err = persistBundles(bs, bundleCacheDir); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
 
 	options := sdk.Options{
-		Config: buf,
+		Config: bytes.NewReader(bs),
+		Logger: logs.opa,
+		Plugins: map[string]plugins.Factory{
+			authzPluginName: authzPluginFactory{inputVersion: inputVersion},
+		},
 	}
 
 	return sdk.New(ctx, options)
 }
 
+func verifyAuditLogFile(path, publicKey string, checkpointEvery uint64) int {
+
+	var pub crypto.PublicKey
+	if publicKey != "" {
+		var err error
+		if pub, err = loadPublicKey(publicKey); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	decisions, checkpoints, err := verifyAuditLog(f, pub, checkpointEvery)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("Audit log intact: %d decisions, %d checkpoints\n", decisions, checkpoints)
+	return 0
+}
+
+// revisionTrackerOf returns the revision tracker when the OPA configuration
+// enables the opa_docker_authz plugin.
+func revisionTrackerOf(opa *sdk.OPA) *revisionTracker {
+
+	if opa == nil {
+		return nil
+	}
+
+	t, _ := opa.Plugin(authzPluginName).(*revisionTracker)
+	return t
+}
+
+// tracker returns the revision tracker of the current OPA configuration,
+// which is replaced whenever the configuration changes.
+func (p *DockerAuthZPlugin) tracker() *revisionTracker {
+	return revisionTrackerOf(p.opa)
+}
+
 func normalizeAllowPath(path string, useConfig bool) string {
 
 	if useConfig && strings.HasPrefix(path, "data") {
@@ -345,46 +764,300 @@ func normalizeAllowPath(path string, useConfig bool) string {
 	return path
 }
 
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "check-access":
+			os.Exit(runCheckAccess(os.Args[2:]))
+		case "test-corpus":
+			os.Exit(runTestCorpus(os.Args[2:]))
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		case "fmt":
+			os.Exit(runFmt(os.Args[2:]))
+		case "schema":
+			os.Exit(runSchema(os.Args[2:]))
+		case "sign-config":
+			os.Exit(runSignConfig(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
 	pluginName := flag.String("plugin-name", "opa-docker-authz", "sets the plugin name that will be registered with Docker")
 	allowPath := flag.String("allowPath", "data.docker.authz.allow", "sets the path of the allow decision in OPA")
 	configFile := flag.String("config-file", "", "sets the path of the config file to load")
+	configSigFile := flag.String("config-signature-file", "", "sets the path of the detached signature of the config file, required by binaries built with a config public key (default: <config-file>.sig)")
+	offline := flag.Bool("offline", false, "refuse to start when a feature connecting to other hosts is configured, such as remote bundles, data URLs, registry lookups or remote decision sinks, and fail the http.send calls of policies")
+	fips := flag.Bool("fips", false, "restrict the keys verifying bundle, configuration and audit log signatures, the JWT keys and secrets of policies and the TLS listeners to FIPS approved algorithms")
+	bundleCacheDir := flag.String("bundle-cache-dir", "", "sets the directory the activated bundles are cached in, to be activated at startup without waiting for the bundle servers (config-file mode)")
+	bundleCAFile := flag.String("bundle-ca-file", "", "sets the path of the CA used to verify the certificates of the services bundles are downloaded from, unless they set their own (config-file mode)")
+	bundleTLSCert := flag.String("bundle-tls-cert-file", "", "sets the path of the client certificate presented to the services bundles are downloaded from, unless they set their own credentials (config-file mode)")
+	bundleTLSKey := flag.String("bundle-tls-key-file", "", "sets the path of the private key of the client certificate presented to the services bundles are downloaded from")
 	policyFile := flag.String("policy-file", "", "sets the path of the policy file to load")
 	dataDir := flag.String("data-dir", "", "sets the path of data files to load")
 	skipPing := flag.Bool("skip-ping", true, "skip policy evaluation for requests to /_ping endpoint")
+	buildKitSessions := flag.String("buildkit-sessions", sessionDecisionPolicy, "sets the decision of requests opening BuildKit sessions, whose gRPC streams can not be inspected: policy, allow or deny")
 	version := flag.Bool("version", false, "print the version of the plugin")
-	check := flag.Bool("check", false, "checks the syntax of the policy-file")
+	check := flag.Bool("check", false, "checks the syntax of the policy-file, or the keys and values of the config-file")
+	logLevelName := flag.String("log-level", "info", "sets the log level (error, info or debug), which SIGUSR1 toggles to debug and back at runtime")
 	quiet := flag.Bool("quiet", false, "disable logging of each HTTP request (policy-file mode)")
 	logOnlyDenied := flag.Bool("log-only-denied", false, "only log denied requests (policy-file mode)")
+	dataURLs := flag.String("data-url", "", "comma separated URLs of JSON data documents to load (policy-file mode)")
+	dataRefreshInterval := flag.Duration("data-refresh-interval", 0, "reload data documents on this interval without recompiling policies (policy-file mode)")
+	dataCAFile := flag.String("data-ca-file", "", "sets the path of the CA used to verify the certificates of data URLs")
+	dataTLSCert := flag.String("data-tls-cert-file", "", "sets the path of the client certificate presented to data URLs")
+	dataTLSKey := flag.String("data-tls-key-file", "", "sets the path of the private key of the client certificate presented to data URLs")
+	httpSendCAFile := flag.String("http-send-ca-file", "", "sets the path of the CA used to verify the certificates of the services policies call with http.send, e.g. JWKS endpoints, unless the calls set their own")
+	httpSendTLSCert := flag.String("http-send-tls-cert-file", "", "sets the path of the client certificate presented to the services policies call with http.send, unless the calls set their own")
+	httpSendTLSKey := flag.String("http-send-tls-key-file", "", "sets the path of the private key of the client certificate presented to the services policies call with http.send")
+	dataRetryMaxDelay := flag.Duration("data-retry-max-delay", defaultDataRetryMaxDelay, "sets the maximum delay between retries of failed data document refreshes")
+	dataLongPoll := flag.Duration("data-long-poll-timeout", 0, "sets how long the data URL may hold a request until its document changes, refreshing as soon as it answers (disabled when 0)")
+	slowEvalThreshold := flag.Duration("slow-eval-threshold", 0, "sets the latency above which decisions are logged with the OPA metrics of their evaluation (0 disables the warnings)")
+	slowEvalProfile := flag.Bool("slow-eval-profile", false, "adds the time spent in the slowest expressions of the policy to slow evaluation warnings, at the cost of profiling every evaluation")
+	policyLibraryFile := flag.String("policy-library", "", "sets the path of the file enabling and parameterizing the baseline rules of the embedded policy library, enforced before the policy")
+	schemaCheckMode := flag.String("schema-check", schemaCheckWarn, "sets how policies referencing input fields absent from the input schema are handled: off, warn or enforce (policy-file mode)")
+	schemaFile := flag.String("schema-file", "", "sets the path of the JSON Schema of the input policies are checked against, the schema of the plugin when empty (policy-file mode)")
+	inputVersion := flag.Int("input-schema-version", defaultInputVersion, "sets the version of the shape of the input document given to policies")
+	bodyLimitsFlag := flag.String("body-limits", "", "comma separated family=bytes pairs bounding the size of the request bodies decoded into the input by endpoint family, e.g. exec=4096,default=1048576")
+	bodyTruncation := flag.String("body-truncation", "deny", "sets the handling of requests whose body exceeds its limit under -body-limits: deny, or policy to let the policy decide from input.BodyTruncated")
+	coalesce := flag.Bool("coalesce-requests", false, "share a single policy evaluation between identical concurrent requests")
+	scrubRulesFile := flag.String("scrub-rules-file", "", "sets the path of the rules scrubbing sensitive values from logged decisions")
+	auditLogFile := flag.String("audit-log-file", "", "sets the path of the hash-chained audit log of all decisions")
+	auditSigningKey := flag.String("audit-signing-key", "", "sets the path of the PKCS #8 private key used to sign audit log checkpoints")
+	auditCheckpointEvery := flag.Uint64("audit-checkpoint-every", 1000, "number of audit log records between signed checkpoints, also required between those of verified logs")
+	decisionCAFile := flag.String("decision-ca-file", "", "sets the path of the CA used to verify the certificates of decision sinks and of the decision log service, unless they set their own")
+	decisionTLSCert := flag.String("decision-tls-cert-file", "", "sets the path of the client certificate presented to decision sinks and to the decision log service, unless they set their own")
+	decisionTLSKey := flag.String("decision-tls-key-file", "", "sets the path of the private key of the client certificate presented to decision sinks and to the decision log service")
+	decisionS3URL := flag.String("decision-s3-url", "", "sets the S3-compatible location decisions are uploaded to, as https://endpoint/bucket/prefix (disabled when empty)")
+	decisionS3Region := flag.String("decision-s3-region", "us-east-1", "sets the region used to sign S3 requests")
+	decisionS3Partition := flag.String("decision-s3-partition", defaultS3Partition, "sets the layout of decision objects below the prefix, from {year}, {month}, {day}, {hour} and {host}")
+	decisionS3FlushInterval := flag.Duration("decision-s3-flush-interval", time.Minute, "sets how often batched decisions are uploaded to S3")
+	decisionESURL := flag.String("decision-es-url", "", "sets the URL of the Elasticsearch or OpenSearch cluster decisions are indexed in (disabled when empty)")
+	decisionESIndex := flag.String("decision-es-index", defaultElasticsearchIndex, "sets the index decisions are written to, from {year}, {month}, {day}, {hour} and {host}")
+	decisionESUsername := flag.String("decision-es-username", "", "sets the username used to authenticate to Elasticsearch")
+	decisionESPasswordFile := flag.String("decision-es-password-file", "", "sets the path of the file holding the password used to authenticate to Elasticsearch")
+	decisionESCAFile := flag.String("decision-es-ca-file", "", "sets the path of the CA used to verify the certificate of Elasticsearch")
+	decisionESFlushInterval := flag.Duration("decision-es-flush-interval", 10*time.Second, "sets how often batched decisions are indexed in Elasticsearch")
+	decisionSplunkURL := flag.String("decision-splunk-url", "", "sets the URL of the Splunk HTTP Event Collector decisions are sent to (disabled when empty)")
+	decisionSplunkTokenFile := flag.String("decision-splunk-token-file", "", "sets the path of the file holding the HTTP Event Collector token")
+	decisionSplunkIndex := flag.String("decision-splunk-index", "", "sets the Splunk index of decision events (the token's default index when empty)")
+	decisionSplunkSourcetype := flag.String("decision-splunk-sourcetype", "_json", "sets the sourcetype of decision events")
+	decisionSplunkCAFile := flag.String("decision-splunk-ca-file", "", "sets the path of the CA used to verify the certificate of the HTTP Event Collector")
+	decisionSplunkFlushInterval := flag.Duration("decision-splunk-flush-interval", 10*time.Second, "sets how often batched decisions are sent to Splunk")
+	decisionSinkFilters := flag.String("decision-sink-filters-file", "", "sets the path of the file selecting and sampling the decisions recorded by each decision sink")
+	decisionSpoolDir := flag.String("decision-spool-dir", "", "sets the directory decisions that could not be sent to S3, Elasticsearch, Splunk or the gRPC collector are spooled to (in memory when empty)")
+	decisionSpoolMaxBytes := flag.Int64("decision-spool-max-bytes", defaultSpoolMaxBytes, "sets the maximum size of the spool of each decision sink, beyond which the oldest decisions are dropped")
+	decisionGRPCAddr := flag.String("decision-grpc-addr", "", "sets the address of the gRPC collector decisions are streamed to, e.g. collector.example.com:4317 (disabled when empty)")
+	decisionGRPCInsecure := flag.Bool("decision-grpc-insecure", false, "connect to the gRPC collector without TLS")
+	decisionGRPCCAFile := flag.String("decision-grpc-ca-file", "", "sets the path of the CA used to verify the certificate of the gRPC collector")
+	decisionGRPCCertFile := flag.String("decision-grpc-tls-cert-file", "", "sets the path of the client certificate presented to the gRPC collector")
+	decisionGRPCKeyFile := flag.String("decision-grpc-tls-key-file", "", "sets the path of the private key of the client certificate presented to the gRPC collector")
+	decisionGRPCFlushInterval := flag.Duration("decision-grpc-flush-interval", time.Second, "sets how often batched decisions are streamed to the gRPC collector")
+	decisionAuditd := flag.Bool("decision-auditd", false, "send denied decisions to the kernel audit subsystem as USER_AVC records, logged by auditd (Linux, requires CAP_AUDIT_WRITE)")
+	decisionAuditdAllowed := flag.Bool("decision-auditd-allowed", false, "also send allowed decisions to the kernel audit subsystem")
+	remoteConfigURL := flag.String("remote-config", "", "sets the Consul or etcd key prefix the OPA configuration and data documents are watched at, e.g. consul://127.0.0.1:8500/opa-docker-authz (disabled when empty)")
+	remoteConfigTokenFile := flag.String("remote-config-token-file", "", "sets the path of the file holding the token used to authenticate to Consul or etcd")
+	remoteConfigCAFile := flag.String("remote-config-ca-file", "", "sets the path of the CA used to verify the certificate of Consul or etcd")
+	remoteConfigTimeout := flag.Duration("remote-config-timeout", time.Minute, "sets how long a remote OPA configuration may take to become ready before it is rejected")
+	verifyAudit := flag.String("verify-audit-log", "", "verifies the hash chain of the given audit log and exits")
+	auditPublicKey := flag.String("audit-public-key", "", "sets the path of the public key used to verify audit log checkpoints")
+	dockerHost := flag.String("docker-host", "unix:///var/run/docker.sock", "sets the address of the Docker daemon used to look up objects referenced by requests")
+	resolveContainers := flag.Bool("resolve-containers", false, "resolve the name and labels of containers referenced by requests")
+	containerCacheTTL := flag.Duration("container-cache-ttl", 30*time.Second, "sets how long resolved container names and labels are cached")
+	resolveImageDigests := flag.Bool("resolve-image-digests", false, "resolve the current digest of image references that are not pinned by digest")
+	imageDigestCacheTTL := flag.Duration("image-digest-cache-ttl", 5*time.Minute, "sets how long resolved image digests are cached")
+	enableHostInfo := flag.Bool("host-info", false, "expose the host information reported by the Docker daemon to policies through docker.host_info(), and resolve input.runtime against the runtimes of the daemon")
+	hostInfoTTL := flag.Duration("host-info-ttl", time.Minute, "sets how long the host information is cached")
+	enableEngineInfo := flag.Bool("engine-info", false, "add the version and ID of the Docker daemon to the input as input.engine")
+	enableRegistryManifests := flag.Bool("registry-manifests", false, "expose image manifests, configs and SBOMs fetched from registries to policies through registry.manifest() and registry.sboms()")
+	registryConfigFile := flag.String("registry-config", "", "sets the path of the Docker client config file holding the credentials used to fetch image manifests and trust data")
+	registryCAFile := flag.String("registry-ca-file", "", "sets the path of the CA used to verify the certificates of registries")
+	registryTLSCert := flag.String("registry-tls-cert-file", "", "sets the path of the client certificate presented to registries")
+	registryTLSKey := flag.String("registry-tls-key-file", "", "sets the path of the private key of the client certificate presented to registries")
+	registryManifestCacheTTL := flag.Duration("registry-manifest-cache-ttl", 5*time.Minute, "sets how long image manifests are cached")
+	registrySBOMCacheTTL := flag.Duration("registry-sbom-cache-ttl", 5*time.Minute, "sets how long the SBOMs attached to images are cached")
+	contentTrust := flag.Bool("content-trust", false, "add the unverified Docker Content Trust data of the image references of requests to the input as input.Image.NotaryClaims")
+	contentTrustServer := flag.String("content-trust-server", "", "sets the URL of the Notary server holding the trust data of all registries (notary.docker.io for Docker Hub, and the registry itself for others, when empty)")
+	contentTrustCacheTTL := flag.Duration("content-trust-cache-ttl", 5*time.Minute, "sets how long the trust data of repositories is cached")
+	enrichers := flag.String("enrichers", "", "comma separated names of the enrichers compiled into the plugin applied to the input, in order (all of them, in name order, when empty)")
+	builtinCacheSize := flag.Int("builtin-cache-size", defaultBuiltinCacheSize, "sets the maximum number of results of builtins calling external services that are cached")
+	ldapURL := flag.String("ldap-url", "", "sets the URL of the LDAP directory queried by ldap.query(), e.g. ldaps://ldap.example.com (disabled when empty)")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "sets the DN the plugin binds to the LDAP directory as (anonymous when empty)")
+	ldapBindPasswordFile := flag.String("ldap-bind-password-file", "", "sets the path of the file holding the password of the LDAP bind DN")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "sets the DN below which LDAP queries search")
+	ldapCAFile := flag.String("ldap-ca-file", "", "sets the path of the CA used to verify the certificate of the LDAP directory")
+	ldapTimeout := flag.Duration("ldap-timeout", 2*time.Second, "sets how long an LDAP query may take, including connecting and binding")
+	ldapSizeLimit := flag.Int("ldap-size-limit", 100, "sets the maximum number of entries an LDAP query may return")
+	ldapCacheTTL := flag.Duration("ldap-cache-ttl", 5*time.Minute, "sets how long the results of LDAP queries are cached")
+	apparmorProfilesFile := flag.String("apparmor-profiles-file", "/sys/kernel/security/apparmor/profiles", "sets the path of the list of AppArmor profiles loaded on the host (disabled when empty)")
+	canonicalizeMounts := flag.Bool("canonicalize-mounts", false, "add the canonical host path of bind mount sources to the input, resolving symbolic links, .. and case even for paths that do not exist yet")
+	mountHostRoot := flag.String("mount-host-root", "/", "sets the path the root filesystem of the host is mounted at in the plugin, for -canonicalize-mounts")
+	apparmorRefreshInterval := flag.Duration("apparmor-refresh-interval", 0, "reload the list of AppArmor profiles on this interval")
+	inspectBuildContext := flag.Bool("inspect-build-context", false, "extract the Dockerfile of build requests into input, fetching remote build contexts from -build-context-hosts")
+	buildContextLimit := flag.Int64("build-context-limit", 64<<20, "sets the maximum number of bytes of a build context read to find its Dockerfile")
+	buildContextHosts := flag.String("build-context-hosts", "", "comma separated hosts remote build contexts are fetched from with -inspect-build-context (none when empty)")
+	resolveUserGroups := flag.Bool("resolve-user-groups", false, "look up the groups of the requesting user in the host's group database")
+	userGroupsCacheTTL := flag.Duration("user-groups-cache-ttl", 5*time.Minute, "sets how long the groups of users are cached")
+	identityResolverKind := flag.String("identity-resolver", "", "sets the resolver mapping the requesting user to a canonical identity (nss)")
+	identityCacheTTL := flag.Duration("identity-cache-ttl", 5*time.Minute, "sets how long resolved identities are cached")
+	spiffeEndpointSocket := flag.String("spiffe-endpoint-socket", "", "sets the address of the SPIFFE Workload API trust bundles of client SVIDs are fetched from, e.g. unix:///run/spire/sockets/agent.sock")
+	spiffeTrustBundles := flag.String("spiffe-trust-bundles", "", "comma separated trust-domain=path pairs of PEM trust bundles used to verify client SVIDs")
+	spiffeSVID := flag.Bool("spiffe-svid", false, "fetch the X.509 SVID of the plugin from -spiffe-endpoint-socket, served by the admin API and presented to the services connected to without a client certificate")
+	spiffeSVIDID := flag.String("spiffe-svid-id", "", "sets the SPIFFE ID of the X.509 SVID of the plugin, when the workload is issued several (the first one when empty)")
+	stateFile := flag.String("state-file", "", "sets the path of the store persisting quota counters, the ownership table, the license index, the decision history and lookup caches (in memory when empty)")
+	quotas := flag.Bool("quotas", false, "count the running containers and recent creations of each user, and expose the counters as data.quota")
+	userResources := flag.Bool("user-resources", false, "add the resources reserved by the running containers of the user to container create requests as input.user_resources (requires -track-ownership)")
+	userResourcesCacheTTL := flag.Duration("user-resources-cache-ttl", 30*time.Second, "sets how long the resource limits of containers are cached")
+	expiryLabel := flag.String("expiry-label", "", "sets the label holding the time to live or expiry time of containers, and periodically reports the expired ones (disabled when empty)")
+	expiryReportInterval := flag.Duration("expiry-report-interval", time.Hour, "sets how often expired containers are reported")
+	expiryWebhook := flag.String("expiry-webhook", "", "sets the URL expired containers are posted to (disabled when empty)")
+	trackOwnership := flag.Bool("track-ownership", false, "track the user who created each container through the Docker daemon's events and expose the table as data.ownership")
+	licenseIndex := flag.Bool("license-index", false, "index the licenses of the packages of the daemon's images, read from the SBOMs attached to them, and expose the index as data.licenses (requires -registry-manifests)")
+	licenseIndexInterval := flag.Duration("license-index-interval", 10*time.Minute, "sets how often the images of the daemon are indexed, besides when images are pulled")
+	explainSampleRate := flag.Float64("explain-sample-rate", 0, "sets the fraction of decisions traced, whose explanations the admin API serves by decision ID (disabled when 0)")
+	explainHistory := flag.Int("explain-history", defaultExplanationHistorySize, "sets the number of explanations of the most recent sampled decisions kept")
+	explainMode := flag.String("explain-mode", explainFull, "sets the part of the trace kept in explanations: full, fails or notes")
+	replayDir := flag.String("replay-dir", "", "sets the directory the inputs of denied requests are kept in, for the replay subcommand to evaluate them against a new policy (disabled when empty)")
+	replayRetention := flag.Duration("replay-retention", defaultReplayRetention, "sets how long the denied requests of -replay-dir are kept")
+	replayMaxBytes := flag.Int64("replay-max-bytes", defaultReplayMaxBytes, "sets the size -replay-dir is kept under, by removing its oldest requests")
+	adminAddr := flag.String("admin-addr", "", "sets the address of the admin API listener, host:port or unix:///path/to/socket (disabled when empty)")
+	adminTokenFile := flag.String("admin-token-file", "", "sets the path of the bearer token file granting write access to the admin API")
+	adminReadTokenFile := flag.String("admin-read-token-file", "", "sets the path of the bearer token file granting read-only access to the admin API")
+	adminReadSubjects := flag.String("admin-read-subjects", "", "comma separated client certificate common names granted read-only access to the admin API")
+	adminWriteSubjects := flag.String("admin-write-subjects", "", "comma separated client certificate common names granted write access to the admin API")
+	adminTLSCert := flag.String("admin-tls-cert-file", "", "sets the path of the TLS certificate served by the admin API")
+	adminTLSKey := flag.String("admin-tls-key-file", "", "sets the path of the TLS private key served by the admin API")
+	adminClientCA := flag.String("admin-tls-ca-file", "", "sets the path of the CA used to verify admin API client certificates")
+	vsockPort := flag.Uint("vsock-port", 0, "sets the AF_VSOCK port the plugin listens on for daemons running in virtual machines, instead of the plugin socket (disabled when 0)")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", defaultTLSReloadInterval, "sets how often TLS certificate, key and CA files are checked for changes (0 disables reloading)")
 
 	flag.Parse()
 
 	if *version {
 		fmt.Println("Version:", version_pkg.Version)
 		fmt.Println("OPA Version:", version_pkg.OPAVersion)
+		if configPublicKey != "" {
+			fmt.Println("Config Signature: required")
+		}
+		if names := extension.Builtins(); len(names) > 0 {
+			fmt.Println("Extension Builtins:", strings.Join(names, ", "))
+		}
+		if names := extension.Enrichers(); len(names) > 0 {
+			fmt.Println("Extension Enrichers:", strings.Join(names, ", "))
+		}
+		if names := extension.Sinks(); len(names) > 0 {
+			fmt.Println("Extension Sinks:", strings.Join(names, ", "))
+		}
 		os.Exit(0)
 	}
 
+	if *verifyAudit != "" {
+		os.Exit(verifyAuditLogFile(*verifyAudit, *auditPublicKey, *auditCheckpointEvery))
+	}
+
+	if *check && *configFile != "" {
+		if err := checkConfigFile(*configFile); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs.setBase(level)
+	logs.watchSignal()
+
+	if err := validInputVersion(*inputVersion); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkSignedMode(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
+	stop := &shutdown{}
+	defer stop.run()
 	useConfig := *configFile != ""
 
+	if *offline {
+		if err := checkOffline(flag.CommandLine, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	offlineMode = *offline
+
+	fipsMode = *fips
+
+	httpSendTLS = endpointTLS{caFile: *httpSendCAFile, certFile: *httpSendTLSCert, keyFile: *httpSendTLSKey}
+	decisionTLS := endpointTLS{caFile: *decisionCAFile, certFile: *decisionTLSCert, keyFile: *decisionTLSKey}
+	services := serviceTLS{
+		bundles:      endpointTLS{caFile: *bundleCAFile, certFile: *bundleTLSCert, keyFile: *bundleTLSKey},
+		decisionLogs: decisionTLS,
+	}
+
+	if *spiffeSVID {
+		if *spiffeEndpointSocket == "" {
+			log.Fatal("-spiffe-svid requires -spiffe-endpoint-socket")
+		}
+		if *adminTLSCert != "" || *adminTLSKey != "" {
+			log.Fatal("-spiffe-svid replaces -admin-tls-cert-file and -admin-tls-key-file")
+		}
+		client, err := newWorkloadAPIClient(*spiffeEndpointSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pluginSVID = newWorkloadSVID(*spiffeSVIDID)
+		go client.watchSVIDs(ctx, pluginSVID)
+		fetchCtx, cancel := context.WithTimeout(ctx, svidFetchTimeout)
+		err = pluginSVID.wait(fetchCtx)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	var opa *sdk.OPA
 	if useConfig {
 		if *policyFile != "" {
 			log.Fatal("Only one of config-file and policy-file arguments allowed")
 		}
 
+		if err := checkConfigFile(*configFile); err != nil {
+			log.Fatal(err)
+		}
+
 		var err error
-		opa, err = initOPA(ctx, *configFile)
+		opa, err = initOPA(ctx, *configFile, *configSigFile, *bundleCacheDir, services, *inputVersion, *offline)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer opa.Stop(ctx)
+		stop.add(func() { opa.Stop(ctx) })
 	}
 
 	instanceID, _ := uuid4()
-	p := DockerAuthZPlugin{
+	p := &DockerAuthZPlugin{
 		configFile:    *configFile,
 		policyFile:    *policyFile,
 		dataDir:       *dataDir,
@@ -394,16 +1067,469 @@ func main() {
 		quiet:         *quiet,
 		logOnlyDenied: *logOnlyDenied,
 		opa:           opa,
+		slowEval:      *slowEvalThreshold,
+		profileEval:   *slowEvalProfile,
+		overlay:       newRuntimeOverlay(),
+		state:         newStateDocuments(),
+		history:       newDecisionHistory(decisionHistorySize),
+		inflight:      newInflightGroup(*coalesce),
+	}
+
+	if *policyLibraryFile != "" {
+		if p.library, err = loadPolicyLibrary(ctx, *policyLibraryFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if p.bodyLimits, err = parseBodyLimits(*bodyLimitsFlag); err != nil {
+		log.Fatal(err)
+	}
+	switch *bodyTruncation {
+	case "deny":
+	case "policy":
+		if p.bodyLimits != nil {
+			p.bodyLimits.policy = true
+		}
+	default:
+		log.Fatalf("Invalid -body-truncation %q, expected deny or policy", *bodyTruncation)
+	}
+
+	p.inputVersion = *inputVersion
+
+	if err := validSessionDecision(*buildKitSessions); err != nil {
+		log.Fatal(err)
+	}
+	p.sessions = *buildKitSessions
+
+	if p.explanations, err = newExplanationStore(*explainSampleRate, *explainHistory, *explainMode); err != nil {
+		log.Fatal(err)
+	}
+
+	if p.enrichers, err = loadEnrichers(splitList(*enrichers)); err != nil {
+		log.Fatal(err)
 	}
 
 	if *check && *policyFile != "" {
 		os.Exit(regoSyntax(*policyFile))
 	}
 
+	schemaCheck := schemaCheckConfig{Mode: *schemaCheckMode, File: *schemaFile}
+	if err := schemaCheck.validate(*inputVersion); err != nil {
+		log.Fatal(err)
+	}
+	if *policyFile != "" {
+		paths := []string{*policyFile}
+		if *dataDir != "" {
+			paths = append(paths, *dataDir)
+		}
+		if err := schemaCheck.checkFiles(paths...); err != nil {
+			log.Fatalf("The policy failed the input schema check: %v", err)
+		}
+	}
+
+	store, err := openStateStore(*stateFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stop.add(func() { store.close() })
+
+	if *stateFile != "" {
+		if err := p.history.persist(store.bucket("decisions")); err != nil {
+			log.Fatal(err)
+		}
+		stop.add(p.history.close)
+	}
+
+	if *scrubRulesFile != "" {
+		var err error
+		if p.scrubber, err = loadScrubber(*scrubRulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *auditLogFile != "" {
+		var signer crypto.Signer
+		var err error
+		if *auditSigningKey != "" {
+			if signer, err = loadSigner(*auditSigningKey); err != nil {
+				log.Fatal(err)
+			}
+			if fipsMode {
+				if err := checkFIPSKey(signer.Public()); err != nil {
+					log.Fatalf("%s: %v", *auditSigningKey, err)
+				}
+			}
+		}
+		audit, err := openAuditLog(*auditLogFile, signer, *auditCheckpointEvery)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.sinks = append(p.sinks, namedSink{name: "audit", Sink: auditSink{log: audit}})
+	}
+
+	spool := func(name string, b *decisionBatch) {
+		if *decisionSpoolDir == "" {
+			return
+		}
+		if err := b.spoolTo(filepath.Join(*decisionSpoolDir, name), *decisionSpoolMaxBytes); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *decisionS3URL != "" {
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		s3, err := newS3Sink(*decisionS3URL, *decisionS3Region, *decisionS3Partition, creds, decisionTLS.caFile, decisionTLS.certFile, decisionTLS.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		spool("s3", &s3.batch)
+		p.sinks = append(p.sinks, namedSink{name: "s3", Sink: intervalSink{s3, *decisionS3FlushInterval}})
+	}
+
+	if *decisionESURL != "" {
+		var password string
+		if *decisionESPasswordFile != "" {
+			bs, err := os.ReadFile(*decisionESPasswordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			password = strings.TrimSpace(string(bs))
+		}
+		esTLS := endpointTLS{caFile: *decisionESCAFile}.or(decisionTLS)
+		es, err := newElasticsearchSink(*decisionESURL, *decisionESIndex, *decisionESUsername, password, esTLS.caFile, esTLS.certFile, esTLS.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		spool("elasticsearch", &es.batch)
+		p.sinks = append(p.sinks, namedSink{name: "elasticsearch", Sink: intervalSink{es, *decisionESFlushInterval}})
+	}
+
+	if *decisionSplunkURL != "" {
+		bs, err := os.ReadFile(*decisionSplunkTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		splunkTLS := endpointTLS{caFile: *decisionSplunkCAFile}.or(decisionTLS)
+		splunk, err := newSplunkSink(*decisionSplunkURL, strings.TrimSpace(string(bs)), *decisionSplunkIndex, *decisionSplunkSourcetype, splunkTLS.caFile, splunkTLS.certFile, splunkTLS.keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		spool("splunk", &splunk.batch)
+		p.sinks = append(p.sinks, namedSink{name: "splunk", Sink: intervalSink{splunk, *decisionSplunkFlushInterval}})
+	}
+
+	if *decisionGRPCAddr != "" {
+		grpcTLS := endpointTLS{caFile: *decisionGRPCCAFile, certFile: *decisionGRPCCertFile, keyFile: *decisionGRPCKeyFile}.or(decisionTLS)
+		exporter, err := newGRPCSink(grpcSinkConfig{
+			addr:     *decisionGRPCAddr,
+			insecure: *decisionGRPCInsecure,
+			caFile:   grpcTLS.caFile,
+			certFile: grpcTLS.certFile,
+			keyFile:  grpcTLS.keyFile,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		spool("grpc", &exporter.batch)
+		p.sinks = append(p.sinks, namedSink{name: "grpc", Sink: grpcSinkAdapter{intervalSink{exporter, *decisionGRPCFlushInterval}, exporter}})
+	}
+
+	if *decisionAuditd {
+		w, err := dialAuditd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.sinks = append(p.sinks, namedSink{name: "auditd", Sink: &auditdSink{w: w, allowed: *decisionAuditdAllowed}})
+	}
+
+	if *replayDir != "" {
+		store, err := openReplayStore(*replayDir, *replayRetention, *replayMaxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.sinks = append(p.sinks, namedSink{name: "replay", Sink: store, filter: replaySinkFilter()})
+	}
+
+	p.sinks = append(p.sinks, extensionSinks()...)
+
+	if *decisionSinkFilters != "" {
+		filters, err := loadSinkFilters(*decisionSinkFilters)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := p.applySinkFilters(filters); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := p.startSinks(ctx); err != nil {
+		log.Fatal(err)
+	}
+	stop.add(func() { p.stopSinks(context.Background()) })
+
+	if !useConfig && (*dataRefreshInterval > 0 || *dataLongPoll > 0 || *dataURLs != "") {
+		var dirs []string
+		if *dataDir != "" {
+			dirs = []string{*dataDir}
+		}
+		p.refresher = newDataRefresher(dirs, splitList(*dataURLs), *dataRefreshInterval, p.overlay, p.state)
+		p.refresher.maxRetryDelay = *dataRetryMaxDelay
+		p.refresher.longPoll = *dataLongPoll
+		if p.refresher.client.Transport, err = clientTransport(*dataCAFile, *dataTLSCert, *dataTLSKey); err != nil {
+			log.Fatal(err)
+		}
+		p.policies = &policyCache{schemaCheck: schemaCheck}
+		if err := p.refresher.start(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *userResources && !*trackOwnership {
+		log.Fatal("-user-resources requires -track-ownership")
+	}
+
+	if *resolveContainers || *resolveImageDigests || *enableHostInfo || *enableEngineInfo || *trackOwnership || *userResources || *quotas || *licenseIndex || *expiryLabel != "" {
+		token, _ := uuid4()
+		docker, err := newDockerClient(*dockerHost, token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.docker = docker
+		if *resolveContainers {
+			p.containers = newContainerResolver(docker, *containerCacheTTL)
+		}
+		if *resolveImageDigests {
+			p.images = newImageResolver(docker, *imageDigestCacheTTL)
+			if *stateFile != "" {
+				if err := p.images.cache.persist(store.bucket("cache/image-digests"), decodeString); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if *enableHostInfo {
+			hostInfo = newHostInfoSource(docker, *hostInfoTTL)
+			p.runtimes = hostInfo
+		}
+		if *enableEngineInfo {
+			p.engine = newEngineInfoSource(docker)
+		}
+		if *trackOwnership {
+			if p.ownership, err = newOwnershipTracker(docker, store, p.state); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *userResources {
+			p.usage = newResourceUsage(docker, p.ownership, *userResourcesCacheTTL)
+		}
+	}
+
+	builtinResults.setLimit(*builtinCacheSize)
+
+	var registryCredentials map[string]registryCredential
+	if *registryConfigFile != "" && (*enableRegistryManifests || *contentTrust) {
+		var err error
+		if registryCredentials, err = loadRegistryCredentials(*registryConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *enableRegistryManifests {
+		var err error
+		if registryManifests, err = newRegistryClient(*registryCAFile, *registryTLSCert, *registryTLSKey, registryCredentials, *registryManifestCacheTTL, *registrySBOMCacheTTL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *contentTrust {
+		var err error
+		if p.trust, err = newTrustResolver(*contentTrustServer, *registryCAFile, *registryTLSCert, *registryTLSKey, registryCredentials, *contentTrustCacheTTL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *ldapURL != "" {
+		cfg := ldapConfig{
+			url:       *ldapURL,
+			bindDN:    *ldapBindDN,
+			baseDN:    *ldapBaseDN,
+			caFile:    *ldapCAFile,
+			timeout:   *ldapTimeout,
+			sizeLimit: *ldapSizeLimit,
+		}
+		if *ldapBindPasswordFile != "" {
+			bs, err := os.ReadFile(*ldapBindPasswordFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.bindPassword = strings.TrimSpace(string(bs))
+		}
+		var err error
+		if ldapDirectory, err = newLDAPClient(cfg, *ldapCacheTTL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *apparmorProfilesFile != "" {
+		p.apparmor = newAppArmorProfiles(*apparmorProfilesFile)
+		p.apparmor.start(*apparmorRefreshInterval)
+	}
+
+	if *canonicalizeMounts {
+		p.mounts = newHostPaths(*mountHostRoot)
+	}
+
+	if *inspectBuildContext {
+		p.builds = newBuildContextInspector(*buildContextLimit, splitList(*buildContextHosts))
+	}
+
+	if *identityResolverKind != "" {
+		var err error
+		if p.identities, err = newIdentityResolver(*identityResolverKind, *identityCacheTTL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *spiffeEndpointSocket != "" || *spiffeTrustBundles != "" {
+		p.spiffe = newSPIFFEVerifier()
+		for _, pair := range splitList(*spiffeTrustBundles) {
+			td, path, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Fatalf("Invalid SPIFFE trust bundle %q, expected trust-domain=path", pair)
+			}
+			if err := p.spiffe.loadBundleFile(td, path); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *spiffeEndpointSocket != "" {
+			client, err := newWorkloadAPIClient(*spiffeEndpointSocket)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go client.watchBundles(ctx, p.spiffe)
+		}
+	}
+
+	if *resolveUserGroups {
+		p.groups = newGroupResolver(*userGroupsCacheTTL)
+		if *stateFile != "" {
+			if err := p.groups.cache.persist(store.bucket("cache/user-groups"), decodeStrings); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if t := p.tracker(); t != nil {
+		t.trackState(p.state)
+	}
+
+	if *remoteConfigURL != "" {
+		var token string
+		if *remoteConfigTokenFile != "" {
+			bs, err := os.ReadFile(*remoteConfigTokenFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			token = strings.TrimSpace(string(bs))
+		}
+		source, err := newRemoteConfigSource(*remoteConfigURL, token, *remoteConfigCAFile, 10*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if useConfig && p.tracker() == nil {
+			log.Printf("Remote data documents require the %v plugin to be enabled in the config file", authzPluginName)
+		}
+		remote := &remoteConfig{
+			opa:            opa,
+			state:          p.state,
+			timeout:        *remoteConfigTimeout,
+			bundleCacheDir: *bundleCacheDir,
+			services:       services,
+			configured: func() {
+				if t := p.tracker(); t != nil {
+					t.trackState(p.state)
+				}
+			},
+		}
+		go source.watch(ctx, func(keys map[string][]byte) {
+			remote.apply(ctx, keys)
+		})
+	}
+
+	if *quotas {
+		if useConfig && p.tracker() == nil {
+			log.Fatalf("Quotas require the %v plugin to be enabled in the config file", authzPluginName)
+		}
+		p.quotas = newQuotaTracker(p.docker, store, p.state)
+		p.quotas.start(time.Minute)
+		go p.quotas.watch(ctx)
+	}
+
+	if p.ownership != nil {
+		if useConfig && p.tracker() == nil {
+			log.Fatalf("Ownership tracking requires the %v plugin to be enabled in the config file", authzPluginName)
+		}
+		p.ownership.groups = p.groups
+		go p.ownership.watch(ctx)
+	}
+
+	if *licenseIndex {
+		if registryManifests == nil {
+			log.Fatal("-license-index requires -registry-manifests")
+		}
+		if useConfig && p.tracker() == nil {
+			log.Fatalf("License indexing requires the %v plugin to be enabled in the config file", authzPluginName)
+		}
+		indexer, err := newLicenseIndexer(p.docker, registryManifests, store, p.state, *licenseIndexInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go indexer.run(ctx)
+	}
+
+	if *expiryLabel != "" {
+		reporter := newExpiryReporter(p.docker, *expiryLabel, *expiryWebhook)
+		reporter.owners = p.ownership
+		go reporter.run(ctx, *expiryReportInterval)
+	}
+
+	if *adminAddr != "" {
+		err := serveAdmin(p, adminConfig{
+			addr:          *adminAddr,
+			tokenFile:     *adminTokenFile,
+			readTokenFile: *adminReadTokenFile,
+			readSubjects:  splitList(*adminReadSubjects),
+			writeSubjects: splitList(*adminWriteSubjects),
+			tlsCertFile:   *adminTLSCert,
+			tlsKeyFile:    *adminTLSKey,
+			clientCAFile:  *adminClientCA,
+			tlsReload:     *tlsReloadInterval,
+			svid:          pluginSVID,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	h := authorization.NewHandler(p)
+	stop.handleSignals()
+
+	if *vsockPort != 0 {
+		l, err := listenVsock(uint32(*vsockPort))
+		if err != nil {
+			log.Fatalf("Failed to listen on vsock port %d: %v", *vsockPort, err)
+		}
+		log.Printf("Starting server on %v.", l.Addr())
+		if err := h.Serve(l); err != nil {
+			log.Printf("Failed serving on vsock: %v", err)
+		}
+		return
+	}
+
 	log.Println("Starting server.")
-	err := h.ServeUnix(*pluginName, 0)
-	if err != nil {
+	if err := h.ServeUnix(*pluginName, 0); err != nil {
 		log.Printf("Failed serving on socket: %v", err)
 	}
 }
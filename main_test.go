@@ -69,22 +69,37 @@ func TestListBindMounts(t *testing.T) {
 		{
 			statement: "parse a simple bind list",
 			input:     `{ "HostConfig": { "Binds" : [ "/var:/home", "volume:/var/lib/app:ro" ] } }`,
-			expected:  []BindMount{{"/var", false, "/var"}},
+			expected:  []BindMount{{"/var", false, "/var", "", "rprivate", "/var"}},
 		},
 		{
 			statement: "expand ..",
 			input:     fmt.Sprintf(`{ "HostConfig": { "Binds" : [ "%s:/host" ] } }`, dotDotPath),
-			expected:  []BindMount{{dotDotPath, false, "/"}},
+			expected:  []BindMount{{dotDotPath, false, "/", "", "rprivate", "/"}},
 		},
 		{
 			statement: "resolve symlinks",
 			input:     fmt.Sprintf(`{ "HostConfig": { "Binds" : [ "%s:/host" ] } }`, symlinkTargetPath),
-			expected:  []BindMount{{symlinkTargetPath, false, symlinkSourcePath}},
+			expected:  []BindMount{{symlinkTargetPath, false, symlinkSourcePath, "", "rprivate", symlinkTargetPath}},
+		},
+		{
+			statement: "clean the source",
+			input:     `{ "HostConfig": { "Binds" : [ "/var/./lib//..:/host" ] } }`,
+			expected:  []BindMount{{"/var/./lib//..", false, "/var", "", "rprivate", "/var"}},
 		},
 		{
 			statement: "parse the readonly attribute",
 			input:     `{ "HostConfig": { "Binds" : [ "/var:/home:ro", "/var/lib:/mnt:rw" ] } }`,
-			expected:  []BindMount{{"/var", true, "/var"}, {"/var/lib", false, "/var/lib"}},
+			expected:  []BindMount{{"/var", true, "/var", "", "rprivate", "/var"}, {"/var/lib", false, "/var/lib", "", "rprivate", "/var/lib"}},
+		},
+		{
+			statement: "parse the propagation mode of binds",
+			input:     `{ "HostConfig": { "Binds" : [ "/var:/home:ro,rshared", "/var/lib:/mnt:slave" ] } }`,
+			expected:  []BindMount{{"/var", true, "/var", "", "rshared", "/var"}, {"/var/lib", false, "/var/lib", "", "slave", "/var/lib"}},
+		},
+		{
+			statement: "parse the propagation mode of mounts",
+			input:     `{ "HostConfig": { "Mounts" : [ { "Source": "/var", "Target": "/mnt", "Type": "bind", "BindOptions": { "Propagation": "shared" } } ] } }`,
+			expected:  []BindMount{{"/var", false, "/var", "", "shared", "/var"}},
 		},
 		{
 			statement: "handle when neither bind nor mounts provided",
@@ -107,7 +122,7 @@ func TestListBindMounts(t *testing.T) {
 				{ "Source": "/var", "Target": "/mnt", "Type": "bind" },
 				{ "Source": "vol", "Target": "/vol", "Type": "volume", "Labels":{"color":"red"} }
 				] } }`,
-			expected: []BindMount{{"/var", false, "/var"}},
+			expected: []BindMount{{"/var", false, "/var", "", "rprivate", "/var"}},
 		},
 		{
 			statement: "parse a readonly mount list",
@@ -115,7 +130,7 @@ func TestListBindMounts(t *testing.T) {
 				{ "Source": "/var", "Target": "/mnt", "Type": "bind", "ReadOnly": true },
 				{ "Source": "/home", "Target": "/home", "Type": "bind" }
 				] } }`,
-			expected: []BindMount{{"/var", true, "/var"}, {"/home", false, "/home"}},
+			expected: []BindMount{{"/var", true, "/var", "", "rprivate", "/var"}, {"/home", false, "/home", "", "rprivate", "/home"}},
 		},
 		{
 			statement: "ignore an invalid mount list",
@@ -123,13 +138,13 @@ func TestListBindMounts(t *testing.T) {
 				{ "Source": "/var", "Target": "/mnt", "Type": "bind", "ReadOnly": true },
 				{ "Source1": "/home", "Target": "/home", "Type": "bind" }
 				] } }`,
-			expected: []BindMount{{"/var", true, "/var"}},
+			expected: []BindMount{{"/var", true, "/var", "", "rprivate", "/var"}},
 		},
 		{
 			statement: "ignore a mount list of the wrong type, whlile reading binds",
 			input: `{ "HostConfig": { "Binds": ["/var:/mnt/var:ro","/home:/home"],
 				"Mounts" : null } }`,
-			expected: []BindMount{{"/var", true, "/var"}, {"/home", false, "/home"}},
+			expected: []BindMount{{"/var", true, "/var", "", "rprivate", "/var"}, {"/home", false, "/home", "", "rprivate", "/home"}},
 		},
 	}
 
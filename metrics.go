@@ -0,0 +1,162 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics exported by the plugin on the admin API.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	revisionComparisons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_revision_comparisons_total",
+		Help: "Number of requests evaluated against two bundle revisions.",
+	}, []string{"mode"})
+
+	revisionDivergences = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_revision_divergences_total",
+		Help: "Number of requests for which two bundle revisions returned different decisions.",
+	}, []string{"mode", "enforced"})
+
+	decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_decisions_total",
+		Help: "Number of policy decisions, by decision and the code attached by the policy.",
+	}, []string{"decision", "code"})
+
+	evaluationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_evaluation_errors_total",
+		Help: "Number of requests that could not be evaluated, by category (compile, eval, timeout, parse, unreachable or other).",
+	}, []string{"category"})
+
+	bodyTruncations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_body_truncations_total",
+		Help: "Number of request bodies left out of the input for exceeding the limit of their endpoint family, by family.",
+	}, []string{"family"})
+
+	expiredContainers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_expired_containers",
+		Help: "Number of containers that outlived their expiry label, as of the last report.",
+	})
+
+	builtinCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_builtin_cache_requests_total",
+		Help: "Number of lookups of builtin results in the cache, by builtin and result (hit or miss).",
+	}, []string{"builtin", "result"})
+
+	builtinCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_docker_authz_builtin_cache_evictions_total",
+		Help: "Number of builtin results removed from the cache, by builtin and reason (expired or size).",
+	}, []string{"builtin", "reason"})
+
+	builtinCacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_builtin_cache_entries",
+		Help: "Number of builtin results in the cache, by builtin.",
+	}, []string{"builtin"})
+
+	bundleLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_bundle_lag_seconds",
+		Help: "Seconds the latest revision of a bundle has been held back from activation, or 0 when it is active, by bundle.",
+	}, []string{"bundle"})
+
+	bundleSinceRequest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_bundle_since_request_seconds",
+		Help: "Seconds since the server of a bundle last answered successfully, or 0 when it has not been polled yet, by bundle.",
+	}, []string{"bundle"})
+
+	bundleStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_bundle_stale",
+		Help: "Whether a bundle has lagged or not been refreshed for longer than staleness.warn_after (1) or not (0), by bundle.",
+	}, []string{"bundle"})
+
+	bundleSource = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opa_docker_authz_bundle_source",
+		Help: "Index of the source a bundle is downloaded from, 0 being the configured one and the failover sources following, by bundle.",
+	}, []string{"bundle"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		revisionComparisons,
+		revisionDivergences,
+		decisions,
+		evaluationErrors,
+		bodyTruncations,
+		expiredContainers,
+		builtinCacheRequests,
+		builtinCacheEvictions,
+		builtinCacheEntries,
+		bundleLag,
+		bundleSinceRequest,
+		bundleStale,
+		bundleSource,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// decisionLabel returns the metric label value of a decision.
+func decisionLabel(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+// inputError is a failure to parse the request of the Docker daemon into the
+// input document.
+type inputError struct {
+	err error
+}
+
+func (e inputError) Error() string {
+	return e.err.Error()
+}
+
+func (e inputError) Unwrap() error {
+	return e.err
+}
+
+// errorCategory returns the metric label value of an evaluation failure,
+// telling policy bugs (compile, eval) apart from failures of the request
+// (parse) and of the environment (timeout, unreachable).
+func errorCategory(err error) string {
+
+	var (
+		astErrs  ast.Errors
+		astErr   *ast.Error
+		evalErr  *topdown.Error
+		inputErr inputError
+		netErr   net.Error
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), topdown.IsCancel(err):
+		return "timeout"
+	case errors.As(err, &inputErr):
+		return "parse"
+	case errors.As(err, &astErrs), errors.As(err, &astErr):
+		return "compile"
+	case errors.As(err, &evalErr), errors.Is(err, errInvalidDecision):
+		return "eval"
+	case errors.As(err, &netErr):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+func TestErrorCategory(t *testing.T) {
+
+	_, parseErr := ast.ParseModule("policy.rego", "package")
+	var syntaxErr *json.SyntaxError
+	err := json.Unmarshal([]byte("{"), &struct{}{})
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected syntax error, got %v", err)
+	}
+
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{parseErr, "compile"},
+		{&topdown.Error{Code: topdown.ConflictErr, Message: "conflict"}, "eval"},
+		{fmt.Errorf("%w: code is not a string", errInvalidDecision), "eval"},
+		{&topdown.Error{Code: topdown.CancelErr, Message: "cancelled"}, "timeout"},
+		{fmt.Errorf("enricher ldap: %w", context.DeadlineExceeded), "timeout"},
+		{inputError{err}, "parse"},
+		{fmt.Errorf("enricher cmdb: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), "unreachable"},
+		{errors.New("unexpected"), "other"},
+	}
+
+	for _, tc := range tests {
+		if category := errorCategory(tc.err); category != tc.expected {
+			t.Errorf("Expected %v for %v, got %v", tc.expected, tc.err, category)
+		}
+	}
+}
+
+func TestEvaluationErrorsMetric(t *testing.T) {
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(policyFile, []byte(`package docker.authz
+
+allow = "yes"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		overlay:    newRuntimeOverlay(),
+		history:    newDecisionHistory(decisionHistorySize),
+	}
+
+	parse := counterValue(t, evaluationErrors.WithLabelValues("parse"))
+	eval := counterValue(t, evaluationErrors.WithLabelValues("eval"))
+
+	resp := p.AuthZReq(authorization.Request{
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.41/containers/create",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(`{"HostConfig":`),
+	})
+	if resp.Allow || resp.Err == "" {
+		t.Fatalf("Expected error for invalid body, got %+v", resp)
+	}
+
+	resp = p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"})
+	if resp.Allow || resp.Err == "" {
+		t.Fatalf("Expected error for invalid decision, got %+v", resp)
+	}
+
+	if delta := counterValue(t, evaluationErrors.WithLabelValues("parse")) - parse; delta != 1 {
+		t.Errorf("Expected 1 parse error, got %v", delta)
+	}
+	if delta := counterValue(t, evaluationErrors.WithLabelValues("eval")) - eval; delta != 1 {
+		t.Errorf("Expected 1 eval error, got %v", delta)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+// Namespaces is the input.namespaces document: the namespace modes of a
+// container being created, from the IpcMode, PidMode, UTSMode, UsernsMode,
+// NetworkMode and CgroupnsMode fields of its HostConfig.
+type Namespaces struct {
+	IPC     Namespace `json:"ipc"`
+	PID     Namespace `json:"pid"`
+	UTS     Namespace `json:"uts"`
+	User    Namespace `json:"userns"`
+	Network Namespace `json:"network"`
+	Cgroup  Namespace `json:"cgroupns"`
+}
+
+// Namespace is the mode of a namespace of a container.
+type Namespace struct {
+	// Mode is the mode without its argument, e.g. host, private,
+	// shareable or container, or the network name for networks. It is
+	// empty when the daemon's default applies.
+	Mode string `json:"mode"`
+
+	// Host is true when the container shares the namespace of the host.
+	Host bool `json:"host"`
+
+	// Container is the container whose namespace is joined, in the
+	// container mode.
+	Container string `json:"container,omitempty"`
+}
+
+// containerNamespaces returns the namespace modes of container create
+// requests, or nil for any other request.
+func containerNamespaces(method, path string, body map[string]interface{}) *Namespaces {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	mode := func(key string) Namespace {
+		value, _ := hostConfig[key].(string)
+		return parseNamespaceMode(value)
+	}
+
+	return &Namespaces{
+		IPC:     mode("IpcMode"),
+		PID:     mode("PidMode"),
+		UTS:     mode("UTSMode"),
+		User:    mode("UsernsMode"),
+		Network: mode("NetworkMode"),
+		Cgroup:  mode("CgroupnsMode"),
+	}
+}
+
+// parseNamespaceMode parses a namespace mode such as host or
+// container:<name|id>. The default network mode is left empty, as the
+// daemon decides which network it is.
+func parseNamespaceMode(value string) Namespace {
+
+	mode, arg, _ := strings.Cut(value, ":")
+	if mode == "default" {
+		mode = ""
+	}
+
+	ns := Namespace{Mode: mode, Host: mode == "host"}
+	if mode == "container" {
+		ns.Container = arg
+	}
+
+	return ns
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestContainerNamespaces(t *testing.T) {
+
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(`{"HostConfig": {
+		"IpcMode": "container:db",
+		"PidMode": "host",
+		"UTSMode": "",
+		"UsernsMode": "host",
+		"NetworkMode": "default",
+		"CgroupnsMode": "private"
+	}}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Namespaces{
+		IPC:     Namespace{Mode: "container", Container: "db"},
+		PID:     Namespace{Mode: "host", Host: true},
+		User:    Namespace{Mode: "host", Host: true},
+		Network: Namespace{},
+		Cgroup:  Namespace{Mode: "private"},
+	}
+
+	got := containerNamespaces("POST", "/v1.41/containers/create", body)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, got)
+	}
+
+	if got := containerNamespaces("POST", "/v1.41/containers/abc/start", body); got != nil {
+		t.Fatalf("Expected no namespaces for other requests, got %+v", got)
+	}
+
+	if got := parseNamespaceMode("my-network"); got != (Namespace{Mode: "my-network"}) {
+		t.Fatalf("Expected the network name as the mode, got %+v", got)
+	}
+}
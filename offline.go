@@ -0,0 +1,172 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// offlineMode, set by -offline, fails the builtins of policies that connect
+// to other hosts.
+var offlineMode bool
+
+// outboundFlags are the flags enabling features that connect to other hosts,
+// which are refused by -offline. The daemon given by -docker-host must be
+// reached through a unix socket.
+var outboundFlags = []string{
+	"data-url",
+	"remote-config",
+	"registry-manifests",
+	"content-trust",
+	"license-index",
+	"build-context-hosts",
+	"ldap-url",
+	"expiry-webhook",
+	"decision-s3-url",
+	"decision-es-url",
+	"decision-splunk-url",
+	"decision-grpc-addr",
+}
+
+// offlineProblems returns the features of the flags set in fs, and of the OPA
+// configuration bs, that connect to other hosts. Either may be nil.
+func offlineProblems(fs *flag.FlagSet, bs []byte) ([]string, error) {
+
+	var problems []string
+
+	for _, name := range outboundFlags {
+		if fs == nil {
+			break
+		}
+		if f := fs.Lookup(name); f != nil && f.Value.String() != f.DefValue {
+			problems = append(problems, "-"+name)
+		}
+	}
+
+	if fs != nil {
+		if f := fs.Lookup("docker-host"); f != nil && !strings.HasPrefix(f.Value.String(), "unix://") {
+			problems = append(problems, "-docker-host (not a unix:// socket)")
+		}
+	}
+
+	if bs == nil {
+		return problems, nil
+	}
+
+	var cfg struct {
+		Services interface{} `json:"services"`
+		Bundles  map[string]struct {
+			Resource string `json:"resource"`
+		} `json:"bundles"`
+		DecisionLogs *struct {
+			Service string `json:"service"`
+			Console bool   `json:"console"`
+		} `json:"decision_logs"`
+		Status *struct {
+			Service string `json:"service"`
+			Console bool   `json:"console"`
+		} `json:"status"`
+		Discovery          json.RawMessage `json:"discovery"`
+		DistributedTracing *struct {
+			Type string `json:"type"`
+		} `json:"distributed_tracing"`
+		Plugins map[string]json.RawMessage `json:"plugins"`
+	}
+	if err := yaml.Unmarshal(bs, &cfg); err != nil {
+		return nil, err
+	}
+
+	services := 0
+	switch s := cfg.Services.(type) {
+	case map[string]interface{}:
+		services = len(s)
+	case []interface{}:
+		services = len(s)
+	}
+
+	var bundles []string
+	for name, b := range cfg.Bundles {
+		if !strings.HasPrefix(b.Resource, "file://") {
+			bundles = append(bundles, fmt.Sprintf("bundles.%s (not a file:// resource)", name))
+		}
+	}
+	sort.Strings(bundles)
+	problems = append(problems, bundles...)
+
+	// The decision log and status plugins default to the first service,
+	// unless they log to the console.
+	if l := cfg.DecisionLogs; l != nil && (l.Service != "" || (!l.Console && services > 0)) {
+		problems = append(problems, "decision_logs")
+	}
+	if s := cfg.Status; s != nil && (s.Service != "" || (!s.Console && services > 0)) {
+		problems = append(problems, "status")
+	}
+	if len(cfg.Discovery) > 0 && string(cfg.Discovery) != "null" {
+		problems = append(problems, "discovery")
+	}
+	if t := cfg.DistributedTracing; t != nil && t.Type != "" && t.Type != "none" {
+		problems = append(problems, "distributed_tracing")
+	}
+
+	if raw, ok := cfg.Plugins[authzPluginName]; ok {
+		var plugin authzPluginConfig
+		if err := json.Unmarshal(raw, &plugin); err != nil {
+			return nil, err
+		}
+		if plugin.BundleAlerts.Webhook != "" {
+			problems = append(problems, "plugins."+authzPluginName+".bundle_alerts.webhook")
+		}
+		for _, name := range sortedFailoverBundles(plugin.Failover) {
+			f := plugin.Failover[name]
+			if f == nil {
+				continue
+			}
+			for _, source := range f.Sources {
+				if !source.file() {
+					problems = append(problems, fmt.Sprintf("plugins.%s.failover.%s (source %s)", authzPluginName, name, source))
+				}
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// checkOffline fails when features connecting to other hosts are configured.
+func checkOffline(fs *flag.FlagSet, bs []byte) error {
+
+	problems, err := offlineProblems(fs, bs)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("offline mode forbids features connecting to other hosts: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// The builtins of policies connecting to other hosts, such as http.send
+// fetching the JWKS verifying tokens, fail in offline mode.
+func init() {
+
+	for _, b := range []*ast.Builtin{ast.HTTPSend, ast.NetLookupIPAddr} {
+		name, impl := b.Name, topdown.GetBuiltin(b.Name)
+		topdown.RegisterBuiltinFunc(name, func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+			if offlineMode {
+				return fmt.Errorf("offline mode: %s connects to other hosts", name)
+			}
+			return impl(bctx, operands, iter)
+		})
+	}
+}
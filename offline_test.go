@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestOfflineProblems(t *testing.T) {
+
+	fs := flag.NewFlagSet("opa-docker-authz", flag.ContinueOnError)
+	fs.String("data-url", "", "")
+	fs.Bool("registry-manifests", false, "")
+	fs.String("ldap-url", "", "")
+	fs.String("data-dir", "", "")
+	if err := fs.Parse([]string{"-data-dir", "/data", "-registry-manifests", "-ldap-url", "ldaps://ldap.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte(`
+services:
+  bundles:
+    url: https://bundles.example.com
+bundles:
+  local:
+    resource: file:///var/lib/opa-docker-authz/authz.tar.gz
+  remote:
+    service: bundles
+    resource: authz.tar.gz
+decision_logs:
+  console: true
+status:
+  service: bundles
+plugins:
+  opa_docker_authz:
+    bundle_alerts:
+      webhook: https://alerts.example.com
+    failover:
+      local:
+        sources:
+          - resource: file:///mnt/backup/authz.tar.gz
+          - service: bundles
+            resource: authz.tar.gz
+`)
+
+	problems, err := offlineProblems(fs, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"-registry-manifests",
+		"-ldap-url",
+		"bundles.remote (not a file:// resource)",
+		"status",
+		"plugins.opa_docker_authz.bundle_alerts.webhook",
+		"plugins.opa_docker_authz.failover.local (source bundles/authz.tar.gz)",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected %v, got %v", expected, problems)
+	}
+
+	// Local bundles, console decision logs and the daemon are allowed.
+	local := []byte(`
+bundles:
+  authz:
+    resource: file:///var/lib/opa-docker-authz/authz.tar.gz
+decision_logs:
+  console: true
+`)
+	if err := checkOffline(flag.NewFlagSet("opa-docker-authz", flag.ContinueOnError), local); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decision logs are uploaded to the first service unless logged to the
+	// console.
+	uploaded := []byte("services:\n  logs:\n    url: https://logs.example.com\ndecision_logs: {}\n")
+	if err := checkOffline(nil, uploaded); err == nil || !strings.Contains(err.Error(), "decision_logs") {
+		t.Fatalf("Expected decision logs to be refused, got %v", err)
+	}
+}
+
+func TestOfflineDockerHost(t *testing.T) {
+
+	tests := map[string]bool{
+		"unix:///var/run/docker.sock":   true,
+		"tcp://docker.example.com:2376": false,
+		"tcp://127.0.0.1:2375":          false,
+	}
+
+	for host, allowed := range tests {
+		fs := flag.NewFlagSet("opa-docker-authz", flag.ContinueOnError)
+		fs.String("docker-host", "unix:///var/run/docker.sock", "")
+		if err := fs.Parse([]string{"-docker-host", host}); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkOffline(fs, nil); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", host, allowed, err)
+		}
+	}
+}
+
+func TestOfflineBuiltins(t *testing.T) {
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte(`{"keys": []}`))
+	}))
+	defer server.Close()
+
+	queries := []string{
+		fmt.Sprintf(`http.send({"method": "get", "url": %q}).status_code == 200`, server.URL+"/jwks"),
+		`io.jwt.decode_verify("a.b.c", {"cert": http.send({"method": "get", "url": "` + server.URL + `/jwks"}).raw_body})`,
+		`net.lookup_ip_addr("localhost")`,
+	}
+
+	offlineMode = true
+	defer func() { offlineMode = false }()
+
+	for _, query := range queries {
+		_, err := rego.New(rego.Query(query), rego.StrictBuiltinErrors(true)).Eval(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "offline mode") {
+			t.Errorf("%s: expected offline mode to fail the builtin, got %v", query, err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("Expected no requests, got %d", n)
+	}
+
+	offlineMode = false
+	rs, err := rego.New(rego.Query(queries[0])).Eval(context.Background())
+	if err != nil || len(rs) != 1 || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("Expected http.send to be sent without offline mode, got %v, %v and %d requests", rs, err, atomic.LoadInt32(&hits))
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// runtimeOverlay holds the policies and data documents pushed through the
+// admin API. The overlay is applied on top of the policy file and data
+// directory on every evaluation and is not persisted across restarts.
+type runtimeOverlay struct {
+	mu         sync.RWMutex
+	modules    map[string]string
+	data       map[string][]byte
+	generation uint64
+}
+
+func newRuntimeOverlay() *runtimeOverlay {
+	return &runtimeOverlay{
+		modules: map[string]string{},
+		data:    map[string][]byte{},
+	}
+}
+
+// overlayModuleName returns the module file name used for an uploaded policy,
+// keeping uploads in their own namespace so they never shadow the policy file.
+func overlayModuleName(name string) string {
+	return "admin/" + name
+}
+
+// putModule validates the module against the base policy and the other
+// uploaded modules before making it visible to evaluations.
+func (o *runtimeOverlay) putModule(name, src string, base map[string]string) error {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	modules := map[string]string{}
+	for k, v := range base {
+		modules[k] = v
+	}
+	for k, v := range o.modules {
+		modules[k] = v
+	}
+	modules[overlayModuleName(name)] = src
+
+	if _, err := ast.CompileModules(modules); err != nil {
+		return err
+	}
+
+	o.modules[overlayModuleName(name)] = src
+	o.generation++
+	return nil
+}
+
+// putData replaces the document at path. Any previously uploaded documents
+// nested below path are discarded since they are overwritten by the new value.
+func (o *runtimeOverlay) putData(path string, bs []byte) error {
+
+	var value interface{}
+	if err := util.UnmarshalJSON(bs, &value); err != nil {
+		return err
+	}
+
+	path = strings.Trim(path, "/")
+	if path == "" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("root document must be an object")
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for k := range o.data {
+		if path == "" || k == path || strings.HasPrefix(k, path+"/") {
+			delete(o.data, k)
+		}
+	}
+	o.data[path] = bs
+	o.generation++
+
+	return nil
+}
+
+func (o *runtimeOverlay) empty() bool {
+
+	if o == nil {
+		return true
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return len(o.modules) == 0 && len(o.data) == 0
+}
+
+// status lists the uploaded module names and document paths.
+func (o *runtimeOverlay) status() map[string][]string {
+
+	result := map[string][]string{"policies": {}, "data": {}}
+	if o == nil {
+		return result
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for name := range o.modules {
+		result["policies"] = append(result["policies"], strings.TrimPrefix(name, overlayModuleName("")))
+	}
+	for path := range o.data {
+		result["data"] = append(result["data"], "/"+path)
+	}
+	sort.Strings(result["policies"])
+	sort.Strings(result["data"])
+
+	return result
+}
+
+// regoOptions returns the options that load the data directories together
+// with the overlay and the state documents. Without either, the data
+// directories are handed to rego.Load as before.
+func (o *runtimeOverlay) regoOptions(dataDirs []string, state *stateDocuments) ([]func(*rego.Rego), error) {
+
+	if o.empty() && state.empty() {
+		return []func(*rego.Rego){rego.Load(dataDirs, nil)}, nil
+	}
+
+	result, err := loader.NewFileLoader().Filtered(dataDirs, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []func(*rego.Rego)
+	for _, m := range result.ParsedModules() {
+		opts = append(opts, rego.ParsedModule(m))
+	}
+
+	doc := result.Documents
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	for name, src := range o.moduleSources() {
+		opts = append(opts, rego.Module(name, src))
+	}
+
+	if err := o.applyData(doc); err != nil {
+		return nil, err
+	}
+
+	if err := state.apply(doc); err != nil {
+		return nil, err
+	}
+
+	return append(opts, rego.Store(inmem.NewFromObject(doc))), nil
+}
+
+// version returns a counter that changes whenever an upload is accepted.
+func (o *runtimeOverlay) version() uint64 {
+
+	if o == nil {
+		return 0
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.generation
+}
+
+// moduleSources returns a copy of the uploaded modules keyed by file name.
+func (o *runtimeOverlay) moduleSources() map[string]string {
+
+	result := map[string]string{}
+	if o == nil {
+		return result
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for name, src := range o.modules {
+		result[name] = src
+	}
+
+	return result
+}
+
+// applyData writes the uploaded documents into doc, which must not be shared
+// with concurrent readers.
+func (o *runtimeOverlay) applyData(doc map[string]interface{}) error {
+
+	if o == nil {
+		return nil
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	// Apply shallower paths first so nested uploads land inside their parents.
+	paths := make([]string, 0, len(o.data))
+	for k := range o.data {
+		paths = append(paths, k)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	for _, path := range paths {
+		var value interface{}
+		if err := util.UnmarshalJSON(o.data[path], &value); err != nil {
+			return err
+		}
+		if path == "" {
+			for k := range doc {
+				delete(doc, k)
+			}
+			for k, v := range value.(map[string]interface{}) {
+				doc[k] = v
+			}
+			continue
+		}
+		setDocument(doc, strings.Split(path, "/"), value)
+	}
+
+	return nil
+}
+
+// setDocument writes value at path inside doc, replacing any non-object
+// values found along the way.
+func setDocument(doc map[string]interface{}, path []string, value interface{}) {
+
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[key] = next
+		}
+		doc = next
+	}
+
+	doc[path[len(path)-1]] = value
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// ContainerOwner records who created a container, in data.ownership and in
+// input.Container.Owner.
+type ContainerOwner struct {
+	User    string            `json:"user"`
+	Groups  []string          `json:"groups"`
+	Name    string            `json:"name"`
+	Image   string            `json:"image"`
+	Created time.Time         `json:"created"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ownershipTracker maintains the table of the containers of the daemon and
+// the users who created them, published to policies as data.ownership. The
+// creator of a container is learnt from the daemon's response to its create
+// request, while the daemon's events report the containers created by other
+// means, such as swarm tasks, renames and removals, including those the
+// plugin never sees a request for, e.g. with --rm. The table is persisted in
+// the state store, and reconciled with the containers of the daemon when the
+// plugin starts.
+type ownershipTracker struct {
+	docker *dockerClient
+	bucket *storeBucket
+	state  *stateDocuments
+
+	// groups, when set, resolves the groups of creators, recorded with
+	// their containers.
+	groups *groupResolver
+
+	mu         sync.Mutex
+	containers map[string]*ContainerOwner
+	since      time.Time
+}
+
+func newOwnershipTracker(docker *dockerClient, store *stateStore, state *stateDocuments) (*ownershipTracker, error) {
+
+	t := &ownershipTracker{
+		docker:     docker,
+		bucket:     store.bucket("ownership/containers"),
+		state:      state,
+		containers: map[string]*ContainerOwner{},
+	}
+
+	err := t.bucket.forEach(func(id string, value json.RawMessage) error {
+		var c ContainerOwner
+		if err := json.Unmarshal(value, &c); err != nil {
+			return err
+		}
+		t.containers[id] = &c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.publish()
+	t.mu.Unlock()
+
+	return t, nil
+}
+
+// dockerContainer is an entry of the response of GET /containers/json.
+type dockerContainer struct {
+	ID      string `json:"Id"`
+	Names   []string
+	Image   string
+	Labels  map[string]string
+	State   string
+	Created int64
+}
+
+// watch reconciles the table with the containers of the daemon, then follows
+// the container events of the daemon until ctx is done.
+func (t *ownershipTracker) watch(ctx context.Context) {
+	t.docker.watchContainers(ctx, []string{"create", "rename", "destroy"}, t.reconcile, func() time.Time {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.since
+	}, t.handle)
+}
+
+// reconcile replaces the table with the containers of the daemon listed at
+// since, keeping the records of the containers already known. The others,
+// created while the plugin was not running, have no creator.
+func (t *ownershipTracker) reconcile(containers []dockerContainer, since time.Time) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	listed := map[string]bool{}
+	for _, dc := range containers {
+		listed[dc.ID] = true
+
+		name := ""
+		if len(dc.Names) > 0 {
+			name = strings.TrimPrefix(dc.Names[0], "/")
+		}
+
+		c := t.containers[dc.ID]
+		switch {
+		case c == nil:
+			labels := dc.Labels
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			c = &ContainerOwner{
+				Groups:  []string{},
+				Name:    name,
+				Image:   dc.Image,
+				Created: time.Unix(dc.Created, 0).UTC(),
+				Labels:  labels,
+			}
+			t.containers[dc.ID] = c
+		case c.Name != name:
+			c.Name = name
+		default:
+			continue
+		}
+		t.save(dc.ID)
+	}
+
+	for id := range t.containers {
+		if !listed[id] {
+			delete(t.containers, id)
+			t.save(id)
+		}
+	}
+
+	t.since = since.UTC()
+	t.publish()
+}
+
+// handle updates the table from a container event.
+func (t *ownershipTracker) handle(e dockerEvent) {
+
+	if e.Type != "container" || e.Actor.ID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at := time.Unix(0, e.TimeNano).UTC()
+	if at.After(t.since) {
+		t.since = at
+	}
+
+	c := t.containers[e.Actor.ID]
+
+	switch e.Action {
+	case "create":
+		// The create request, if the plugin authorized one, may have been
+		// observed already, without the name generated by the daemon.
+		if c != nil {
+			if c.Name != "" {
+				return
+			}
+			c.Name = e.Actor.Attributes["name"]
+			break
+		}
+		labels := map[string]string{}
+		for k, v := range e.Actor.Attributes {
+			if k != "name" && k != "image" {
+				labels[k] = v
+			}
+		}
+		t.containers[e.Actor.ID] = &ContainerOwner{
+			Groups:  []string{},
+			Name:    e.Actor.Attributes["name"],
+			Image:   e.Actor.Attributes["image"],
+			Created: at,
+			Labels:  labels,
+		}
+	case "rename":
+		if c == nil {
+			return
+		}
+		c.Name = strings.TrimPrefix(e.Actor.Attributes["name"], "/")
+	case "destroy":
+		if c == nil {
+			return
+		}
+		delete(t.containers, e.Actor.ID)
+	default:
+		return
+	}
+
+	t.save(e.Actor.ID)
+	t.publish()
+}
+
+// observe records the creator of a container, and the groups of the creator,
+// from the daemon's response to its create request.
+func (t *ownershipTracker) observe(ctx context.Context, r authorization.Request) {
+
+	if t == nil || r.RequestMethod != http.MethodPost || r.ResponseStatusCode != http.StatusCreated {
+		return
+	}
+
+	u, err := url.Parse(r.RequestURI)
+	if err != nil || strings.Trim(trimAPIVersion(u.Path), "/") != "containers/create" {
+		return
+	}
+
+	var resp struct{ Id string }
+	if err := json.Unmarshal(r.ResponseBody, &resp); err != nil || resp.Id == "" {
+		return
+	}
+
+	var body struct {
+		Image  string
+		Labels map[string]string
+	}
+	_ = json.Unmarshal(r.RequestBody, &body)
+	if body.Labels == nil {
+		body.Labels = map[string]string{}
+	}
+
+	groups := t.groups.groups(ctx, r.User)
+	if groups == nil {
+		groups = []string{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := &ContainerOwner{
+		User:    r.User,
+		Groups:  groups,
+		Name:    strings.TrimPrefix(u.Query().Get("name"), "/"),
+		Image:   body.Image,
+		Created: time.Now().UTC(),
+		Labels:  body.Labels,
+	}
+	if event := t.containers[resp.Id]; event != nil {
+		c.Created = event.Created
+		if c.Name == "" {
+			c.Name = event.Name
+		}
+	}
+	t.containers[resp.Id] = c
+
+	t.save(resp.Id)
+	t.publish()
+}
+
+// lookup returns the record of the container addressed by ref, which may be a
+// full ID, a name or an unambiguous ID prefix as accepted by the daemon, or
+// nil when the container is unknown.
+func (t *ownershipTracker) lookup(ref string) *ContainerOwner {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.containers[ref]
+	if !ok {
+		ambiguous := false
+		for id, candidate := range t.containers {
+			if candidate.Name == strings.TrimPrefix(ref, "/") {
+				c, ambiguous = candidate, false
+				break
+			}
+			if strings.HasPrefix(id, ref) {
+				ambiguous = c != nil
+				c = candidate
+			}
+		}
+		if ambiguous {
+			return nil
+		}
+	}
+	if c == nil {
+		return nil
+	}
+
+	copied := *c
+	return &copied
+}
+
+// enrichOwner adds the record of the container a request is addressed to, if
+// known, as input.Container.Owner.
+func (p *DockerAuthZPlugin) enrichOwner(_ context.Context, _ *authorization.Request, doc map[string]interface{}) error {
+	if endpoint, ok := doc["Container"].(*ContainerEndpoint); ok && endpoint != nil {
+		endpoint.Owner = p.ownership.lookup(endpoint.ID)
+	}
+	return nil
+}
+
+// save persists the record of the container id, or its removal. Callers must
+// hold t.mu.
+func (t *ownershipTracker) save(id string) {
+
+	var err error
+	if c, ok := t.containers[id]; ok {
+		err = t.bucket.put(id, c)
+	} else {
+		err = t.bucket.delete(id)
+	}
+	if err != nil {
+		log.Printf("Failed to persist the ownership table: %v", err)
+	}
+}
+
+// publish sets data.ownership. Callers must hold t.mu.
+func (t *ownershipTracker) publish() {
+
+	containers := make(map[string]interface{}, len(t.containers))
+	for id, c := range t.containers {
+		copied := *c
+		containers[id] = &copied
+	}
+
+	t.state.set("ownership", map[string]interface{}{"containers": containers})
+}
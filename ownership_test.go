@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func ownershipTable(t *testing.T, state *stateDocuments) map[string]interface{} {
+
+	doc := map[string]interface{}{}
+	if err := state.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	return doc["ownership"].(map[string]interface{})["containers"].(map[string]interface{})
+}
+
+func containerEvent(action, id string, at time.Time, attributes map[string]string) dockerEvent {
+
+	e := dockerEvent{Type: "container", Action: action, TimeNano: at.UnixNano()}
+	e.Actor.ID = id
+	e.Actor.Attributes = attributes
+
+	return e
+}
+
+func TestOwnershipTracker(t *testing.T) {
+
+	state := newStateDocuments()
+	o, err := newOwnershipTracker(nil, nil, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if table := ownershipTable(t, state); len(table) != 0 {
+		t.Fatalf("Expected an empty table, got %v", table)
+	}
+
+	now := time.Now()
+
+	// The response to a create request gives the creator, whether or not
+	// its event was seen first.
+	o.observe(context.Background(), authorization.Request{
+		User:               "alice",
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.41/containers/create?name=web",
+		RequestBody:        []byte(`{"Image":"nginx","Labels":{"team":"a"}}`),
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Id":"aaa111"}`),
+	})
+	o.handle(containerEvent("create", "aaa111", now, map[string]string{"name": "web", "image": "nginx", "team": "a"}))
+
+	o.handle(containerEvent("create", "bbb111", now, map[string]string{"name": "eager_turing", "image": "redis"}))
+	o.observe(context.Background(), authorization.Request{
+		User:               "bob",
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.41/containers/create",
+		RequestBody:        []byte(`{"Image":"redis"}`),
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Id":"bbb111"}`),
+	})
+
+	// Containers created without a request, such as swarm tasks, have no
+	// creator.
+	o.handle(containerEvent("create", "ccc111", now, map[string]string{"name": "svc.1.x", "image": "nginx", "com.docker.swarm.service.name": "svc"}))
+
+	// Failed creations are ignored.
+	o.observe(context.Background(), authorization.Request{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 409, ResponseBody: []byte(`{"message":"conflict"}`)})
+
+	table := ownershipTable(t, state)
+	if len(table) != 3 {
+		t.Fatalf("Expected 3 containers, got %v", table)
+	}
+	for id, expected := range map[string]string{"aaa111": "alice/web", "bbb111": "bob/eager_turing", "ccc111": "/svc.1.x"} {
+		c := table[id].(map[string]interface{})
+		if got := fmt.Sprintf("%v/%v", c["user"], c["name"]); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, id, got)
+		}
+	}
+	if labels := table["aaa111"].(map[string]interface{})["labels"]; fmt.Sprint(labels) != "map[team:a]" {
+		t.Errorf("Expected the labels of the request, got %v", labels)
+	}
+	if labels := table["ccc111"].(map[string]interface{})["labels"]; fmt.Sprint(labels) != "map[com.docker.swarm.service.name:svc]" {
+		t.Errorf("Expected the labels of the event, got %v", labels)
+	}
+
+	o.handle(containerEvent("rename", "aaa111", now, map[string]string{"name": "/frontend", "oldName": "/web"}))
+	o.handle(containerEvent("destroy", "bbb111", now, nil))
+
+	table = ownershipTable(t, state)
+	if len(table) != 2 || table["aaa111"].(map[string]interface{})["name"] != "frontend" {
+		t.Fatalf("Expected bbb111 removed and aaa111 renamed, got %v", table)
+	}
+}
+
+func TestDockerEvents(t *testing.T) {
+
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"Type":"container","Action":"create","Actor":{"ID":"aaa111","Attributes":{"name":"web"}},"timeNano":1700000000000000001}
+{"Type":"container","Action":"destroy","Actor":{"ID":"aaa111","Attributes":{}},"timeNano":1700000001000000000}
+`))
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	since := time.Unix(1700000000, 5)
+	err = docker.events(context.Background(), since, map[string][]string{"type": {"container"}}, func(e dockerEvent) {
+		events = append(events, e.Action+" "+e.Actor.ID)
+	})
+	if err == nil {
+		t.Fatal("Expected the end of the stream to be reported")
+	}
+
+	if strings.Join(events, ",") != "create aaa111,destroy aaa111" {
+		t.Fatalf("Unexpected events %v", events)
+	}
+	if !strings.Contains(query, "since=1700000000.000000005") || !strings.Contains(query, "filters=") {
+		t.Fatalf("Unexpected query %q", query)
+	}
+}
+
+func TestContainerOwner(t *testing.T) {
+
+	o, err := newOwnershipTracker(nil, nil, newStateDocuments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ user, id, name string }{{"alice", "aaa111", "web"}, {"bob", "aab222", "db"}} {
+		o.observe(context.Background(), authorization.Request{
+			User:               c.user,
+			RequestMethod:      "POST",
+			RequestURI:         "/v1.41/containers/create?name=" + c.name,
+			ResponseStatusCode: 201,
+			ResponseBody:       []byte(`{"Id":"` + c.id + `"}`),
+		})
+	}
+
+	p := &DockerAuthZPlugin{ownership: o}
+
+	for ref, expected := range map[string]string{"aaa111": "alice", "web": "alice", "aab": "bob", "aa": "", "unknown": ""} {
+		input, err := p.buildInput(context.Background(), authorization.Request{
+			RequestMethod: "POST",
+			RequestURI:    "/v1.41/containers/" + ref + "/stop",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner := input.(map[string]interface{})["Container"].(*ContainerEndpoint).Owner
+		switch {
+		case expected == "" && owner != nil:
+			t.Errorf("Expected no owner for %s, got %+v", ref, owner)
+		case expected != "" && (owner == nil || owner.User != expected):
+			t.Errorf("Expected owner %s for %s, got %+v", expected, ref, owner)
+		}
+	}
+}
+
+func TestOwnershipPersistence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := newOwnershipTracker(nil, store, newStateDocuments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQuotaTracker(nil, store, newStateDocuments())
+	for _, c := range []struct{ user, id, name string }{{"alice", "aaa111", "web"}, {"bob", "bbb111", "db"}} {
+		r := authorization.Request{
+			User:               c.user,
+			RequestMethod:      "POST",
+			RequestURI:         "/v1.41/containers/create?name=" + c.name,
+			ResponseStatusCode: 201,
+			ResponseBody:       []byte(`{"Id":"` + c.id + `"}`),
+		}
+		o.observe(context.Background(), r)
+		q.observe(r)
+	}
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table survives a restart, during which bbb111 was removed, web
+	// renamed and ccc111 created.
+	store, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	state := newStateDocuments()
+	if o, err = newOwnershipTracker(nil, store, state); err != nil {
+		t.Fatal(err)
+	}
+	if table := ownershipTable(t, state); len(table) != 2 {
+		t.Fatalf("Expected the persisted table, got %v", table)
+	}
+
+	quotaState := newStateDocuments()
+	q = newQuotaTracker(nil, store, quotaState)
+
+	listed := []dockerContainer{
+		{ID: "aaa111", Names: []string{"/frontend"}, Image: "nginx"},
+		{ID: "ccc111", Names: []string{"/cron"}, Image: "alpine", Labels: map[string]string{"team": "ops"}, Created: 1700000000},
+	}
+	o.reconcile(listed, time.Now())
+	q.reconcile(listed, time.Now())
+
+	table := ownershipTable(t, state)
+	if len(table) != 2 {
+		t.Fatalf("Expected 2 containers, got %v", table)
+	}
+	for id, expected := range map[string]string{"aaa111": "alice/frontend", "ccc111": "/cron"} {
+		c := table[id].(map[string]interface{})
+		if got := fmt.Sprintf("%v/%v", c["user"], c["name"]); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, id, got)
+		}
+	}
+	if created := table["ccc111"].(map[string]interface{})["created"]; created != "2023-11-14T22:13:20Z" {
+		t.Errorf("Expected the creation time of the listed container, got %v", created)
+	}
+
+	if n := quotaUsers(t, quotaState)["bob"].(map[string]interface{})["containers"]; fmt.Sprint(n) != "0" {
+		t.Fatalf("Expected bob's container to be dropped from the quotas, got %v", n)
+	}
+}
+
+func TestOwnershipWatch(t *testing.T) {
+
+	streamed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			if r.URL.Query().Get("all") != "1" {
+				t.Errorf("Expected all containers to be listed, got %v", r.URL)
+			}
+			_, _ = w.Write([]byte(`[{"Id": "aaa111", "Names": ["/web"], "Image": "nginx", "Created": 1700000000}]`))
+		case "/events":
+			if r.URL.Query().Get("since") == "" {
+				t.Errorf("Expected events since the listing, got %v", r.URL)
+			}
+			_, _ = w.Write([]byte(`{"Type":"container","Action":"destroy","Actor":{"ID":"aaa111"},"timeNano":1700000001000000000}` + "\n"))
+			w.(http.Flusher).Flush()
+			close(streamed)
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := newStateDocuments()
+	o, err := newOwnershipTracker(docker, nil, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.watch(ctx)
+
+	// aaa111 is listed, then destroyed.
+	<-streamed
+	deadline := time.Now().Add(5 * time.Second)
+	for o.lookup("aaa111") != nil || len(ownershipTable(t, state)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected aaa111 to be destroyed, got %v", ownershipTable(t, state))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
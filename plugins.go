@@ -0,0 +1,174 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PluginRequest is the input.plugin document: a Docker plugin being
+// installed, upgraded or configured, and the host access it is granted.
+type PluginRequest struct {
+	// Action is pull, upgrade or set.
+	Action string `json:"action"`
+
+	// Name is the local name of the plugin, and Remote the reference it is
+	// pulled from, when installed or upgraded.
+	Name   string `json:"name"`
+	Remote string `json:"remote"`
+
+	Privileges PluginPrivileges `json:"privileges"`
+
+	// Settings are the environment variables and arguments set by set
+	// requests, keyed by name.
+	Settings map[string]string `json:"settings"`
+}
+
+// PluginPrivileges is the host access granted to a plugin: the privileges
+// accepted when it is installed or upgraded, or the mount sources and device
+// paths set on it.
+type PluginPrivileges struct {
+	// Network is the network mode of the plugin, e.g. host, or empty when
+	// it has no access to the networks of the host.
+	Network string `json:"network"`
+
+	HostPID         bool     `json:"host_pid"`
+	HostIPC         bool     `json:"host_ipc"`
+	Mounts          []string `json:"mounts"`
+	Devices         []string `json:"devices"`
+	AllowAllDevices bool     `json:"allow_all_devices"`
+	Capabilities    []string `json:"capabilities"`
+
+	// Unknown lists the names of the privileges not recognized above.
+	Unknown []string `json:"unknown"`
+}
+
+// requestedPlugin returns the plugin of /plugins/pull, /plugins/{name}/upgrade
+// and /plugins/{name}/set requests, or nil for any other request. The body of
+// pull and upgrade requests is the list of privileges the client accepted, and
+// that of set requests the list of settings.
+func requestedPlugin(method, path string, query url.Values, body interface{}) *PluginRequest {
+
+	path = trimAPIVersion(path)
+	if method != "POST" || !strings.HasPrefix(path, "/plugins/") {
+		return nil
+	}
+
+	// Plugin names may contain slashes, e.g. vieux/sshfs:latest.
+	plugin := &PluginRequest{Settings: map[string]string{}}
+	switch name := strings.TrimPrefix(path, "/plugins/"); {
+	case name == "pull":
+		plugin.Action, plugin.Name, plugin.Remote = "pull", query.Get("name"), query.Get("remote")
+		if plugin.Name == "" {
+			plugin.Name = plugin.Remote
+		}
+	case strings.HasSuffix(name, "/upgrade"):
+		plugin.Action, plugin.Name, plugin.Remote = "upgrade", strings.TrimSuffix(name, "/upgrade"), query.Get("remote")
+	case strings.HasSuffix(name, "/set"):
+		plugin.Action, plugin.Name = "set", strings.TrimSuffix(name, "/set")
+	default:
+		return nil
+	}
+
+	items, _ := body.([]interface{})
+	if plugin.Action == "set" {
+		plugin.Privileges = pluginSettings(items, plugin.Settings)
+	} else {
+		plugin.Privileges = pluginPrivileges(items)
+	}
+
+	return plugin
+}
+
+// pluginPrivileges parses the privileges of plugin pull and upgrade requests,
+// as listed by GET /plugins/privileges.
+func pluginPrivileges(items []interface{}) PluginPrivileges {
+
+	privileges := newPluginPrivileges()
+
+	for _, item := range items {
+		privilege, _ := item.(map[string]interface{})
+		name, _ := privilege["Name"].(string)
+		values := stringList(privilege["Value"])
+
+		switch strings.ToLower(name) {
+		case "network":
+			if len(values) > 0 {
+				privileges.Network = values[0]
+			}
+		case "host pid namespace":
+			privileges.HostPID = true
+		case "host ipc namespace":
+			privileges.HostIPC = true
+		case "mount":
+			privileges.Mounts = append(privileges.Mounts, values...)
+		case "device":
+			privileges.Devices = append(privileges.Devices, values...)
+		case "allow-all-devices":
+			privileges.AllowAllDevices = true
+		case "capabilities":
+			for _, c := range values {
+				privileges.Capabilities = append(privileges.Capabilities, canonicalCapability(c))
+			}
+		default:
+			privileges.Unknown = append(privileges.Unknown, name)
+		}
+	}
+
+	privileges.sort()
+	return privileges
+}
+
+// pluginSettings parses the settings of plugin set requests, e.g.
+// DEBUG=1, data.source=/srv or args=-v, collecting the mount sources and
+// device paths into the returned privileges and the others into settings.
+func pluginSettings(items []interface{}, settings map[string]string) PluginPrivileges {
+
+	privileges := newPluginPrivileges()
+
+	for _, item := range items {
+		setting, _ := item.(string)
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(key, ".source"):
+			privileges.Mounts = append(privileges.Mounts, value)
+		case strings.HasSuffix(key, ".path"):
+			privileges.Devices = append(privileges.Devices, value)
+		default:
+			settings[key] = value
+		}
+	}
+
+	privileges.sort()
+	return privileges
+}
+
+func newPluginPrivileges() PluginPrivileges {
+	return PluginPrivileges{Mounts: []string{}, Devices: []string{}, Capabilities: []string{}, Unknown: []string{}}
+}
+
+func (p PluginPrivileges) sort() {
+	for _, list := range [][]string{p.Mounts, p.Devices, p.Capabilities, p.Unknown} {
+		sort.Strings(list)
+	}
+}
+
+// canonicalCapability returns a capability in the form of the capabilities of
+// plugin configurations, e.g. CAP_SYS_ADMIN for sys_admin.
+func canonicalCapability(c string) string {
+
+	c = strings.ToUpper(c)
+	if !strings.HasPrefix(c, "CAP_") {
+		c = "CAP_" + c
+	}
+
+	return c
+}
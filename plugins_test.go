@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestRequestedPlugin(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		uri      string
+		body     string
+		expected *PluginRequest
+	}{
+		{
+			name: "pull",
+			uri:  "/v1.41/plugins/pull?remote=vieux/sshfs:latest&name=sshfs",
+			body: `[
+				{"Name": "network", "Description": "permissions to access a network", "Value": ["host"]},
+				{"Name": "mount", "Description": "host path to mount", "Value": ["/var/lib/docker/plugins/"]},
+				{"Name": "device", "Description": "host device to access", "Value": ["/dev/fuse"]},
+				{"Name": "capabilities", "Description": "list of additional capabilities required", "Value": ["CAP_SYS_ADMIN", "net_admin"]},
+				{"Name": "host pid namespace", "Description": "", "Value": ["true"]},
+				{"Name": "allow-all-devices", "Description": "", "Value": ["true"]},
+				{"Name": "gpus", "Description": "", "Value": ["all"]}
+			]`,
+			expected: &PluginRequest{
+				Action: "pull",
+				Name:   "sshfs",
+				Remote: "vieux/sshfs:latest",
+				Privileges: PluginPrivileges{
+					Network:         "host",
+					HostPID:         true,
+					Mounts:          []string{"/var/lib/docker/plugins/"},
+					Devices:         []string{"/dev/fuse"},
+					AllowAllDevices: true,
+					Capabilities:    []string{"CAP_NET_ADMIN", "CAP_SYS_ADMIN"},
+					Unknown:         []string{"gpus"},
+				},
+				Settings: map[string]string{},
+			},
+		},
+		{
+			name: "upgrade without privileges",
+			uri:  "/v1.41/plugins/vieux/sshfs:latest/upgrade?remote=vieux/sshfs:next",
+			expected: &PluginRequest{
+				Action:     "upgrade",
+				Name:       "vieux/sshfs:latest",
+				Remote:     "vieux/sshfs:next",
+				Privileges: newPluginPrivileges(),
+				Settings:   map[string]string{},
+			},
+		},
+		{
+			name: "set",
+			uri:  "/v1.41/plugins/sshfs/set",
+			body: `["DEBUG=1", "state.source=/", "fuse.path=/dev/fuse", "args=-v"]`,
+			expected: &PluginRequest{
+				Action: "set",
+				Name:   "sshfs",
+				Privileges: PluginPrivileges{
+					Mounts:       []string{"/"},
+					Devices:      []string{"/dev/fuse"},
+					Capabilities: []string{},
+					Unknown:      []string{},
+				},
+				Settings: map[string]string{"DEBUG": "1", "args": "-v"},
+			},
+		},
+		{
+			name: "enable",
+			uri:  "/v1.41/plugins/sshfs/enable",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := authorization.Request{RequestMethod: "POST", RequestURI: tc.uri}
+			if tc.body != "" {
+				r.RequestHeaders = map[string]string{"Content-Type": "application/json"}
+				r.RequestBody = []byte(tc.body)
+			}
+
+			input, err := makeInput(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := input.(map[string]interface{})["plugin"].(*PluginRequest)
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
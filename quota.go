@@ -0,0 +1,387 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// quotaWindow is the period over which container creations are counted.
+const quotaWindow = time.Hour
+
+// quotaContainer records who created a container, and whether it is running.
+type quotaContainer struct {
+	User    string `json:"user"`
+	Name    string `json:"name,omitempty"`
+	Running bool   `json:"running,omitempty"`
+}
+
+// quotaTracker counts the running containers of each user and the containers
+// each user created within the last hour, by observing the responses of the
+// Docker daemon. Containers stopping, and removals the plugin sees no request
+// for, e.g. with --rm, are learnt from the daemon's events. The counters are
+// persisted in the state store, mirrored in memory, and published to policies
+// as data.quota.
+type quotaTracker struct {
+	docker     *dockerClient
+	containers *storeBucket
+	creates    *storeBucket
+	state      *stateDocuments
+
+	mu    sync.Mutex
+	since time.Time
+
+	// owned and recent mirror the containers and creates buckets, and
+	// running counts the running containers of each user, so that the
+	// counters are published without reading the store.
+	owned   map[string]quotaContainer
+	recent  map[string][]time.Time
+	running map[string]int
+}
+
+func newQuotaTracker(docker *dockerClient, store *stateStore, state *stateDocuments) *quotaTracker {
+
+	q := &quotaTracker{
+		docker:     docker,
+		containers: store.bucket("quota/containers"),
+		creates:    store.bucket("quota/creates"),
+		state:      state,
+		owned:      map[string]quotaContainer{},
+		recent:     map[string][]time.Time{},
+		running:    map[string]int{},
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_ = q.containers.forEach(func(id string, value json.RawMessage) error {
+		var c quotaContainer
+		if err := json.Unmarshal(value, &c); err != nil {
+			return nil
+		}
+		q.owned[id] = c
+		if c.Running {
+			q.running[c.User]++
+		}
+		return nil
+	})
+
+	err := q.creates.forEach(func(user string, value json.RawMessage) error {
+		var creates []time.Time
+		if err := json.Unmarshal(value, &creates); err != nil {
+			return q.creates.delete(user)
+		}
+		q.recent[user] = creates
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to persist quota counters: %v", err)
+	}
+
+	q.publish(time.Now())
+
+	return q
+}
+
+// start republishes the counters periodically so that creations drop out of
+// the window even when no containers are created or removed.
+func (q *quotaTracker) start(interval time.Duration) {
+	go func() {
+		for now := range time.Tick(interval) {
+			q.mu.Lock()
+			q.publish(now)
+			q.mu.Unlock()
+		}
+	}()
+}
+
+// observe updates the counters from a response of the Docker daemon.
+func (q *quotaTracker) observe(r authorization.Request) {
+
+	if q == nil {
+		return
+	}
+
+	u, err := url.Parse(r.RequestURI)
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(trimAPIVersion(u.Path), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "containers" {
+		return
+	}
+
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch {
+	case r.RequestMethod == http.MethodPost && action == "" && parts[1] == "create" && r.ResponseStatusCode == http.StatusCreated:
+		var created struct{ Id string }
+		if err := json.Unmarshal(r.ResponseBody, &created); err != nil || created.Id == "" {
+			return
+		}
+		creates := append(q.recent[r.User], now)
+		err := q.set(created.Id, quotaContainer{User: r.User, Name: u.Query().Get("name")})
+		if err == nil {
+			err = q.creates.put(r.User, creates)
+		}
+		q.recent[r.User] = creates
+		if err != nil {
+			log.Printf("Failed to persist quota counters: %v", err)
+		}
+	case r.RequestMethod == http.MethodDelete && action == "" && r.ResponseStatusCode == http.StatusNoContent:
+		if id := q.find(parts[1]); id != "" {
+			if err := q.remove(id); err != nil {
+				log.Printf("Failed to persist quota counters: %v", err)
+			}
+		}
+	case r.RequestMethod == http.MethodPost && action == "" && parts[1] == "prune" && r.ResponseStatusCode == http.StatusOK:
+		var pruned struct{ ContainersDeleted []string }
+		if err := json.Unmarshal(r.ResponseBody, &pruned); err != nil {
+			return
+		}
+		for _, id := range pruned.ContainersDeleted {
+			if err := q.remove(id); err != nil {
+				log.Printf("Failed to persist quota counters: %v", err)
+			}
+		}
+	case r.RequestMethod == http.MethodPost && (action == "start" || action == "restart") &&
+		(r.ResponseStatusCode == http.StatusNoContent || r.ResponseStatusCode == http.StatusNotModified):
+		// The start event follows, but the container counts against the
+		// next request of the user already.
+		id := q.find(parts[1])
+		if id == "" {
+			return
+		}
+		if err := q.setRunning(id, true); err != nil {
+			log.Printf("Failed to persist quota counters: %v", err)
+		}
+	default:
+		return
+	}
+
+	q.publish(now)
+}
+
+// watch reconciles the counters with the containers of the daemon, then
+// follows the containers starting, stopping and being removed until ctx is
+// done.
+func (q *quotaTracker) watch(ctx context.Context) {
+	q.docker.watchContainers(ctx, []string{"start", "die", "destroy"}, q.reconcile, func() time.Time {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.since
+	}, q.handle)
+}
+
+// reconcile drops the containers that are no longer listed by the daemon at
+// since, e.g. those removed while the plugin was not running, and updates
+// whether the others are running.
+func (q *quotaTracker) reconcile(containers []dockerContainer, since time.Time) {
+
+	listed := map[string]bool{}
+	for _, c := range containers {
+		listed[c.ID] = c.State == "running" || c.State == "paused" || c.State == "restarting"
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id := range q.owned {
+		running, ok := listed[id]
+		var err error
+		if ok {
+			err = q.setRunning(id, running)
+		} else {
+			err = q.remove(id)
+		}
+		if err != nil {
+			log.Printf("Failed to persist quota counters: %v", err)
+		}
+	}
+
+	q.since = since.UTC()
+	q.publish(time.Now())
+}
+
+// handle updates the counters from a start, die or destroy event.
+func (q *quotaTracker) handle(e dockerEvent) {
+
+	if e.Type != "container" || e.Actor.ID == "" {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	at := time.Unix(0, e.TimeNano).UTC()
+	if at.After(q.since) {
+		q.since = at
+	}
+
+	if _, ok := q.owned[e.Actor.ID]; !ok {
+		return
+	}
+
+	var err error
+	switch e.Action {
+	case "start":
+		err = q.setRunning(e.Actor.ID, true)
+	case "die":
+		err = q.setRunning(e.Actor.ID, false)
+	case "destroy":
+		err = q.remove(e.Actor.ID)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to persist quota counters: %v", err)
+	}
+
+	q.publish(time.Now())
+}
+
+// set records the container id and updates the running counters. Callers
+// must hold q.mu.
+func (q *quotaTracker) set(id string, c quotaContainer) error {
+
+	if old, ok := q.owned[id]; ok && old.Running {
+		q.release(old.User)
+	}
+	if c.Running {
+		q.running[c.User]++
+	}
+	q.owned[id] = c
+
+	return q.containers.put(id, c)
+}
+
+// setRunning records whether the container id is running, when it is tracked.
+// Callers must hold q.mu.
+func (q *quotaTracker) setRunning(id string, running bool) error {
+
+	c, ok := q.owned[id]
+	if !ok || c.Running == running {
+		return nil
+	}
+	c.Running = running
+
+	return q.set(id, c)
+}
+
+// remove drops the container id. Callers must hold q.mu.
+func (q *quotaTracker) remove(id string) error {
+
+	c, ok := q.owned[id]
+	if !ok {
+		return nil
+	}
+	if c.Running {
+		q.release(c.User)
+	}
+	delete(q.owned, id)
+
+	return q.containers.delete(id)
+}
+
+// release decrements the running counter of user. Callers must hold q.mu.
+func (q *quotaTracker) release(user string) {
+	if q.running[user]--; q.running[user] <= 0 {
+		delete(q.running, user)
+	}
+}
+
+// find returns the ID of the container addressed by ref, which may be a full
+// ID, an unambiguous ID prefix or a name. Callers must hold q.mu.
+func (q *quotaTracker) find(ref string) string {
+
+	var exact, named, match string
+	ambiguous := false
+
+	for id, c := range q.owned {
+		switch {
+		case id == ref:
+			exact = id
+		case c.Name != "" && c.Name == strings.TrimPrefix(ref, "/"):
+			named = id
+		case strings.HasPrefix(id, ref):
+			ambiguous = match != ""
+			match = id
+		}
+	}
+
+	switch {
+	case exact != "":
+		return exact
+	case named != "":
+		return named
+	case ambiguous:
+		return ""
+	}
+
+	return match
+}
+
+// publish drops creations that fell out of the window and sets data.quota.
+// Callers must hold q.mu.
+func (q *quotaTracker) publish(now time.Time) {
+
+	users := map[string]interface{}{}
+
+	for user, creates := range q.recent {
+		i := 0
+		for i < len(creates) && now.Sub(creates[i]) >= quotaWindow {
+			i++
+		}
+		var err error
+		switch i {
+		case 0:
+		case len(creates):
+			delete(q.recent, user)
+			err = q.creates.delete(user)
+		default:
+			q.recent[user] = creates[i:]
+			err = q.creates.put(user, creates[i:])
+		}
+		if err != nil {
+			log.Printf("Failed to persist quota counters: %v", err)
+		}
+	}
+
+	for user, creates := range q.recent {
+		users[user] = map[string]interface{}{
+			"containers":        q.running[user],
+			"creates_last_hour": len(creates),
+		}
+	}
+
+	for user, n := range q.running {
+		if _, ok := users[user]; !ok {
+			users[user] = map[string]interface{}{
+				"containers":        n,
+				"creates_last_hour": 0,
+			}
+		}
+	}
+
+	q.state.set("quota", map[string]interface{}{"users": users})
+}
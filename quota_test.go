@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/plugins"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+func quotaUsers(t *testing.T, state *stateDocuments) map[string]interface{} {
+
+	doc := map[string]interface{}{}
+	if err := state.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	return doc["quota"].(map[string]interface{})["users"].(map[string]interface{})
+}
+
+func TestQuotaTracker(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	state := newStateDocuments()
+
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newQuotaTracker(nil, store, state)
+
+	responses := []authorization.Request{
+		{User: "alice", RequestMethod: "POST", RequestURI: "/v1.41/containers/create?name=web", ResponseStatusCode: 201, ResponseBody: []byte(`{"Id":"aaa111"}`)},
+		{User: "alice", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 201, ResponseBody: []byte(`{"Id":"aaa222"}`)},
+		{User: "alice", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 409, ResponseBody: []byte(`{"message":"conflict"}`)},
+		{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 201, ResponseBody: []byte(`{"Id":"bbb111"}`)},
+		{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 201, ResponseBody: []byte(`{"Id":"bbb222"}`)},
+		{User: "carol", RequestMethod: "POST", RequestURI: "/v1.41/containers/create", ResponseStatusCode: 201, ResponseBody: []byte(`{"Id":"ccc111"}`)},
+		{User: "alice", RequestMethod: "POST", RequestURI: "/v1.41/containers/web/start", ResponseStatusCode: 204},
+		{User: "alice", RequestMethod: "POST", RequestURI: "/v1.41/containers/aaa2/start", ResponseStatusCode: 304},
+		{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/bbb222/restart", ResponseStatusCode: 204},
+		{User: "bob", RequestMethod: "POST", RequestURI: "/v1.41/containers/bbb111/start", ResponseStatusCode: 500},
+		{User: "bob", RequestMethod: "DELETE", RequestURI: "/v1.41/containers/web?force=1", ResponseStatusCode: 204},
+		{User: "bob", RequestMethod: "POST", RequestURI: "/containers/prune", ResponseStatusCode: 200, ResponseBody: []byte(`{"ContainersDeleted":["bbb111"]}`)},
+	}
+	for _, r := range responses {
+		q.observe(r)
+	}
+
+	// Only running containers are counted.
+	expected := map[string]interface{}{
+		"alice": map[string]interface{}{"containers": json.Number("1"), "creates_last_hour": json.Number("2")},
+		"bob":   map[string]interface{}{"containers": json.Number("1"), "creates_last_hour": json.Number("2")},
+		"carol": map[string]interface{}{"containers": json.Number("0"), "creates_last_hour": json.Number("1")},
+	}
+	if users := quotaUsers(t, state); !reflect.DeepEqual(users, expected) {
+		t.Fatalf("Expected %v, got %v", expected, users)
+	}
+
+	// The counters survive a restart.
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	state = newStateDocuments()
+	q = newQuotaTracker(nil, store, state)
+	if users := quotaUsers(t, state); !reflect.DeepEqual(users, expected) {
+		t.Fatalf("Expected %v, got %v", expected, users)
+	}
+
+	// Creations drop out of the window, running containers are still
+	// counted.
+	q.mu.Lock()
+	q.publish(time.Now().Add(quotaWindow))
+	q.mu.Unlock()
+
+	expected = map[string]interface{}{
+		"alice": map[string]interface{}{"containers": json.Number("1"), "creates_last_hour": json.Number("0")},
+		"bob":   map[string]interface{}{"containers": json.Number("1"), "creates_last_hour": json.Number("0")},
+	}
+	if users := quotaUsers(t, state); !reflect.DeepEqual(users, expected) {
+		t.Fatalf("Expected %v, got %v", expected, users)
+	}
+}
+
+func TestQuotaTrackerFind(t *testing.T) {
+
+	store, _ := openStateStore("")
+	q := newQuotaTracker(nil, store, newStateDocuments())
+	_ = q.set("abc123", quotaContainer{User: "alice", Name: "web"})
+	_ = q.set("abd456", quotaContainer{User: "alice"})
+
+	tests := map[string]string{
+		"abc123": "abc123",
+		"abc":    "abc123",
+		"ab":     "",
+		"web":    "abc123",
+		"/web":   "abc123",
+		"db":     "",
+	}
+
+	for ref, expected := range tests {
+		t.Run(ref, func(t *testing.T) {
+			if id := q.find(ref); id != expected {
+				t.Fatalf("Expected %v, got %v", expected, id)
+			}
+		})
+	}
+}
+
+func TestQuotaWatch(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			_, _ = w.Write([]byte(`[{"Id": "aaa111", "State": "running"}, {"Id": "bbb111", "State": "running"}, {"Id": "ddd111", "State": "exited"}, {"Id": "eee111", "State": "paused"}]`))
+		case "/events":
+			for _, action := range []string{"start", "die", "destroy"} {
+				if events := r.URL.Query().Get("filters"); !strings.Contains(events, `"`+action+`"`) {
+					t.Errorf("Expected %s events, got %v", action, events)
+				}
+			}
+			_, _ = w.Write([]byte(`{"Type":"container","Action":"destroy","Actor":{"ID":"aaa111"},"timeNano":1700000001000000000}` + "\n"))
+			_, _ = w.Write([]byte(`{"Type":"container","Action":"die","Actor":{"ID":"bbb111"},"timeNano":1700000002000000000}` + "\n"))
+			_, _ = w.Write([]byte(`{"Type":"container","Action":"start","Actor":{"ID":"ddd111"},"timeNano":1700000003000000000}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := openStateStore("")
+	state := newStateDocuments()
+	q := newQuotaTracker(docker, store, state)
+	q.mu.Lock()
+	for _, id := range []string{"aaa111", "bbb111", "ccc111", "ddd111", "eee111"} {
+		_ = q.set(id, quotaContainer{User: "alice"})
+	}
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.watch(ctx)
+
+	// ccc111 is not listed, aaa111 is destroyed, e.g. with --rm, bbb111
+	// stops and ddd111 starts, leaving ddd111 and the paused eee111.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		started := q.owned["ddd111"].Running
+		q.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the events to be handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice, _ := quotaUsers(t, state)["alice"].(map[string]interface{})
+	if n := alice["containers"]; fmt.Sprint(n) != "2" {
+		t.Fatalf("Expected 2 containers, got %v", n)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.owned["ccc111"]; ok {
+		t.Errorf("Expected ccc111 to be dropped")
+	}
+	if _, ok := q.owned["aaa111"]; ok {
+		t.Errorf("Expected aaa111 to be dropped")
+	}
+}
+
+func TestStateDocumentsPolicyFile(t *testing.T) {
+
+	state := newStateDocuments()
+	state.set("quota", map[string]interface{}{"users": map[string]interface{}{"alice": map[string]interface{}{"containers": 3}}})
+
+	opts, err := newRuntimeOverlay().regoOptions(nil, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rego.New(append(opts, rego.Query("data.quota.users.alice.containers"))...).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs) != 1 || !reflect.DeepEqual(rs[0].Expressions[0].Value, json.Number("3")) {
+		t.Fatalf("Expected 3, got %v", rs)
+	}
+}
+
+func TestStateDocumentsConfigFile(t *testing.T) {
+
+	ctx := context.Background()
+
+	manager, err := plugins.New([]byte(`{}`), "test", inmem.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.RegisterCompilerTrigger(func(storage.Transaction) {})
+
+	tracker := authzPluginFactory{}.New(manager, authzPluginConfig{}).(*revisionTracker)
+	if err := tracker.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Stop(ctx)
+
+	state := newStateDocuments()
+	tracker.trackState(state)
+	state.set("quota", map[string]interface{}{"users": map[string]interface{}{}})
+
+	value, err := storage.ReadOne(ctx, manager.Store, storage.Path{"quota"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"users": map[string]interface{}{}}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("Expected %v, got %v", expected, value)
+	}
+
+	// Revisions include the state documents, and writing state documents
+	// updates them without snapshotting a new revision.
+	err = storage.Txn(ctx, manager.Store, storage.TransactionParams{}, func(txn storage.Transaction) error {
+		return tracker.snapshot(ctx, txn, ast.NewCompiler())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.mu.Lock()
+	latest := tracker.latest
+	tracker.mu.Unlock()
+
+	state.set("quota", map[string]interface{}{"users": map[string]interface{}{"alice": map[string]interface{}{"containers": 1}}})
+
+	tracker.mu.Lock()
+	if tracker.latest != latest {
+		t.Fatal("Expected state documents not to create a revision")
+	}
+	tracker.mu.Unlock()
+
+	value, err = storage.ReadOne(ctx, latest.store, storage.Path{"quota", "users", "alice", "containers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != json.Number("1") {
+		t.Fatalf("Expected 1, got %v", value)
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const registryManifestBuiltin = "registry.manifest"
+
+// Registries are asked for manifests of these media types, and image indexes
+// are resolved to the manifest of the platform of the host.
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// registryResponseLimit bounds the size of manifests and image configs read
+// from registries.
+const registryResponseLimit = 4 << 20
+
+// registryTimeout bounds the time taken by each request to a registry.
+const registryTimeout = 30 * time.Second
+
+var (
+	errRegistryManifestUnavailable = errors.New("registry manifests are not enabled, see -registry-manifests")
+	errRegistryNotFound            = errors.New("404 Not Found")
+)
+
+// ImageManifest is the result of registry.manifest: the manifest and config
+// of an image, as published in its registry.
+type ImageManifest struct {
+	Reference string `json:"reference"`
+
+	// Digest is the digest the reference resolves to, which is the digest of
+	// the image index for multi-platform images.
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+
+	// Platforms lists the platforms of multi-platform images.
+	Platforms []ImagePlatform `json:"platforms"`
+
+	OS           string      `json:"os"`
+	Architecture string      `json:"architecture"`
+	Variant      string      `json:"variant"`
+	Created      string      `json:"created"`
+	Layers       int         `json:"layers"`
+	Size         int64       `json:"size"`
+	Config       ImageConfig `json:"config"`
+}
+
+// ImagePlatform is a platform an image is published for.
+type ImagePlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+}
+
+// ImageConfig is the part of an image config containers are created from.
+type ImageConfig struct {
+	User         string            `json:"user"`
+	Env          []string          `json:"env"`
+	Entrypoint   []string          `json:"entrypoint"`
+	Cmd          []string          `json:"cmd"`
+	WorkingDir   string            `json:"working_dir"`
+	ExposedPorts []string          `json:"exposed_ports"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// registryManifest is the part of a manifest or image index read by the
+// plugin.
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		MediaType string        `json:"mediaType"`
+		Digest    string        `json:"digest"`
+		Platform  ImagePlatform `json:"platform"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+}
+
+// registryImageConfig is the part of an image config read by the plugin.
+type registryImageConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+	Created      string `json:"created"`
+	Config       struct {
+		User         string
+		Env          []string
+		Entrypoint   []string
+		Cmd          []string
+		WorkingDir   string
+		ExposedPorts map[string]interface{}
+		Labels       map[string]string
+	} `json:"config"`
+}
+
+// registryCredential is a username and password accepted by a registry.
+type registryCredential struct {
+	username string
+	password string
+}
+
+// loadRegistryCredentials reads the credentials of a Docker client config
+// file, keyed by registry hostname. Credentials kept in credential helpers
+// are not available.
+func loadRegistryCredentials(path string) (map[string]registryCredential, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	result := make(map[string]registryCredential, len(cfg.Auths))
+	for address, auth := range cfg.Auths {
+		cred := registryCredential{username: auth.Username, password: auth.Password}
+		if auth.Auth != "" {
+			pair, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid auth of %s: %w", path, address, err)
+			}
+			cred.username, cred.password, _ = strings.Cut(string(pair), ":")
+		}
+		if host := registryHostname(address); host != "" {
+			result[host] = cred
+		}
+	}
+
+	return result, nil
+}
+
+// registryHostname returns the host of a server address, which may be given
+// with or without scheme and path, e.g. https://index.docker.io/v1/.
+func registryHostname(address string) string {
+
+	if address == "" {
+		return ""
+	}
+
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// registryClient fetches image manifests, configs and SBOMs from registries,
+// caching them for the TTL of its caches.
+type registryClient struct {
+	client      *http.Client
+	credentials map[string]registryCredential
+	platform    ImagePlatform
+	cache       *builtinCacheView
+	sboms       *builtinCacheView
+}
+
+func newRegistryClient(caFile, certFile, keyFile string, credentials map[string]registryCredential, ttl, sbomTTL time.Duration) (*registryClient, error) {
+
+	transport, err := clientTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registryClient{
+		client:      &http.Client{Transport: transport, Timeout: registryTimeout},
+		credentials: credentials,
+		platform:    ImagePlatform{OS: "linux", Architecture: runtime.GOARCH},
+		cache:       builtinResults.view(registryManifestBuiltin, ttl),
+		sboms:       builtinResults.view(registrySBOMsBuiltin, sbomTTL),
+	}, nil
+}
+
+func (c *registryClient) manifest(ctx context.Context, ref string) (ImageManifest, error) {
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ImageManifest{}, err
+	}
+	named = reference.TagNameOnly(named)
+
+	v, err := c.cache.get(named.String(), func() (interface{}, error) {
+		return c.fetch(ctx, named)
+	})
+	if err != nil {
+		return ImageManifest{}, err
+	}
+
+	return v.(ImageManifest), nil
+}
+
+func (c *registryClient) fetch(ctx context.Context, named reference.Named) (ImageManifest, error) {
+
+	s := c.session(named)
+
+	var m registryManifest
+	digest, err := s.getManifest(ctx, manifestRef(named), &m)
+	if err != nil {
+		return ImageManifest{}, err
+	}
+
+	result := ImageManifest{
+		Reference: named.String(),
+		Digest:    digest,
+		MediaType: m.MediaType,
+		Platforms: []ImagePlatform{},
+		Config:    ImageConfig{Env: []string{}, Entrypoint: []string{}, Cmd: []string{}, ExposedPorts: []string{}, Labels: map[string]string{}},
+	}
+
+	if len(m.Manifests) > 0 {
+		selected := ""
+		for _, desc := range m.Manifests {
+			// Attestations are listed with an unknown platform.
+			if desc.Platform.OS == "unknown" {
+				continue
+			}
+			result.Platforms = append(result.Platforms, desc.Platform)
+			if selected == "" && desc.Platform.OS == c.platform.OS && desc.Platform.Architecture == c.platform.Architecture {
+				selected = desc.Digest
+			}
+		}
+		if selected == "" {
+			return ImageManifest{}, fmt.Errorf("%s has no manifest for %s/%s", named, c.platform.OS, c.platform.Architecture)
+		}
+		m = registryManifest{}
+		if _, err := s.getManifest(ctx, selected, &m); err != nil {
+			return ImageManifest{}, err
+		}
+	}
+
+	result.Layers = len(m.Layers)
+	for _, layer := range m.Layers {
+		result.Size += layer.Size
+	}
+
+	if m.Config.Digest == "" {
+		return result, nil
+	}
+
+	var cfg registryImageConfig
+	if _, err := s.get(ctx, "/blobs/"+m.Config.Digest, nil, &cfg); err != nil {
+		return ImageManifest{}, err
+	}
+
+	result.OS = cfg.OS
+	result.Architecture = cfg.Architecture
+	result.Variant = cfg.Variant
+	result.Created = cfg.Created
+	result.Config.User = cfg.Config.User
+	result.Config.WorkingDir = cfg.Config.WorkingDir
+	result.Config.Env = append(result.Config.Env, cfg.Config.Env...)
+	result.Config.Entrypoint = append(result.Config.Entrypoint, cfg.Config.Entrypoint...)
+	result.Config.Cmd = append(result.Config.Cmd, cfg.Config.Cmd...)
+	for port := range cfg.Config.ExposedPorts {
+		result.Config.ExposedPorts = append(result.Config.ExposedPorts, port)
+	}
+	sort.Strings(result.Config.ExposedPorts)
+	for k, v := range cfg.Config.Labels {
+		result.Config.Labels[k] = v
+	}
+
+	return result, nil
+}
+
+// session returns a session with the repository of named.
+func (c *registryClient) session(named reference.Named) *registrySession {
+
+	domain := reference.Domain(named)
+	s := &registrySession{
+		client: c.client,
+		host:   domain,
+		repo:   reference.Path(named),
+		cred:   c.credential(domain),
+	}
+	if domain == "docker.io" {
+		s.host = "registry-1.docker.io"
+	}
+
+	return s
+}
+
+// manifestRef returns the digest or tag the manifest of named is fetched by.
+func manifestRef(named reference.Named) string {
+
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+
+	return ""
+}
+
+// credential returns the credential configured for the registry at domain.
+func (c *registryClient) credential(domain string) *registryCredential {
+	return lookupRegistryCredential(c.credentials, domain)
+}
+
+// lookupRegistryCredential returns the credential of the registry at domain in
+// credentials. Docker Hub credentials are commonly keyed by index.docker.io.
+func lookupRegistryCredential(credentials map[string]registryCredential, domain string) *registryCredential {
+
+	hosts := []string{domain}
+	if domain == "docker.io" {
+		hosts = append(hosts, "index.docker.io", "registry-1.docker.io")
+	}
+
+	for _, host := range hosts {
+		if cred, ok := credentials[host]; ok {
+			return &cred
+		}
+	}
+
+	return nil
+}
+
+// registrySession is a sequence of requests to a repository, authorized by
+// answering the challenge of the first request that is rejected.
+type registrySession struct {
+	client *http.Client
+	host   string
+	repo   string
+	cred   *registryCredential
+
+	authorization string
+}
+
+func (s *registrySession) getManifest(ctx context.Context, ref string, v interface{}) (string, error) {
+
+	accept := []string{mediaTypeDockerManifest, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}
+
+	return s.get(ctx, "/manifests/"+ref, accept, v)
+}
+
+// get fetches path below the repository into v, returning the digest of the
+// content.
+func (s *registrySession) get(ctx context.Context, path string, accept []string, v interface{}) (string, error) {
+
+	u := "https://" + s.host + "/v2/" + s.repo + path
+
+	resp, err := s.do(ctx, u, accept)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && s.authorization == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := s.authorize(ctx, challenge); err != nil {
+			return "", err
+		}
+		if resp, err = s.do(ctx, u, accept); err != nil {
+			return "", err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("registry %s: GET %s: %w", s.host, path, errRegistryNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry %s: GET %s: %s", s.host, path, resp.Status)
+	}
+
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, registryResponseLimit))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return "", fmt.Errorf("registry %s: GET %s: %w", s.host, path, err)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(bs)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	return digest, nil
+}
+
+func (s *registrySession) do(ctx context.Context, u string, accept []string) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
+	}
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+
+	return s.client.Do(req)
+}
+
+// authorize answers the challenge of a registry: basic authentication with the
+// configured credential, or a bearer token obtained from the token service
+// named by the challenge, anonymously when no credential is configured.
+func (s *registrySession) authorize(ctx context.Context, challenge string) error {
+
+	scheme, params := parseAuthChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if s.cred == nil {
+			return fmt.Errorf("registry %s: no credentials configured", s.host)
+		}
+		s.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(s.cred.username+":"+s.cred.password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry %s: unsupported authentication challenge %q", s.host, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return fmt.Errorf("registry %s: invalid token realm %q", s.host, params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + s.repo + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.cred != nil {
+		req.SetBasicAuth(s.cred.username, s.cred.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry %s: token request: %s", s.host, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, registryResponseLimit)).Decode(&token); err != nil {
+		return fmt.Errorf("registry %s: token request: %w", s.host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("registry %s: token request: no token returned", s.host)
+	}
+
+	s.authorization = "Bearer " + token.Token
+
+	return nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseAuthChallenge(header string) (string, map[string]string) {
+
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(strings.TrimSpace(value[end+2:]), ",")
+			continue
+		}
+
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+
+	return scheme, params
+}
+
+// registryManifests is the client of registry.manifest, set when
+// -registry-manifests is given.
+var registryManifests *registryClient
+
+func init() {
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:    registryManifestBuiltin,
+		Decl:    types.NewFunction(types.Args(types.S), types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		Memoize: true,
+	}, func(bctx rego.BuiltinContext, ref *ast.Term) (*ast.Term, error) {
+
+		client := registryManifests
+		if client == nil {
+			return nil, errRegistryManifestUnavailable
+		}
+
+		s, ok := ref.Value.(ast.String)
+		if !ok {
+			return nil, nil
+		}
+
+		m, err := client.manifest(bctx.Context, string(s))
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ast.InterfaceToValue(m)
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(v), nil
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestRegistryManifestBuiltin(t *testing.T) {
+
+	var server *httptest.Server
+	manifests := 0
+
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/token" {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "alice" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if scope := r.URL.Query().Get("scope"); scope != "repository:team/app:pull" {
+				t.Errorf("Unexpected scope %v", scope)
+			}
+			_, _ = w.Write([]byte(`{"token": "t0ken"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:team/app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/1.0":
+			manifests++
+			w.Header().Set("Docker-Content-Digest", "sha256:index")
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.oci.image.index.v1+json",
+				"manifests": [
+					{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+					{"digest": "sha256:amd", "platform": {"os": "linux", "architecture": "amd64"}},
+					{"digest": "sha256:att", "platform": {"os": "unknown", "architecture": "unknown"}}
+				]
+			}`))
+		case "/v2/team/app/manifests/sha256:amd":
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				"config": {"digest": "sha256:config"},
+				"layers": [{"size": 100}, {"size": 23}]
+			}`))
+		case "/v2/team/app/blobs/sha256:config":
+			_, _ = w.Write([]byte(`{
+				"os": "linux",
+				"architecture": "amd64",
+				"config": {"User": "app", "ExposedPorts": {"8080/tcp": {}}, "Labels": {"team": "payments"}}
+			}`))
+		default:
+			t.Errorf("Unexpected request %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(`{"auths": {"`+host+`": {"auth": "YWxpY2U6c2VjcmV0"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := loadRegistryCredentials(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newRegistryClient("", "", "", credentials, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.client = server.Client()
+	client.platform = ImagePlatform{OS: "linux", Architecture: "amd64"}
+
+	registryManifests = client
+	defer func() { registryManifests = nil }()
+
+	for i := 0; i < 2; i++ {
+		rs, err := rego.New(rego.Query(`m := registry.manifest("` + host + `/team/app:1.0")`)).Eval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 {
+			t.Fatalf("Expected a result, got %v", rs)
+		}
+
+		bs, _ := json.Marshal(rs[0].Bindings["m"])
+		var m ImageManifest
+		if err := json.Unmarshal(bs, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Digest != "sha256:index" || m.Architecture != "amd64" || m.Layers != 2 || m.Size != 123 {
+			t.Fatalf("Unexpected manifest %s", bs)
+		}
+		if len(m.Platforms) != 2 || m.Config.User != "app" || m.Config.Labels["team"] != "payments" || m.Config.ExposedPorts[0] != "8080/tcp" {
+			t.Fatalf("Unexpected manifest %s", bs)
+		}
+	}
+
+	if manifests != 1 {
+		t.Fatalf("Expected 1 manifest lookup, got %d", manifests)
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull,push"`)
+	if scheme != "Bearer" {
+		t.Fatalf("Expected Bearer, got %v", scheme)
+	}
+	if params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:library/alpine:pull,push" {
+		t.Fatalf("Unexpected parameters %v", params)
+	}
+}
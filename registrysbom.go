@@ -0,0 +1,372 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const registrySBOMsBuiltin = "registry.sboms"
+
+// SBOMs are attached to images as artifacts holding the document, listed by
+// the referrers API, or as in-toto attestations wrapped in DSSE envelopes,
+// listed by the referrers API or pushed by cosign attest to a tag derived from
+// the digest of the image.
+const (
+	mediaTypeSPDX         = "application/spdx+json"
+	mediaTypeCycloneDX    = "application/vnd.cyclonedx+json"
+	mediaTypeInToto       = "application/vnd.in-toto+json"
+	mediaTypeDSSEEnvelope = "application/vnd.dsse.envelope.v1+json"
+)
+
+const (
+	sbomFormatSPDX      = "spdx"
+	sbomFormatCycloneDX = "cyclonedx"
+)
+
+// SBOM predicate types of in-toto statements. CycloneDX predicate types may
+// carry the version of the specification, e.g. https://cyclonedx.org/bom/v1.5.
+const (
+	predicateTypeSPDX      = "https://spdx.dev/Document"
+	predicateTypeCycloneDX = "https://cyclonedx.org/bom"
+)
+
+// ImageSBOM is an element of the result of registry.sboms: an SBOM attached
+// to an image.
+type ImageSBOM struct {
+	Reference string `json:"reference"`
+
+	// Digest is the digest of the image the SBOM is attached to.
+	Digest string `json:"digest"`
+
+	// Format is spdx or cyclonedx.
+	Format string `json:"format"`
+
+	// PredicateType is the predicate type of the attestation holding the
+	// SBOM, empty for SBOMs attached as is.
+	PredicateType string `json:"predicate_type"`
+
+	// Source is referrers or attestation, for SBOMs found through the
+	// referrers API or the tag of cosign attestations.
+	Source string `json:"source"`
+
+	Packages []SBOMPackage `json:"packages"`
+	Document interface{}   `json:"document"`
+}
+
+// SBOMPackage is a package listed by an SBOM.
+type SBOMPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	PURL    string `json:"purl"`
+
+	// Licenses are the SPDX license identifiers or expressions of the
+	// package, e.g. MIT or GPL-2.0-only OR MIT.
+	Licenses []string `json:"licenses"`
+}
+
+// registryDescriptor is the part of a descriptor read by the plugin.
+type registryDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	ArtifactType string            `json:"artifactType"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+// registryArtifact is the part of a referrers index or artifact manifest read
+// by the plugin.
+type registryArtifact struct {
+	ArtifactType string               `json:"artifactType"`
+	Config       registryDescriptor   `json:"config"`
+	Manifests    []registryDescriptor `json:"manifests"`
+	Layers       []registryDescriptor `json:"layers"`
+}
+
+func (c *registryClient) sbomsOf(ctx context.Context, ref string) ([]ImageSBOM, error) {
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+	named = reference.TagNameOnly(named)
+
+	v, err := c.sboms.get(named.String(), func() (interface{}, error) {
+		return c.fetchSBOMs(ctx, named)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]ImageSBOM), nil
+}
+
+// fetchSBOMs returns the SBOMs attached to the image named resolves to, which
+// is the image index for multi-platform images: those listed by the referrers
+// API, then those of cosign attestations.
+func (c *registryClient) fetchSBOMs(ctx context.Context, named reference.Named) ([]ImageSBOM, error) {
+
+	s := c.session(named)
+
+	var m registryManifest
+	digest, err := s.getManifest(ctx, manifestRef(named), &m)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []ImageSBOM{}
+
+	// Registries without the referrers API answer 404.
+	var referrers registryArtifact
+	if _, err := s.get(ctx, "/referrers/"+digest, []string{mediaTypeOCIIndex}, &referrers); err != nil && !errors.Is(err, errRegistryNotFound) {
+		return nil, err
+	}
+	for _, desc := range referrers.Manifests {
+		switch desc.ArtifactType {
+		case mediaTypeSPDX, mediaTypeCycloneDX, mediaTypeInToto, mediaTypeDSSEEnvelope:
+		default:
+			continue
+		}
+		var artifact registryArtifact
+		if _, err := s.getManifest(ctx, desc.Digest, &artifact); err != nil {
+			return nil, err
+		}
+		sboms, err := s.artifactSBOMs(ctx, artifact)
+		if err != nil {
+			return nil, err
+		}
+		for _, sbom := range sboms {
+			sbom.Source = "referrers"
+			result = append(result, sbom)
+		}
+	}
+
+	var attestations registryArtifact
+	_, err = s.getManifest(ctx, strings.Replace(digest, ":", "-", 1)+".att", &attestations)
+	if err != nil && !errors.Is(err, errRegistryNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		sboms, err := s.artifactSBOMs(ctx, attestations)
+		if err != nil {
+			return nil, err
+		}
+		for _, sbom := range sboms {
+			sbom.Source = "attestation"
+			result = append(result, sbom)
+		}
+	}
+
+	for i := range result {
+		result[i].Reference = named.String()
+		result[i].Digest = digest
+	}
+
+	return result, nil
+}
+
+// artifactSBOMs returns the SBOMs held by the layers of an artifact, skipping
+// the layers holding other documents and attestations.
+func (s *registrySession) artifactSBOMs(ctx context.Context, artifact registryArtifact) ([]ImageSBOM, error) {
+
+	var result []ImageSBOM
+
+	for _, layer := range artifact.Layers {
+		mediaType := layer.MediaType
+		if mediaType == "" || mediaType == "application/octet-stream" {
+			mediaType = artifact.ArtifactType
+		}
+
+		switch mediaType {
+		case mediaTypeSPDX, mediaTypeCycloneDX:
+			var doc interface{}
+			if _, err := s.get(ctx, "/blobs/"+layer.Digest, nil, &doc); err != nil {
+				return nil, err
+			}
+			format := sbomFormatSPDX
+			if mediaType == mediaTypeCycloneDX {
+				format = sbomFormatCycloneDX
+			}
+			result = append(result, ImageSBOM{Format: format, Document: doc})
+
+		case mediaTypeInToto, mediaTypeDSSEEnvelope:
+			// cosign annotates the layers of attestations with their
+			// predicate type, which spares fetching the other ones.
+			if predicateType, ok := layer.Annotations["predicateType"]; ok && sbomFormat(predicateType) == "" {
+				continue
+			}
+			var statement inTotoStatement
+			if mediaType == mediaTypeInToto {
+				if _, err := s.get(ctx, "/blobs/"+layer.Digest, nil, &statement); err != nil {
+					return nil, err
+				}
+			} else {
+				var envelope dsseEnvelope
+				if _, err := s.get(ctx, "/blobs/"+layer.Digest, nil, &envelope); err != nil {
+					return nil, err
+				}
+				if err := envelope.statement(&statement); err != nil {
+					return nil, fmt.Errorf("registry %s: attestation %s: %w", s.host, layer.Digest, err)
+				}
+			}
+			format := sbomFormat(statement.PredicateType)
+			if format == "" {
+				continue
+			}
+			result = append(result, ImageSBOM{Format: format, PredicateType: statement.PredicateType, Document: statement.Predicate})
+		}
+	}
+
+	for i := range result {
+		result[i].Packages = sbomPackages(result[i].Format, result[i].Document)
+	}
+
+	return result, nil
+}
+
+// sbomFormat returns the format of the SBOMs of an in-toto predicate type, or
+// an empty string when the predicate is not an SBOM.
+func sbomFormat(predicateType string) string {
+
+	switch {
+	case predicateType == predicateTypeSPDX:
+		return sbomFormatSPDX
+	case predicateType == predicateTypeCycloneDX || strings.HasPrefix(predicateType, predicateTypeCycloneDX+"/"):
+		return sbomFormatCycloneDX
+	}
+
+	return ""
+}
+
+// inTotoStatement is the part of an in-toto statement read by the plugin.
+type inTotoStatement struct {
+	PredicateType string      `json:"predicateType"`
+	Predicate     interface{} `json:"predicate"`
+}
+
+// dsseEnvelope is a DSSE envelope. Its signatures are not verified.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+}
+
+func (e dsseEnvelope) statement(v *inTotoStatement) error {
+
+	if e.PayloadType != mediaTypeInToto {
+		return fmt.Errorf("unexpected payload type %q", e.PayloadType)
+	}
+
+	bs, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bs, v)
+}
+
+// sbomPackages returns the packages listed by an SPDX or CycloneDX document,
+// including the nested components of CycloneDX documents.
+func sbomPackages(format string, doc interface{}) []SBOMPackage {
+
+	result := []SBOMPackage{}
+	root, _ := doc.(map[string]interface{})
+
+	switch format {
+	case sbomFormatSPDX:
+		packages, _ := root["packages"].([]interface{})
+		for _, p := range packages {
+			p, _ := p.(map[string]interface{})
+			pkg := SBOMPackage{Name: sbomField(p, "name"), Version: sbomField(p, "versionInfo"), Licenses: []string{}}
+			// The concluded license is preferred to the declared one,
+			// unless the author of the SBOM made no assertion.
+			for _, key := range []string{"licenseConcluded", "licenseDeclared"} {
+				if license := sbomField(p, key); license != "" && license != "NOASSERTION" && license != "NONE" {
+					pkg.Licenses = append(pkg.Licenses, license)
+					break
+				}
+			}
+			refs, _ := p["externalRefs"].([]interface{})
+			for _, ref := range refs {
+				ref, _ := ref.(map[string]interface{})
+				if sbomField(ref, "referenceType") == "purl" {
+					pkg.PURL = sbomField(ref, "referenceLocator")
+					break
+				}
+			}
+			result = append(result, pkg)
+		}
+
+	case sbomFormatCycloneDX:
+		var walk func(components interface{})
+		walk = func(components interface{}) {
+			list, _ := components.([]interface{})
+			for _, c := range list {
+				c, _ := c.(map[string]interface{})
+				pkg := SBOMPackage{Name: sbomField(c, "name"), Version: sbomField(c, "version"), PURL: sbomField(c, "purl"), Licenses: []string{}}
+				licenses, _ := c["licenses"].([]interface{})
+				for _, l := range licenses {
+					l, _ := l.(map[string]interface{})
+					license, _ := l["license"].(map[string]interface{})
+					for _, id := range []string{sbomField(l, "expression"), sbomField(license, "id"), sbomField(license, "name")} {
+						if id != "" {
+							pkg.Licenses = append(pkg.Licenses, id)
+							break
+						}
+					}
+				}
+				result = append(result, pkg)
+				walk(c["components"])
+			}
+		}
+		walk(root["components"])
+	}
+
+	return result
+}
+
+func sbomField(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func init() {
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:    registrySBOMsBuiltin,
+		Decl:    types.NewFunction(types.Args(types.S), types.NewArray(nil, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A)))),
+		Memoize: true,
+	}, func(bctx rego.BuiltinContext, ref *ast.Term) (*ast.Term, error) {
+
+		client := registryManifests
+		if client == nil {
+			return nil, errRegistryManifestUnavailable
+		}
+
+		s, ok := ref.Value.(ast.String)
+		if !ok {
+			return nil, nil
+		}
+
+		sboms, err := client.sbomsOf(bctx.Context, string(s))
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ast.InterfaceToValue(sboms)
+		if err != nil {
+			return nil, err
+		}
+
+		return ast.NewTerm(v), nil
+	})
+}
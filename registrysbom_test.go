@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestRegistrySBOMsBuiltin(t *testing.T) {
+
+	statement := `{
+		"_type": "https://in-toto.io/Statement/v0.1",
+		"predicateType": "https://cyclonedx.org/bom/v1.5",
+		"predicate": {
+			"bomFormat": "CycloneDX",
+			"components": [
+				{"name": "openssl", "version": "3.0.13", "purl": "pkg:apk/alpine/openssl@3.0.13", "licenses": [{"license": {"id": "Apache-2.0"}}],
+				 "components": [{"name": "libcrypto3", "version": "3.0.13"}]}
+			]
+		}
+	}`
+	envelope := `{"payloadType": "application/vnd.in-toto+json", "payload": "` + base64.StdEncoding.EncodeToString([]byte(statement)) + `", "signatures": []}`
+
+	referrers := 0
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/1.0":
+			w.Header().Set("Docker-Content-Digest", "sha256:image")
+			_, _ = w.Write([]byte(`{"mediaType": "application/vnd.oci.image.manifest.v1+json"}`))
+		case "/v2/team/app/referrers/sha256:image":
+			referrers++
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.oci.image.index.v1+json",
+				"manifests": [
+					{"digest": "sha256:signature", "artifactType": "application/vnd.dev.cosign.artifact.sig.v1+json"},
+					{"digest": "sha256:spdx", "artifactType": "application/spdx+json"}
+				]
+			}`))
+		case "/v2/team/app/manifests/sha256:spdx":
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				"artifactType": "application/spdx+json",
+				"layers": [{"mediaType": "application/spdx+json", "digest": "sha256:spdxdoc"}]
+			}`))
+		case "/v2/team/app/blobs/sha256:spdxdoc":
+			_, _ = w.Write([]byte(`{
+				"spdxVersion": "SPDX-2.3",
+				"packages": [{
+					"name": "busybox",
+					"versionInfo": "1.36.1",
+					"licenseConcluded": "NOASSERTION",
+					"licenseDeclared": "GPL-2.0-only",
+					"externalRefs": [{"referenceType": "purl", "referenceLocator": "pkg:apk/alpine/busybox@1.36.1"}]
+				}]
+			}`))
+		case "/v2/team/app/manifests/sha256-image.att":
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				"layers": [
+					{"mediaType": "application/vnd.dsse.envelope.v1+json", "digest": "sha256:provenance", "annotations": {"predicateType": "https://slsa.dev/provenance/v0.2"}},
+					{"mediaType": "application/vnd.dsse.envelope.v1+json", "digest": "sha256:cyclonedx", "annotations": {"predicateType": "https://cyclonedx.org/bom/v1.5"}}
+				]
+			}`))
+		case "/v2/team/app/blobs/sha256:cyclonedx":
+			_, _ = w.Write([]byte(envelope))
+		case "/v2/team/bare/manifests/1.0":
+			w.Header().Set("Docker-Content-Digest", "sha256:bare")
+			_, _ = w.Write([]byte(`{"mediaType": "application/vnd.oci.image.manifest.v1+json"}`))
+		case "/v2/team/bare/referrers/sha256:bare", "/v2/team/bare/manifests/sha256-bare.att":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	client, err := newRegistryClient("", "", "", nil, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.client = server.Client()
+
+	registryManifests = client
+	defer func() { registryManifests = nil }()
+
+	eval := func(ref string) []ImageSBOM {
+		rs, err := rego.New(rego.Query(`s := registry.sboms("` + ref + `")`)).Eval(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 {
+			t.Fatalf("Expected a result, got %v", rs)
+		}
+		bs, _ := json.Marshal(rs[0].Bindings["s"])
+		var sboms []ImageSBOM
+		if err := json.Unmarshal(bs, &sboms); err != nil {
+			t.Fatal(err)
+		}
+		return sboms
+	}
+
+	for i := 0; i < 2; i++ {
+		sboms := eval(host + "/team/app:1.0")
+		if len(sboms) != 2 {
+			t.Fatalf("Expected 2 SBOMs, got %+v", sboms)
+		}
+
+		spdx := sboms[0]
+		if spdx.Format != "spdx" || spdx.Source != "referrers" || spdx.Digest != "sha256:image" || spdx.PredicateType != "" {
+			t.Fatalf("Unexpected SBOM %+v", spdx)
+		}
+		if len(spdx.Packages) != 1 || !reflect.DeepEqual(spdx.Packages[0], SBOMPackage{Name: "busybox", Version: "1.36.1", PURL: "pkg:apk/alpine/busybox@1.36.1", Licenses: []string{"GPL-2.0-only"}}) {
+			t.Fatalf("Unexpected packages %+v", spdx.Packages)
+		}
+
+		cdx := sboms[1]
+		if cdx.Format != "cyclonedx" || cdx.Source != "attestation" || cdx.PredicateType != "https://cyclonedx.org/bom/v1.5" {
+			t.Fatalf("Unexpected SBOM %+v", cdx)
+		}
+		if len(cdx.Packages) != 2 || cdx.Packages[0].PURL != "pkg:apk/alpine/openssl@3.0.13" || cdx.Packages[0].Licenses[0] != "Apache-2.0" || cdx.Packages[1].Name != "libcrypto3" {
+			t.Fatalf("Unexpected packages %+v", cdx.Packages)
+		}
+	}
+
+	if referrers != 1 {
+		t.Fatalf("Expected 1 referrers lookup, got %d", referrers)
+	}
+
+	// Images without SBOMs, in registries without the referrers API, have
+	// none rather than failing.
+	if sboms := eval(host + "/team/bare:1.0"); len(sboms) != 0 {
+		t.Fatalf("Expected no SBOMs, got %+v", sboms)
+	}
+}
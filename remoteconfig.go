@@ -0,0 +1,469 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/sdk"
+	"github.com/open-policy-agent/opa/util"
+)
+
+const (
+	// remoteConfigKey is the key, below the prefix, holding the OPA
+	// configuration.
+	remoteConfigKey = "config"
+	// remoteConfigSignatureKey is the key, below the prefix, holding the
+	// detached signature of the OPA configuration, as written by
+	// sign-config.
+	remoteConfigSignatureKey = remoteConfigKey + configSignatureSuffix
+	// remoteDataPrefix is the prefix, below the prefix, of the keys holding
+	// data documents.
+	remoteDataPrefix = "data/"
+)
+
+// remoteConfigSource watches the keys below a prefix of a key-value store.
+type remoteConfigSource interface {
+	// watch calls fn with the keys below the prefix, relative to it, and
+	// again whenever they change, until ctx is done.
+	watch(ctx context.Context, fn func(map[string][]byte))
+}
+
+// newRemoteConfigSource returns the source for location, either
+// consul://host:port/prefix or etcd://host:port/prefix. The stores are
+// reached over HTTP, or over HTTPS with the consul+https and etcd+https
+// schemes.
+func newRemoteConfigSource(location, token, caFile string, interval time.Duration) (remoteConfigSource, error) {
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := clientTransport(caFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	store, scheme, ok := strings.Cut(u.Scheme, "+")
+	if !ok {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unsupported remote configuration %q", location)
+	}
+
+	base := scheme + "://" + u.Host
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	switch store {
+	case "consul":
+		return &consulSource{
+			client:   &http.Client{Transport: transport},
+			base:     base,
+			prefix:   prefix,
+			token:    token,
+			interval: interval,
+		}, nil
+	case "etcd":
+		return &etcdSource{
+			client:   &http.Client{Transport: transport},
+			base:     base,
+			prefix:   prefix,
+			token:    token,
+			interval: interval,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported remote configuration %q, expected consul:// or etcd://", location)
+	}
+}
+
+// consulSource watches a prefix of the Consul KV store with blocking queries.
+type consulSource struct {
+	client   *http.Client
+	base     string
+	prefix   string
+	token    string
+	interval time.Duration
+}
+
+type consulPair struct {
+	Key   string
+	Value []byte
+}
+
+func (c *consulSource) watch(ctx context.Context, fn func(map[string][]byte)) {
+
+	var index uint64
+
+	for ctx.Err() == nil {
+		keys, next, err := c.fetch(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to read remote configuration from Consul: %v", err)
+				sleepContext(ctx, c.interval)
+			}
+			continue
+		}
+
+		// The index may go backwards, e.g. after a restore, in which case
+		// the watch starts over.
+		if next < index {
+			next = 0
+		}
+		if next != index {
+			fn(keys)
+		}
+		index = next
+	}
+}
+
+// fetch returns the keys below the prefix once their index exceeds index,
+// or the wait time of the blocking query has passed.
+func (c *consulSource) fetch(ctx context.Context, index uint64) (map[string][]byte, uint64, error) {
+
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", "5m")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/v1/kv/"+c.prefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	var pairs []consulPair
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+			return nil, 0, err
+		}
+	case http.StatusNotFound:
+	default:
+		return nil, 0, fmt.Errorf("GET /v1/kv/%s: %s", c.prefix, resp.Status)
+	}
+
+	keys := map[string][]byte{}
+	for _, p := range pairs {
+		if key := strings.TrimPrefix(p.Key, c.prefix); key != "" && !strings.HasSuffix(key, "/") {
+			keys[key] = p.Value
+		}
+	}
+
+	return keys, next, nil
+}
+
+// etcdSource watches a prefix of etcd through its v3 JSON gateway.
+type etcdSource struct {
+	client   *http.Client
+	base     string
+	prefix   string
+	token    string
+	interval time.Duration
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+func (e *etcdSource) watch(ctx context.Context, fn func(map[string][]byte)) {
+
+	for ctx.Err() == nil {
+		keys, revision, err := e.fetch(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to read remote configuration from etcd: %v", err)
+				sleepContext(ctx, e.interval)
+			}
+			continue
+		}
+		fn(keys)
+
+		// Block until the prefix changes after the revision just read.
+		if err := e.wait(ctx, revision); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to watch remote configuration in etcd: %v", err)
+			sleepContext(ctx, e.interval)
+		}
+	}
+}
+
+// rangeEnd returns the end of the range of keys starting with the prefix.
+func (e *etcdSource) rangeEnd() []byte {
+
+	end := []byte(e.prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return []byte{0}
+}
+
+func (e *etcdSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.base+path, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// fetch returns the keys below the prefix and the revision they were read at.
+func (e *etcdSource) fetch(ctx context.Context) (map[string][]byte, int64, error) {
+
+	resp, err := e.post(ctx, "/v3/kv/range", map[string]interface{}{
+		"key":       base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(e.rangeEnd()),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Header etcdHeader     `json:"header"`
+		Kvs    []etcdKeyValue `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+
+	revision, err := strconv.ParseInt(result.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := map[string][]byte{}
+	for _, kv := range result.Kvs {
+		if key := strings.TrimPrefix(string(kv.Key), e.prefix); key != "" {
+			keys[key] = kv.Value
+		}
+	}
+
+	return keys, revision, nil
+}
+
+// wait returns once a key below the prefix changed after revision.
+func (e *etcdSource) wait(ctx context.Context, revision int64) error {
+
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.prefix)),
+			"range_end":      base64.StdEncoding.EncodeToString(e.rangeEnd()),
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return nil
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// remoteConfig applies the keys read from a remote configuration source:
+// the OPA configuration in -config-file mode, and data documents in either
+// mode.
+type remoteConfig struct {
+	opa     *sdk.OPA
+	state   *stateDocuments
+	timeout time.Duration
+
+	// bundleCacheDir is the -bundle-cache-dir the bundles of remote
+	// configurations are persisted to.
+	bundleCacheDir string
+
+	// services is the TLS configuration of the services of remote
+	// configurations, by class.
+	services serviceTLS
+
+	// configured is called after the OPA configuration was replaced.
+	configured func()
+
+	config []byte
+	data   map[string]bool
+}
+
+func (c *remoteConfig) apply(ctx context.Context, keys map[string][]byte) {
+
+	if bs, ok := keys[remoteConfigKey]; ok && !bytes.Equal(bs, c.config) {
+		if err := c.configure(ctx, bs, keys[remoteConfigSignatureKey]); err != nil {
+			log.Printf("Failed to apply remote OPA configuration: %v", err)
+		} else {
+			c.config = bs
+		}
+	}
+
+	doc := map[string]interface{}{}
+	for key, bs := range keys {
+		if !strings.HasPrefix(key, remoteDataPrefix) {
+			continue
+		}
+		path := strings.Split(strings.Trim(strings.TrimPrefix(key, remoteDataPrefix), "/"), "/")
+		var value interface{}
+		if err := util.Unmarshal(bs, &value); err != nil {
+			log.Printf("Failed to parse remote data document %s: %v", key, err)
+			continue
+		}
+		if path[0] == "" || value == nil {
+			continue
+		}
+		setDocument(doc, path, value)
+	}
+
+	data := map[string]bool{}
+	for key, value := range doc {
+		data[key] = true
+		c.state.set(key, value)
+	}
+	for key := range c.data {
+		if !data[key] {
+			c.state.remove(key)
+		}
+	}
+	c.data = data
+}
+
+// configure replaces the OPA configuration, keeping the previous one when the
+// new configuration does not become ready within the timeout. sig is the
+// detached signature of the configuration, verified when the binary requires
+// configurations to be signed.
+func (c *remoteConfig) configure(ctx context.Context, bs, sig []byte) error {
+
+	if c.opa == nil {
+		return fmt.Errorf("the %q key is only supported with -config-file", remoteConfigKey)
+	}
+
+	if err := checkRemoteConfigSignature(bs, sig); err != nil {
+		return err
+	}
+
+	bs, err := interpolateConfig(bs)
+	if err != nil {
+		return err
+	}
+
+	problems, err := checkConfigBytes(bs)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		msgs := make([]string, 0, len(problems))
+		for _, p := range problems {
+			msgs = append(msgs, p.String())
+		}
+		return fmt.Errorf("invalid configuration: %s", strings.Join(msgs, "; "))
+	}
+
+	if bs, err = resolveSecretRefs(bs); err != nil {
+		return err
+	}
+
+	if bs, err = c.services.apply(bs); err != nil {
+		return err
+	}
+
+	if fipsMode {
+		if err := checkFIPSConfig(bs); err != nil {
+			return err
+		}
+	}
+
+	if c.bundleCacheDir != "" {
+		if bs, err = persistBundles(bs, c.bundleCacheDir); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if err := c.opa.Configure(ctx, sdk.ConfigOptions{Config: bytes.NewReader(bs)}); err != nil {
+		return err
+	}
+
+	log.Printf("Applied remote OPA configuration")
+	if c.configured != nil {
+		c.configured()
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsulSource(t *testing.T) {
+
+	changes := make(chan struct{})
+	index := 10
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/opa/" || r.Header.Get("X-Consul-Token") != "secret" {
+			t.Errorf("Unexpected request %v %v", r.URL, r.Header)
+		}
+		if r.URL.Query().Get("index") != "" {
+			select {
+			case <-changes:
+				index++
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+		pairs := []map[string]interface{}{
+			{"Key": "opa/", "Value": nil},
+			{"Key": "opa/data/users", "Value": []byte(fmt.Sprintf(`{"index": %d}`, index))},
+		}
+		json.NewEncoder(w).Encode(pairs)
+	}))
+	defer srv.Close()
+
+	source, err := newRemoteConfigSource(strings.Replace(srv.URL, "http", "consul", 1)+"/opa", "secret", "", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan map[string][]byte)
+	go source.watch(ctx, func(keys map[string][]byte) { updates <- keys })
+
+	for _, expected := range []string{`{"index": 10}`, `{"index": 11}`} {
+		keys := <-updates
+		if !reflect.DeepEqual(keys, map[string][]byte{"data/users": []byte(expected)}) {
+			t.Fatalf("Expected %v, got %v", expected, keys)
+		}
+		changes <- struct{}{}
+	}
+}
+
+func TestEtcdSource(t *testing.T) {
+
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	changes := make(chan struct{})
+	revision := 5
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if body["key"] != b64("opa/") || body["range_end"] != b64("opa0") {
+				t.Errorf("Unexpected range %v", body)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"header": map[string]string{"revision": fmt.Sprint(revision)},
+				"kvs": []map[string]string{
+					{"key": b64("opa/config"), "value": b64(fmt.Sprintf("revision: %d", revision))},
+				},
+			})
+		case "/v3/watch":
+			create := body["create_request"].(map[string]interface{})
+			if create["start_revision"] != fmt.Sprint(revision+1) {
+				t.Errorf("Unexpected watch %v", body)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+			w.(http.Flusher).Flush()
+			select {
+			case <-changes:
+				revision++
+			case <-r.Context().Done():
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"events": []interface{}{map[string]interface{}{}}}})
+		}
+	}))
+	defer srv.Close()
+
+	source, err := newRemoteConfigSource(strings.Replace(srv.URL, "http", "etcd", 1)+"/opa/", "", "", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan map[string][]byte)
+	go source.watch(ctx, func(keys map[string][]byte) { updates <- keys })
+
+	for _, expected := range []string{"revision: 5", "revision: 6"} {
+		keys := <-updates
+		if !reflect.DeepEqual(keys, map[string][]byte{"config": []byte(expected)}) {
+			t.Fatalf("Expected %v, got %v", expected, keys)
+		}
+		changes <- struct{}{}
+	}
+}
+
+func TestRemoteConfigApply(t *testing.T) {
+
+	state := newStateDocuments()
+	state.set("quota", map[string]interface{}{})
+
+	c := &remoteConfig{state: state, timeout: time.Second}
+
+	c.apply(context.Background(), map[string][]byte{
+		"config":         []byte("bundles: {}"),
+		"data/users":     []byte(`{"alice": {"admin": true}}`),
+		"data/teams/web": []byte("members: [alice]"),
+		"other":          []byte("ignored"),
+	})
+
+	doc := map[string]interface{}{}
+	if err := state.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"quota": map[string]interface{}{},
+		"users": map[string]interface{}{"alice": map[string]interface{}{"admin": true}},
+		"teams": map[string]interface{}{"web": map[string]interface{}{"members": []interface{}{"alice"}}},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("Expected %v, got %v", expected, doc)
+	}
+
+	// The OPA configuration is rejected outside of -config-file mode.
+	if c.config != nil {
+		t.Fatalf("Expected the configuration to be rejected, got %s", c.config)
+	}
+
+	// Documents removed from the store are removed from data, while other
+	// documents are left alone.
+	c.apply(context.Background(), map[string][]byte{"data/teams/web": []byte("members: [bob]")})
+
+	doc = map[string]interface{}{}
+	if err := state.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{
+		"quota": map[string]interface{}{},
+		"teams": map[string]interface{}{"web": map[string]interface{}{"members": []interface{}{"bob"}}},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("Expected %v, got %v", expected, doc)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/util"
+)
+
+const (
+	defaultReplayRetention = 7 * 24 * time.Hour
+	defaultReplayMaxBytes  = 1 << 30
+
+	// replaySegmentBytes and replaySegmentAge bound the segments of the
+	// replay store, which are removed as a whole.
+	replaySegmentBytes = 4 << 20
+	replaySegmentAge   = time.Hour
+)
+
+// replayStore is the decision sink keeping the decision events of denied
+// requests on disk, with their scrubbed input, for the replay subcommand to
+// evaluate them against a new policy. The events are appended as JSON lines
+// to segment files, which are removed once older than the retention, and
+// from the oldest while the store exceeds its size.
+type replayStore struct {
+	dir       string
+	retention time.Duration
+	maxBytes  int64
+	now       func() time.Time
+
+	mu       sync.Mutex
+	segments []*replaySegment
+	tail     *os.File
+	size     int64
+}
+
+type replaySegment struct {
+	path     string
+	size     int64
+	created  time.Time
+	modified time.Time
+}
+
+// openReplayStore opens the store in dir, picking up the segments left by a
+// previous run.
+func openReplayStore(dir string, retention time.Duration, maxBytes int64) (*replayStore, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	paths, err := replaySegmentPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &replayStore{dir: dir, retention: retention, maxBytes: maxBytes, now: time.Now}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &replaySegment{path: path, size: info.Size(), modified: info.ModTime()})
+		s.size += info.Size()
+	}
+
+	return s, nil
+}
+
+// replaySegmentPaths returns the segments of the store in dir, oldest first.
+func replaySegmentPaths(dir string) ([]string, error) {
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func (s *replayStore) Start(context.Context) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trim()
+}
+
+func (s *replayStore) Record(event map[string]interface{}) error {
+
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.tail == nil || s.segments[len(s.segments)-1].size >= replaySegmentBytes || now.Sub(s.segments[len(s.segments)-1].created) >= replaySegmentAge {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.tail.Write(bs); err != nil {
+		return err
+	}
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(len(bs))
+	seg.modified = now
+	s.size += int64(len(bs))
+
+	return s.trim()
+}
+
+func (s *replayStore) Flush(context.Context) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tail == nil {
+		return nil
+	}
+
+	return s.tail.Sync()
+}
+
+func (s *replayStore) Stop(ctx context.Context) error {
+
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeTail()
+}
+
+// rotate starts a new segment. Callers must hold s.mu.
+func (s *replayStore) rotate(now time.Time) error {
+
+	if err := s.closeTail(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.jsonl", now.UnixNano()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.tail = f
+	s.segments = append(s.segments, &replaySegment{path: path, created: now, modified: now})
+
+	return nil
+}
+
+func (s *replayStore) closeTail() error {
+
+	if s.tail == nil {
+		return nil
+	}
+
+	err := s.tail.Close()
+	s.tail = nil
+
+	return err
+}
+
+// trim removes the segments last written to before the retention, and the
+// oldest segments while the store exceeds its size. The segment being written
+// is kept. Callers must hold s.mu.
+func (s *replayStore) trim() error {
+
+	cutoff := s.now().Add(-s.retention)
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.tail != nil && len(s.segments) == 1 {
+			break
+		}
+		if !seg.modified.Before(cutoff) && s.size <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.size -= seg.size
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+// replayEntry is a decision kept by the replay store.
+type replayEntry struct {
+	DecisionID string                 `json:"decision_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Input      map[string]interface{} `json:"input"`
+	Result     bool                   `json:"result"`
+	Code       string                 `json:"code,omitempty"`
+}
+
+// loadReplay reads the decisions kept in the store in dir since the given
+// time, oldest first. Lines truncated by a crash are skipped.
+func loadReplay(dir string, since time.Time) ([]replayEntry, error) {
+
+	paths, err := replaySegmentPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []replayEntry
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			var entry replayEntry
+			if util.UnmarshalJSON(line, &entry) != nil {
+				continue
+			}
+			if ts, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err == nil && ts.Before(since) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		f.Close()
+	}
+
+	return entries, nil
+}
+
+// replayResult is the decision of the new policy for a kept decision.
+type replayResult struct {
+	replayEntry
+	decision decision
+	err      error
+}
+
+func (r replayResult) changed() bool {
+	return r.err == nil && r.decision.Allowed != r.Result
+}
+
+// replayDecisions evaluates the kept decisions with query.
+func replayDecisions(ctx context.Context, query rego.PreparedEvalQuery, entries []replayEntry) []replayResult {
+
+	results := make([]replayResult, 0, len(entries))
+
+	for _, entry := range entries {
+		result := replayResult{replayEntry: entry}
+
+		rs, err := query.Eval(ctx, rego.EvalInput(entry.Input))
+		switch {
+		case err != nil:
+			result.err = err
+		case len(rs) > 0:
+			// Invalid decisions deny the request.
+			result.decision, _ = parseDecision(rs[0].Expressions[0].Value)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// reportReplay writes the decisions changed by the new policy, or every
+// decision when verbose, and returns the number of changes and errors.
+func reportReplay(w io.Writer, results []replayResult, verbose bool) (int, int) {
+
+	changed, failed := 0, 0
+
+	for _, r := range results {
+		user, _ := r.Input["User"].(string)
+		method, _ := r.Input["Method"].(string)
+		path, _ := r.Input["Path"].(string)
+		request := fmt.Sprintf("%s %s %s (user %q)", r.Timestamp, method, path, user)
+
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Fprintf(w, "ERROR %s %s: %v\n", r.DecisionID, request, r.err)
+		case r.changed():
+			changed++
+			fmt.Fprintf(w, "CHANGED %s %s: %s -> %s\n", r.DecisionID, request, replayOutcome(r.Result, r.Code), replayOutcome(r.decision.Allowed, r.decision.Code))
+		case verbose:
+			fmt.Fprintf(w, "SAME %s %s: %s\n", r.DecisionID, request, replayOutcome(r.decision.Allowed, r.decision.Code))
+		}
+	}
+
+	fmt.Fprintf(w, "%d decisions replayed, %d changed, %d errors\n", len(results), changed, failed)
+
+	return changed, failed
+}
+
+func replayOutcome(allowed bool, code string) string {
+
+	if allowed {
+		return "allowed"
+	}
+	if code != "" {
+		return "denied (code: " + code + ")"
+	}
+
+	return "denied"
+}
+
+// runReplay implements the replay subcommand, which evaluates a policy
+// against the decisions kept by -replay-dir and reports those it decides
+// differently, before the policy is rolled out. The exit code is 0 when no
+// decision changes, 1 when some do and 2 on errors.
+func runReplay(args []string) int {
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	policyFile := fs.String("policy-file", "", "sets the path of the policy file to evaluate")
+	dataDir := fs.String("data-dir", "", "sets the path of data files to load")
+	allowPath := fs.String("allowPath", "data.docker.authz.allow", "sets the path of the allow decision in OPA")
+	since := fs.Duration("since", 0, "sets how far back decisions are replayed (all of them when 0)")
+	verbose := fs.Bool("v", false, "report unchanged decisions as well")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *policyFile == "" || fs.NArg() != 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: opa-docker-authz replay -policy-file <file> [-data-dir <dir>] [-since <duration>] <replay-dir>")
+		return 2
+	}
+
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+
+	entries, err := loadReplay(fs.Arg(0), from)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(entries) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "no decisions found in %s\n", fs.Arg(0))
+		return 2
+	}
+
+	ctx := context.Background()
+	query, err := prepareOfflinePolicy(ctx, *policyFile, *dataDir, *allowPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	changed, failed := reportReplay(os.Stdout, replayDecisions(ctx, query, entries), *verbose)
+	switch {
+	case failed > 0:
+		return 2
+	case changed > 0:
+		return 1
+	}
+
+	return 0
+}
+
+// replaySinkFilter is the filter of the replay store unless
+// -decision-sink-filters sets one: only denied decisions are kept.
+func replaySinkFilter() *sinkFilter {
+	return &sinkFilter{Decisions: "denied"}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestReplayStoreRetention(t *testing.T) {
+
+	dir := t.TempDir()
+	s, err := openReplayStore(dir, 24*time.Hour, defaultReplayMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	record := func(id string) {
+		event := map[string]interface{}{"decision_id": id, "timestamp": now.Format(time.RFC3339Nano), "result": false}
+		if err := s.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record("a")
+	record("b")
+	now = now.Add(2 * replaySegmentAge)
+	record("c")
+
+	entries, err := loadReplay(dir, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || len(s.segments) != 2 {
+		t.Fatalf("Expected 3 decisions in 2 segments, got %v in %d", entries, len(s.segments))
+	}
+
+	// The first segment expires, and -since skips the decisions before it.
+	now = now.Add(24*time.Hour - replaySegmentAge)
+	record("d")
+
+	entries, err = loadReplay(dir, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].DecisionID != "c" || entries[1].DecisionID != "d" {
+		t.Fatalf("Expected decisions c and d, got %v", entries)
+	}
+
+	entries, err = loadReplay(dir, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DecisionID != "d" {
+		t.Fatalf("Expected decision d, got %v", entries)
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The segments are picked up on restart.
+	s, err = openReplayStore(dir, 24*time.Hour, defaultReplayMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(s.segments))
+	}
+}
+
+func TestReplayStoreMaxBytes(t *testing.T) {
+
+	dir := t.TempDir()
+	s, err := openReplayStore(dir, defaultReplayRetention, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for _, id := range []string{"a", "b", "c"} {
+		event := map[string]interface{}{"decision_id": id, "input": map[string]interface{}{"Path": strings.Repeat("x", 40)}}
+		if err := s.Record(event); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(replaySegmentAge)
+	}
+
+	// The segment being written is kept, even when over the size.
+	entries, err := loadReplay(dir, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DecisionID != "c" {
+		t.Fatalf("Expected decision c, got %v", entries)
+	}
+	if len(s.segments) != 1 {
+		t.Fatalf("Expected 1 segment, got %d", len(s.segments))
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	dir := t.TempDir()
+	content := `{"decision_id":"1","timestamp":"2022-09-01T00:00:00Z","input":{"User":"alice","Method":"POST","Path":"/v1.41/containers/create"},"result":false,"code":"privileged"}
+{"decision_id":"2","timestamp":"2022-09-01T00:00:01Z","input":{"User":"bob","Method":"DELETE","Path":"/v1.41/images/alpine"},"result":false}
+{"decision_id":"3","timestamp":"2022-09-01T00:00:02Z","input":{"User":"al
+`
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001.jsonl"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadReplay(dir, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the truncated decision to be skipped, got %v", entries)
+	}
+
+	query, err := rego.New(
+		rego.Query("data.docker.authz.allow"),
+		rego.Module("authz.rego", `package docker.authz
+
+default allow = false
+
+allow {
+	input.User == "alice"
+}
+`),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	changed, failed := reportReplay(&out, replayDecisions(context.Background(), query, entries), false)
+	if changed != 1 || failed != 0 {
+		t.Fatalf("Expected 1 change and no errors, got %d and %d", changed, failed)
+	}
+
+	expected := `CHANGED 1 2022-09-01T00:00:00Z POST /v1.41/containers/create (user "alice"): denied (code: privileged) -> allowed
+2 decisions replayed, 1 changed, 0 errors
+`
+	if out.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, out.String())
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+// defaultCPUPeriod is the CFS period in microseconds Docker uses when a
+// quota is given without a period.
+const defaultCPUPeriod = 100000
+
+// Resources is the input.resources document, with the resource limits of a
+// container create or update request resolved to canonical units. Limits
+// that are not set, or set to unlimited, are omitted.
+type Resources struct {
+	MemoryBytes            *int64 `json:"memory_bytes,omitempty"`
+	MemoryReservationBytes *int64 `json:"memory_reservation_bytes,omitempty"`
+
+	// MemorySwapBytes is the limit of memory and swap combined; -1 allows
+	// unlimited swap.
+	MemorySwapBytes  *int64 `json:"memory_swap_bytes,omitempty"`
+	MemorySwappiness *int64 `json:"memory_swappiness,omitempty"`
+
+	// CPUMillicores is the CPU limit given by --cpus, or by the CFS quota
+	// and period, in thousandths of a CPU.
+	CPUMillicores *int64 `json:"cpu_millicores,omitempty"`
+	CPUShares     *int64 `json:"cpu_shares,omitempty"`
+	CPUQuotaUs    *int64 `json:"cpu_quota_us,omitempty"`
+	CPUPeriodUs   *int64 `json:"cpu_period_us,omitempty"`
+	CpusetCpus    string `json:"cpuset_cpus,omitempty"`
+
+	PidsLimit *int64 `json:"pids_limit,omitempty"`
+}
+
+// requestedResources returns the resources of container create requests,
+// whose limits are found in HostConfig, and of container update requests,
+// whose limits are found at the top level of the body.
+func requestedResources(method, path string, body map[string]interface{}) *Resources {
+
+	if method != "POST" {
+		return nil
+	}
+
+	var config map[string]interface{}
+	switch containerAction(path) {
+	case "create":
+		config, _ = body["HostConfig"].(map[string]interface{})
+	case "update":
+		config = body
+	}
+	if config == nil {
+		return nil
+	}
+
+	positive := func(key string) *int64 {
+		if v, ok := config[key].(float64); ok && v > 0 {
+			n := int64(v)
+			return &n
+		}
+		return nil
+	}
+
+	res := &Resources{
+		MemoryBytes:            positive("Memory"),
+		MemoryReservationBytes: positive("MemoryReservation"),
+		MemorySwapBytes:        positive("MemorySwap"),
+		CPUShares:              positive("CpuShares"),
+		CPUQuotaUs:             positive("CpuQuota"),
+		CPUPeriodUs:            positive("CpuPeriod"),
+		PidsLimit:              positive("PidsLimit"),
+	}
+
+	if v, ok := config["MemorySwap"].(float64); ok && v == -1 {
+		unlimited := int64(-1)
+		res.MemorySwapBytes = &unlimited
+	}
+
+	if v, ok := config["MemorySwappiness"].(float64); ok && v >= 0 {
+		n := int64(v)
+		res.MemorySwappiness = &n
+	}
+
+	res.CpusetCpus, _ = config["CpusetCpus"].(string)
+
+	if nano := positive("NanoCpus"); nano != nil {
+		millicores := *nano / 1e6
+		res.CPUMillicores = &millicores
+	} else if res.CPUQuotaUs != nil {
+		period := int64(defaultCPUPeriod)
+		if res.CPUPeriodUs != nil {
+			period = *res.CPUPeriodUs
+		}
+		millicores := *res.CPUQuotaUs * 1000 / period
+		res.CPUMillicores = &millicores
+	}
+
+	return res
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestedResources(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "create with cpus",
+			method:   "POST",
+			path:     "/v1.41/containers/create",
+			body:     `{"HostConfig": {"Memory": 536870912, "MemorySwap": -1, "NanoCpus": 1500000000, "PidsLimit": 100, "MemorySwappiness": -1}}`,
+			expected: `{"memory_bytes":536870912,"memory_swap_bytes":-1,"cpu_millicores":1500,"pids_limit":100}`,
+		},
+		{
+			name:     "create with quota",
+			method:   "POST",
+			path:     "/containers/create",
+			body:     `{"HostConfig": {"CpuQuota": 50000, "CpuPeriod": 200000, "CpuShares": 512, "MemorySwappiness": 0, "CpusetCpus": "0-1"}}`,
+			expected: `{"memory_swappiness":0,"cpu_millicores":250,"cpu_shares":512,"cpu_quota_us":50000,"cpu_period_us":200000,"cpuset_cpus":"0-1"}`,
+		},
+		{
+			name:     "update",
+			method:   "POST",
+			path:     "/v1.41/containers/abc/update",
+			body:     `{"Memory": 1073741824, "CpuQuota": 200000, "PidsLimit": -1}`,
+			expected: `{"memory_bytes":1073741824,"cpu_millicores":2000,"cpu_quota_us":200000}`,
+		},
+		{
+			name:     "unlimited",
+			method:   "POST",
+			path:     "/v1.41/containers/create",
+			body:     `{"HostConfig": {"Memory": 0}}`,
+			expected: `{}`,
+		},
+		{
+			name:     "other",
+			method:   "POST",
+			path:     "/v1.41/containers/abc/start",
+			body:     `{}`,
+			expected: `null`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			bs, err := json.Marshal(requestedResources(tc.method, tc.path, body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bs) != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, string(bs))
+			}
+		})
+	}
+}
@@ -0,0 +1,651 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/plugins"
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// authzPluginName is the key of the plugin section in the OPA configuration
+// that enables revision tracking in config-file mode.
+const authzPluginName = "opa_docker_authz"
+
+// authzPluginConfig is the configuration found under
+// plugins.opa_docker_authz in the OPA configuration file.
+type authzPluginConfig struct {
+	Activation activationConfig `json:"activation"`
+	Canary     *canaryConfig    `json:"canary,omitempty"`
+	Shadow     bool             `json:"shadow,omitempty"`
+	Divergence divergenceConfig `json:"divergence"`
+	Staleness  stalenessConfig  `json:"staleness"`
+
+	BundleAlerts bundleAlertConfig          `json:"bundle_alerts"`
+	Failover     map[string]*bundleFailover `json:"failover,omitempty"`
+
+	SchemaCheck schemaCheckConfig `json:"schema_check"`
+}
+
+// duration is a time.Duration that is configured as a string such as "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+// revision is a snapshot of the policies and data activated from bundles,
+// kept so that it can be enforced after a newer revision has landed.
+type revision struct {
+	bundles   map[string]string
+	compiler  *ast.Compiler
+	store     storage.Store
+	landed    time.Time
+	activated time.Time
+
+	// rejected is set when the policies fail the input schema check in
+	// enforce mode. Rejected revisions are never activated.
+	rejected bool
+}
+
+func (r *revision) String() string {
+
+	if r == nil {
+		return ""
+	}
+
+	parts := make([]string, 0, len(r.bundles))
+	for name, rev := range r.bundles {
+		parts = append(parts, name+"@"+rev)
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
+
+// eval evaluates query against the snapshot.
+func (r *revision) eval(ctx context.Context, query string, input interface{}) (decision, error) {
+
+	rs, err := rego.New(append([]func(*rego.Rego){
+		rego.Query(query),
+		rego.Compiler(r.compiler),
+		rego.Store(r.store),
+		rego.Input(input),
+	}, append(evalStatsOptions(ctx), explainOptions(ctx)...)...)...).Eval(ctx)
+	if err != nil {
+		return decision{}, err
+	}
+
+	if len(rs) == 0 {
+		return decision{}, nil
+	}
+
+	// Invalid decisions deny the request.
+	d, _ := parseDecision(rs[0].Expressions[0].Value)
+	return d, nil
+}
+
+// revisionTracker is an OPA plugin that snapshots every bundle activation and
+// decides which revision is enforced, according to the activation schedule.
+type revisionTracker struct {
+	manager *plugins.Manager
+
+	mu       sync.Mutex
+	config   authzPluginConfig
+	latest   *revision
+	active   *revision
+	previous *revision
+	canary   *canary
+	state    *stateDocuments
+	untrack  func()
+	stop     chan struct{}
+
+	divergences divergenceLog
+
+	// bundleStatuses are the last statuses of the bundle plugin, and stale
+	// the bundles last reported stale.
+	bundleStatuses map[string]*bundlePlugin.Status
+	stale          map[string]bool
+	alerter        *bundleAlerter
+	failover       map[string]*failoverState
+}
+
+// revisionRoute describes how a single request is evaluated.
+type revisionRoute struct {
+	// enforce is the revision whose decision is returned, or nil when the
+	// latest revision is enforced through the SDK.
+	enforce *revision
+	// compare is evaluated alongside while a canary is running, or while a
+	// held revision is evaluated in shadow mode.
+	compare *revision
+	mode    string
+	canary  *canary
+}
+
+type authzPluginFactory struct {
+	// inputVersion is the version of the input policies are given, which
+	// the schema check checks them against.
+	inputVersion int
+}
+
+func (f authzPluginFactory) Validate(m *plugins.Manager, config []byte) (interface{}, error) {
+
+	var cfg authzPluginConfig
+	if err := util.Unmarshal(config, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Activation.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Canary.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Divergence.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Staleness.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.BundleAlerts.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := validateFailover(cfg.Failover, m.Services()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.SchemaCheck.validate(f.inputVersion); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (authzPluginFactory) New(m *plugins.Manager, config interface{}) plugins.Plugin {
+	return &revisionTracker{
+		manager: m,
+		config:  config.(authzPluginConfig),
+		stop:    make(chan struct{}),
+		alerter: newBundleAlerter(),
+
+		failover: map[string]*failoverState{},
+	}
+}
+
+func (t *revisionTracker) Start(ctx context.Context) error {
+
+	err := storage.Txn(ctx, t.manager.Store, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := t.snapshot(ctx, txn, t.manager.GetCompiler()); err != nil {
+			return err
+		}
+		_, err := t.manager.Store.Register(ctx, txn, storage.TriggerConfig{
+			OnCommit: func(ctx context.Context, txn storage.Transaction, event storage.TriggerEvent) {
+				// Policy changes are handled by the compiler trigger, which
+				// runs once the manager has installed the new compiler.
+				if event.DataChanged() && !event.PolicyChanged() && !t.stateDocuments().owns(event) {
+					t.onCommit(ctx, txn, t.manager.GetCompiler())
+				}
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	t.manager.RegisterCompilerTrigger(func(txn storage.Transaction) {
+		t.onCommit(ctx, txn, t.manager.GetCompiler())
+	})
+
+	t.trackBundleStatus()
+
+	go t.run()
+
+	t.manager.UpdatePluginStatus(authzPluginName, &plugins.Status{State: plugins.StateOK})
+	return nil
+}
+
+func (t *revisionTracker) Stop(context.Context) {
+
+	t.mu.Lock()
+	if t.untrack != nil {
+		t.untrack()
+	}
+	t.mu.Unlock()
+
+	if p := bundlePlugin.Lookup(t.manager); p != nil {
+		p.UnregisterBulkListener(authzPluginName)
+	}
+
+	close(t.stop)
+	t.manager.UpdatePluginStatus(authzPluginName, &plugins.Status{State: plugins.StateNotReady})
+}
+
+func (t *revisionTracker) Reconfigure(_ context.Context, config interface{}) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config = config.(authzPluginConfig)
+
+	// The bundle plugin is reconfigured with the sources of the new
+	// configuration as well.
+	t.failover = map[string]*failoverState{}
+	bundleSource.Reset()
+}
+
+// run re-evaluates the schedule periodically so that held revisions are
+// activated when their window opens, even without incoming requests.
+func (t *revisionTracker) run() {
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			t.advance(now)
+			t.reportStaleness(now)
+			t.mu.Unlock()
+
+			switchSources(context.Background(), t.manager, t.failBack(context.Background(), now))
+		}
+	}
+}
+
+func (t *revisionTracker) onCommit(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler) {
+
+	if err := t.snapshot(ctx, txn, compiler); err != nil {
+		log.Printf("Failed to snapshot bundle revision: %v", err)
+	}
+
+	// Bundle activations may have erased the state documents from the
+	// store. They are written back once the transaction has been released.
+	if state := t.stateDocuments(); !state.empty() {
+		go func() {
+			for key, value := range state.documents() {
+				t.writeState(key, value)
+			}
+		}()
+	}
+}
+
+// trackState keeps the state documents in the store, and in the retained
+// revisions, so that policies read them under data.
+func (t *revisionTracker) trackState(state *stateDocuments) {
+
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+
+	untrack := state.onChange(t.writeState)
+
+	t.mu.Lock()
+	t.untrack = untrack
+	t.mu.Unlock()
+}
+
+func (t *revisionTracker) stateDocuments() *stateDocuments {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// writeState writes a state document into the store and into the retained
+// revisions, or removes it when value is nil.
+func (t *revisionTracker) writeState(key string, value interface{}) {
+
+	ctx := context.Background()
+	path := storage.Path{key}
+
+	op := storage.AddOp
+	if value == nil {
+		op = storage.RemoveOp
+	}
+
+	doc, err := copyDocument(map[string]interface{}{key: value})
+	if err != nil {
+		log.Printf("Failed to write state document %v: %v", key, err)
+		return
+	}
+
+	err = storage.Txn(ctx, t.manager.Store, storage.WriteParams, func(txn storage.Transaction) error {
+		err := t.manager.Store.Write(ctx, txn, op, path, doc[key])
+		if storage.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to write state document %v: %v", key, err)
+	}
+
+	t.mu.Lock()
+	revisions := []*revision{t.latest, t.active, t.previous}
+	if t.canary != nil {
+		revisions = append(revisions, t.canary.candidate)
+	}
+	t.mu.Unlock()
+
+	seen := map[*revision]bool{}
+	for _, rev := range revisions {
+		if rev == nil || seen[rev] {
+			continue
+		}
+		seen[rev] = true
+		if err := storage.WriteOne(ctx, rev.store, op, path, doc[key]); err != nil && !storage.IsNotFound(err) {
+			log.Printf("Failed to write state document %v to bundle revision %v: %v", key, rev, err)
+		}
+	}
+}
+
+// snapshot copies the current contents of the store so that the revision
+// can still be evaluated after later bundle activations modify the store.
+func (t *revisionTracker) snapshot(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler) error {
+
+	if compiler == nil {
+		return nil
+	}
+
+	root, err := t.manager.Store.Read(ctx, txn, storage.Path{})
+	if err != nil {
+		return err
+	}
+
+	doc, ok := root.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected root document type %T", root)
+	}
+
+	doc, err = copyDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	if err := t.stateDocuments().apply(doc); err != nil {
+		return err
+	}
+
+	revisions := map[string]string{}
+	names, err := bundle.ReadBundleNamesFromStore(ctx, t.manager.Store, txn)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	for _, name := range names {
+		rev, err := bundle.ReadBundleRevisionFromStore(ctx, t.manager.Store, txn, name)
+		if err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+		revisions[name] = rev
+	}
+
+	rev := &revision{
+		bundles:  revisions,
+		compiler: compiler,
+		store:    inmem.NewFromObject(doc),
+		landed:   time.Now(),
+	}
+
+	t.mu.Lock()
+	check := t.config.SchemaCheck
+	t.mu.Unlock()
+
+	rev.rejected = check.report(check.check(compiler.Modules)) != nil
+
+	t.land(rev)
+
+	return nil
+}
+
+// land tracks rev as the latest revision, activating it unless the schedule
+// holds it back or it was rejected.
+func (t *revisionTracker) land(rev *revision) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.reportStaleness(rev.landed)
+
+	t.latest = rev
+
+	// Nothing to hold back for: the first bundle revision is enforced as
+	// soon as it lands. A rejected one is replaced by a revision without
+	// policies, which denies every request until a revision passes.
+	if t.active == nil || len(t.active.bundles) == 0 {
+		if rev.rejected {
+			log.Printf("Bundle revision %v failed the input schema check, denying all requests until a revision passes it", rev)
+			t.active = emptyRevision(rev.landed)
+			return
+		}
+		rev.activated = rev.landed
+		t.active = rev
+		return
+	}
+
+	t.advance(rev.landed)
+	if rev.rejected {
+		log.Printf("Bundle revision %v failed the input schema check, %v remains active", rev, t.active)
+	} else if t.active != rev {
+		log.Printf("Bundle revision %v landed, %v remains active until activation is allowed", rev, t.active)
+	}
+}
+
+// emptyRevision returns a revision without policies or data, under which
+// every request is denied.
+func emptyRevision(now time.Time) *revision {
+
+	compiler := ast.NewCompiler()
+	compiler.Compile(map[string]*ast.Module{})
+
+	return &revision{bundles: map[string]string{}, compiler: compiler, store: inmem.New(), landed: now, activated: now}
+}
+
+// advance applies the activation schedule at now. Callers must hold t.mu.
+func (t *revisionTracker) advance(now time.Time) {
+
+	cfg := t.config.Activation
+
+	if t.previous != nil && cfg.shouldRevert(t.active.bundles, now) {
+		log.Printf("Bundle revision %v reached its scheduled end, reverting to %v", t.active, t.previous)
+		t.active, t.previous = t.previous, nil
+		t.active.activated = now
+	}
+
+	if t.canary != nil && t.canary.ramp(t.config.Canary, now) {
+		t.promote(t.canary.candidate, now)
+	}
+
+	pending := t.latest != nil && t.latest != t.active && t.latest.activated.IsZero() && !t.latest.rejected
+	if !pending || !cfg.canActivate(t.latest.bundles, now) {
+		return
+	}
+
+	t.latest.activated = now
+
+	if t.config.Canary.enabled() {
+		log.Printf("Starting canary of bundle revision %v at %v%% (stable %v)", t.latest, t.config.Canary.Percent, t.active)
+		t.canary = &canary{candidate: t.latest, percent: t.config.Canary.Percent, stepped: now}
+		return
+	}
+
+	t.promote(t.latest, now)
+}
+
+// promote makes rev the active revision. Callers must hold t.mu.
+func (t *revisionTracker) promote(rev *revision, now time.Time) {
+	log.Printf("Activating bundle revision %v (previously %v)", rev, t.active)
+	rev.activated = now
+	t.previous, t.active, t.canary = t.active, rev, nil
+}
+
+// route decides which revision enforces the decision for r. While a canary
+// is running, requests hashing below its percentage are enforced by the
+// candidate, and the other revision is returned for comparison.
+func (t *revisionTracker) route(now time.Time, r authorization.Request) revisionRoute {
+
+	if t == nil {
+		return revisionRoute{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.advance(now)
+
+	route := revisionRoute{enforce: t.active}
+
+	if t.canary != nil {
+		key := r.User
+		if t.config.Canary.HashBy == canaryHashByRequest {
+			key, _ = uuid4()
+		}
+
+		route.canary, route.mode = t.canary, compareModeCanary
+		if canaryBucket(key) < t.canary.percent {
+			route.enforce, route.compare = t.canary.candidate, t.active
+		} else {
+			route.compare = t.canary.candidate
+		}
+	}
+
+	if route.compare == nil && t.config.Shadow && t.latest != t.active && t.latest.activated.IsZero() {
+		route.compare, route.mode = t.latest, compareModeShadow
+	}
+
+	if route.enforce == t.latest {
+		route.enforce = nil
+	}
+
+	return route
+}
+
+// latestRevision returns the snapshot of the latest bundles, if any.
+func (t *revisionTracker) latestRevision() *revision {
+
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.latest
+}
+
+// recordComparison records the decisions of the enforced and the compared
+// revision of route.
+func (t *revisionTracker) recordComparison(route revisionRoute, enforced, compared bool, input interface{}) {
+
+	t.mu.Lock()
+	cfg := t.config.Divergence
+	enforcedRevision := route.enforce
+	if enforcedRevision == nil {
+		enforcedRevision = t.latest
+	}
+	if route.canary != nil && t.canary == route.canary {
+		route.canary.compared++
+		if enforced != compared {
+			route.canary.diverged++
+		}
+	}
+	t.mu.Unlock()
+
+	t.divergences.record(cfg, divergenceSample{
+		Mode:             route.mode,
+		EnforcedRevision: enforcedRevision.String(),
+		EnforcedResult:   enforced,
+		ComparedRevision: route.compare.String(),
+		ComparedResult:   compared,
+		Input:            input,
+	})
+}
+
+// status summarizes the tracked revisions for the admin API.
+func (t *revisionTracker) status() map[string]interface{} {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := map[string]interface{}{
+		"active": t.active.String(),
+		"latest": t.latest.String(),
+	}
+	if t.active != nil {
+		result["activated"] = t.active.activated.Format(time.RFC3339Nano)
+	}
+	if t.previous != nil {
+		result["previous"] = t.previous.String()
+	}
+	if t.canary != nil {
+		result["canary"] = map[string]interface{}{
+			"candidate": t.canary.candidate.String(),
+			"percent":   t.canary.percent,
+			"compared":  t.canary.compared,
+			"diverged":  t.canary.diverged,
+			"frozen":    t.canary.frozen,
+		}
+	}
+
+	staleness := []interface{}{}
+	for _, s := range bundleStalenesses(t.config.Staleness, t.active, t.latest, t.bundleStatuses, time.Now()) {
+		staleness = append(staleness, map[string]interface{}{
+			"bundle":                s.Bundle,
+			"active_revision":       s.ActiveRevision,
+			"latest_revision":       s.LatestRevision,
+			"lag_seconds":           s.Lag.Seconds(),
+			"since_request_seconds": s.SinceRequest.Seconds(),
+			"stale":                 s.Stale,
+		})
+	}
+	result["staleness"] = staleness
+
+	if len(t.config.Failover) > 0 {
+		failover := map[string]interface{}{}
+		for name, state := range t.failover {
+			failover[name] = map[string]interface{}{
+				"source":   resolveSource(name, state.sources(t.config.Failover[name])[state.current], state.primary).String(),
+				"index":    state.current,
+				"failures": state.failures,
+			}
+		}
+		result["failover"] = failover
+	}
+
+	return result
+}
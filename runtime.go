@@ -0,0 +1,93 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// sandboxedRuntimes are the OCI runtimes known to run containers in a
+// sandbox, a user-space kernel or a virtual machine, rather than as
+// processes of the host kernel.
+var sandboxedRuntimes = map[string]bool{
+	"runsc":                      true,
+	"io.containerd.runsc.v1":     true,
+	"kata":                       true,
+	"kata-runtime":               true,
+	"kata-qemu":                  true,
+	"kata-fc":                    true,
+	"kata-clh":                   true,
+	"io.containerd.kata.v2":      true,
+	"io.containerd.kata-qemu.v2": true,
+	"io.containerd.kata-fc.v2":   true,
+	"io.containerd.kata-clh.v2":  true,
+}
+
+// Runtime is the input.runtime document: the OCI runtime a container is
+// created with.
+type Runtime struct {
+	// Name is the runtime requested, or the daemon's default runtime when
+	// none is and -host-info is given. It is empty otherwise.
+	Name string `json:"name"`
+
+	// Default is true when the request leaves the runtime to the daemon.
+	Default bool `json:"default"`
+
+	// Sandboxed is true for the runtimes of gVisor and Kata Containers.
+	Sandboxed bool `json:"sandboxed"`
+
+	// Configured reports whether the runtime is configured on the daemon.
+	// It is null unless -host-info is given.
+	Configured *bool `json:"configured"`
+}
+
+// requestedRuntime returns the runtime of container create requests, or nil
+// for any other request.
+func requestedRuntime(method, path string, body map[string]interface{}) *Runtime {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	name, _ := hostConfig["Runtime"].(string)
+
+	return &Runtime{Name: name, Default: name == "", Sandboxed: sandboxedRuntimes[name]}
+}
+
+// enrichRuntime resolves the runtime of container create requests against
+// the runtimes configured on the daemon. The runtime is left as requested
+// when the daemon cannot be queried.
+func (p *DockerAuthZPlugin) enrichRuntime(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	runtime, ok := doc["runtime"].(*Runtime)
+	if !ok || runtime == nil || p.docker.isLookup(r.RequestHeaders) {
+		return nil
+	}
+
+	info, err := p.runtimes.get(ctx)
+	if err != nil {
+		log.Printf("Failed to look up the runtimes of the daemon: %v", err)
+		return nil
+	}
+
+	if runtime.Default {
+		runtime.Name = info.DefaultRuntime
+		runtime.Sandboxed = sandboxedRuntimes[runtime.Name]
+	}
+
+	configured := false
+	for _, name := range info.Runtimes {
+		if name == runtime.Name {
+			configured = true
+		}
+	}
+	runtime.Configured = &configured
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntime(t *testing.T) {
+
+	// The host information is cached with the results of docker.host_info,
+	// which other tests look up from other daemons.
+	builtinResults = newBuiltinCache(defaultBuiltinCacheSize)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"DefaultRuntime": "runc", "Runtimes": {"runc": {}, "runsc": {"path": "/usr/local/bin/runsc"}}}`))
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body       string
+		plugin     *DockerAuthZPlugin
+		expected   Runtime
+		configured string
+	}{
+		{
+			body:       `{"HostConfig": {"Runtime": "runsc"}}`,
+			plugin:     &DockerAuthZPlugin{},
+			expected:   Runtime{Name: "runsc", Sandboxed: true},
+			configured: "null",
+		},
+		{
+			body:       `{"HostConfig": {}}`,
+			plugin:     &DockerAuthZPlugin{},
+			expected:   Runtime{Default: true},
+			configured: "null",
+		},
+		{
+			body:       `{"HostConfig": {"Runtime": "runsc"}}`,
+			plugin:     &DockerAuthZPlugin{docker: docker, runtimes: newHostInfoSource(docker, time.Minute)},
+			expected:   Runtime{Name: "runsc", Sandboxed: true},
+			configured: "true",
+		},
+		{
+			body:       `{"HostConfig": {}}`,
+			plugin:     &DockerAuthZPlugin{docker: docker, runtimes: newHostInfoSource(docker, time.Minute)},
+			expected:   Runtime{Name: "runc", Default: true},
+			configured: "true",
+		},
+		{
+			body:       `{"HostConfig": {"Runtime": "kata"}}`,
+			plugin:     &DockerAuthZPlugin{docker: docker, runtimes: newHostInfoSource(docker, time.Minute)},
+			expected:   Runtime{Name: "kata", Sandboxed: true},
+			configured: "false",
+		},
+	}
+
+	for _, tc := range tests {
+		req := containerCreate("bob", tc.body)
+		input, err := tc.plugin.buildInput(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		runtime := input.(map[string]interface{})["runtime"].(*Runtime)
+		configured := "null"
+		if runtime.Configured != nil {
+			configured = map[bool]string{true: "true", false: "false"}[*runtime.Configured]
+		}
+		got := *runtime
+		got.Configured = nil
+		if got != tc.expected || configured != tc.configured {
+			t.Errorf("Expected %+v (configured: %v) for %s, got %+v (configured: %v)", tc.expected, tc.configured, tc.body, got, configured)
+		}
+	}
+
+	if runtime := requestedRuntime("POST", "/v1.41/containers/abc/start", nil); runtime != nil {
+		t.Fatalf("Expected no runtime, got %+v", runtime)
+	}
+}
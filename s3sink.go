@@ -0,0 +1,294 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultS3Partition lays out decision log objects by day and host.
+const defaultS3Partition = "{year}/{month}/{day}/{host}"
+
+// awsCredentials are the static credentials used to sign S3 requests.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromEnv reads the credentials from the standard AWS
+// environment variables.
+func awsCredentialsFromEnv() (awsCredentials, error) {
+
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return creds, nil
+}
+
+// s3Sink batches decision records and periodically uploads them as gzip
+// compressed, newline delimited JSON objects to an S3-compatible bucket.
+type s3Sink struct {
+	client    *http.Client
+	endpoint  *url.URL
+	prefix    string
+	partition string
+	region    string
+	host      string
+	creds     awsCredentials
+	batch     decisionBatch
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// newS3Sink returns a sink writing below location, a URL of the form
+// https://endpoint/bucket/prefix. Buckets are addressed path-style, which
+// every S3-compatible service supports. The TLS configuration of the service is
+// given by caFile, certFile and keyFile, as for clientTLSConfig.
+func newS3Sink(location, region, partition string, creds awsCredentials, caFile, certFile, keyFile string) (*s3Sink, error) {
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported S3 URL %q", location)
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 URL %q has no bucket", location)
+	}
+
+	transport, err := clientTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Sink{
+		client:    &http.Client{Transport: transport, Timeout: time.Minute},
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + bucket},
+		prefix:    strings.Trim(prefix, "/"),
+		partition: partition,
+		region:    region,
+		host:      host,
+		creds:     creds,
+		batch:     decisionBatch{name: "S3"},
+	}, nil
+}
+
+// record adds entry to the next batch.
+func (s *s3Sink) record(entry interface{}) {
+
+	if s == nil {
+		return
+	}
+
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode decision for S3: %v", err)
+		return
+	}
+
+	s.batch.add(bs)
+}
+
+// start uploads the batch on every interval until ctx is done.
+func (s *s3Sink) start(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, "S3", interval, s.flush)
+}
+
+// flush uploads the buffered records as a single object. On failure the
+// records are kept for the next attempt.
+func (s *s3Sink) flush(ctx context.Context) error {
+
+	if s == nil {
+		return nil
+	}
+
+	batch := s.batch.take()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, bs := range batch {
+		gz.Write(bs)
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err := s.put(ctx, s.objectKey(now, seq), body.Bytes(), now)
+	if err != nil {
+		s.batch.requeue(batch)
+	}
+
+	return err
+}
+
+// objectKey returns the key of the object holding the batch flushed at now.
+func (s *s3Sink) objectKey(now time.Time, seq uint64) string {
+
+	partition := expandTimeLayout(s.partition, now, s.host)
+
+	name := fmt.Sprintf("%s-%s-%d.ndjson.gz", s.host, now.Format("20060102T150405Z"), seq)
+
+	parts := []string{}
+	for _, p := range []string{s.prefix, strings.Trim(partition, "/"), name} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (s *s3Sink) put(ctx context.Context, key string, body []byte, now time.Time) error {
+
+	u := *s.endpoint
+	u.Path += "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.region, "s3", s.creds, now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", key, resp.Status)
+	}
+
+	return nil
+}
+
+// signV4 signs req with AWS Signature Version 4, covering the host and every
+// header already set on req.
+func signV4(req *http.Request, payloadHash, region, service string, creds awsCredentials, now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// awsEscape escapes s as required by Signature Version 4, which differs from
+// url.QueryEscape in its handling of spaces and tildes.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
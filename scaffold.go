@@ -0,0 +1,221 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// scaffoldPolicy is the starter policy generated by init. It allows requests
+// unless one of the deny rules matches.
+const scaffoldPolicy = `package {{.Package}}
+
+# Requests are denied unless allow is true. The plugin queries
+# {{.AllowPath}}, see -allowPath.
+default allow = false
+
+allow {
+	not deny
+}
+
+# Read-only users may only inspect the daemon.
+deny {
+	data.users[input.User].readOnly
+	not read_methods[input.Method]
+}
+
+# Only administrators may create privileged containers.
+deny {
+	input.Body.HostConfig.Privileged == true
+	not data.users[input.User].admin
+}
+
+# Bind mounts must resolve to one of the allowed directories, or below them.
+# Paths that do not exist on the host do not resolve, and are denied.
+deny {
+	mount := input.BindMounts[_]
+	not allowed_mount(mount)
+}
+
+read_methods = {"GET", "HEAD"}
+
+allowed_mount(mount) {
+	mount.Resolved == data.allowed_mounts[_]
+}
+
+allowed_mount(mount) {
+	startswith(mount.Resolved, concat("", [data.allowed_mounts[_], "/"]))
+}
+`
+
+// scaffoldTests are the unit tests of the starter policy, run with opa test.
+const scaffoldTests = `package {{.Package}}
+
+users = {
+	"alice": {"admin": true},
+	"bob": {"readOnly": true},
+	"carol": {},
+}
+
+allowed_mounts = ["/srv/data"]
+
+test_read_allowed_for_read_only_user {
+	allow with input as {"User": "bob", "Method": "GET", "PathPlain": "/v1.41/containers/json"}
+		with data.users as users
+}
+
+test_write_denied_for_read_only_user {
+	not allow with input as {"User": "bob", "Method": "POST", "PathPlain": "/v1.41/containers/create", "Body": {}}
+		with data.users as users
+}
+
+test_privileged_allowed_for_admin {
+	allow with input as {"User": "alice", "Method": "POST", "PathPlain": "/v1.41/containers/create", "Body": {"HostConfig": {"Privileged": true}}}
+		with data.users as users
+}
+
+test_privileged_denied_for_user {
+	not allow with input as {"User": "carol", "Method": "POST", "PathPlain": "/v1.41/containers/create", "Body": {"HostConfig": {"Privileged": true}}}
+		with data.users as users
+}
+
+test_bind_mount_allowed_below_allowed_directory {
+	allow with input as {"User": "carol", "Method": "POST", "PathPlain": "/v1.41/containers/create", "BindMounts": [{"Source": "/srv/data/app", "ReadOnly": false, "Resolved": "/srv/data/app"}]}
+		with data.users as users
+		with data.allowed_mounts as allowed_mounts
+}
+
+test_bind_mount_denied_outside_allowed_directories {
+	not allow with input as {"User": "carol", "Method": "POST", "PathPlain": "/v1.41/containers/create", "BindMounts": [{"Source": "/srv/database", "ReadOnly": false, "Resolved": "/srv/database"}]}
+		with data.users as users
+		with data.allowed_mounts as allowed_mounts
+}
+`
+
+// scaffoldData is the example data document loaded with -data-dir.
+var scaffoldData = map[string]interface{}{
+	"users": map[string]interface{}{
+		"alice": map[string]interface{}{"admin": true},
+		"bob":   map[string]interface{}{"readOnly": true},
+	},
+	"allowed_mounts": []string{"/srv/data"},
+}
+
+// scaffoldFile is a file generated by init, relative to the target directory.
+type scaffoldFile struct {
+	name    string
+	content []byte
+}
+
+// scaffold returns the files of a starter policy in package pkg.
+func scaffold(pkg string) ([]scaffoldFile, error) {
+
+	params := struct {
+		Package   string
+		AllowPath string
+	}{
+		Package:   pkg,
+		AllowPath: "data." + pkg + ".allow",
+	}
+
+	var files []scaffoldFile
+	for _, f := range []struct{ name, text string }{
+		{"authz.rego", scaffoldPolicy},
+		{"authz_test.rego", scaffoldTests},
+	} {
+		var buf bytes.Buffer
+		if err := template.Must(template.New(f.name).Parse(f.text)).Execute(&buf, params); err != nil {
+			return nil, err
+		}
+		if _, err := ast.ParseModule(f.name, buf.String()); err != nil {
+			return nil, fmt.Errorf("invalid package %q: %w", pkg, err)
+		}
+		files = append(files, scaffoldFile{f.name, buf.Bytes()})
+	}
+
+	for _, f := range []struct {
+		name  string
+		value interface{}
+	}{
+		{filepath.Join("data", "data.json"), scaffoldData},
+		{filepath.Join("schemas", "input.json"), inputSchema(defaultInputVersion)},
+	} {
+		bs, err := json.MarshalIndent(f.value, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, scaffoldFile{f.name, append(bs, '\n')})
+	}
+
+	return files, nil
+}
+
+// runInit implements the init subcommand, writing a starter policy, its
+// tests, example data and the schema of the input document to a directory.
+func runInit(args []string) int {
+
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	dir := fs.String("dir", ".", "sets the path of the directory the starter policy is written to")
+	pkg := fs.String("package", "docker.authz", "sets the package of the starter policy")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	files, err := scaffold(*pkg)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*force {
+		for _, f := range files {
+			if _, err := os.Stat(filepath.Join(*dir, f.name)); err == nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%s already exists, use -force to overwrite it\n", filepath.Join(*dir, f.name))
+				return 1
+			}
+		}
+	}
+
+	for _, f := range files {
+		path := filepath.Join(*dir, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := os.WriteFile(path, f.content, 0644); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Created", path)
+	}
+
+	fmt.Printf(`
+Run the policy tests with:
+
+  opa test %s %s
+
+Type check the policy against the input schema with:
+
+  opa check --schema %s %s
+
+Start the plugin with:
+
+  opa-docker-authz -policy-file %s -data-dir %s -allowPath %s
+`,
+		filepath.Join(*dir, "authz.rego"), filepath.Join(*dir, "authz_test.rego"),
+		filepath.Join(*dir, "schemas"), filepath.Join(*dir, "authz.rego"),
+		filepath.Join(*dir, "authz.rego"), filepath.Join(*dir, "data"), "data."+*pkg+".allow")
+
+	return 0
+}
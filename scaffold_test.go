@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+func TestInitScaffold(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if code := runInit([]string{"-dir", dir, "-package", "example.authz"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if code := runInit([]string{"-dir", dir}); code != 1 {
+		t.Fatalf("Expected existing files to be kept, got exit code %d", code)
+	}
+
+	// The generated tests pass.
+	rs, err := rego.New(
+		rego.Query("data.example.authz"),
+		rego.Load([]string{filepath.Join(dir, "authz.rego"), filepath.Join(dir, "authz_test.rego")}, nil),
+	).Eval(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := 0
+	for name, value := range rs[0].Expressions[0].Value.(map[string]interface{}) {
+		if !strings.HasPrefix(name, "test_") {
+			continue
+		}
+		tests++
+		if value != true {
+			t.Errorf("Expected %s to pass", name)
+		}
+	}
+	if tests == 0 {
+		t.Fatal("Expected generated tests")
+	}
+
+	// The policy type checks against the generated input schema.
+	bs, err := os.ReadFile(filepath.Join(dir, "schemas", "input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema interface{}
+	if err := json.Unmarshal(bs, &schema); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := os.ReadFile(filepath.Join(dir, "authz.rego"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := ast.NewSchemaSet()
+	schemas.Put(ast.InputRootRef, schema)
+	compiler := ast.NewCompiler().WithSchemas(schemas)
+	if compiler.Compile(map[string]*ast.Module{"authz.rego": ast.MustParseModule(string(policy))}); compiler.Failed() {
+		t.Fatal(compiler.Errors)
+	}
+}
+
+func TestInputSchemaCoversInput(t *testing.T) {
+
+	input, err := makeInput(authorization.Request{
+		RequestMethod: "POST",
+		RequestURI:    "/v1.41/containers/create?name=web",
+		RequestHeaders: map[string]string{
+			"Content-Type": "application/json",
+		},
+		RequestBody: []byte(`{"Image": "nginx", "HostConfig": {"Binds": ["/srv:/srv"]}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties := inputSchema(latestInputVersion)["properties"].(map[string]interface{})
+	for name := range input.(map[string]interface{}) {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("Expected input field %s in schema", name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// inputField is a top-level field of the input document.
+type inputField struct {
+	name        string
+	description string
+	value       interface{}
+}
+
+// inputFields lists the fields of the input document with a value of the Go
+// type they hold, so that the schema follows the input as it evolves.
+var inputFields = []inputField{
+	{"Headers", "the headers of the request, by canonical name", map[string]string(nil)},
+	{"Path", "the request URI, including the query", ""},
+	{"PathPlain", "the path of the request URI", ""},
+	{"PathArr", "the path of the request URI split on /", []string(nil)},
+	{"Query", "the query parameters of the request", url.Values(nil)},
+	{"params", "the first value of each query parameter, the one the daemon acts on", map[string]string(nil)},
+	{"Method", "the HTTP method of the request", ""},
+	{"Body", "the JSON body of the request", map[string]interface{}(nil)},
+	{"User", "the authenticated user", ""},
+	{"AuthMethod", "the method the user authenticated with", ""},
+	{"BindMounts", "the bind mounts of containers being created", []BindMount(nil)},
+	{"Container", "the container endpoint being called", (*ContainerEndpoint)(nil)},
+	{"Image", "the image referenced by the request", (*ImageReference)(nil)},
+	{"devices", "the devices requested for containers being created", []Device(nil)},
+	{"gpus", "the GPUs requested for containers being created", (*GPURequest)(nil)},
+	{"namespaces", "the namespace modes of containers being created", (*Namespaces)(nil)},
+	{"sysctls", "the sysctls of containers being created", map[string]string(nil)},
+	{"sysctl_flags", "sysctls that would apply to the host", []SysctlFinding(nil)},
+	{"Seccomp", "the seccomp profile of containers being created", (*SeccompSummary)(nil)},
+	{"AppArmor", "the AppArmor profile of containers being created", (*AppArmorProfile)(nil)},
+	{"security_opt", "the security options of containers being created", (*SecurityOptions)(nil)},
+	{"runtime", "the OCI runtime of containers being created", (*Runtime)(nil)},
+	{"log_config", "the log driver and options of containers being created", (*LogConfig)(nil)},
+	{"restart", "the restart policy of containers and services being created or updated", (*RestartPolicy)(nil)},
+	{"healthcheck", "the healthcheck of containers and services being created", (*Healthcheck)(nil)},
+	{"resources", "the resource limits requested for containers", (*Resources)(nil)},
+	{"env", "the environment of containers being created", map[string]string(nil)},
+	{"env_flags", "environment variables that look like secrets", []EnvFinding(nil)},
+	{"Secrets", "the secrets mounted into service tasks", []ServiceFile(nil)},
+	{"Configs", "the configs mounted into service tasks", []ServiceFile(nil)},
+	{"compose", "the Compose project of containers being created", (*Compose)(nil)},
+	{"plugin", "the Docker plugin being installed, upgraded or configured, and its privileges", (*PluginRequest)(nil)},
+	{"session", "the BuildKit session being opened", (*BuildKitSession)(nil)},
+	{"buildkit", "the frontend, attributes and contexts of BuildKit builds", (*BuildKitBuild)(nil)},
+	{"BuildContext", "the build context of image builds, with -inspect-build-context", (*BuildContext)(nil)},
+	{"user_groups", "the groups of the user, with -resolve-user-groups", []string(nil)},
+	{"identity", "the canonical identity of the user, with -identity-resolver", (*Identity)(nil)},
+	{"spiffe", "the SPIFFE ID of the client, with -spiffe-trust-bundles", (*SPIFFEIdentity)(nil)},
+	{"user_resources", "the resources reserved by the running containers of the user, with -user-resources", (*UserResources)(nil)},
+	{"engine", "the version and ID of the Docker daemon, with -engine-info", (*EngineInfo)(nil)},
+	{"schema_version", "the version of the shape of the input document, with -input-schema-version", 0},
+	{"BodyTruncated", "true when the body exceeded its limit under -body-limits and was left out", false},
+}
+
+// inputFieldVersions lists the fields whose shape in the version of the key
+// differs from their shape in the versions above it.
+var inputFieldVersions = map[int][]inputField{}
+
+// inputSchema returns a JSON Schema describing the input document in the
+// shape of version.
+func inputSchema(version int) map[string]interface{} {
+
+	fields := map[string]inputField{}
+	for _, field := range inputFields {
+		fields[field.name] = field
+	}
+	for v := latestInputVersion - 1; v >= version; v-- {
+		for _, field := range inputFieldVersions[v] {
+			fields[field.name] = field
+		}
+	}
+
+	properties := map[string]interface{}{}
+	for _, field := range fields {
+		schema := typeSchema(reflect.TypeOf(field.value))
+		schema["description"] = field.description
+		properties[field.name] = schema
+	}
+
+	return map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"title":      "opa-docker-authz input",
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeSchema returns the schema of the JSON encoding of values of type t.
+// Maps, slices and pointers may be encoded as null.
+func typeSchema(t reflect.Type) map[string]interface{} {
+
+	if t == nil || t.Kind() == reflect.Interface {
+		return map[string]interface{}{}
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(typeSchema(t.Elem()))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())})
+	case reflect.Map:
+		return nullable(map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())})
+	case reflect.Struct:
+		return structSchema(t)
+	}
+
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of a struct, honouring its json tags.
+func structSchema(t reflect.Type) map[string]interface{} {
+
+	properties := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// nullable extends schema to also accept null.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+
+	if typ, ok := schema["type"].(string); ok {
+		schema["type"] = []string{typ, "null"}
+	}
+
+	return schema
+}
+
+// runSchema implements the schema subcommand, which prints the JSON Schema of
+// the input document, or writes it to the file given with -o, for type
+// checking policies with opa check --schema.
+func runSchema(args []string) int {
+	return printSchema(os.Stdout, os.Stderr, args)
+}
+
+func printSchema(stdout, stderr io.Writer, args []string) int {
+
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	output := fs.String("o", "", "sets the path of the file the schema is written to (standard output when empty)")
+	inputVersion := fs.Int("input-schema-version", defaultInputVersion, "sets the version of the shape of the input document described")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := validInputVersion(*inputVersion); err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if fs.NArg() != 0 {
+		_, _ = fmt.Fprintln(stderr, "usage: opa-docker-authz schema [-o <file>] [-input-schema-version <version>]")
+		return 2
+	}
+
+	bs, err := json.MarshalIndent(inputSchema(*inputVersion), "", "  ")
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+	bs = append(bs, '\n')
+
+	if *output == "" {
+		_, _ = stdout.Write(bs)
+		return 0
+	}
+
+	if err := os.WriteFile(*output, bs, 0644); err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	return 0
+}
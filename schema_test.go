@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestSchemaCommand(t *testing.T) {
+
+	var stdout, stderr bytes.Buffer
+	if code := printSchema(&stdout, &stderr, nil); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "input.json")
+	if code := printSchema(&stdout, &stderr, []string{"-o", path}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, stdout.Bytes()) {
+		t.Fatal("Expected the same schema on standard output and in the file")
+	}
+
+	var schema interface{}
+	if err := util.Unmarshal(bs, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(policy string) ast.Errors {
+		schemas := ast.NewSchemaSet()
+		schemas.Put(ast.SchemaRootRef, schema)
+		compiler := ast.NewCompiler().WithSchemas(schemas)
+		compiler.Compile(map[string]*ast.Module{"authz.rego": ast.MustParseModule(policy)})
+		return compiler.Errors
+	}
+
+	if errs := check(`package docker.authz
+deny { input.BindMounts[_].Propagation == "rshared" }
+deny { input.namespaces.pid.host }
+deny { input.gpus.count > 1 }`); len(errs) > 0 {
+		t.Fatalf("Expected the policy to type check, got %v", errs)
+	}
+
+	errs := check(`package docker.authz
+deny { input.namespaces.pid.hots }`)
+	if len(errs) == 0 || !strings.Contains(errs.Error(), "hots") {
+		t.Fatalf("Expected a type error for the misspelt field, got %v", errs)
+	}
+
+	if code := printSchema(&stdout, &stderr, []string{"extra"}); code != 2 {
+		t.Fatalf("Expected exit code 2 for extra arguments, got %d", code)
+	}
+}
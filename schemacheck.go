@@ -0,0 +1,128 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// Modes of the type check of policies against the input schema.
+const (
+	schemaCheckOff     = "off"
+	schemaCheckWarn    = "warn"
+	schemaCheckEnforce = "enforce"
+)
+
+// schemaCheckConfig configures the type check of policies against the input
+// schema when they are activated, which catches references to input fields
+// that do not exist: rules that would silently never match.
+type schemaCheckConfig struct {
+	// Mode is off, warn, which logs the errors, or enforce, which also
+	// refuses the policy. It defaults to warn.
+	Mode string `json:"mode,omitempty"`
+
+	// File is the path of the JSON Schema of the input, the one of this
+	// version of the plugin when empty.
+	File string `json:"file,omitempty"`
+
+	schema interface{}
+}
+
+// validate checks the mode, and loads the schema the policies are checked
+// against: the provided one, or that of the version of the input given to
+// them.
+func (c *schemaCheckConfig) validate(version int) error {
+
+	switch c.Mode {
+	case "":
+		c.Mode = schemaCheckWarn
+	case schemaCheckOff, schemaCheckWarn, schemaCheckEnforce:
+	default:
+		return fmt.Errorf("invalid schema check mode %q, expected off, warn or enforce", c.Mode)
+	}
+
+	if c.File == "" {
+		c.schema = inputSchema(version)
+		return nil
+	}
+
+	bs, err := os.ReadFile(c.File)
+	if err != nil {
+		return err
+	}
+	if err := util.Unmarshal(bs, &c.schema); err != nil {
+		return fmt.Errorf("invalid input schema %v: %w", c.File, err)
+	}
+
+	return nil
+}
+
+// check type checks modules against the input schema, returning the type
+// errors found, if any. Other compilation errors are left to the compilation
+// of the policy itself.
+func (c schemaCheckConfig) check(modules map[string]*ast.Module) ast.Errors {
+
+	if c.Mode == schemaCheckOff || c.schema == nil || len(modules) == 0 {
+		return nil
+	}
+
+	copies := make(map[string]*ast.Module, len(modules))
+	for name, m := range modules {
+		copies[name] = m.Copy()
+	}
+
+	schemas := ast.NewSchemaSet()
+	schemas.Put(ast.SchemaRootRef, c.schema)
+	compiler := ast.NewCompiler().SetErrorLimit(0).WithSchemas(schemas)
+	compiler.Compile(copies)
+
+	var errs ast.Errors
+	for _, err := range compiler.Errors {
+		if err.Code == ast.TypeErr {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// checkFiles type checks the Rego files found at paths, logging the errors,
+// which are returned in enforce mode.
+func (c schemaCheckConfig) checkFiles(paths ...string) error {
+
+	// Policies that cannot be loaded fail on evaluation instead.
+	result, err := loader.AllRegos(paths)
+	if err != nil {
+		log.Printf("Skipping the input schema check: %v", err)
+		return nil
+	}
+
+	modules := map[string]*ast.Module{}
+	for _, m := range result.Modules {
+		modules[m.Name] = m.Parsed
+	}
+
+	return c.report(c.check(modules))
+}
+
+// report logs the errors of a check, returning them in enforce mode.
+func (c schemaCheckConfig) report(errs ast.Errors) error {
+
+	for _, err := range errs {
+		log.Printf("Policy references the input inconsistently with its schema: %v", err)
+	}
+
+	if len(errs) > 0 && c.Mode == schemaCheckEnforce {
+		return errs
+	}
+
+	return nil
+}
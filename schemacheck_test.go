@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/ast"
+)
+
+const misspeltPolicy = `package docker.authz
+
+allow {
+	input.User == "alice"
+}
+
+deny {
+	input.namespaces.pid.hots
+}
+`
+
+func TestSchemaCheck(t *testing.T) {
+
+	modules := map[string]*ast.Module{"authz.rego": ast.MustParseModule(misspeltPolicy)}
+
+	for _, mode := range []string{"", schemaCheckWarn, schemaCheckEnforce} {
+		cfg := schemaCheckConfig{Mode: mode}
+		if err := cfg.validate(defaultInputVersion); err != nil {
+			t.Fatal(err)
+		}
+		errs := cfg.check(modules)
+		if len(errs) != 1 {
+			t.Fatalf("Expected one type error in mode %q, got %v", mode, errs)
+		}
+		if err := cfg.report(errs); (err != nil) != (mode == schemaCheckEnforce) {
+			t.Fatalf("Expected the policy to be refused only in enforce mode, got %v in mode %q", err, mode)
+		}
+	}
+
+	off := schemaCheckConfig{Mode: schemaCheckOff}
+	if err := off.validate(defaultInputVersion); err != nil {
+		t.Fatal(err)
+	}
+	if errs := off.check(modules); len(errs) != 0 {
+		t.Fatalf("Expected no errors when off, got %v", errs)
+	}
+
+	if err := (&schemaCheckConfig{Mode: "strict"}).validate(defaultInputVersion); err == nil {
+		t.Fatal("Expected an invalid mode to be rejected")
+	}
+
+	// A provided schema replaces the schema of the plugin.
+	dir := t.TempDir()
+	schemaFile := filepath.Join(dir, "input.json")
+	if err := os.WriteFile(schemaFile, []byte(`{"type": "object", "properties": {"User": {"type": "string"}, "namespaces": {"type": "object"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provided := schemaCheckConfig{Mode: schemaCheckEnforce, File: schemaFile}
+	if err := provided.validate(defaultInputVersion); err != nil {
+		t.Fatal(err)
+	}
+	if errs := provided.check(modules); len(errs) != 0 {
+		t.Fatalf("Expected no errors against the provided schema, got %v", errs)
+	}
+
+	policyFile := filepath.Join(dir, "authz.rego")
+	if err := os.WriteFile(policyFile, []byte(misspeltPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	enforce := schemaCheckConfig{Mode: schemaCheckEnforce}
+	if err := enforce.validate(defaultInputVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := enforce.checkFiles(policyFile); err == nil {
+		t.Fatal("Expected the policy file to be refused")
+	}
+}
+
+func TestRevisionTrackerSchemaCheck(t *testing.T) {
+
+	now := time.Now()
+	tracker := &revisionTracker{}
+
+	// A rejected first revision is replaced by one denying every request.
+	v1 := &revision{bundles: map[string]string{"authz": "v1"}, landed: now, rejected: true}
+	tracker.land(v1)
+	route := tracker.route(now, authorization.Request{})
+	if route.enforce == nil || route.enforce == v1 || len(route.enforce.bundles) != 0 {
+		t.Fatalf("Expected an empty revision to be enforced, got %+v", route)
+	}
+
+	d, err := route.enforce.eval(context.Background(), "data.docker.authz.allow", map[string]interface{}{})
+	if err != nil || d.Allowed {
+		t.Fatalf("Expected the empty revision to deny, got %+v (error: %v)", d, err)
+	}
+
+	// A passing revision is activated, and a rejected one is held back.
+	v2 := &revision{bundles: map[string]string{"authz": "v2"}, landed: now}
+	tracker.land(v2)
+	if route := tracker.route(now, authorization.Request{}); route.enforce != nil {
+		t.Fatalf("Expected the passing revision to be enforced, got %+v", route)
+	}
+
+	v3 := &revision{bundles: map[string]string{"authz": "v3"}, landed: now, rejected: true}
+	tracker.land(v3)
+	if route := tracker.route(now.Add(time.Hour), authorization.Request{}); route.enforce != v2 {
+		t.Fatalf("Expected the rejected revision to be held back, got %+v", route)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+const defaultScrubReplacement = "[REDACTED]"
+
+// scrubRule removes sensitive values from decision records. A rule with a
+// path replaces the values it selects; a rule with a pattern rewrites the
+// matching parts of strings, either below its path or anywhere in the record.
+type scrubRule struct {
+	Path        string `json:"path,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	segments []string
+	re       *regexp.Regexp
+}
+
+type scrubConfig struct {
+	Rules []scrubRule `json:"rules"`
+}
+
+// scrubber applies the configured rules to decision records before they are
+// persisted or logged.
+type scrubber struct {
+	rules []scrubRule
+}
+
+func loadScrubber(path string) (*scrubber, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg scrubConfig
+	if err := yaml.Unmarshal(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return newScrubber(cfg.Rules)
+}
+
+func newScrubber(rules []scrubRule) (*scrubber, error) {
+
+	s := &scrubber{}
+
+	for i, r := range rules {
+		if r.Path == "" && r.Pattern == "" {
+			return nil, fmt.Errorf("scrub rule %d: path or pattern is required", i)
+		}
+
+		if r.Path != "" {
+			segments, err := parseScrubPath(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("scrub rule %d: %w", i, err)
+			}
+			r.segments = segments
+		}
+
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("scrub rule %d: %w", i, err)
+			}
+			r.re = re
+		}
+
+		if r.Replacement == "" {
+			r.Replacement = defaultScrubReplacement
+		}
+
+		s.rules = append(s.rules, r)
+	}
+
+	return s, nil
+}
+
+// parseScrubPath parses the supported JSONPath subset: $.a.b, $.a['b'],
+// $.a[0] and the wildcards .* and [*].
+func parseScrubPath(path string) ([]string, error) {
+
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q must start with $", path)
+	}
+
+	var segments []string
+	rest := path[1:]
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %q has an empty segment", path)
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated bracket", path)
+			}
+			key := strings.Trim(rest[1:end], `'"`)
+			segments = append(segments, key)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q is not supported", path)
+		}
+	}
+
+	return segments, nil
+}
+
+// scrub returns a scrubbed deep copy of record. The record itself is left
+// untouched as it may still be in use by the caller.
+func (s *scrubber) scrub(record map[string]interface{}) map[string]interface{} {
+
+	if s == nil || len(s.rules) == 0 {
+		return record
+	}
+
+	doc, err := copyDocument(record)
+	if err != nil {
+		return map[string]interface{}{"error": "decision record could not be scrubbed"}
+	}
+
+	for _, r := range s.rules {
+		if r.segments == nil {
+			doc = scrubStrings(doc, r.re, r.Replacement).(map[string]interface{})
+			continue
+		}
+		doc = scrubPath(doc, r.segments, r).(map[string]interface{})
+	}
+
+	return doc
+}
+
+// scrubInput scrubs a bare input document, with paths relative to the record
+// the input would appear in.
+func (s *scrubber) scrubInput(input interface{}) interface{} {
+
+	if s == nil || len(s.rules) == 0 {
+		return input
+	}
+
+	return s.scrub(map[string]interface{}{"input": input})["input"]
+}
+
+func scrubPath(value interface{}, segments []string, r scrubRule) interface{} {
+
+	if len(segments) == 0 {
+		if r.re == nil {
+			return r.Replacement
+		}
+		return scrubStrings(value, r.re, r.Replacement)
+	}
+
+	key, rest := segments[0], segments[1:]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if key == "*" || key == k {
+				v[k] = scrubPath(child, rest, r)
+			}
+		}
+	case []interface{}:
+		idx, err := strconv.Atoi(key)
+		for i, child := range v {
+			if key == "*" || (err == nil && idx == i) {
+				v[i] = scrubPath(child, rest, r)
+			}
+		}
+	}
+
+	return value
+}
+
+func scrubStrings(value interface{}, re *regexp.Regexp, replacement string) interface{} {
+
+	switch v := value.(type) {
+	case string:
+		return re.ReplaceAllString(v, replacement)
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = scrubStrings(child, re, replacement)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = scrubStrings(child, re, replacement)
+		}
+	}
+
+	return value
+}
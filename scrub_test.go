@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScrubber(t *testing.T) {
+	s, err := newScrubber([]scrubRule{
+		{Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Replacement: "[email]"},
+		{Path: "$.input.Headers.Authorization"},
+		{Path: "$.input.Body.Env[*]", Pattern: `^(\w*(?:TOKEN|SECRET)\w*)=.*`, Replacement: "$1=[REDACTED]"},
+		{Path: "$.input.Body['Cmd'][1]", Replacement: "[arg]"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := map[string]interface{}{
+		"input": map[string]interface{}{
+			"User": "alice@example.com",
+			"Headers": map[string]interface{}{
+				"Authorization": "Bearer abc",
+				"Content-Type":  "application/json",
+			},
+			"Body": map[string]interface{}{
+				"Env": []interface{}{"GITHUB_TOKEN=ghp_123", "PATH=/bin"},
+				"Cmd": []interface{}{"run", "--password=hunter2"},
+			},
+		},
+		"result": true,
+	}
+
+	expected := map[string]interface{}{
+		"input": map[string]interface{}{
+			"User": "[email]",
+			"Headers": map[string]interface{}{
+				"Authorization": "[REDACTED]",
+				"Content-Type":  "application/json",
+			},
+			"Body": map[string]interface{}{
+				"Env": []interface{}{"GITHUB_TOKEN=[REDACTED]", "PATH=/bin"},
+				"Cmd": []interface{}{"run", "[arg]"},
+			},
+		},
+		"result": true,
+	}
+
+	if result := s.scrub(record); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	if record["input"].(map[string]interface{})["User"] != "alice@example.com" {
+		t.Error("Expected original record to be left untouched")
+	}
+}
+
+func TestScrubRuleValidation(t *testing.T) {
+	tests := []scrubRule{
+		{},
+		{Path: "input.User"},
+		{Path: "$.input[User"},
+		{Pattern: "("},
+	}
+
+	for _, tc := range tests {
+		if _, err := newScrubber([]scrubRule{tc}); err == nil {
+			t.Errorf("Expected error for rule %+v", tc)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Seccomp modes of container create requests.
+const (
+	seccompModeDefault    = "default"
+	seccompModeUnconfined = "unconfined"
+	seccompModeCustom     = "custom"
+)
+
+// SeccompSummary summarizes the seccomp profile a container is created with.
+type SeccompSummary struct {
+	Mode string
+
+	// DefaultAction and Actions are set for custom profiles. Actions maps
+	// each action to the syscalls it applies to; syscalls whose rule only
+	// applies for certain arguments are listed as well.
+	DefaultAction string              `json:",omitempty"`
+	Actions       map[string][]string `json:",omitempty"`
+
+	// Permissive is true when syscalls are allowed unless denied, i.e. the
+	// container is unconfined or the default action allows or only logs.
+	Permissive bool
+
+	// Error is set when a custom profile could not be read or parsed.
+	Error string `json:",omitempty"`
+}
+
+// seccompProfile is the part of a seccomp profile used for the summary.
+type seccompProfile struct {
+	DefaultAction string `json:"defaultAction"`
+	Syscalls      []struct {
+		Name   string   `json:"name"`
+		Names  []string `json:"names"`
+		Action string   `json:"action"`
+	} `json:"syscalls"`
+}
+
+// seccompSummary summarizes the seccomp profile of a container create
+// request, or returns nil for any other request.
+func seccompSummary(body map[string]interface{}) *SeccompSummary {
+
+	hostConfig, ok := body["HostConfig"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	// Docker disables seccomp for privileged containers.
+	if privileged, _ := hostConfig["Privileged"].(bool); privileged {
+		return &SeccompSummary{Mode: seccompModeUnconfined, Permissive: true}
+	}
+
+	var profile string
+	for _, opt := range stringList(hostConfig["SecurityOpt"]) {
+		if strings.HasPrefix(opt, "seccomp=") || strings.HasPrefix(opt, "seccomp:") {
+			profile = opt[len("seccomp="):]
+		}
+	}
+
+	switch profile {
+	case "", "builtin":
+		return &SeccompSummary{Mode: seccompModeDefault}
+	case "unconfined":
+		return &SeccompSummary{Mode: seccompModeUnconfined, Permissive: true}
+	}
+
+	summary := &SeccompSummary{Mode: seccompModeCustom}
+
+	// The Docker CLI sends the content of profile files; profiles given as
+	// paths are read from the host.
+	bs := []byte(profile)
+	if !strings.HasPrefix(strings.TrimSpace(profile), "{") {
+		var err error
+		if bs, err = os.ReadFile(profile); err != nil {
+			summary.Error = err.Error()
+			return summary
+		}
+	}
+
+	var p seccompProfile
+	if err := json.Unmarshal(bs, &p); err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+
+	summary.DefaultAction = p.DefaultAction
+	summary.Permissive = p.DefaultAction == "SCMP_ACT_ALLOW" || p.DefaultAction == "SCMP_ACT_LOG"
+	summary.Actions = map[string][]string{}
+
+	seen := map[string]map[string]bool{}
+	for _, rule := range p.Syscalls {
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		if seen[rule.Action] == nil {
+			seen[rule.Action] = map[string]bool{}
+		}
+		for _, name := range names {
+			if !seen[rule.Action][name] {
+				seen[rule.Action][name] = true
+				summary.Actions[rule.Action] = append(summary.Actions[rule.Action], name)
+			}
+		}
+	}
+
+	for _, names := range summary.Actions {
+		sort.Strings(names)
+	}
+
+	return summary
+}
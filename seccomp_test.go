@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSeccompSummary(t *testing.T) {
+	profile := `{"defaultAction": "SCMP_ACT_ERRNO", "syscalls": [
+		{"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"},
+		{"name": "ptrace", "action": "SCMP_ACT_ALLOW"},
+		{"names": ["read"], "action": "SCMP_ACT_ALLOW"}
+	]}`
+
+	tests := []struct {
+		name     string
+		body     map[string]interface{}
+		expected *SeccompSummary
+	}{
+		{
+			name:     "default",
+			body:     map[string]interface{}{"HostConfig": map[string]interface{}{}},
+			expected: &SeccompSummary{Mode: seccompModeDefault},
+		},
+		{
+			name: "unconfined",
+			body: map[string]interface{}{"HostConfig": map[string]interface{}{
+				"SecurityOpt": []interface{}{"seccomp=unconfined"},
+			}},
+			expected: &SeccompSummary{Mode: seccompModeUnconfined, Permissive: true},
+		},
+		{
+			name: "privileged",
+			body: map[string]interface{}{"HostConfig": map[string]interface{}{
+				"Privileged": true,
+			}},
+			expected: &SeccompSummary{Mode: seccompModeUnconfined, Permissive: true},
+		},
+		{
+			name: "inline",
+			body: map[string]interface{}{"HostConfig": map[string]interface{}{
+				"SecurityOpt": []interface{}{"no-new-privileges", "seccomp=" + profile},
+			}},
+			expected: &SeccompSummary{
+				Mode:          seccompModeCustom,
+				DefaultAction: "SCMP_ACT_ERRNO",
+				Actions:       map[string][]string{"SCMP_ACT_ALLOW": {"ptrace", "read", "write"}},
+			},
+		},
+		{
+			name: "permissive",
+			body: map[string]interface{}{"HostConfig": map[string]interface{}{
+				"SecurityOpt": []interface{}{`seccomp={"defaultAction": "SCMP_ACT_LOG"}`},
+			}},
+			expected: &SeccompSummary{
+				Mode:          seccompModeCustom,
+				DefaultAction: "SCMP_ACT_LOG",
+				Actions:       map[string][]string{},
+				Permissive:    true,
+			},
+		},
+		{
+			name: "invalid",
+			body: map[string]interface{}{"HostConfig": map[string]interface{}{
+				"SecurityOpt": []interface{}{"seccomp={"},
+			}},
+			expected: &SeccompSummary{Mode: seccompModeCustom, Error: "unexpected end of JSON input"},
+		},
+		{
+			name: "not a create request",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := seccompSummary(tc.body)
+			if !reflect.DeepEqual(result, tc.expected) {
+				bs, _ := json.Marshal(result)
+				t.Errorf("Expected %+v, got %s", tc.expected, bs)
+			}
+		})
+	}
+}
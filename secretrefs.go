@@ -0,0 +1,134 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	secretFilePrefix = "file://"
+	secretEnvPrefix  = "env://"
+)
+
+// secretConfigKeys are the keys of the OPA configuration, and of the plugin
+// sections in it, whose values are secrets. The values of headers, such as
+// the Authorization header of a service, are secrets as well.
+var secretConfigKeys = map[string]bool{
+	"token":                  true,
+	"password":               true,
+	"secret":                 true,
+	"client_secret":          true,
+	"private_key":            true,
+	"private_key_passphrase": true,
+	"key":                    true,
+	"webhook":                true,
+}
+
+// resolveSecretRefs returns the OPA configuration bs, given as YAML or JSON,
+// with the secrets it references replaced by their values: file:///path by
+// the content of the file, without its trailing newline, and env://NAME by
+// the environment variable. bs is returned as is when it references none.
+func resolveSecretRefs(bs []byte) ([]byte, error) {
+
+	var doc interface{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveSecrets(doc, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if !resolved {
+		return bs, nil
+	}
+
+	return json.Marshal(doc)
+}
+
+// resolveSecrets replaces the references of the secret-bearing values under
+// v in place, and reports whether it replaced any.
+func resolveSecrets(v interface{}, path []string, secret bool) (bool, error) {
+
+	resolved := false
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		inHeaders := len(path) > 0 && path[len(path)-1] == "headers"
+		for key, value := range v {
+			p := append(append([]string{}, path...), key)
+			if s, ok := value.(string); ok {
+				if !secretConfigKeys[key] && !inHeaders {
+					continue
+				}
+				secret, ok, err := resolveSecretRef(s)
+				if err != nil {
+					return false, fmt.Errorf("%s: %w", strings.Join(p, "."), err)
+				}
+				if ok {
+					v[key], resolved = secret, true
+				}
+				continue
+			}
+			r, err := resolveSecrets(value, p, secretConfigKeys[key])
+			if err != nil {
+				return false, err
+			}
+			resolved = resolved || r
+		}
+	case []interface{}:
+		for i, value := range v {
+			p := append(append([]string{}, path...), strconv.Itoa(i))
+			if s, ok := value.(string); ok && secret {
+				secret, ok, err := resolveSecretRef(s)
+				if err != nil {
+					return false, fmt.Errorf("%s: %w", strings.Join(p, "."), err)
+				}
+				if ok {
+					v[i], resolved = secret, true
+				}
+				continue
+			}
+			r, err := resolveSecrets(value, p, secret)
+			if err != nil {
+				return false, err
+			}
+			resolved = resolved || r
+		}
+	}
+
+	return resolved, nil
+}
+
+// resolveSecretRef returns the secret referenced by value, and false when
+// value is not a reference.
+func resolveSecretRef(value string) (string, bool, error) {
+
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimRight(string(bs), "\r\n"), true, nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", false, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, true, nil
+	}
+
+	return value, false, nil
+}
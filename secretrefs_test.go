@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecretRefs(t *testing.T) {
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPA_CLIENT_SECRET", "hunter2")
+
+	config := []byte(`
+services:
+  bundles:
+    url: https://bundles.example.com
+    headers:
+      X-Api-Key: env://OPA_CLIENT_SECRET
+    credentials:
+      bearer:
+        token: file://` + tokenFile + `
+bundles:
+  authz:
+    service: bundles
+    resource: file:///var/lib/opa-docker-authz/authz.tar.gz
+`)
+
+	bs, err := resolveSecretRefs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Services map[string]struct {
+			Headers     map[string]string `json:"headers"`
+			Credentials struct {
+				Bearer struct {
+					Token string `json:"token"`
+				} `json:"bearer"`
+			} `json:"credentials"`
+		} `json:"services"`
+		Bundles map[string]struct {
+			Resource string `json:"resource"`
+		} `json:"bundles"`
+	}
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := doc.Services["bundles"]
+	if svc.Credentials.Bearer.Token != "s3cr3t" || svc.Headers["X-Api-Key"] != "hunter2" {
+		t.Fatalf("Expected the secrets to be resolved, got %+v", svc)
+	}
+
+	// Values that are not secrets are left alone.
+	if r := doc.Bundles["authz"].Resource; r != "file:///var/lib/opa-docker-authz/authz.tar.gz" {
+		t.Fatalf("Expected the bundle resource to be kept, got %v", r)
+	}
+
+	// Configurations without references are returned as is.
+	plain := []byte("services:\n  bundles:\n    url: https://bundles.example.com\n")
+	if bs, err := resolveSecretRefs(plain); err != nil || string(bs) != string(plain) {
+		t.Fatalf("Expected the configuration to be kept, got %s, %v", bs, err)
+	}
+
+	for _, missing := range []string{
+		"services:\n  s:\n    credentials:\n      bearer:\n        token: env://OPA_UNSET_SECRET\n",
+		"services:\n  s:\n    credentials:\n      bearer:\n        token: file://" + filepath.Join(dir, "missing") + "\n",
+	} {
+		if _, err := resolveSecretRefs([]byte(missing)); err == nil {
+			t.Fatalf("Expected a missing secret to fail, for %q", missing)
+		}
+	}
+}
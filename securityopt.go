@@ -0,0 +1,149 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SecurityOptions is the input.security_opt document: the SecurityOpt
+// entries of a container create request, parsed into their options.
+type SecurityOptions struct {
+	// Seccomp is the seccomp mode, default, unconfined or custom, which
+	// input.Seccomp summarizes.
+	Seccomp string `json:"seccomp"`
+
+	// AppArmor is the AppArmor profile given with apparmor=, empty when
+	// the daemon's default applies.
+	AppArmor string `json:"apparmor"`
+
+	// Label holds the SELinux label options given with label=.
+	Label SELinuxLabel `json:"label"`
+
+	NoNewPrivileges bool `json:"no_new_privileges"`
+
+	// UnmaskedPaths is true with systempaths=unconfined, which exposes
+	// the host's /proc and /sys paths Docker masks.
+	UnmaskedPaths bool `json:"unmasked_paths"`
+
+	WritableCgroups bool `json:"writable_cgroups"`
+
+	// Unknown lists the entries that are not recognized.
+	Unknown []string `json:"unknown"`
+}
+
+// SELinuxLabel holds the SELinux label options of a container.
+type SELinuxLabel struct {
+	User     string `json:"user,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Level    string `json:"level,omitempty"`
+	FileType string `json:"filetype,omitempty"`
+
+	// Disable is true with label=disable, which turns off SELinux
+	// separation for the container.
+	Disable bool `json:"disable"`
+}
+
+// securityOptions parses the SecurityOpt entries of container create
+// requests, or returns nil for any other request.
+func securityOptions(method, path string, body map[string]interface{}) *SecurityOptions {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	opts := &SecurityOptions{Seccomp: seccompModeDefault, Unknown: []string{}}
+
+	for _, opt := range stringList(hostConfig["SecurityOpt"]) {
+		// Options are given as key=value, or as key:value by older clients.
+		key, value, hasValue := opt, "", false
+		if i := strings.IndexAny(opt, "=:"); i >= 0 {
+			key, value, hasValue = opt[:i], opt[i+1:], true
+		}
+
+		ok := true
+		switch key {
+		case "seccomp":
+			switch value {
+			case "", "builtin":
+				opts.Seccomp = seccompModeDefault
+			case "unconfined":
+				opts.Seccomp = seccompModeUnconfined
+			default:
+				opts.Seccomp = seccompModeCustom
+			}
+		case "apparmor":
+			opts.AppArmor = value
+		case "label":
+			ok = opts.Label.parse(value)
+		case "no-new-privileges":
+			opts.NoNewPrivileges, ok = parseSecurityBool(value, hasValue)
+		case "systempaths":
+			opts.UnmaskedPaths = value == "unconfined"
+			ok = opts.UnmaskedPaths
+		case "writable-cgroups":
+			opts.WritableCgroups, ok = parseSecurityBool(value, hasValue)
+		default:
+			ok = false
+		}
+		if !ok {
+			opts.Unknown = append(opts.Unknown, opt)
+		}
+	}
+
+	// Docker disables seccomp for privileged containers.
+	if privileged, _ := hostConfig["Privileged"].(bool); privileged {
+		opts.Seccomp = seccompModeUnconfined
+	}
+
+	return opts
+}
+
+// parse parses a label option, e.g. type:svirt_apache_t or disable.
+func (l *SELinuxLabel) parse(value string) bool {
+
+	if value == "disable" {
+		l.Disable = true
+		return true
+	}
+
+	key, v, ok := strings.Cut(value, ":")
+	if !ok {
+		return false
+	}
+
+	switch key {
+	case "user":
+		l.User = v
+	case "role":
+		l.Role = v
+	case "type":
+		l.Type = v
+	case "level":
+		l.Level = v
+	case "filetype":
+		l.FileType = v
+	default:
+		return false
+	}
+
+	return true
+}
+
+// parseSecurityBool parses the value of a boolean option, which is true
+// when given without a value.
+func parseSecurityBool(value string, hasValue bool) (bool, bool) {
+
+	if !hasValue {
+		return true, true
+	}
+
+	b, err := strconv.ParseBool(value)
+
+	return b, err == nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSecurityOptions(t *testing.T) {
+	tests := []struct {
+		note     string
+		body     string
+		expected *SecurityOptions
+	}{
+		{
+			note:     "none",
+			body:     `{"HostConfig": {}}`,
+			expected: &SecurityOptions{Seccomp: "default", Unknown: []string{}},
+		},
+		{
+			note: "all",
+			body: `{"HostConfig": {"SecurityOpt": [
+				"seccomp={\"defaultAction\": \"SCMP_ACT_ERRNO\"}",
+				"apparmor=docker-custom",
+				"label=type:svirt_apache_t",
+				"label=level:s0:c100,c200",
+				"no-new-privileges",
+				"systempaths=unconfined",
+				"writable-cgroups=true"
+			]}}`,
+			expected: &SecurityOptions{
+				Seccomp:         "custom",
+				AppArmor:        "docker-custom",
+				Label:           SELinuxLabel{Type: "svirt_apache_t", Level: "s0:c100,c200"},
+				NoNewPrivileges: true,
+				UnmaskedPaths:   true,
+				WritableCgroups: true,
+				Unknown:         []string{},
+			},
+		},
+		{
+			note: "legacy separators",
+			body: `{"HostConfig": {"SecurityOpt": ["seccomp:unconfined", "label:disable", "no-new-privileges:false"]}}`,
+			expected: &SecurityOptions{
+				Seccomp: "unconfined",
+				Label:   SELinuxLabel{Disable: true},
+				Unknown: []string{},
+			},
+		},
+		{
+			note: "unknown",
+			body: `{"HostConfig": {"SecurityOpt": ["label=kind:x", "no-new-privileges=maybe", "credentialspec=file://spec.json"]}}`,
+			expected: &SecurityOptions{
+				Seccomp: "default",
+				Unknown: []string{"label=kind:x", "no-new-privileges=maybe", "credentialspec=file://spec.json"},
+			},
+		},
+		{
+			note:     "privileged",
+			body:     `{"HostConfig": {"Privileged": true}}`,
+			expected: &SecurityOptions{Seccomp: "unconfined", Unknown: []string{}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			got := securityOptions("POST", "/v1.41/containers/create", body)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	if got := securityOptions("POST", "/v1.41/containers/abc/start", nil); got != nil {
+		t.Fatalf("Expected no security options, got %+v", got)
+	}
+}
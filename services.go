@@ -0,0 +1,79 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+)
+
+// ServiceFile is a swarm secret or config referenced by a service.
+type ServiceFile struct {
+	Name string
+	ID   string
+
+	// Target is the path of the file in the container, relative to
+	// /run/secrets for secrets. It is empty for configs used as runtime
+	// credential specs.
+	Target string `json:",omitempty"`
+	Mode   *int   `json:",omitempty"`
+}
+
+// serviceContainerSpec returns the container spec of service create and
+// update requests, or nil for any other request.
+func serviceContainerSpec(method, path string, body map[string]interface{}) map[string]interface{} {
+	spec, _ := serviceTaskTemplate(method, path, body)["ContainerSpec"].(map[string]interface{})
+	return spec
+}
+
+// serviceTaskTemplate returns the task template of service create and update
+// requests, or nil for any other request.
+func serviceTaskTemplate(method, path string, body map[string]interface{}) map[string]interface{} {
+
+	if method != "POST" {
+		return nil
+	}
+
+	parts := strings.Split(strings.Trim(trimAPIVersion(path), "/"), "/")
+	isCreate := len(parts) == 2 && parts[0] == "services" && parts[1] == "create"
+	isUpdate := len(parts) == 3 && parts[0] == "services" && parts[2] == "update"
+	if !isCreate && !isUpdate {
+		return nil
+	}
+
+	task, _ := body["TaskTemplate"].(map[string]interface{})
+	return task
+}
+
+// serviceFiles returns the secrets or configs, as given by key, referenced
+// by a service create or update request.
+func serviceFiles(spec map[string]interface{}, key string) []ServiceFile {
+
+	items, _ := spec[key].([]interface{})
+
+	result := []ServiceFile{}
+	for _, v := range items {
+		item, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		// The fields are named SecretName and SecretID, or ConfigName and
+		// ConfigID.
+		kind := strings.TrimSuffix(key, "s")
+		f := ServiceFile{}
+		f.Name, _ = item[kind+"Name"].(string)
+		f.ID, _ = item[kind+"ID"].(string)
+		if file, ok := item["File"].(map[string]interface{}); ok {
+			f.Target, _ = file["Name"].(string)
+			if mode, ok := file["Mode"].(float64); ok {
+				m := int(mode)
+				f.Mode = &m
+			}
+		}
+		result = append(result, f)
+	}
+
+	return result
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestServiceFiles(t *testing.T) {
+	body := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"Name": "web",
+		"TaskTemplate": {
+			"ContainerSpec": {
+				"Image": "nginx",
+				"Secrets": [
+					{"File": {"Name": "db_password", "UID": "0", "GID": "0", "Mode": 292}, "SecretID": "s1", "SecretName": "db_password"},
+					{"File": {"Name": "tls/key.pem"}, "SecretID": "s2", "SecretName": "web_tls_key"}
+				],
+				"Configs": [
+					{"File": {"Name": "/etc/nginx/nginx.conf"}, "ConfigID": "c1", "ConfigName": "nginx_conf"},
+					{"Runtime": {}, "ConfigID": "c2", "ConfigName": "credspec"}
+				]
+			}
+		}
+	}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/v1.41/services/create", "/v1.41/services/web/update"} {
+		spec := serviceContainerSpec("POST", path, body)
+		if spec == nil {
+			t.Fatalf("Expected container spec for %v", path)
+		}
+
+		mode := 292
+		expectedSecrets := []ServiceFile{
+			{Name: "db_password", ID: "s1", Target: "db_password", Mode: &mode},
+			{Name: "web_tls_key", ID: "s2", Target: "tls/key.pem"},
+		}
+		if secrets := serviceFiles(spec, "Secrets"); !reflect.DeepEqual(secrets, expectedSecrets) {
+			t.Errorf("Expected %+v, got %+v", expectedSecrets, secrets)
+		}
+
+		expectedConfigs := []ServiceFile{
+			{Name: "nginx_conf", ID: "c1", Target: "/etc/nginx/nginx.conf"},
+			{Name: "credspec", ID: "c2"},
+		}
+		if configs := serviceFiles(spec, "Configs"); !reflect.DeepEqual(configs, expectedConfigs) {
+			t.Errorf("Expected %+v, got %+v", expectedConfigs, configs)
+		}
+	}
+
+	if spec := serviceContainerSpec("POST", "/v1.41/containers/create", body); spec != nil {
+		t.Errorf("Expected no container spec, got %v", spec)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// shutdown runs the cleanup of the plugin, such as stopping the decision
+// sinks, which writes the final checkpoint of the audit log, and closing the
+// state store. The plugin handler serves until it is killed, so cleanup runs
+// both when main returns and when the plugin is asked to stop by a signal.
+type shutdown struct {
+	mu   sync.Mutex
+	fns  []func()
+	done bool
+}
+
+// add registers fn to run on shutdown. Functions run in the reverse order of
+// their registration, as deferred calls do.
+func (s *shutdown) add(fn func()) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fns = append(s.fns, fn)
+}
+
+// run runs the registered functions, once.
+func (s *shutdown) run() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return
+	}
+	s.done = true
+
+	for i := len(s.fns) - 1; i >= 0; i-- {
+		s.fns[i]()
+	}
+}
+
+// handleSignals runs the shutdown and exits on SIGINT or SIGTERM, which
+// docker sends to stop managed plugins and systemd to stop services.
+func (s *shutdown) handleSignals() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down.", sig)
+		s.run()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShutdown(t *testing.T) {
+
+	var ran []int
+	s := &shutdown{}
+	for i := 1; i <= 3; i++ {
+		i := i
+		s.add(func() { ran = append(ran, i) })
+	}
+
+	s.run()
+	s.run()
+
+	if expected := []int{3, 2, 1}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("Expected %v, got %v", expected, ran)
+	}
+}
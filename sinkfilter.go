@@ -0,0 +1,185 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// sinkFilter selects the decisions recorded by a sink. Every condition given
+// must hold, and the decisions selected are then sampled.
+type sinkFilter struct {
+	// Decisions is "allowed", "denied" or "all" (the default).
+	Decisions string `json:"decisions,omitempty"`
+
+	// Methods are the HTTP methods of the requests recorded.
+	Methods []string `json:"methods,omitempty"`
+
+	// Paths are regular expressions, one of which must match the path of the
+	// request, without its query.
+	Paths []string `json:"paths,omitempty"`
+
+	// Codes are the deny codes of the decisions recorded.
+	Codes []string `json:"codes,omitempty"`
+
+	// SampleRate is the fraction of the selected decisions recorded, from 0
+	// to 1 (the default).
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+
+	paths []*regexp.Regexp
+}
+
+type sinkFiltersConfig struct {
+	Sinks map[string]*sinkFilter `json:"sinks"`
+}
+
+// loadSinkFilters reads the filters of the decision sinks, keyed by sink
+// name, from the YAML or JSON file at path.
+func loadSinkFilters(path string) (map[string]*sinkFilter, error) {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg sinkFiltersConfig
+	if err := yaml.Unmarshal(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, f := range cfg.Sinks {
+		if f == nil {
+			return nil, fmt.Errorf("%s: sink %s: filter is empty", path, name)
+		}
+		if err := f.compile(); err != nil {
+			return nil, fmt.Errorf("%s: sink %s: %w", path, name, err)
+		}
+	}
+
+	return cfg.Sinks, nil
+}
+
+func (f *sinkFilter) compile() error {
+
+	switch f.Decisions {
+	case "", "all", "allowed", "denied":
+	default:
+		return fmt.Errorf("decisions must be all, allowed or denied, got %q", f.Decisions)
+	}
+
+	if f.SampleRate != nil && (*f.SampleRate < 0 || *f.SampleRate > 1) {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %v", *f.SampleRate)
+	}
+
+	for _, p := range f.Paths {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		f.paths = append(f.paths, re)
+	}
+
+	return nil
+}
+
+// applySinkFilters sets the filters of the sinks of the plugin, replacing
+// their default filters. Filters of sinks that are not enabled are rejected,
+// as they are likely misspelled.
+func (p *DockerAuthZPlugin) applySinkFilters(filters map[string]*sinkFilter) error {
+
+	enabled := map[string]bool{}
+	for i := range p.sinks {
+		enabled[p.sinks[i].name] = true
+		if f, ok := filters[p.sinks[i].name]; ok {
+			p.sinks[i].filter = f
+		}
+	}
+
+	var unknown []string
+	for name := range filters {
+		if !enabled[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("filters given for decision sinks that are not enabled: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// match reports whether the sink records event. Sampling is decided by the
+// decision ID, so that a decision is either recorded or skipped consistently.
+func (f *sinkFilter) match(event map[string]interface{}) bool {
+
+	if f == nil {
+		return true
+	}
+
+	allowed, _ := event["result"].(bool)
+	switch {
+	case f.Decisions == "allowed" && !allowed, f.Decisions == "denied" && allowed:
+		return false
+	}
+
+	input, _ := event["input"].(map[string]interface{})
+
+	if len(f.Methods) > 0 {
+		method, _ := input["Method"].(string)
+		if !containsFold(f.Methods, method) {
+			return false
+		}
+	}
+
+	if len(f.paths) > 0 {
+		path, _ := input["PathPlain"].(string)
+		matched := false
+		for _, re := range f.paths {
+			if re.MatchString(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.Codes) > 0 {
+		code, _ := event["code"].(string)
+		if !containsFold(f.Codes, code) {
+			return false
+		}
+	}
+
+	if f.SampleRate != nil && *f.SampleRate < 1 {
+		id, _ := event["decision_id"].(string)
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return float64(h.Sum32()) < *f.SampleRate*math.MaxUint32
+	}
+
+	return true
+}
+
+func containsFold(values []string, s string) bool {
+
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
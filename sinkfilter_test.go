@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSinkFilters(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "filters.yaml")
+	err := os.WriteFile(path, []byte(`sinks:
+  audit:
+    decisions: denied
+  fake:
+    methods: [post]
+    paths: ['^/v[\d.]+/containers/create$']
+    sample_rate: 0.5
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters, err := loadSinkFilters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit, fake := &fakeSink{}, &fakeSink{}
+	p := &DockerAuthZPlugin{sinks: []namedSink{{name: "audit", Sink: audit}, {name: "fake", Sink: fake}}}
+	if err := p.applySinkFilters(filters); err != nil {
+		t.Fatal(err)
+	}
+
+	event := func(id string, allowed bool, method, path string) map[string]interface{} {
+		return map[string]interface{}{
+			"decision_id": id,
+			"result":      allowed,
+			"input":       map[string]interface{}{"Method": method, "PathPlain": path},
+		}
+	}
+
+	p.recordEvent(event("a", true, "GET", "/v1.41/info"))
+	p.recordEvent(event("b", false, "GET", "/v1.41/info"))
+	if len(audit.events) != 1 || audit.events[0]["decision_id"] != "b" {
+		t.Fatalf("Expected the denied decision only, got %v", audit.events)
+	}
+	if len(fake.events) != 0 {
+		t.Fatalf("Expected no decision, got %v", fake.events)
+	}
+
+	for i := 0; i < 1000; i++ {
+		p.recordEvent(event(fmt.Sprintf("create-%d", i), true, "POST", "/v1.41/containers/create"))
+	}
+	if n := len(fake.events); n < 400 || n > 600 {
+		t.Fatalf("Expected about half of the decisions to be sampled, got %d", n)
+	}
+
+	// Sampling is decided by the decision ID.
+	if !p.sinks[1].filter.match(fake.events[0]) {
+		t.Fatal("Expected a sampled decision to be sampled again")
+	}
+
+	if err := p.applySinkFilters(map[string]*sinkFilter{"elasticsearch": {}}); err == nil {
+		t.Fatal("Expected filters of sinks that are not enabled to be rejected")
+	}
+
+	rate := 2.0
+	if err := (&sinkFilter{SampleRate: &rate}).compile(); err == nil {
+		t.Fatal("Expected an invalid sample rate to be rejected")
+	}
+}
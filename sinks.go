@@ -0,0 +1,130 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/open-policy-agent/opa-docker-authz/extension"
+)
+
+// namedSink is a sink of decision events, named in logs, which records the
+// events selected by its filter.
+type namedSink struct {
+	name string
+	extension.Sink
+	filter *sinkFilter
+}
+
+// batchingSink is implemented by the sinks batching decisions and sending
+// them on an interval.
+type batchingSink interface {
+	record(entry interface{})
+	start(ctx context.Context, interval time.Duration)
+	flush(ctx context.Context) error
+}
+
+// intervalSink adapts a batchingSink to the Sink interface.
+type intervalSink struct {
+	batchingSink
+	interval time.Duration
+}
+
+func (s intervalSink) Start(ctx context.Context) error {
+	s.start(ctx, s.interval)
+	return nil
+}
+
+func (s intervalSink) Record(event map[string]interface{}) error {
+	s.record(event)
+	return nil
+}
+
+func (s intervalSink) Flush(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+func (s intervalSink) Stop(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+// auditSink adapts the audit log to the Sink interface.
+type auditSink struct {
+	log *auditLog
+}
+
+func (s auditSink) Start(context.Context) error {
+	return nil
+}
+
+func (s auditSink) Record(event map[string]interface{}) error {
+	return s.log.record(event)
+}
+
+func (s auditSink) Flush(context.Context) error {
+
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	if f, ok := s.log.w.(*os.File); ok {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+func (s auditSink) Stop(context.Context) error {
+	return s.log.close()
+}
+
+// extensionSinks returns the sinks registered by extensions, in name order.
+func extensionSinks() []namedSink {
+
+	var result []namedSink
+	for _, name := range extension.Sinks() {
+		s, _ := extension.LookupSink(name)
+		result = append(result, namedSink{name: name, Sink: s})
+	}
+
+	return result
+}
+
+// startSinks starts the sinks of the plugin.
+func (p *DockerAuthZPlugin) startSinks(ctx context.Context) error {
+
+	for _, s := range p.sinks {
+		if err := s.Start(ctx); err != nil {
+			return fmt.Errorf("decision sink %s: %w", s.name, err)
+		}
+	}
+
+	return nil
+}
+
+// stopSinks stops the sinks of the plugin, sending the decisions they still
+// hold.
+func (p *DockerAuthZPlugin) stopSinks(ctx context.Context) {
+	for _, s := range p.sinks {
+		if err := s.Stop(ctx); err != nil {
+			log.Printf("Failed to stop decision sink %s: %v", s.name, err)
+		}
+	}
+}
+
+// recordEvent passes a decision event to every sink selecting it.
+func (p *DockerAuthZPlugin) recordEvent(event map[string]interface{}) {
+	for _, s := range p.sinks {
+		if !s.filter.match(event) {
+			continue
+		}
+		if err := s.Record(event); err != nil {
+			log.Printf("Failed to record decision in sink %s: %v", s.name, err)
+		}
+	}
+}
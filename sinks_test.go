@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+type fakeSink struct {
+	events  []map[string]interface{}
+	stopped bool
+}
+
+func (s *fakeSink) Start(context.Context) error { return nil }
+
+func (s *fakeSink) Record(event map[string]interface{}) error {
+	s.events = append(s.events, event)
+	return errors.New("ignored")
+}
+
+func (s *fakeSink) Flush(context.Context) error { return nil }
+
+func (s *fakeSink) Stop(context.Context) error {
+	s.stopped = true
+	return nil
+}
+
+func TestDecisionSinks(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeSink{}
+	p := &DockerAuthZPlugin{
+		history: newDecisionHistory(10),
+		sinks: []namedSink{
+			{name: "audit", Sink: auditSink{log: audit}},
+			{name: "fake", Sink: fake},
+		},
+	}
+	if err := p.startSinks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p.recordDecision(context.Background(), "abc", authorization.Request{User: "alice"}, map[string]interface{}{"User": "alice"}, decision{Code: "denied_user"}, nil)
+	p.stopSinks(context.Background())
+
+	if len(fake.events) != 1 || fake.events[0]["decision_id"] != "abc" || fake.events[0]["code"] != "denied_user" || !fake.stopped {
+		t.Fatalf("Expected decision to be passed to the sink before it is stopped, got %v", fake.events)
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), `"decision_id":"abc"`) {
+		t.Fatalf("Expected decision in audit log, got %s", bs)
+	}
+}
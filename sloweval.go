@@ -0,0 +1,162 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/metrics"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// slowEvalTopExprs is the number of expressions listed in slow evaluation
+// warnings when profiling is enabled.
+const slowEvalTopExprs = 10
+
+type evalStatsKey struct{}
+
+// evalStats collects the OPA metrics of an evaluation, and the time spent in
+// each expression of the policy when profiling is enabled, so that slow
+// evaluations can be reported.
+type evalStats struct {
+	metrics metrics.Metrics
+	profile *exprProfile
+}
+
+// withEvalStats returns a context collecting the statistics of the
+// evaluations run with it into s.
+func withEvalStats(ctx context.Context, s *evalStats) context.Context {
+	return context.WithValue(ctx, evalStatsKey{}, s)
+}
+
+// evalStatsOptions returns the options collecting the statistics of an
+// evaluation into the evalStats of ctx, if any.
+func evalStatsOptions(ctx context.Context) []func(*rego.Rego) {
+
+	s, _ := ctx.Value(evalStatsKey{}).(*evalStats)
+	if s == nil {
+		return nil
+	}
+
+	opts := []func(*rego.Rego){rego.Metrics(s.metrics)}
+	if s.profile != nil {
+		opts = append(opts, rego.QueryTracer(s.profile))
+	}
+
+	return opts
+}
+
+// exprProfile is a query tracer attributing the time between two trace events
+// to the expression of the first, as OPA's profiler does.
+type exprProfile struct {
+	exprs    map[string]*exprTiming
+	last     *exprTiming
+	lastTime time.Time
+}
+
+type exprTiming struct {
+	location string
+	text     string
+	time     time.Duration
+	evals    int
+}
+
+func newExprProfile() *exprProfile {
+	return &exprProfile{exprs: map[string]*exprTiming{}}
+}
+
+func (p *exprProfile) Enabled() bool {
+	return true
+}
+
+func (p *exprProfile) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{}
+}
+
+func (p *exprProfile) TraceEvent(e topdown.Event) {
+
+	now := time.Now()
+	if p.last != nil {
+		p.last.time += now.Sub(p.lastTime)
+	}
+	p.last, p.lastTime = nil, now
+
+	if e.Location == nil {
+		return
+	}
+
+	key := fmt.Sprintf("%s:%d:%d", e.Location.File, e.Location.Row, e.Location.Col)
+	t, ok := p.exprs[key]
+	if !ok {
+		t = &exprTiming{location: fmt.Sprintf("%s:%d", e.Location.File, e.Location.Row), text: string(e.Location.Text)}
+		p.exprs[key] = t
+	}
+	if e.Op == topdown.EvalOp {
+		t.evals++
+	}
+	p.last = t
+}
+
+// top returns the n expressions evaluation spent the most time in.
+func (p *exprProfile) top(n int) []*exprTiming {
+
+	result := make([]*exprTiming, 0, len(p.exprs))
+	for _, t := range p.exprs {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].time > result[j].time
+	})
+
+	if len(result) > n {
+		result = result[:n]
+	}
+
+	return result
+}
+
+// warnSlowEvaluation logs a request whose decision took longer than the
+// -slow-eval-threshold, with the statistics of its evaluation.
+func (p *DockerAuthZPlugin) warnSlowEvaluation(r authorization.Request, elapsed time.Duration, stats *evalStats) {
+
+	path := r.RequestURI
+	if u, err := url.Parse(r.RequestURI); err == nil {
+		path = u.Path
+	}
+
+	warning := map[string]interface{}{
+		"method":       r.RequestMethod,
+		"path":         path,
+		"user":         r.User,
+		"duration_ms":  float64(elapsed.Microseconds()) / 1000,
+		"threshold_ms": float64(p.slowEval.Microseconds()) / 1000,
+	}
+	if m := stats.metrics.All(); len(m) > 0 {
+		warning["metrics"] = m
+	}
+	if stats.profile != nil {
+		var exprs []map[string]interface{}
+		for _, t := range stats.profile.top(slowEvalTopExprs) {
+			exprs = append(exprs, map[string]interface{}{
+				"location": t.location,
+				"text":     t.text,
+				"time_ms":  float64(t.time.Microseconds()) / 1000,
+				"evals":    t.evals,
+			})
+		}
+		warning["expressions"] = exprs
+	}
+
+	bs, _ := json.Marshal(warning)
+	log.Printf("Slow policy evaluation: %s", bs)
+}
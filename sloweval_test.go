@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestSlowEvaluationWarning(t *testing.T) {
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(policyFile, []byte(`package docker.authz
+
+allow {
+	count([x | x := numbers.range(1, 100)[_]; y := numbers.range(1, 100)[_]; x == y]) == 100
+}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	p := &DockerAuthZPlugin{
+		policyFile:  policyFile,
+		allowPath:   "data.docker.authz.allow",
+		quiet:       true,
+		overlay:     newRuntimeOverlay(),
+		history:     newDecisionHistory(decisionHistorySize),
+		slowEval:    time.Nanosecond,
+		profileEval: true,
+	}
+
+	resp := p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/containers/json?all=1", User: "alice"})
+	if !resp.Allow {
+		t.Fatalf("Expected request to be allowed, got %+v", resp)
+	}
+
+	line := buf.String()
+	i := strings.Index(line, "Slow policy evaluation: ")
+	if i < 0 {
+		t.Fatalf("Expected slow evaluation warning, got %q", line)
+	}
+
+	var warning struct {
+		Method      string                 `json:"method"`
+		Path        string                 `json:"path"`
+		Metrics     map[string]interface{} `json:"metrics"`
+		Expressions []struct {
+			Location string `json:"location"`
+			Evals    int    `json:"evals"`
+		} `json:"expressions"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line[i+len("Slow policy evaluation: "):])), &warning); err != nil {
+		t.Fatal(err)
+	}
+
+	if warning.Method != "GET" || warning.Path != "/v1.41/containers/json" {
+		t.Errorf("Expected GET /v1.41/containers/json, got %v %v", warning.Method, warning.Path)
+	}
+	if _, ok := warning.Metrics["timer_rego_query_eval_ns"]; !ok {
+		t.Errorf("Expected evaluation timer in metrics, got %v", warning.Metrics)
+	}
+	if len(warning.Expressions) == 0 || !strings.HasPrefix(warning.Expressions[0].Location, policyFile+":") {
+		t.Errorf("Expected expressions of the policy, got %+v", warning.Expressions)
+	}
+}
+
+func TestSlowEvaluationThreshold(t *testing.T) {
+
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(policyFile, []byte(`package docker.authz
+
+allow = true`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	p := &DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		overlay:    newRuntimeOverlay(),
+		history:    newDecisionHistory(decisionHistorySize),
+		slowEval:   time.Hour,
+	}
+
+	if resp := p.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/info"}); !resp.Allow {
+		t.Fatalf("Expected request to be allowed, got %+v", resp)
+	}
+	if strings.Contains(buf.String(), "Slow policy evaluation") {
+		t.Fatalf("Expected no warning below the threshold, got %q", buf.String())
+	}
+}
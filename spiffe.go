@@ -0,0 +1,317 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SPIFFEIdentity is the input.spiffe document, holding the SPIFFE ID of the
+// X.509 SVID the client presented to the daemon.
+type SPIFFEIdentity struct {
+	ID          string `json:"id,omitempty"`
+	TrustDomain string `json:"trust_domain,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Verified    bool   `json:"verified"`
+
+	// Error is set when the client presented a certificate that is not a
+	// valid SVID.
+	Error string `json:"error,omitempty"`
+}
+
+// spiffeVerifier verifies X.509 SVIDs against the trust bundles of their
+// trust domains, as configured from files or fetched from the Workload API.
+type spiffeVerifier struct {
+	mu      sync.RWMutex
+	static  map[string]*x509.CertPool
+	fetched map[string]*x509.CertPool
+}
+
+func newSPIFFEVerifier() *spiffeVerifier {
+	return &spiffeVerifier{static: map[string]*x509.CertPool{}}
+}
+
+// setBundles replaces the fetched trust bundles, keyed by trust domain.
+func (v *spiffeVerifier) setBundles(bundles map[string][]*x509.Certificate) {
+
+	pools := make(map[string]*x509.CertPool, len(bundles))
+	for td, certs := range bundles {
+		pool := x509.NewCertPool()
+		for _, c := range certs {
+			pool.AddCert(c)
+		}
+		pools[td] = pool
+	}
+
+	v.mu.Lock()
+	v.fetched = pools
+	v.mu.Unlock()
+}
+
+// loadBundleFile adds the certificates of a PEM file as the trust bundle of
+// trustDomain.
+func (v *spiffeVerifier) loadBundleFile(trustDomain, path string) error {
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+
+	v.mu.Lock()
+	v.static[trustDomain] = pool
+	v.mu.Unlock()
+
+	return nil
+}
+
+// identify returns the SPIFFE identity of the peer certificates of a request,
+// or nil when the client did not present a certificate.
+func (v *spiffeVerifier) identify(certs []*authorization.PeerCertificate) *SPIFFEIdentity {
+
+	if v == nil || len(certs) == 0 {
+		return nil
+	}
+
+	id := &SPIFFEIdentity{}
+	if err := v.verify(certs, id); err != nil {
+		id.Error = err.Error()
+	}
+
+	return id
+}
+
+func (v *spiffeVerifier) verify(certs []*authorization.PeerCertificate, id *SPIFFEIdentity) error {
+
+	leaf := (*x509.Certificate)(certs[0])
+
+	if len(leaf.URIs) != 1 || leaf.URIs[0].Scheme != "spiffe" {
+		return errors.New("certificate is not an X.509 SVID: expected exactly one spiffe URI SAN")
+	}
+
+	u := leaf.URIs[0]
+	id.ID, id.TrustDomain, id.Path = u.String(), u.Host, u.Path
+
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" || u.Port() != "" {
+		return fmt.Errorf("invalid SPIFFE ID %q", u)
+	}
+
+	if leaf.IsCA {
+		return errors.New("X.509 SVID must not be a CA certificate")
+	}
+
+	v.mu.RLock()
+	roots := v.fetched[u.Host]
+	if roots == nil {
+		roots = v.static[u.Host]
+	}
+	v.mu.RUnlock()
+
+	if roots == nil {
+		return fmt.Errorf("no trust bundle for trust domain %q", u.Host)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert((*x509.Certificate)(c))
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+
+	id.Verified = true
+	return nil
+}
+
+// rawCodec passes pre-encoded protobuf messages through gRPC, so that the
+// Workload API can be called without generated stubs.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *(v.(*[]byte)), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+// workloadAPIClient is a client of the SPIFFE Workload API, served by e.g. the
+// SPIRE agent on a unix socket.
+type workloadAPIClient struct {
+	target string
+}
+
+// newWorkloadAPIClient returns a client for the socket address addr, given as
+// unix:///path/to/socket.
+func newWorkloadAPIClient(addr string) (*workloadAPIClient, error) {
+
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "unix" || u.Path == "" {
+		return nil, fmt.Errorf("invalid workload API address %q, expected unix:///path", addr)
+	}
+
+	return &workloadAPIClient{target: "unix://" + u.Path}, nil
+}
+
+// stream calls a server streaming method of the Workload API with an empty
+// request, passing each response to fn until ctx is done or the stream ends.
+func (c *workloadAPIClient) stream(ctx context.Context, method string, fn func([]byte) error) error {
+
+	conn, err := grpc.DialContext(ctx, c.target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+
+	s, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+
+	req := []byte{}
+	if err := s.SendMsg(&req); err != nil {
+		return err
+	}
+	if err := s.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var resp []byte
+		if err := s.RecvMsg(&resp); err != nil {
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// watchBundles keeps the trust bundles of v up to date with the
+// FetchX509Bundles stream, reconnecting after failures.
+func (c *workloadAPIClient) watchBundles(ctx context.Context, v *spiffeVerifier) {
+
+	for {
+		err := c.stream(ctx, "/SpiffeWorkloadAPI/FetchX509Bundles", func(resp []byte) error {
+			bundles, err := parseX509BundlesResponse(resp)
+			if err != nil {
+				return err
+			}
+			v.setBundles(bundles)
+			return nil
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			log.Printf("SPIFFE Workload API bundle stream ended, reconnecting: %v", err)
+		}
+	}
+}
+
+// parseX509BundlesResponse decodes an X509BundlesResponse, whose field 2 maps
+// trust domain names to their DER encoded certificates.
+func parseX509BundlesResponse(bs []byte) (map[string][]*x509.Certificate, error) {
+
+	bundles := map[string][]*x509.Certificate{}
+
+	err := forEachField(bs, func(num protowire.Number, v []byte) error {
+		if num != 2 {
+			return nil
+		}
+
+		var td string
+		var der []byte
+		err := forEachField(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				td = string(v)
+			case 2:
+				der = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		certs, err := x509.ParseCertificates(der)
+		if err != nil {
+			return fmt.Errorf("trust bundle of %s: %w", td, err)
+		}
+
+		bundles[strings.TrimPrefix(td, "spiffe://")] = certs
+		return nil
+	})
+
+	return bundles, err
+}
+
+// forEachField calls fn with each length-delimited field of a protobuf
+// message, skipping fields of other wire types.
+func forEachField(bs []byte, fn func(protowire.Number, []byte) error) error {
+
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		bs = bs[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, bs)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			bs = bs[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(bs)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		bs = bs[n:]
+
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testCertificate(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testSVID(t *testing.T, id string) (*x509.Certificate, *x509.Certificate) {
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	u, _ := url.Parse(id)
+	leaf, _ := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{u},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	return ca, leaf
+}
+
+func TestSPIFFEWorkloadAPI(t *testing.T) {
+	ca, leaf := testSVID(t, "spiffe://example.org/ns/ci/sa/runner")
+	_, foreign := testSVID(t, "spiffe://example.org/ns/ci/sa/other")
+
+	// X509BundlesResponse{bundles: {"spiffe://example.org": ca}}
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, "spiffe://example.org")
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, ca.Raw)
+	var resp []byte
+	resp = protowire.AppendTag(resp, 2, protowire.BytesType)
+	resp = protowire.AppendBytes(resp, entry)
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != "/SpiffeWorkloadAPI/FetchX509Bundles" {
+			t.Errorf("Unexpected method %v", method)
+		}
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if len(md.Get("workload.spiffe.io")) == 0 {
+			t.Errorf("Expected workload.spiffe.io metadata")
+		}
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		if err := stream.SendMsg(&resp); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}))
+	go func() { _ = server.Serve(l) }()
+	defer server.Stop()
+
+	client, err := newWorkloadAPIClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	v := newSPIFFEVerifier()
+	go client.watchBundles(ctx, v)
+
+	var id *SPIFFEIdentity
+	for i := 0; i < 100; i++ {
+		id = v.identify([]*authorization.PeerCertificate{(*authorization.PeerCertificate)(leaf)})
+		if id.Verified {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	expected := SPIFFEIdentity{ID: "spiffe://example.org/ns/ci/sa/runner", TrustDomain: "example.org", Path: "/ns/ci/sa/runner", Verified: true}
+	if *id != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, *id)
+	}
+
+	// An SVID of the same trust domain signed by another CA is rejected.
+	id = v.identify([]*authorization.PeerCertificate{(*authorization.PeerCertificate)(foreign)})
+	if id.Verified || id.Error == "" {
+		t.Errorf("Expected verification error, got %+v", *id)
+	}
+
+	// Requests without client certificates have no SPIFFE identity.
+	if id := v.identify(nil); id != nil {
+		t.Errorf("Expected no identity, got %+v", *id)
+	}
+
+	// Certificates without a SPIFFE ID are reported as errors.
+	id = v.identify([]*authorization.PeerCertificate{(*authorization.PeerCertificate)(ca)})
+	if id.Verified || id.Error == "" {
+		t.Errorf("Expected verification error, got %+v", *id)
+	}
+}
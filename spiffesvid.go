@@ -0,0 +1,190 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// svidFetchTimeout bounds the wait for the first SVID at startup.
+const svidFetchTimeout = 30 * time.Second
+
+// pluginSVID, set by -spiffe-svid, is the X.509 SVID the plugin presents as
+// client certificate to the services it connects to without one configured.
+var pluginSVID *workloadSVID
+
+// workloadSVID holds the X.509 SVID of the plugin fetched from the Workload
+// API, replaced whenever the agent rotates it, so that no long-lived
+// certificate and key files are kept on the host.
+type workloadSVID struct {
+	// id, when set, selects the SVID of the plugin among those of the
+	// workload. The first one is used otherwise.
+	id string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	ready chan struct{}
+}
+
+func newWorkloadSVID(id string) *workloadSVID {
+	return &workloadSVID{id: id, ready: make(chan struct{})}
+}
+
+// certificate returns the current SVID, nil until the first one is fetched.
+func (s *workloadSVID) certificate() *tls.Certificate {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert
+}
+
+// set replaces the SVID. In FIPS mode, SVIDs whose key is not FIPS approved
+// are rejected.
+func (s *workloadSVID) set(cert *tls.Certificate) error {
+
+	if fipsMode {
+		if err := checkFIPSKey(cert.Leaf.PublicKey); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	first := s.cert == nil
+	s.cert = cert
+	s.mu.Unlock()
+
+	if first {
+		close(s.ready)
+	}
+
+	return nil
+}
+
+// wait blocks until the first SVID is fetched, or ctx is done.
+func (s *workloadSVID) wait(ctx context.Context) error {
+
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no X.509 SVID fetched from the SPIFFE Workload API: %w", ctx.Err())
+	}
+}
+
+// watchSVIDs keeps s up to date with the FetchX509SVID stream, reconnecting
+// after failures.
+func (c *workloadAPIClient) watchSVIDs(ctx context.Context, s *workloadSVID) {
+
+	for {
+		err := c.stream(ctx, "/SpiffeWorkloadAPI/FetchX509SVID", func(resp []byte) error {
+			cert, err := parseX509SVIDResponse(resp, s.id)
+			if err != nil {
+				return err
+			}
+			if err := s.set(cert); err != nil {
+				log.Printf("Rejected X.509 SVID %s: %v", cert.Leaf.URIs[0], err)
+				return nil
+			}
+			log.Printf("Fetched X.509 SVID %s, valid until %v.", cert.Leaf.URIs[0], cert.Leaf.NotAfter)
+			return nil
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+			log.Printf("SPIFFE Workload API SVID stream ended, reconnecting: %v", err)
+		}
+	}
+}
+
+// parseX509SVIDResponse decodes the SVID with the SPIFFE ID id, or the first
+// one when id is empty, of an X509SVIDResponse, whose field 1 lists the SVIDs
+// of the workload: their SPIFFE ID, DER encoded certificate chain and PKCS #8
+// private key.
+func parseX509SVIDResponse(bs []byte, id string) (*tls.Certificate, error) {
+
+	var found bool
+	var chain, key []byte
+
+	err := forEachField(bs, func(num protowire.Number, v []byte) error {
+		if num != 1 || found {
+			return nil
+		}
+
+		var svidID string
+		var svidChain, svidKey []byte
+		err := forEachField(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				svidID = string(v)
+			case 2:
+				svidChain = v
+			case 3:
+				svidKey = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if id == "" || svidID == id {
+			found, chain, key = true, svidChain, svidKey
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		if id != "" {
+			return nil, fmt.Errorf("no X.509 SVID for %s", id)
+		}
+		return nil, errors.New("no X.509 SVID")
+	}
+
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty X.509 SVID")
+	}
+	if len(certs[0].URIs) != 1 || certs[0].URIs[0].Scheme != "spiffe" {
+		return nil, errors.New("certificate is not an X.509 SVID: expected exactly one spiffe URI SAN")
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported X.509 SVID key %T", priv)
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(certs[0].PublicKey) {
+		return nil, errors.New("the X.509 SVID key does not match its certificate")
+	}
+
+	cert := &tls.Certificate{PrivateKey: signer, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testSVIDResponse returns an X509SVIDResponse holding an SVID for each of
+// ids, issued by a new CA, and the CA.
+func testSVIDResponse(t *testing.T, serial int64, ids ...string) ([]byte, *x509.Certificate) {
+
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	var resp []byte
+	for i, id := range ids {
+		u, _ := url.Parse(id)
+		leaf, key := testCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial*100 + int64(i)),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			URIs:         []*url.URL{u},
+			DNSNames:     []string{"localhost"},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var svid []byte
+		svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+		svid = protowire.AppendString(svid, id)
+		svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+		svid = protowire.AppendBytes(svid, append(append([]byte(nil), leaf.Raw...), ca.Raw...))
+		svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+		svid = protowire.AppendBytes(svid, der)
+		svid = protowire.AppendTag(svid, 4, protowire.BytesType)
+		svid = protowire.AppendBytes(svid, ca.Raw)
+
+		resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+		resp = protowire.AppendBytes(resp, svid)
+	}
+
+	return resp, ca
+}
+
+func TestParseX509SVIDResponse(t *testing.T) {
+
+	resp, _ := testSVIDResponse(t, 1, "spiffe://example.org/docker/authz", "spiffe://example.org/docker/other")
+
+	cert, err := parseX509SVIDResponse(resp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := cert.Leaf.URIs[0].String(); id != "spiffe://example.org/docker/authz" {
+		t.Fatalf("Expected the first SVID, got %v", id)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("Expected the chain of the SVID, got %d certificates", len(cert.Certificate))
+	}
+
+	cert, err = parseX509SVIDResponse(resp, "spiffe://example.org/docker/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := cert.Leaf.URIs[0].String(); id != "spiffe://example.org/docker/other" {
+		t.Fatalf("Expected the selected SVID, got %v", id)
+	}
+
+	if _, err := parseX509SVIDResponse(resp, "spiffe://example.org/missing"); err == nil {
+		t.Fatal("Expected an error for a missing SVID")
+	}
+}
+
+func TestWorkloadSVID(t *testing.T) {
+
+	first, firstCA := testSVIDResponse(t, 1, "spiffe://example.org/docker/authz")
+	second, secondCA := testSVIDResponse(t, 2, "spiffe://example.org/docker/authz")
+
+	rotate := make(chan struct{})
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		if method != "/SpiffeWorkloadAPI/FetchX509SVID" {
+			t.Errorf("Unexpected method %v", method)
+		}
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		if err := stream.SendMsg(&first); err != nil {
+			return err
+		}
+		select {
+		case <-rotate:
+			if err := stream.SendMsg(&second); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}))
+	go func() { _ = server.Serve(l) }()
+	defer server.Stop()
+
+	client, err := newWorkloadAPIClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svid := newWorkloadSVID("")
+	go client.watchSVIDs(ctx, svid)
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := svid.wait(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := newSVIDTLSFiles(svid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", files.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	served := func() *x509.Certificate {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[1]
+	}
+
+	if ca := served(); !ca.Equal(firstCA) {
+		t.Fatal("Expected the first SVID to be served")
+	}
+
+	close(rotate)
+	for i := 0; i < 100 && !served().Equal(secondCA); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if ca := served(); !ca.Equal(secondCA) {
+		t.Fatal("Expected the rotated SVID to be served")
+	}
+}
+
+func TestClientTLSConfigSVID(t *testing.T) {
+
+	resp, _ := testSVIDResponse(t, 1, "spiffe://example.org/docker/authz")
+	cert, err := parseX509SVIDResponse(resp, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svid := newWorkloadSVID("")
+	if err := svid.set(cert); err != nil {
+		t.Fatal(err)
+	}
+	pluginSVID = svid
+	defer func() { pluginSVID = nil }()
+
+	var presented string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			presented = r.TLS.PeerCertificates[0].URIs[0].String()
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	transport, err := clientTransport("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = true
+
+	res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if presented != "spiffe://example.org/docker/authz" {
+		t.Fatalf("Expected the SVID to be presented, got %q", presented)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// splunkRetries is the number of times a batch is resent to the HTTP Event
+// Collector within a flush before it is left for the next one.
+const splunkRetries = 3
+
+// splunkEvent is the envelope of an event sent to the HTTP Event Collector.
+type splunkEvent struct {
+	Time       float64     `json:"time"`
+	Host       string      `json:"host"`
+	Source     string      `json:"source"`
+	Sourcetype string      `json:"sourcetype"`
+	Index      string      `json:"index,omitempty"`
+	Event      interface{} `json:"event"`
+}
+
+// splunkSink batches decision records and sends them to a Splunk HTTP Event
+// Collector.
+type splunkSink struct {
+	client     *http.Client
+	endpoint   string
+	token      string
+	index      string
+	sourcetype string
+	host       string
+	backoff    time.Duration
+	batch      decisionBatch
+}
+
+// newSplunkSink returns a sink sending events to the collector at endpoint,
+// e.g. https://splunk.example.com:8088. The event endpoint is appended unless
+// endpoint already names it. The TLS configuration of the collector is given
+// by caFile, certFile and keyFile, as for clientTLSConfig.
+func newSplunkSink(endpoint, token, index, sourcetype, caFile, certFile, keyFile string) (*splunkSink, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported Splunk HEC URL %q", endpoint)
+	}
+	if !strings.HasPrefix(u.Path, "/services/collector") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/services/collector/event"
+	}
+
+	transport, err := clientTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &splunkSink{
+		client:     &http.Client{Transport: transport, Timeout: time.Minute},
+		endpoint:   u.String(),
+		token:      token,
+		index:      index,
+		sourcetype: sourcetype,
+		host:       host,
+		backoff:    time.Second,
+		batch:      decisionBatch{name: "Splunk"},
+	}, nil
+}
+
+// record adds entry to the next batch.
+func (s *splunkSink) record(entry interface{}) {
+
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+	bs, err := json.Marshal(splunkEvent{
+		Time:       float64(now.UnixNano()) / float64(time.Second),
+		Host:       s.host,
+		Source:     "opa-docker-authz",
+		Sourcetype: s.sourcetype,
+		Index:      s.index,
+		Event:      entry,
+	})
+	if err != nil {
+		log.Printf("Failed to encode decision for Splunk: %v", err)
+		return
+	}
+
+	s.batch.add(bs)
+}
+
+// start sends the batch on every interval until ctx is done.
+func (s *splunkSink) start(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, "Splunk", interval, s.flush)
+}
+
+// flush sends the pending decisions in a single request, retrying with
+// exponential backoff while the collector is unavailable or overloaded. When
+// every attempt fails, the decisions are kept for the next flush.
+func (s *splunkSink) flush(ctx context.Context) error {
+
+	if s == nil {
+		return nil
+	}
+
+	batch := s.batch.take()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body := bytes.Join(batch, []byte{'\n'})
+	backoff := s.backoff
+
+	var err error
+	for attempt := 0; attempt < splunkRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				s.batch.requeue(batch)
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var retry bool
+		if retry, err = s.send(ctx, body); err == nil || !retry {
+			break
+		}
+	}
+
+	if err != nil {
+		s.batch.requeue(batch)
+	}
+
+	return err
+}
+
+// send posts body to the collector, reporting whether a failure may be
+// resolved by sending it again.
+func (s *splunkSink) send(ctx context.Context, body []byte) (bool, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	var result struct {
+		Text string `json:"text"`
+		Code int    `json:"code"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	err = fmt.Errorf("POST %s: %s (%s)", req.URL.Path, resp.Status, result.Text)
+
+	// Authentication and format errors are not resolved by retrying, but the
+	// batch is still kept in case the token is fixed on the collector side.
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, err
+}
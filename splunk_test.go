@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplunkSinkFlush(t *testing.T) {
+
+	var events []splunkEvent
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/collector/event" || r.Header.Get("Authorization") != "Splunk secret" {
+			t.Errorf("Unexpected request %v %v", r.URL.Path, r.Header)
+		}
+		status := statuses[0]
+		statuses = statuses[1:]
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte(`{"text":"Server is busy","code":9}`))
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		for {
+			var e splunkEvent
+			if err := dec.Decode(&e); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, e)
+		}
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer srv.Close()
+
+	s, err := newSplunkSink(srv.URL, "secret", "security", "_json", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.backoff = time.Millisecond
+
+	s.record(map[string]interface{}{"decision_id": "1"})
+	s.record(map[string]interface{}{"decision_id": "2"})
+
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %v", events)
+	}
+	for i, e := range events {
+		if e.Index != "security" || e.Sourcetype != "_json" || e.Source != "opa-docker-authz" || e.Time == 0 {
+			t.Fatalf("Unexpected event envelope %+v", e)
+		}
+		if id := e.Event.(map[string]interface{})["decision_id"]; id != string(rune('1'+i)) {
+			t.Fatalf("Expected decision %v, got %v", i+1, id)
+		}
+	}
+}
+
+func TestSplunkSinkRetry(t *testing.T) {
+
+	tests := map[string]struct {
+		status   int
+		attempts int
+	}{
+		"unavailable":  {http.StatusServiceUnavailable, splunkRetries},
+		"throttled":    {http.StatusTooManyRequests, splunkRetries},
+		"unauthorized": {http.StatusForbidden, 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				w.WriteHeader(tc.status)
+				w.Write([]byte(`{"text":"failed","code":4}`))
+			}))
+			defer srv.Close()
+
+			s, err := newSplunkSink(srv.URL+"/services/collector/event", "secret", "", "_json", "", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.backoff = time.Millisecond
+
+			s.record(map[string]interface{}{"decision_id": "1"})
+			if err := s.flush(context.Background()); err == nil || !strings.Contains(err.Error(), "failed") {
+				t.Fatalf("Expected an error, got %v", err)
+			}
+			if attempts != tc.attempts {
+				t.Fatalf("Expected %v attempts, got %v", tc.attempts, attempts)
+			}
+			if n := len(s.batch.take()); n != 1 {
+				t.Fatalf("Expected the decision to be kept, got %v", n)
+			}
+		})
+	}
+}
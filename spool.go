@@ -0,0 +1,257 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultSpoolMaxBytes bounds the size of the spool of each sink unless
+	// -decision-spool-max-bytes is given.
+	defaultSpoolMaxBytes = 256 << 20
+
+	// spoolSegmentItems and spoolSegmentBytes bound the segments of a spool,
+	// which are read and removed as a whole.
+	spoolSegmentItems = 1000
+	spoolSegmentBytes = 4 << 20
+
+	// spoolTakeItems bounds the number of spooled decisions sent in a flush.
+	spoolTakeItems = 5000
+
+	// maxSpoolItemSize bounds the size of a spooled decision, beyond which a
+	// segment is considered corrupt.
+	maxSpoolItemSize = 64 << 20
+)
+
+// decisionSpool keeps the decisions of a sink on disk while its destination
+// is unreachable, so that they survive network partitions and restarts. The
+// decisions are appended to segment files, read back in order once the
+// destination recovers, and removed once they have been sent. When the spool
+// exceeds its size, the oldest segments are dropped.
+type decisionSpool struct {
+	dir      string
+	maxBytes int64
+
+	segments []*spoolSegment
+	tail     *os.File
+	next     int
+	size     int64
+	inflight int
+}
+
+// spoolSegment is a file of length-prefixed decisions.
+type spoolSegment struct {
+	path  string
+	items int
+	size  int64
+}
+
+// openDecisionSpool opens the spool in dir, picking up the decisions left
+// by a previous run.
+func openDecisionSpool(dir string, maxBytes int64) (*decisionSpool, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	s := &decisionSpool{dir: dir, maxBytes: maxBytes}
+	for _, path := range paths {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".spool"))
+		if err != nil {
+			continue
+		}
+		items, err := readSpoolSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &spoolSegment{path: path, items: len(items), size: info.Size()})
+		s.size += info.Size()
+		s.next = n + 1
+	}
+
+	return s, nil
+}
+
+// empty reports whether the spool holds no decisions.
+func (s *decisionSpool) empty() bool {
+	return len(s.segments) == 0
+}
+
+// write appends items to the spool, returning the number of decisions
+// dropped to keep the spool within its size.
+func (s *decisionSpool) write(items [][]byte) (int, error) {
+
+	for _, item := range items {
+		seg := s.tailSegment()
+		if s.tail == nil || seg.items >= spoolSegmentItems || seg.size >= spoolSegmentBytes {
+			if err := s.rotate(); err != nil {
+				return 0, err
+			}
+			seg = s.tailSegment()
+		}
+		record := binary.AppendUvarint(nil, uint64(len(item)))
+		record = append(record, item...)
+		if _, err := s.tail.Write(record); err != nil {
+			return 0, err
+		}
+		seg.items++
+		seg.size += int64(len(record))
+		s.size += int64(len(record))
+	}
+
+	return s.trim()
+}
+
+// take returns the oldest spooled decisions, up to spoolTakeItems. They stay
+// in the spool until release is called.
+func (s *decisionSpool) take() ([][]byte, error) {
+
+	var items [][]byte
+	s.inflight = 0
+	for _, seg := range s.segments {
+		if len(items) > 0 && len(items)+seg.items > spoolTakeItems {
+			break
+		}
+		if s.tail != nil && seg == s.tailSegment() {
+			if err := s.closeTail(); err != nil {
+				return nil, err
+			}
+		}
+		segItems, err := readSpoolSegment(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, segItems...)
+		s.inflight++
+	}
+
+	return items, nil
+}
+
+// release removes the segments returned by the last take, once they have
+// been sent.
+func (s *decisionSpool) release() error {
+
+	for _, seg := range s.segments[:s.inflight] {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.size -= seg.size
+	}
+	s.segments = s.segments[s.inflight:]
+	s.inflight = 0
+
+	return nil
+}
+
+// retain keeps the segments returned by the last take, which could not be
+// sent, to be taken again.
+func (s *decisionSpool) retain() {
+	s.inflight = 0
+}
+
+func (s *decisionSpool) tailSegment() *spoolSegment {
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate starts a new segment.
+func (s *decisionSpool) rotate() error {
+
+	if err := s.closeTail(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.spool", s.next))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.next++
+	s.tail = f
+	s.segments = append(s.segments, &spoolSegment{path: path})
+
+	return nil
+}
+
+func (s *decisionSpool) closeTail() error {
+
+	if s.tail == nil {
+		return nil
+	}
+
+	err := s.tail.Close()
+	s.tail = nil
+
+	return err
+}
+
+// trim drops the oldest segments not taken while the spool exceeds its
+// size, returning the number of decisions dropped.
+func (s *decisionSpool) trim() (int, error) {
+
+	dropped := 0
+	for s.size > s.maxBytes && len(s.segments) > s.inflight+1 {
+		seg := s.segments[s.inflight]
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return dropped, err
+		}
+		s.size -= seg.size
+		dropped += seg.items
+		s.segments = append(s.segments[:s.inflight], s.segments[s.inflight+1:]...)
+	}
+
+	return dropped, nil
+}
+
+// readSpoolSegment reads the decisions of a segment. A record truncated by a
+// crash ends the segment.
+func readSpoolSegment(path string) ([][]byte, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var items [][]byte
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > maxSpoolItemSize {
+			break
+		}
+		item := make([]byte, n)
+		if _, err := io.ReadFull(r, item); err != nil {
+			break
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
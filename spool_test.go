@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecisionBatchSpool(t *testing.T) {
+
+	dir := t.TempDir()
+	b := decisionBatch{name: "test"}
+	if err := b.spoolTo(dir, defaultSpoolMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	strs := func(items [][]byte) []string {
+		result := []string{}
+		for _, item := range items {
+			result = append(result, string(item))
+		}
+		return result
+	}
+
+	b.add([]byte("a"))
+	b.add([]byte("b"))
+	batch := b.take()
+	b.add([]byte("c"))
+
+	// The destination is unreachable: everything pending is spooled, and
+	// decisions made meanwhile follow.
+	b.requeue(batch)
+	b.add([]byte("d"))
+	if len(b.items) != 0 {
+		t.Fatalf("Expected no decisions in memory, got %v", strs(b.items))
+	}
+
+	batch = b.take()
+	if expected := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(strs(batch), expected) {
+		t.Fatalf("Expected %v, got %v", expected, strs(batch))
+	}
+	b.add([]byte("e"))
+	b.requeue(batch)
+
+	// A restart picks up the spooled decisions.
+	b = decisionBatch{name: "test"}
+	if err := b.spoolTo(dir, defaultSpoolMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+	batch = b.take()
+	if expected := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(strs(batch), expected) {
+		t.Fatalf("Expected %v, got %v", expected, strs(batch))
+	}
+
+	// Once sent, the spool is drained and decisions are kept in memory again.
+	if batch = b.take(); len(batch) != 0 {
+		t.Fatalf("Expected the spool to be drained, got %v", strs(batch))
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*.spool")); len(paths) != 0 {
+		t.Fatalf("Expected spool segments to be removed, got %v", paths)
+	}
+	b.add([]byte("f"))
+	if expected := []string{"f"}; !reflect.DeepEqual(strs(b.items), expected) {
+		t.Fatalf("Expected %v in memory, got %v", expected, strs(b.items))
+	}
+}
+
+func TestDecisionSpoolLimit(t *testing.T) {
+
+	dir := t.TempDir()
+	s, err := openDecisionSpool(dir, 10*spoolSegmentItems)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items [][]byte
+	for i := 0; i < 3*spoolSegmentItems; i++ {
+		items = append(items, []byte(fmt.Sprintf("%09d", i)))
+	}
+
+	dropped, err := s.write(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 2*spoolSegmentItems {
+		t.Fatalf("Expected %d decisions dropped, got %d", 2*spoolSegmentItems, dropped)
+	}
+
+	taken, err := s.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(taken) != spoolSegmentItems || string(taken[0]) != fmt.Sprintf("%09d", 2*spoolSegmentItems) {
+		t.Fatalf("Expected the newest segment to be kept, got %d decisions from %s", len(taken), taken[0])
+	}
+
+	// A record truncated by a crash ends its segment.
+	path := filepath.Join(dir, fmt.Sprintf("%020d.spool", s.next))
+	if err := os.WriteFile(path, []byte{1, 'x', 5, 'y'}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := readSpoolSegment(path); len(items) != 1 || string(items[0]) != "x" {
+		t.Fatalf("Expected the complete record only, got %q", items)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+)
+
+// stalenessConfig sets when bundles are reported stale: when the active
+// revision has lagged behind the latest one landed, or the bundle servers
+// have not answered, for longer than WarnAfter. Zero disables the warnings.
+type stalenessConfig struct {
+	WarnAfter duration `json:"warn_after,omitempty"`
+}
+
+func (c *stalenessConfig) validate() error {
+
+	if c.WarnAfter < 0 {
+		return fmt.Errorf("staleness warn_after must not be negative")
+	}
+
+	return nil
+}
+
+// bundleStaleness is the staleness of a bundle.
+type bundleStaleness struct {
+	Bundle         string
+	ActiveRevision string
+	LatestRevision string
+
+	// Lag is how long the latest revision has been held back, or zero when
+	// it is active.
+	Lag time.Duration
+
+	// SinceRequest is how long ago the bundle server last answered, or
+	// zero when it has not been polled yet.
+	SinceRequest time.Duration
+
+	Stale bool
+}
+
+// bundleStalenesses returns the staleness of the bundles of the active and
+// latest revisions, and of those the bundle plugin reports, at now.
+func bundleStalenesses(cfg stalenessConfig, active, latest *revision, statuses map[string]*bundlePlugin.Status, now time.Time) []bundleStaleness {
+
+	names := map[string]bool{}
+	for _, rev := range []*revision{active, latest} {
+		if rev != nil {
+			for name := range rev.bundles {
+				names[name] = true
+			}
+		}
+	}
+	for name := range statuses {
+		names[name] = true
+	}
+
+	result := make([]bundleStaleness, 0, len(names))
+	for _, name := range sortedSet(names) {
+		s := bundleStaleness{Bundle: name}
+		if active != nil {
+			s.ActiveRevision = active.bundles[name]
+		}
+		if latest != nil {
+			s.LatestRevision = latest.bundles[name]
+			if latest != active && s.LatestRevision != s.ActiveRevision {
+				s.Lag = now.Sub(latest.landed)
+			}
+		}
+
+		if status := statuses[name]; status != nil {
+			last := status.LastSuccessfulRequest
+			if status.LastSuccessfulDownload.After(last) {
+				last = status.LastSuccessfulDownload
+			}
+			if !last.IsZero() {
+				s.SinceRequest = now.Sub(last)
+			}
+		}
+
+		warnAfter := time.Duration(cfg.WarnAfter)
+		s.Stale = warnAfter > 0 && (s.Lag > warnAfter || s.SinceRequest > warnAfter)
+
+		result = append(result, s)
+	}
+
+	return result
+}
+
+// reason describes why the bundle is stale.
+func (s bundleStaleness) reason(warnAfter time.Duration) string {
+
+	var reasons []string
+	if s.Lag > warnAfter {
+		reasons = append(reasons, fmt.Sprintf("revision %q has been held back for %v, %q remains active", s.LatestRevision, s.Lag.Round(time.Second), s.ActiveRevision))
+	}
+	if s.SinceRequest > warnAfter {
+		reasons = append(reasons, fmt.Sprintf("the bundle server last answered %v ago", s.SinceRequest.Round(time.Second)))
+	}
+
+	return strings.Join(reasons, ", and ")
+}
+
+// trackBundleStatus keeps the statuses the bundle plugin reports, if enabled,
+// alerts on the bundles failing repeatedly and fails them over.
+func (t *revisionTracker) trackBundleStatus() {
+
+	p := bundlePlugin.Lookup(t.manager)
+	if p == nil {
+		return
+	}
+
+	p.RegisterBulkListener(authzPluginName, func(statuses map[string]*bundlePlugin.Status) {
+		copied := make(map[string]*bundlePlugin.Status, len(statuses))
+		for name, status := range statuses {
+			s := *status
+			copied[name] = &s
+		}
+
+		t.mu.Lock()
+		t.bundleStatuses = copied
+		cfg := t.config.BundleAlerts
+		alerts := t.alerter.observe(cfg, copied)
+		switches := t.observeFailover(copied, p.Config().Bundles, time.Now())
+		t.mu.Unlock()
+
+		// The listener is called with the bundle plugin locked.
+		go switchSources(context.Background(), t.manager, switches)
+
+		for _, alert := range alerts {
+			go func(alert BundleAlert) {
+				if err := t.alerter.send(context.Background(), cfg.Webhook, alert); err != nil {
+					log.Printf("Failed to send alert of bundle %s: %v", alert.Bundle, err)
+				}
+			}(alert)
+		}
+	})
+}
+
+// reportStaleness updates the staleness gauges at now, and logs the bundles
+// becoming stale or recovering. Callers must hold t.mu.
+func (t *revisionTracker) reportStaleness(now time.Time) []bundleStaleness {
+
+	result := bundleStalenesses(t.config.Staleness, t.active, t.latest, t.bundleStatuses, now)
+
+	bundleLag.Reset()
+	bundleSinceRequest.Reset()
+	bundleStale.Reset()
+
+	stale := map[string]bool{}
+	for _, s := range result {
+		bundleLag.WithLabelValues(s.Bundle).Set(s.Lag.Seconds())
+		bundleSinceRequest.WithLabelValues(s.Bundle).Set(s.SinceRequest.Seconds())
+
+		var value float64
+		if s.Stale {
+			value = 1
+			stale[s.Bundle] = true
+			if !t.stale[s.Bundle] {
+				log.Printf("Bundle %s is stale: %s", s.Bundle, s.reason(time.Duration(t.config.Staleness.WarnAfter)))
+			}
+		}
+		bundleStale.WithLabelValues(s.Bundle).Set(value)
+	}
+
+	names := make([]string, 0, len(t.stale))
+	for name := range t.stale {
+		if !stale[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Bundle %s is no longer stale", name)
+	}
+
+	t.stale = stale
+
+	return result
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	bundlePlugin "github.com/open-policy-agent/opa/plugins/bundle"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBundleStalenesses(t *testing.T) {
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	cfg := stalenessConfig{WarnAfter: duration(time.Hour)}
+
+	v1 := &revision{bundles: map[string]string{"authz": "v1", "data": "d1"}, landed: now.Add(-48 * time.Hour)}
+	v2 := &revision{bundles: map[string]string{"authz": "v2", "data": "d1"}, landed: now.Add(-2 * time.Hour)}
+	statuses := map[string]*bundlePlugin.Status{
+		"authz": {LastSuccessfulRequest: now.Add(-time.Minute)},
+		"data":  {LastSuccessfulRequest: now.Add(-3 * time.Hour), LastSuccessfulDownload: now.Add(-90 * time.Minute)},
+		"users": {},
+	}
+
+	result := bundleStalenesses(cfg, v1, v2, statuses, now)
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 bundles, got %+v", result)
+	}
+
+	// The latest revision of authz is held back, and the server of data has
+	// not answered since its last download.
+	authz, data, users := result[0], result[1], result[2]
+	if authz.ActiveRevision != "v1" || authz.LatestRevision != "v2" || authz.Lag != 2*time.Hour || authz.SinceRequest != time.Minute || !authz.Stale {
+		t.Fatalf("Expected authz to lag by 2h, got %+v", authz)
+	}
+	if data.Lag != 0 || data.SinceRequest != 90*time.Minute || !data.Stale {
+		t.Fatalf("Expected data to be last refreshed 90m ago, got %+v", data)
+	}
+	if users.Lag != 0 || users.SinceRequest != 0 || users.Stale {
+		t.Fatalf("Expected users not to be polled yet, got %+v", users)
+	}
+
+	// Without a threshold, nothing is stale.
+	for _, s := range bundleStalenesses(stalenessConfig{}, v1, v2, statuses, now) {
+		if s.Stale {
+			t.Fatalf("Expected %v not to be stale", s.Bundle)
+		}
+	}
+
+	// Once activated, the latest revision no longer lags.
+	for _, s := range bundleStalenesses(cfg, v2, v2, nil, now) {
+		if s.Lag != 0 || s.Stale {
+			t.Fatalf("Expected %v to be up to date, got %+v", s.Bundle, s)
+		}
+	}
+}
+
+func TestRevisionTrackerStaleness(t *testing.T) {
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	tracker := &revisionTracker{config: authzPluginConfig{
+		Activation: activationConfig{Windows: []activationWindow{{Start: "02:00", End: "04:00"}}},
+		Staleness:  stalenessConfig{WarnAfter: duration(time.Hour)},
+	}}
+	if err := tracker.config.Activation.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.land(&revision{bundles: map[string]string{"authz": "v1"}, landed: now})
+	tracker.land(&revision{bundles: map[string]string{"authz": "v2"}, landed: now.Add(time.Minute)})
+
+	gauge := func() float64 {
+		var m dto.Metric
+		if err := bundleStale.WithLabelValues("authz").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	if v := gauge(); v != 0 {
+		t.Fatalf("Expected authz not to be stale yet, got %v", v)
+	}
+
+	// v2 is held back until the window opens.
+	tracker.mu.Lock()
+	tracker.advance(now.Add(2 * time.Hour))
+	tracker.reportStaleness(now.Add(2 * time.Hour))
+	tracker.mu.Unlock()
+
+	if v := gauge(); v != 1 || !tracker.stale["authz"] {
+		t.Fatalf("Expected authz to be stale, got %v", v)
+	}
+
+	activation := time.Date(2022, 9, 2, 2, 30, 0, 0, time.UTC)
+	tracker.mu.Lock()
+	tracker.advance(activation)
+	tracker.reportStaleness(activation)
+	tracker.mu.Unlock()
+
+	if v := gauge(); v != 0 || tracker.stale["authz"] {
+		t.Fatalf("Expected authz to recover once activated, got %v", v)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// stateDocuments are documents maintained by the plugin itself, such as quota
+// counters, that policies read under data next to the policy data. Each
+// document is owned by a single top-level key.
+type stateDocuments struct {
+	mu        sync.RWMutex
+	docs      map[string]interface{}
+	owned     map[string]bool
+	version   uint64
+	listeners map[int]func(key string, value interface{})
+	next      int
+}
+
+func newStateDocuments() *stateDocuments {
+	return &stateDocuments{
+		docs:      map[string]interface{}{},
+		owned:     map[string]bool{},
+		listeners: map[int]func(key string, value interface{}){},
+	}
+}
+
+// set replaces the document at key. value must not be nil, nor modified
+// afterwards.
+func (s *stateDocuments) set(key string, value interface{}) {
+
+	s.mu.Lock()
+	s.docs[key] = value
+	s.owned[key] = true
+	s.version++
+	listeners := s.listenerFuncs()
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(key, value)
+	}
+}
+
+// remove deletes the document at key, if any.
+func (s *stateDocuments) remove(key string) {
+
+	s.mu.Lock()
+	if _, ok := s.docs[key]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.docs, key)
+	s.version++
+	listeners := s.listenerFuncs()
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(key, nil)
+	}
+}
+
+// listenerFuncs returns the registered listeners. Callers must hold s.mu.
+func (s *stateDocuments) listenerFuncs() []func(key string, value interface{}) {
+
+	listeners := make([]func(key string, value interface{}), 0, len(s.listeners))
+	for _, fn := range s.listeners {
+		listeners = append(listeners, fn)
+	}
+
+	return listeners
+}
+
+// onChange registers fn to be called with every document that is set, or
+// with a nil value for every document that is removed, after calling it with
+// the documents set so far. The returned function unregisters fn.
+func (s *stateDocuments) onChange(fn func(key string, value interface{})) func() {
+
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.listeners[id] = fn
+	s.mu.Unlock()
+
+	for k, v := range s.documents() {
+		fn(k, v)
+	}
+
+	return func() {
+		s.mu.Lock()
+		delete(s.listeners, id)
+		s.mu.Unlock()
+	}
+}
+
+func (s *stateDocuments) empty() bool {
+
+	if s == nil {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.docs) == 0
+}
+
+// keys returns the sorted keys of the documents.
+func (s *stateDocuments) keys() []string {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.docs))
+	for k := range s.docs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// documents returns the documents keyed by their top-level key.
+func (s *stateDocuments) documents() map[string]interface{} {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	docs := make(map[string]interface{}, len(s.docs))
+	for k, v := range s.docs {
+		docs[k] = v
+	}
+
+	return docs
+}
+
+// owns reports whether every path changed by event belongs to a document,
+// including documents that were removed.
+func (s *stateDocuments) owns(event storage.TriggerEvent) bool {
+
+	if s == nil || len(event.Data) == 0 {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, e := range event.Data {
+		if len(e.Path) == 0 {
+			return false
+		}
+		if !s.owned[e.Path[0]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// currentVersion returns a counter that changes whenever a document is set.
+func (s *stateDocuments) currentVersion() uint64 {
+
+	if s == nil {
+		return 0
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// apply writes the documents into doc, which must not be shared with
+// concurrent readers. The documents are copied so that evaluations cannot
+// observe later changes.
+func (s *stateDocuments) apply(doc map[string]interface{}) error {
+
+	if s == nil {
+		return nil
+	}
+
+	docs, err := copyDocument(s.documents())
+	if err != nil {
+		return err
+	}
+
+	for k, v := range docs {
+		doc[k] = v
+	}
+
+	return nil
+}
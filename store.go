@@ -0,0 +1,377 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// storeCompactionSlack is the number of superseded log records tolerated
+// before the log is compacted, in addition to the number of live records.
+const storeCompactionSlack = 1000
+
+// storeRecord is a single line of the store's log. A record either sets the
+// value of a key in a bucket, or deletes it.
+type storeRecord struct {
+	Bucket  string          `json:"b"`
+	Key     string          `json:"k"`
+	Value   json.RawMessage `json:"v,omitempty"`
+	Deleted bool            `json:"d,omitempty"`
+}
+
+// stateStore is a small embedded key-value store persisting the plugin's own
+// state, such as quota counters, the decision history and lookup caches.
+// Keys are grouped in buckets, values are JSON documents. Every change is
+// appended to a log file, which is replayed on open and compacted once it
+// holds more superseded records than live ones. A store without a path is
+// kept in memory only. The state is small and rewritten wholesale on
+// compaction, so a log of JSON lines serves it without adding a database such
+// as bbolt or SQLite to the dependencies of the plugin.
+type stateStore struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	buckets map[string]map[string]json.RawMessage
+	live    int
+	records int
+}
+
+// storeBucket is a named group of keys in a store.
+type storeBucket struct {
+	store *stateStore
+	name  string
+}
+
+// openStateStore opens the store persisted at path, creating it if needed.
+func openStateStore(path string) (*stateStore, error) {
+
+	s := &stateStore{path: path, buckets: map[string]map[string]json.RawMessage{}}
+	if path == "" {
+		return s, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("state store %s: %w", path, err)
+	}
+
+	// A crash may have left a partially written record at the end of the
+	// log, which is discarded.
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s.f, s.w = f, bufio.NewWriter(f)
+
+	if s.records > 2*s.live+storeCompactionSlack {
+		if err := s.compact(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// replay applies the records of the log and returns the offset of the end
+// of the last complete record.
+func (s *stateStore) replay(r io.Reader) (int64, error) {
+
+	var offset int64
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		var rec storeRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// Only the last record may be incomplete.
+			if _, err := br.Peek(1); err == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("offset %d: %w", offset, err)
+		}
+
+		s.apply(rec)
+		s.records++
+		offset += int64(len(line))
+	}
+}
+
+// apply updates the in-memory state with rec. Callers must hold s.mu.
+func (s *stateStore) apply(rec storeRecord) {
+
+	bucket, ok := s.buckets[rec.Bucket]
+	if !ok {
+		bucket = map[string]json.RawMessage{}
+		s.buckets[rec.Bucket] = bucket
+	}
+
+	_, existed := bucket[rec.Key]
+
+	if rec.Deleted {
+		delete(bucket, rec.Key)
+		if existed {
+			s.live--
+		}
+		return
+	}
+
+	bucket[rec.Key] = rec.Value
+	if !existed {
+		s.live++
+	}
+}
+
+// append writes rec to the log and applies it. Callers must hold s.mu.
+func (s *stateStore) append(rec storeRecord) error {
+
+	if s.w != nil {
+		bs, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(append(bs, '\n')); err != nil {
+			return err
+		}
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+		s.records++
+	}
+
+	s.apply(rec)
+
+	if s.w != nil && s.records > 2*s.live+storeCompactionSlack {
+		if err := s.compact(); err != nil {
+			log.Printf("Failed to compact state store %s: %v", s.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the log with only the live records, replacing the old log
+// atomically. Callers must hold s.mu.
+func (s *stateStore) compact() error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	records := 0
+
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		bucket := s.buckets[name]
+		for _, key := range bucketKeys(bucket) {
+			bs, err := json.Marshal(storeRecord{Bucket: name, Key: key, Value: bucket[key]})
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			if _, err := w.Write(append(bs, '\n')); err != nil {
+				tmp.Close()
+				return err
+			}
+			records++
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	s.f.Close()
+	s.f, s.w, s.records = tmp, bufio.NewWriter(tmp), records
+
+	// The rename is only durable once the directory entry is: a crash before
+	// would bring back the old log, or, on some file systems, no log at all.
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir flushes the entries of the directory at path to disk.
+func syncDir(path string) error {
+
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// close flushes the log to disk and closes it.
+func (s *stateStore) close() error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w = nil, nil
+
+	return err
+}
+
+// bucket returns the bucket called name. Buckets exist as long as they hold
+// keys and need not be created.
+func (s *stateStore) bucket(name string) *storeBucket {
+
+	if s == nil {
+		return nil
+	}
+
+	return &storeBucket{store: s, name: name}
+}
+
+// get decodes the value of key into v, reporting whether the key exists.
+func (b *storeBucket) get(key string, v interface{}) (bool, error) {
+
+	if b == nil {
+		return false, nil
+	}
+
+	b.store.mu.Lock()
+	value, ok := b.store.buckets[b.name][key]
+	b.store.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(value, v)
+}
+
+// put sets the value of key to the JSON encoding of v.
+func (b *storeBucket) put(key string, v interface{}) error {
+
+	if b == nil {
+		return nil
+	}
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	if bytes.Equal(b.store.buckets[b.name][key], bs) {
+		return nil
+	}
+
+	return b.store.append(storeRecord{Bucket: b.name, Key: key, Value: bs})
+}
+
+// delete removes key, if it exists.
+func (b *storeBucket) delete(key string) error {
+
+	if b == nil {
+		return nil
+	}
+
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	if _, ok := b.store.buckets[b.name][key]; !ok {
+		return nil
+	}
+
+	return b.store.append(storeRecord{Bucket: b.name, Key: key, Deleted: true})
+}
+
+// forEach calls fn with the keys and values of the bucket in key order. The
+// bucket may be modified by fn, which does not affect the iteration.
+func (b *storeBucket) forEach(fn func(key string, value json.RawMessage) error) error {
+
+	if b == nil {
+		return nil
+	}
+
+	b.store.mu.Lock()
+	bucket := make(map[string]json.RawMessage, len(b.store.buckets[b.name]))
+	for k, v := range b.store.buckets[b.name] {
+		bucket[k] = v
+	}
+	b.store.mu.Unlock()
+
+	for _, key := range bucketKeys(bucket) {
+		if err := fn(key, bucket[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bucketKeys returns the sorted keys of bucket.
+func bucketKeys(bucket map[string]json.RawMessage) []string {
+
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func countLines(t *testing.T, path string) int {
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n
+}
+
+func TestStateStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "state.log")
+
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := store.bucket("test")
+	if err := b.put("a", []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.put("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.put("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.bucket("other").put("a", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut short by a crash is discarded.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"b":"test","k":"d","v":`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	store, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	var a []string
+	if ok, err := store.bucket("test").get("a", &a); !ok || err != nil || !reflect.DeepEqual(a, []string{"x"}) {
+		t.Fatalf("Expected [x], got %v (%v, %v)", a, ok, err)
+	}
+
+	var keys []string
+	err = store.bucket("test").forEach(func(key string, _ json.RawMessage) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+
+	var other string
+	if ok, _ := store.bucket("other").get("a", &other); !ok || other != "y" {
+		t.Fatalf("Expected y, got %v", other)
+	}
+
+	if err := store.bucket("test").put("d", 4); err != nil {
+		t.Fatal(err)
+	}
+	if n := countLines(t, path); n != 6 {
+		t.Fatalf("Expected 6 records, got %v", n)
+	}
+}
+
+func TestStateStoreCompaction(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "state.log")
+
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := store.bucket("test")
+	for i := 0; i < 2*storeCompactionSlack; i++ {
+		if err := b.put(strconv.Itoa(i%10), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countLines(t, path); n > storeCompactionSlack+20 {
+		t.Fatalf("Expected the log to be compacted, got %v records", n)
+	}
+
+	store, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	for i := 0; i < 10; i++ {
+		var v int
+		if _, err := store.bucket("test").get(strconv.Itoa(i), &v); err != nil || v != 2*storeCompactionSlack-10+i {
+			t.Fatalf("Expected %v, got %v (%v)", 2*storeCompactionSlack-10+i, v, err)
+		}
+	}
+}
+
+func TestDecisionHistoryPersist(t *testing.T) {
+
+	store, _ := openStateStore("")
+
+	h := newDecisionHistory(3)
+	if err := h.persist(store.bucket("decisions")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		h.add(decisionRecord{DecisionID: strconv.Itoa(i)})
+	}
+	h.close()
+
+	h = newDecisionHistory(2)
+	if err := h.persist(store.bucket("decisions")); err != nil {
+		t.Fatal(err)
+	}
+	h.add(decisionRecord{DecisionID: "5"})
+	h.close()
+
+	var ids []string
+	for _, rec := range h.list() {
+		ids = append(ids, rec.DecisionID)
+	}
+	if expected := []string{"5", "4"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+
+	n := 0
+	_ = store.bucket("decisions").forEach(func(string, json.RawMessage) error {
+		n++
+		return nil
+	})
+	if n != 2 {
+		t.Fatalf("Expected 2 persisted decisions, got %v", n)
+	}
+}
+
+func TestDecisionHistoryPersistBurst(t *testing.T) {
+
+	store, _ := openStateStore("")
+
+	// The writer falls behind, and skips the decisions that left the ring.
+	h := newDecisionHistory(3)
+	if err := h.persist(store.bucket("decisions")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		h.add(decisionRecord{DecisionID: strconv.Itoa(i)})
+	}
+	h.close()
+
+	var keys []string
+	_ = store.bucket("decisions").forEach(func(key string, _ json.RawMessage) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if expected := []string{decisionHistoryKey(998), decisionHistoryKey(999), decisionHistoryKey(1000)}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+
+	h = newDecisionHistory(3)
+	if err := h.persist(store.bucket("decisions")); err != nil {
+		t.Fatal(err)
+	}
+	h.close()
+
+	var ids []string
+	for _, rec := range h.list() {
+		ids = append(ids, rec.DecisionID)
+	}
+	if expected := []string{"999", "998", "997"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestLookupCachePersist(t *testing.T) {
+
+	store, _ := openStateStore("")
+
+	c := newLookupCache(time.Minute)
+	if err := c.persist(store.bucket("cache"), decodeStrings); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.get("alice", func() (interface{}, error) { return []string{"docker"}, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newLookupCache(time.Minute)
+	if err := c.persist(store.bucket("cache"), decodeStrings); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.get("alice", func() (interface{}, error) { return nil, os.ErrNotExist })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"docker"}; !reflect.DeepEqual(v, expected) {
+		t.Fatalf("Expected %v, got %v", expected, v)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// SysctlFinding flags a sysctl of a container that would apply to the host
+// rather than to the namespaces of the container.
+type SysctlFinding struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// ipcSysctls are the sysctls of the IPC namespace, besides those below
+// fs.mqueue.
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// utsSysctls are the sysctls of the UTS namespace.
+var utsSysctls = map[string]bool{
+	"kernel.hostname":   true,
+	"kernel.domainname": true,
+}
+
+// requestedSysctls returns the Sysctls of container create requests, keyed
+// with dots rather than slashes, or nil for any other request.
+func requestedSysctls(method, path string, body map[string]interface{}) map[string]string {
+
+	if method != "POST" || containerAction(path) != "create" {
+		return nil
+	}
+
+	hostConfig, _ := body["HostConfig"].(map[string]interface{})
+	values, _ := hostConfig["Sysctls"].(map[string]interface{})
+
+	sysctls := make(map[string]string, len(values))
+	for key, v := range values {
+		value, _ := v.(string)
+		sysctls[strings.ReplaceAll(key, "/", ".")] = value
+	}
+
+	return sysctls
+}
+
+// sysctlFindings flags the sysctls that are not namespaced, or whose
+// namespace the container shares with the host.
+func sysctlFindings(sysctls map[string]string, ns *Namespaces) []SysctlFinding {
+
+	var findings []SysctlFinding
+
+	for key := range sysctls {
+		reason := ""
+		switch {
+		case ipcSysctls[key] || strings.HasPrefix(key, "fs.mqueue."):
+			if ns != nil && ns.IPC.Host {
+				reason = "host_ipc"
+			}
+		case utsSysctls[key]:
+			if ns != nil && ns.UTS.Host {
+				reason = "host_uts"
+			}
+		case strings.HasPrefix(key, "net."):
+			if ns != nil && ns.Network.Host {
+				reason = "host_network"
+			}
+		default:
+			reason = "not_namespaced"
+		}
+		if reason != "" {
+			findings = append(findings, SysctlFinding{Key: key, Reason: reason})
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Key < findings[j].Key })
+
+	return findings
+}
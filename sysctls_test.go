@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSysctls(t *testing.T) {
+
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(`{"HostConfig": {
+		"NetworkMode": "host",
+		"Sysctls": {
+			"kernel/shmmax": "68719476736",
+			"fs.mqueue.msg_max": "100",
+			"net.ipv4.ip_forward": "1",
+			"kernel.core_pattern": "|/tmp/x",
+			"vm.overcommit_memory": "1"
+		}
+	}}`), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sysctls := requestedSysctls("POST", "/v1.41/containers/create", body)
+	expected := map[string]string{
+		"kernel.shmmax":        "68719476736",
+		"fs.mqueue.msg_max":    "100",
+		"net.ipv4.ip_forward":  "1",
+		"kernel.core_pattern":  "|/tmp/x",
+		"vm.overcommit_memory": "1",
+	}
+	if !reflect.DeepEqual(sysctls, expected) {
+		t.Fatalf("Expected %v, got %v", expected, sysctls)
+	}
+
+	findings := sysctlFindings(sysctls, containerNamespaces("POST", "/v1.41/containers/create", body))
+	expectedFindings := []SysctlFinding{
+		{Key: "kernel.core_pattern", Reason: "not_namespaced"},
+		{Key: "net.ipv4.ip_forward", Reason: "host_network"},
+		{Key: "vm.overcommit_memory", Reason: "not_namespaced"},
+	}
+	if !reflect.DeepEqual(findings, expectedFindings) {
+		t.Fatalf("Expected %v, got %v", expectedFindings, findings)
+	}
+
+	if sysctls := requestedSysctls("POST", "/v1.41/containers/abc/start", body); sysctls != nil {
+		t.Fatalf("Expected no sysctls, got %v", sysctls)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultTLSReloadInterval is how often the serving certificate files are
+// checked for changes unless -tls-reload-interval is given.
+const defaultTLSReloadInterval = 10 * time.Second
+
+// tlsFiles serves the certificate, key and client CA read from files,
+// reloading them when they change so that rotated certificates are served
+// without restarting the plugin.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	// svid, when set, is served instead of the certificate and key files.
+	svid *workloadSVID
+
+	mu        sync.RWMutex
+	loaded    bool
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+}
+
+// newTLSFiles loads the certificate and key, and the client CA when caFile
+// is not empty.
+func newTLSFiles(certFile, keyFile, caFile string) (*tlsFiles, error) {
+
+	f := &tlsFiles{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// newSVIDTLSFiles serves the X.509 SVID of the plugin, and loads the client CA
+// when caFile is not empty.
+func newSVIDTLSFiles(svid *workloadSVID, caFile string) (*tlsFiles, error) {
+
+	f := &tlsFiles{caFile: caFile, svid: svid}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// reload reads the files again when any of them has been modified since
+// they were last loaded, reporting whether they were. On failure, the
+// previously loaded files keep being served.
+func (f *tlsFiles) reload() (bool, error) {
+
+	var modTimes [3]time.Time
+	for i, path := range []string{f.certFile, f.keyFile, f.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	f.mu.RLock()
+	unchanged := f.loaded && modTimes == f.modTimes
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if f.svid == nil {
+		pair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return false, err
+		}
+		if pair.Leaf == nil {
+			if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+				return false, err
+			}
+		}
+		if fipsMode {
+			if err := checkFIPSKey(pair.Leaf.PublicKey); err != nil {
+				return false, fmt.Errorf("%s: %w", f.certFile, err)
+			}
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if f.caFile != "" {
+		bs, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return false, fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+	}
+
+	f.mu.Lock()
+	f.cert, f.clientCAs, f.modTimes, f.loaded = cert, pool, modTimes, true
+	f.mu.Unlock()
+
+	return true, nil
+}
+
+// watch checks the files for changes every interval.
+func (f *tlsFiles) watch(interval time.Duration) {
+
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			reloaded, err := f.reload()
+			switch {
+			case err != nil && f.svid != nil:
+				log.Printf("Failed to reload TLS client CA %s: %v", f.caFile, err)
+			case err != nil:
+				log.Printf("Failed to reload TLS certificate %s: %v", f.certFile, err)
+			case reloaded && f.svid != nil:
+				log.Printf("Reloaded TLS client CA %s.", f.caFile)
+			case reloaded:
+				log.Printf("Reloaded TLS certificate %s, valid until %v.", f.certFile, f.certificate().Leaf.NotAfter)
+			}
+		}
+	}()
+}
+
+func (f *tlsFiles) certificate() *tls.Certificate {
+
+	if f.svid != nil {
+		return f.svid.certificate()
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.cert
+}
+
+// config returns a TLS configuration serving the current certificate, and
+// verifying the client certificates given against the current client CA.
+// In FIPS mode, the configuration is restricted to FIPS approved algorithms.
+func (f *tlsFiles) config() *tls.Config {
+
+	restrict := func(cfg *tls.Config) *tls.Config {
+		if fipsMode {
+			return fipsTLSConfig(cfg)
+		}
+		return cfg
+	}
+
+	cfg := restrict(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return f.certificate(), nil
+		},
+	})
+
+	if f.caFile == "" {
+		return cfg
+	}
+
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert := f.certificate()
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		return restrict(&tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*cert},
+			ClientCAs:    f.clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}), nil
+	}
+
+	return cfg
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestKeyPair(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+
+	cert, key := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		certFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}
+	for path, bs := range files {
+		if err := os.WriteFile(path, bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedSerial(t *testing.T, addr string) int64 {
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLSFilesReload(t *testing.T) {
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+	writeTestKeyPair(t, certFile, keyFile, 1, modTime)
+
+	files, err := newTLSFiles(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", files.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	if serial := servedSerial(t, ln.Addr().String()); serial != 1 {
+		t.Fatalf("Expected serial 1, got %d", serial)
+	}
+
+	if reloaded, err := files.reload(); err != nil || reloaded {
+		t.Fatalf("Expected unchanged files not to be reloaded, got %v, %v", reloaded, err)
+	}
+
+	writeTestKeyPair(t, certFile, keyFile, 2, modTime.Add(time.Minute))
+	if reloaded, err := files.reload(); err != nil || !reloaded {
+		t.Fatalf("Expected rotated files to be reloaded, got %v, %v", reloaded, err)
+	}
+
+	if serial := servedSerial(t, ln.Addr().String()); serial != 2 {
+		t.Fatalf("Expected serial 2, got %d", serial)
+	}
+
+	// A half-written rotation keeps the previous certificate in place.
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.reload(); err == nil {
+		t.Fatal("Expected an invalid key to fail reloading")
+	}
+	if serial := servedSerial(t, ln.Addr().String()); serial != 2 {
+		t.Fatalf("Expected serial 2, got %d", serial)
+	}
+}
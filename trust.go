@@ -0,0 +1,229 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// trustReleasesRole is the delegation role Docker Content Trust clients
+// prefer to the targets role when resolving tags, as docker trust sign
+// publishes signatures to it.
+const trustReleasesRole = "targets/releases"
+
+// NotaryClaims describes the Docker Content Trust data the Notary server of
+// the registry of an image reference publishes for it. The signatures of the
+// data are not verified, so anyone able to serve or tamper with it controls
+// these claims: they are not a trust signal, and tell policies only which
+// digest clients with content trust enabled, which verify the signatures,
+// would resolve the reference to.
+type NotaryClaims struct {
+	// HasTrustData is true when the Notary server has trust data for the
+	// repository.
+	HasTrustData bool
+
+	// Tag is the claimed tag of the reference: its own tag, or, for references
+	// pinned by digest only, the tag claimed for the digest.
+	Tag string `json:",omitempty"`
+
+	// ClaimedDigest is the digest the trust data claims Tag is signed for.
+	ClaimedDigest string `json:",omitempty"`
+
+	// PinnedToClaim is true when the reference is pinned by the claimed
+	// digest, as the references of clients with content trust enabled are:
+	// they resolve tags through the trust data and send the daemon the
+	// digest.
+	PinnedToClaim bool
+}
+
+// trustTargets is the part of the targets metadata of a repository read by
+// the plugin.
+type trustTargets struct {
+	Signed struct {
+		Targets map[string]struct {
+			Hashes map[string]string `json:"hashes"`
+		} `json:"targets"`
+		Delegations struct {
+			Roles []struct {
+				Name string `json:"name"`
+			} `json:"roles"`
+		} `json:"delegations"`
+	} `json:"signed"`
+}
+
+// trustResolver looks up the trust data of image references in Notary
+// servers, using the registry credentials configured for the plugin. The
+// signatures of the trust data are not verified: it tells policies which
+// digests clients with content trust enabled resolve tags to, and these
+// clients verify the signatures themselves.
+type trustResolver struct {
+	client      *http.Client
+	credentials map[string]registryCredential
+
+	// server, when set, is the host of the Notary server of all registries.
+	// Otherwise, Docker Hub uses notary.docker.io and other registries serve
+	// their own trust data.
+	server string
+
+	cache *lookupCache
+}
+
+func newTrustResolver(server, caFile, certFile, keyFile string, credentials map[string]registryCredential, ttl time.Duration) (*trustResolver, error) {
+
+	transport, err := clientTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &trustResolver{
+		client:      &http.Client{Transport: transport, Timeout: registryTimeout},
+		credentials: credentials,
+		cache:       newLookupCache(ttl),
+	}
+
+	if server != "" {
+		u, err := url.Parse(server)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid content trust server %q", server)
+		}
+		r.server = u.Host
+	}
+
+	return r, nil
+}
+
+// resolve sets the Notary claims of image. Lookup failures are logged and leave
+// the image unchanged.
+func (r *trustResolver) resolve(ctx context.Context, image *ImageReference) {
+
+	if r == nil || image == nil || image.Name == "" {
+		return
+	}
+
+	v, err := r.cache.get(image.Name, func() (interface{}, error) {
+		return r.targets(ctx, image.Name)
+	})
+	if err != nil {
+		log.Printf("Failed to look up trust data of image %s: %v", image.Name, err)
+		return
+	}
+
+	image.NotaryClaims = notaryClaims(image, v.(map[string]string))
+}
+
+// notaryClaims returns the Notary claims of image, given the digests the tags
+// of its repository are claimed to be signed for, which are nil when it has no
+// trust data.
+func notaryClaims(image *ImageReference, targets map[string]string) *NotaryClaims {
+
+	claims := &NotaryClaims{HasTrustData: targets != nil}
+	if !claims.HasTrustData {
+		return claims
+	}
+
+	switch {
+	case image.Digest == "":
+		claims.Tag = image.Tag
+		claims.ClaimedDigest = targets[image.Tag]
+	case image.Tag != "":
+		// Both are given, e.g. nginx:1.25@sha256:..., and the daemon only
+		// uses the digest.
+		claims.Tag = image.Tag
+		claims.ClaimedDigest = targets[image.Tag]
+		claims.PinnedToClaim = claims.ClaimedDigest == image.Digest
+	default:
+		tags := make([]string, 0, len(targets))
+		for tag, digest := range targets {
+			if digest == image.Digest {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		if len(tags) > 0 {
+			claims.Tag = tags[0]
+			claims.ClaimedDigest = image.Digest
+			claims.PinnedToClaim = true
+		}
+	}
+
+	if claims.ClaimedDigest == "" {
+		claims.Tag = ""
+	}
+
+	return claims
+}
+
+// targets returns the digests the tags of the repository name are signed for,
+// nil when the repository has no trust data. Tags signed by the releases
+// delegation take precedence over those of the targets role.
+func (r *trustResolver) targets(ctx context.Context, name string) (map[string]string, error) {
+
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := reference.Domain(named)
+	s := &registrySession{
+		client: r.client,
+		host:   r.server,
+		repo:   named.Name(),
+		cred:   lookupRegistryCredential(r.credentials, domain),
+	}
+	if s.host == "" {
+		s.host = domain
+		if domain == "docker.io" {
+			s.host = "notary.docker.io"
+		}
+	}
+
+	var targets trustTargets
+	if _, err := s.get(ctx, "/_trust/tuf/targets.json", nil, &targets); err != nil {
+		if errors.Is(err, errRegistryNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := map[string]string{}
+	addTargets(result, targets)
+
+	for _, role := range targets.Signed.Delegations.Roles {
+		if role.Name != trustReleasesRole {
+			continue
+		}
+		var releases trustTargets
+		if _, err := s.get(ctx, "/_trust/tuf/"+trustReleasesRole+".json", nil, &releases); err != nil && !errors.Is(err, errRegistryNotFound) {
+			return nil, err
+		}
+		addTargets(result, releases)
+	}
+
+	return result, nil
+}
+
+// addTargets sets the digests of the targets of metadata in result, keyed by
+// their tags.
+func addTargets(result map[string]string, metadata trustTargets) {
+
+	for tag, target := range metadata.Signed.Targets {
+		sum, err := base64.StdEncoding.DecodeString(target.Hashes["sha256"])
+		if err != nil || len(sum) == 0 {
+			continue
+		}
+		result[tag] = "sha256:" + hex.EncodeToString(sum)
+	}
+}
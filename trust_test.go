@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrustResolver(t *testing.T) {
+
+	digest := func(b byte) (string, string) {
+		sum := bytes.Repeat([]byte{b}, 32)
+		return "sha256:" + hex.EncodeToString(sum), base64.StdEncoding.EncodeToString(sum)
+	}
+	a, aHash := digest(0xaa)
+	b, bHash := digest(0xbb)
+	c, cHash := digest(0xcc)
+
+	lookups := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/v2/docker.io/library/nginx/_trust/tuf/targets.json":
+			lookups++
+			_, _ = w.Write([]byte(`{"signed": {
+				"targets": {"1.25": {"hashes": {"sha256": "` + aHash + `"}}, "latest": {"hashes": {"sha256": "` + aHash + `"}}},
+				"delegations": {"roles": [{"name": "targets/releases"}]}
+			}}`))
+		case "/v2/docker.io/library/nginx/_trust/tuf/targets/releases.json":
+			_, _ = w.Write([]byte(`{"signed": {"targets": {
+				"1.25": {"hashes": {"sha256": "` + cHash + `"}},
+				"1.26": {"hashes": {"sha256": "` + bHash + `"}}
+			}}}`))
+		case "/v2/docker.io/library/unsigned/_trust/tuf/targets.json":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resolver, err := newTrustResolver(server.URL, "", "", "", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.client = server.Client()
+
+	for _, tc := range []struct {
+		ref      string
+		expected NotaryClaims
+	}{
+		// Tags signed by the releases delegation take precedence.
+		{"nginx:1.25", NotaryClaims{HasTrustData: true, Tag: "1.25", ClaimedDigest: c}},
+		{"nginx@" + c, NotaryClaims{HasTrustData: true, Tag: "1.25", ClaimedDigest: c, PinnedToClaim: true}},
+		{"nginx@" + a, NotaryClaims{HasTrustData: true, Tag: "latest", ClaimedDigest: a, PinnedToClaim: true}},
+		{"nginx:1.26@" + a, NotaryClaims{HasTrustData: true, Tag: "1.26", ClaimedDigest: b}},
+		{"nginx:1.26@" + b, NotaryClaims{HasTrustData: true, Tag: "1.26", ClaimedDigest: b, PinnedToClaim: true}},
+		{"nginx:unsigned", NotaryClaims{HasTrustData: true}},
+		{"nginx@sha256:" + strings.Repeat("d", 64), NotaryClaims{HasTrustData: true}},
+		{"unsigned:1.0", NotaryClaims{}},
+	} {
+		image := parseImageReference(tc.ref)
+		resolver.resolve(context.Background(), image)
+		if image.NotaryClaims == nil || *image.NotaryClaims != tc.expected {
+			t.Errorf("Expected %+v for %s, got %+v", tc.expected, tc.ref, image.NotaryClaims)
+		}
+	}
+
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup, got %d", lookups)
+	}
+
+	if _, err := newTrustResolver("http://notary.example.com", "", "", "", nil, time.Minute); err == nil {
+		t.Errorf("Expected a plain HTTP server to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// UserResources is the input.user_resources document: the resources reserved
+// by the running containers the requesting user created.
+type UserResources struct {
+	Containers             int   `json:"containers"`
+	MemoryBytes            int64 `json:"memory_bytes"`
+	MemoryReservationBytes int64 `json:"memory_reservation_bytes"`
+	CPUMillicores          int64 `json:"cpu_millicores"`
+
+	// UnlimitedMemory and UnlimitedCPU count the containers without a
+	// memory or CPU limit, which the totals cannot account for.
+	UnlimitedMemory int `json:"unlimited_memory"`
+	UnlimitedCPU    int `json:"unlimited_cpu"`
+}
+
+// resourceUsage sums the resources of the running containers of a user, as
+// reported by the daemon, for container create requests. The containers of
+// a user are found in the ownership table.
+type resourceUsage struct {
+	docker *dockerClient
+	owners *ownershipTracker
+	cache  *lookupCache
+}
+
+func newResourceUsage(docker *dockerClient, owners *ownershipTracker, ttl time.Duration) *resourceUsage {
+	return &resourceUsage{docker: docker, owners: owners, cache: newLookupCache(ttl)}
+}
+
+// total returns the resources reserved by the running containers of user.
+func (u *resourceUsage) total(ctx context.Context, user string) (*UserResources, error) {
+
+	var containers []dockerContainer
+	if err := u.docker.get(ctx, "/containers/json", &containers); err != nil {
+		return nil, err
+	}
+
+	total := &UserResources{}
+	for _, c := range containers {
+		owner := u.owners.lookup(c.ID)
+		if owner == nil || owner.User != user {
+			continue
+		}
+
+		res, err := u.resources(ctx, c.ID)
+		if err == errDockerNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		total.Containers++
+		if res.MemoryBytes != nil {
+			total.MemoryBytes += *res.MemoryBytes
+		} else {
+			total.UnlimitedMemory++
+		}
+		if res.MemoryReservationBytes != nil {
+			total.MemoryReservationBytes += *res.MemoryReservationBytes
+		}
+		if res.CPUMillicores != nil {
+			total.CPUMillicores += *res.CPUMillicores
+		} else {
+			total.UnlimitedCPU++
+		}
+	}
+
+	return total, nil
+}
+
+// resources returns the resource limits of the container id, cached for the
+// TTL of the cache since they only change with docker update.
+func (u *resourceUsage) resources(ctx context.Context, id string) (*Resources, error) {
+
+	v, err := u.cache.get(id, func() (interface{}, error) {
+		var info struct {
+			HostConfig map[string]interface{}
+		}
+		if err := u.docker.get(ctx, "/containers/"+url.PathEscape(id)+"/json", &info); err != nil {
+			return nil, err
+		}
+		res := requestedResources("POST", "/containers/create", map[string]interface{}{"HostConfig": info.HostConfig})
+		if res == nil {
+			res = &Resources{}
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Resources), nil
+}
+
+// enrichUserResources adds the resources reserved by the requesting user to
+// container create requests. It is null for any other request, and when the
+// daemon cannot be queried.
+func (p *DockerAuthZPlugin) enrichUserResources(ctx context.Context, r *authorization.Request, doc map[string]interface{}) error {
+
+	doc["user_resources"] = (*UserResources)(nil)
+
+	u, err := url.Parse(r.RequestURI)
+	if err != nil || r.RequestMethod != "POST" || containerAction(u.Path) != "create" || p.docker.isLookup(r.RequestHeaders) {
+		return nil
+	}
+
+	total, err := p.usage.total(ctx, r.User)
+	if err != nil {
+		log.Printf("Failed to sum the resources of user %q: %v", r.User, err)
+		return nil
+	}
+	doc["user_resources"] = total
+
+	return nil
+}
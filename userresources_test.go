@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestUserResources(t *testing.T) {
+
+	inspects := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			_, _ = w.Write([]byte(`[{"Id": "aaa111"}, {"Id": "aaa222"}, {"Id": "aaa333"}, {"Id": "bbb111"}, {"Id": "ccc111"}]`))
+		case "/containers/aaa111/json":
+			inspects++
+			_, _ = w.Write([]byte(`{"HostConfig": {"Memory": 4294967296, "MemoryReservation": 2147483648, "NanoCpus": 2000000000}}`))
+		case "/containers/aaa222/json":
+			inspects++
+			_, _ = w.Write([]byte(`{"HostConfig": {"Memory": 1073741824, "CpuQuota": 50000, "CpuPeriod": 100000}}`))
+		case "/containers/aaa333/json":
+			inspects++
+			_, _ = w.Write([]byte(`{"HostConfig": {"Memory": 0}}`))
+		default:
+			t.Errorf("Unexpected lookup %v", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	docker, err := newDockerClient(strings.Replace(server.URL, "http://", "tcp://", 1), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners, err := newOwnershipTracker(docker, nil, newStateDocuments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, user := range map[string]string{"aaa111": "alice", "aaa222": "alice", "aaa333": "alice", "bbb111": "bob"} {
+		owners.observe(context.Background(), authorization.Request{
+			User:               user,
+			RequestMethod:      "POST",
+			RequestURI:         "/v1.41/containers/create",
+			ResponseStatusCode: 201,
+			ResponseBody:       []byte(`{"Id":"` + id + `"}`),
+		})
+	}
+
+	p := &DockerAuthZPlugin{docker: docker, ownership: owners, usage: newResourceUsage(docker, owners, time.Minute)}
+
+	for i := 0; i < 2; i++ {
+		input, err := p.buildInput(context.Background(), containerCreate("alice", `{"HostConfig": {"Memory": 1073741824}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := input.(map[string]interface{})["user_resources"].(*UserResources)
+		expected := UserResources{
+			Containers:             3,
+			MemoryBytes:            5368709120,
+			MemoryReservationBytes: 2147483648,
+			CPUMillicores:          2500,
+			UnlimitedMemory:        1,
+			UnlimitedCPU:           1,
+		}
+		if total == nil || *total != expected {
+			t.Fatalf("Expected %+v, got %+v", expected, total)
+		}
+	}
+
+	if inspects != 3 {
+		t.Fatalf("Expected the limits of containers to be cached, got %d inspects", inspects)
+	}
+
+	// Other requests are not enriched.
+	input, err := p.buildInput(context.Background(), authorization.Request{RequestMethod: "GET", RequestURI: "/v1.41/containers/json", User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := input.(map[string]interface{})["user_resources"].(*UserResources); total != nil {
+		t.Fatalf("Expected no totals, got %+v", total)
+	}
+}
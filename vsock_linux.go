@@ -0,0 +1,117 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener accepts connections on an AF_VSOCK socket, through which
+// Docker daemons running in virtual machines reach the plugin running on
+// their host. The net package does not support the address family, so the
+// sockets are wrapped in files registered with the runtime poller.
+type vsockListener struct {
+	f    *os.File
+	addr vsockAddr
+}
+
+// listenVsock listens on port for connections from any context ID.
+func listenVsock(port uint32) (net.Listener, error) {
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	addr := vsockAddr{cid: unix.VMADDR_CID_ANY, port: port}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			addr = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+	}
+
+	return &vsockListener{f: os.NewFile(uintptr(fd), "vsock:"+addr.String()), addr: addr}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var nfd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err = rc.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept", acceptErr)
+	}
+
+	remote := vsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+
+	return &vsockConn{File: os.NewFile(uintptr(nfd), "vsock:"+remote.String()), local: l.addr, remote: remote}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a connection accepted by a vsockListener.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// vsockAddr is the address of an AF_VSOCK socket.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a vsockAddr) String() string {
+	return fmt.Sprintf("vm(%d):%d", a.cid, a.port)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestVsockListener(t *testing.T) {
+
+	l, err := listenVsock(unix.VMADDR_PORT_ANY)
+	if err != nil {
+		t.Skipf("vsock unavailable: %v", err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(vsockAddr).port
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := os.NewFile(uintptr(fd), "vsock")
+	defer client.Close()
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_LOCAL, Port: port}); err != nil {
+		t.Skipf("vsock loopback unavailable: %v", err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping, got %q", buf)
+	}
+	if conn.RemoteAddr().Network() != "vsock" {
+		t.Fatalf("Expected vsock address, got %v", conn.RemoteAddr())
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("Expected accept on a closed listener to fail")
+	}
+}
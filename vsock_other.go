@@ -0,0 +1,17 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenVsock is only supported on Linux.
+func listenVsock(port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("vsock listeners are not supported on this platform")
+}